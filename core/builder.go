@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"os"
 	"syscall"
 	"time"
@@ -21,6 +22,7 @@ import (
 
 	metrics "gx/ipfs/QmRg1gKTHzc3CZXSKzem8aR4E3TubFhbgXwfVuWnSK5CC5/go-metrics-interface"
 	goprocessctx "gx/ipfs/QmSF8fPo3jgVBAy8fpdjjYqgG87dkJgUprRBHRd2tmfgpP/goprocess/context"
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
 	offline "gx/ipfs/QmYk9mQ4iByLLFzZPGWMnjJof3DQ3QneFFR6ZtNAXd8UvS/go-ipfs-exchange-offline"
 	bstore "gx/ipfs/QmayRSLCiM2gWR7Kay8vqu3Yy5mf7yPqocF9ZRgDUPYMcc/go-ipfs-blockstore"
 	peer "gx/ipfs/QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74/go-libp2p-peer"
@@ -35,7 +37,8 @@ type BuildCfg struct {
 	// If online is set, the node will have networking enabled
 	Online bool
 
-	// ExtraOpts is a map of extra options used to configure the ipfs nodes creation
+	// ExtraOpts is a map of extra options used to configure the ipfs nodes creation.
+	// "p2p" enables libp2p stream mounting regardless of the config.
 	ExtraOpts map[string]bool
 
 	// If permanent then node should run more expensive processes
@@ -45,6 +48,16 @@ type BuildCfg struct {
 	// If NilRepo is set, a repo backed by a nil datastore will be constructed
 	NilRepo bool
 
+	// ListenAddrs, if set, are listened on instead of Addresses.Swarm from
+	// the config, e.g. /ip4/127.0.0.1/tcp/0 to run several nodes in one
+	// process. The ports picked are in PeerHost.Addrs() once it's built.
+	ListenAddrs []ma.Multiaddr
+
+	// Peerstore, if set, is used by the node instead of an empty one, e.g.
+	// with the addresses of known peers. It must not be shared with other
+	// nodes, which would mix up their keys.
+	Peerstore pstore.Peerstore
+
 	Routing RoutingOption
 	Host    HostOption
 	Repo    repo.Repo
@@ -132,11 +145,15 @@ func NewNode(ctx context.Context, cfg *BuildCfg) (*IpfsNode, error) {
 		mode:      offlineMode,
 		Repo:      cfg.Repo,
 		ctx:       ctx,
-		Peerstore: pstore.NewPeerstore(),
+		Peerstore: cfg.Peerstore,
+	}
+	if n.Peerstore == nil {
+		n.Peerstore = pstore.NewPeerstore()
 	}
 	if cfg.Online {
 		n.mode = onlineMode
 	}
+	n.p2pEnabled = cfg.getOpt("p2p")
 
 	// TODO: this is a weird circular-ish dependency, rework it
 	n.proc = goprocessctx.WithContextAndTeardown(ctx, n.teardown)
@@ -149,6 +166,17 @@ func NewNode(ctx context.Context, cfg *BuildCfg) (*IpfsNode, error) {
 	return n, nil
 }
 
+// checkPeerstore makes sure a peerstore given to a node isn't used by another
+// node already, which would have stored its private key in it
+func checkPeerstore(ps pstore.Peerstore, self peer.ID) error {
+	for _, p := range ps.Peers() {
+		if p != self && ps.PrivKey(p) != nil {
+			return fmt.Errorf("peerstore holds the private key of %s, it can't be shared with another node", p.Pretty())
+		}
+	}
+	return nil
+}
+
 func isTooManyFDError(err error) bool {
 	perr, ok := err.(*os.PathError)
 	if ok && perr.Err == syscall.EMFILE {
@@ -163,6 +191,11 @@ func setupNode(ctx context.Context, n *IpfsNode, cfg *BuildCfg) error {
 	if err := n.loadID(); err != nil {
 		return err
 	}
+	if cfg.Peerstore != nil {
+		if err := checkPeerstore(cfg.Peerstore, n.Identity); err != nil {
+			return err
+		}
+	}
 
 	rds := &retry.Datastore{
 		Batching:    n.Repo.Datastore(),
@@ -216,7 +249,7 @@ func setupNode(ctx context.Context, n *IpfsNode, cfg *BuildCfg) error {
 
 	if cfg.Online {
 		do := setupDiscoveryOption(rcfg.Discovery)
-		if err := n.startOnlineServices(ctx, cfg.Routing, cfg.Host, do, cfg.getOpt("pubsub"), cfg.getOpt("ipnsps"), cfg.getOpt("mplex")); err != nil {
+		if err := n.startOnlineServices(ctx, cfg.Routing, cfg.Host, do, cfg.getOpt("pubsub"), cfg.getOpt("ipnsps"), cfg.getOpt("mplex"), cfg.ListenAddrs); err != nil {
 			return err
 		}
 	} else {
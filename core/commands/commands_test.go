@@ -162,14 +162,27 @@ func TestCommands(t *testing.T) {
 		"/object/put",
 		"/object/stat",
 		"/p2p",
+		"/p2p/debug",
+		"/p2p/debug/dump",
 		"/p2p/listener",
 		"/p2p/listener/close",
+		"/p2p/listener/group",
 		"/p2p/listener/ls",
 		"/p2p/listener/open",
+		"/p2p/listener/pause",
+		"/p2p/listener/resume",
+		"/p2p/listener/retarget",
+		"/p2p/ping",
+		"/p2p/protocols",
+		"/p2p/restore-status",
+		"/p2p/stats",
 		"/p2p/stream",
 		"/p2p/stream/close",
 		"/p2p/stream/dial",
 		"/p2p/stream/ls",
+		"/p2p/stream/stat",
+		"/p2p/stream/top",
+		"/p2p/test",
 		"/pin",
 		"/pin/add",
 		"/ping",
@@ -2,43 +2,329 @@ package commands
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	gonet "net"
+	"path"
+	"sort"
 	"strconv"
+	"strings"
 	"text/tabwriter"
+	"text/template"
+	"time"
 
-	cmds "github.com/ipfs/go-ipfs/commands"
 	core "github.com/ipfs/go-ipfs/core"
+	e "github.com/ipfs/go-ipfs/core/commands/e"
+	p2p "github.com/ipfs/go-ipfs/p2p"
+	config "github.com/ipfs/go-ipfs/repo/config"
 
+	humanize "gx/ipfs/QmPSBJL4momYnE7DcUyk2DVhD6rH488ZmHBGLbxNdhU44K/go-humanize"
+	circuit "gx/ipfs/QmR5sXZi68rm9m2E3KiXj6hE5m3GeLaDjbLPUeV6W3MLR8/go-libp2p-circuit"
+	cmds "gx/ipfs/QmSKYWC84fqkKB54Te5JMcov2MBVzucXaRGxFqByzzCbHe/go-ipfs-cmds"
 	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	peer "gx/ipfs/QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74/go-libp2p-peer"
+	cid "gx/ipfs/QmcZfnkapfECQGcLZaf9B79NRg7cRa9EnZh4LSbkCzwNvY/go-cid"
 	"gx/ipfs/QmceUdzxkimdYsgtX733uNgzf1DLHyBKN6ehGSp85ayppM/go-ipfs-cmdkit"
+	pstore "gx/ipfs/QmdeiKhUy1TVGBaKxt7y1QmBDLBdisSrLJ1x58Eoj4PXUh/go-libp2p-peerstore"
 )
 
+var (
+	// ErrStreamMountingDisabled is returned by p2p commands when
+	// stream mounting isn't enabled on the node, see IpfsNode.P2PEnabled
+	ErrStreamMountingDisabled = errors.New("libp2p stream mounting not enabled. " +
+		"Restart the daemon with 'ipfs daemon --enable-p2p', or enable it for good " +
+		"with 'ipfs config --json Experimental.Libp2pStreamMounting true' and restart the daemon")
+
+	// ErrP2PNotOnline is returned by p2p commands when they are run without
+	// the daemon
+	ErrP2PNotOnline = errors.New("p2p commands need a running daemon. Start it with 'ipfs daemon'")
+
+	// ErrNoProtocol is returned when closing a listener without naming it
+	ErrNoProtocol = errors.New("no protocol name specified")
+
+	// ErrNoHandlerID is returned when closing a stream without naming it
+	ErrNoHandlerID = errors.New("no HandlerID specified")
+
+	// ErrNoMatch is returned when no listener or stream matches the one
+	// given to a close command
+	ErrNoMatch = errors.New("no matching listener or stream found")
+
+	// ErrWaitTimeout is reported by stream dial --wait when no stream was
+	// established before --wait-timeout
+	ErrWaitTimeout = errors.New("no stream was established before --wait-timeout")
+)
+
+// The JSON encoding of the ls outputs is part of the API, their field names
+// are spelled out so that renaming a field can't change it by accident.
+// HandlerIDs are decimal strings, as JavaScript clients can't represent all
+// uint64 values. Lists are always encoded as arrays, empty ones included.
+// testdata/p2p_*.json holds the expected encodings, next to the text output
+// in testdata/p2p_*.txt.
+
 // P2PListenerInfoOutput is output type of ls command
 type P2PListenerInfoOutput struct {
+	// "remote" for listeners forwarding streams of remote peers to a local
+	// address, "local" for forwards of local connections to a peer opened
+	// by stream dial. Set by listener ls
+	Direction string `json:"Direction,omitempty"`
+
+	Protocol string   `json:"Protocol"`
+	Aliases  []string `json:"Aliases,omitempty"`
+	Address  string   `json:"Address"`
+
+	// Time the listener was opened
+	Created time.Time `json:"Created"`
+
+	// Whether the listener is paused
+	Paused bool `json:"Paused,omitempty"`
+
+	// Protocols of the listener without a stream handler on the host, set
+	// with --verify
+	MissingHandlers []string `json:"MissingHandlers,omitempty"`
+
+	// Key/value pairs given to listener open, set with --meta
+	Meta map[string]string `json:"Meta,omitempty"`
+
+	// Group the listener was opened in with 'listener group'
+	Group string `json:"Group,omitempty"`
+
+	// Active streams of the listener, set with --streams
+	Streams []P2PListenerStreamOutput `json:"Streams,omitempty"`
+
+	// Ambiguous protocol names, set by listener open
+	Warnings []string `json:"Warnings,omitempty"`
+
+	// Whether listener open found the listener open already, set with
+	// --exists-ok
+	Existed bool `json:"Existed,omitempty"`
+
+	// Whether the listener is in P2P.Listeners, and whether it is active,
+	// inactive or its entry has an error, set with --config
+	Configured bool   `json:"Configured,omitempty"`
+	State      string `json:"State,omitempty"`
+}
+
+// P2PListenerStreamOutput is a stream nested under its listener in the
+// output of ls command
+type P2PListenerStreamOutput struct {
+	HandlerID  string `json:"HandlerID"`
+	RemotePeer string `json:"RemotePeer"`
+	Age        string `json:"Age"`
+	BytesIn    uint64 `json:"BytesIn"`
+	BytesOut   uint64 `json:"BytesOut"`
+}
+
+// P2PDialTarget is the local address forwarding to one of the dialed peers
+type P2PDialTarget struct {
+	Peer    string
+	Address string
+
+	// Whether the peerstore had addresses of the peer before the dial
+	PeerKnown bool `json:",omitempty"`
+
+	// Address of the peer given to the command, and how long it is kept in
+	// the peerstore, a duration or "permanent"
+	AddedAddress    string `json:",omitempty"`
+	AddedAddressTTL string `json:",omitempty"`
+}
+
+// P2PDialOutput is output type of stream dial command
+type P2PDialOutput struct {
 	Protocol string
+	Aliases  []string `json:",omitempty"`
 	Address  string
+	Peer     string `json:",omitempty"`
+
+	// Set like Peer when a single peer was dialed, see P2PDialTarget
+	PeerKnown       bool   `json:",omitempty"`
+	AddedAddress    string `json:",omitempty"`
+	AddedAddressTTL string `json:",omitempty"`
+
+	// Bound address of each dialed peer, set with --append-peer-id
+	Targets []P2PDialTarget `json:",omitempty"`
+
+	// Set with --wait in a second output: the HandlerID of the first stream
+	// established, or whether none was before --wait-timeout
+	FirstStream  string `json:",omitempty"`
+	WaitTimedOut bool   `json:",omitempty"`
+
+	// Ambiguous protocol names, and the bind address when it isn't a
+	// loopback address unless --allow-public was given
+	Warnings []string `json:",omitempty"`
 }
 
 // P2PStreamInfoOutput is output type of streams command
 type P2PStreamInfoOutput struct {
-	HandlerID     string
-	Protocol      string
-	LocalPeer     string
-	LocalAddress  string
-	RemotePeer    string
-	RemoteAddress string
+	HandlerID     string `json:"HandlerID"`
+	Protocol      string `json:"Protocol"`
+	LocalPeer     string `json:"LocalPeer"`
+	LocalAddress  string `json:"LocalAddress"`
+	RemotePeer    string `json:"RemotePeer"`
+	RemoteAddress string `json:"RemoteAddress"`
+	Priority      string `json:"Priority"`
+
+	// Traffic and time since the stream was opened, set with --verbose
+	BytesIn  uint64 `json:"BytesIn,omitempty"`
+	BytesOut uint64 `json:"BytesOut,omitempty"`
+	Age      string `json:"Age,omitempty"`
+
+	// Traffic and latency, set with --stats
+	Stats *P2PStreamStatsOutput `json:"Stats,omitempty"`
+}
+
+// P2PStreamStatsOutput holds the traffic of a stream and the round trip time
+// to its remote peer
+type P2PStreamStatsOutput struct {
+	BytesIn  uint64 `json:"BytesIn"`
+	BytesOut uint64 `json:"BytesOut"`
+
+	// Last measured round trip time, empty unless the stream was opened with
+	// --measure-latency
+	Latency string `json:"Latency,omitempty"`
 }
 
 // P2PLsOutput is output type of ls command
 type P2PLsOutput struct {
-	Listeners []P2PListenerInfoOutput
+	Listeners []P2PListenerInfoOutput `json:"Listeners"`
+
+	// Totals, set with --count, Listeners is empty then
+	Count *P2PCountOutput `json:"Count,omitempty"`
 }
 
 // P2PStreamsOutput is output type of streams command
 type P2PStreamsOutput struct {
-	Streams []P2PStreamInfoOutput
+	Streams []P2PStreamInfoOutput `json:"Streams"`
+
+	// Totals, set with --count, Streams is empty then
+	Count *P2PCountOutput `json:"Count,omitempty"`
+
+	// Traffic of all the listed streams, set with --total
+	Totals *P2PStreamTotalsOutput `json:"Totals,omitempty"`
+
+	// With --watch, "opened" or "closed", the stream is the only one
+	// listed
+	Event string `json:"Event,omitempty"`
+}
+
+// P2PStreamTotalsOutput sums up the streams listed by stream ls
+type P2PStreamTotalsOutput struct {
+	Streams  int    `json:"Streams"`
+	BytesIn  uint64 `json:"BytesIn"`
+	BytesOut uint64 `json:"BytesOut"`
+}
+
+// P2PCountOutput holds the number of listeners or streams
+type P2PCountOutput struct {
+	Total int `json:"Total"`
+
+	// Totals by protocol, set with --by-protocol
+	ByProtocol map[string]int `json:"ByProtocol,omitempty"`
+}
+
+// P2PStreamStatOutput is output type of stream stat and stream top commands
+type P2PStreamStatOutput struct {
+	HandlerID string
+	BytesIn   uint64
+	BytesOut  uint64
+
+	// Bytes per second since the previous sample
+	RateIn  float64
+	RateOut float64
+
+	// Set on the last sample, with the final counters, once the stream
+	// closed while it was watched
+	Closed bool `json:",omitempty"`
+}
+
+// P2PStatsOutput is output type of stats command
+type P2PStatsOutput struct {
+	// Listeners forwarding p2p streams to local addresses, and listeners
+	// opened by 'stream dial' forwarding local connections to peers
+	Listeners     int
+	DialListeners int
+
+	// Active streams, and all streams opened and failed since the daemon
+	// started
+	Streams       int
+	StreamsOpened uint64
+	StreamsFailed uint64
+
+	// Bytes transferred by all streams since the daemon started
+	BytesIn  uint64
+	BytesOut uint64
+
+	// Outgoing streams re-opened after failing before any data was sent
+	Redials uint64
+
+	// Bandwidth limit and current use in bytes per second, the limit is 0
+	// when unlimited
+	BandwidthLimit int64
+	BandwidthUsed  float64
+}
+
+// P2PPingOutput is output type of ping command
+type P2PPingOutput struct {
+	Peer     string
+	Protocol string
+
+	// Number of bytes echoed back by the peer, 0 if no payload was sent
+	Echoed int
+
+	// Time taken to open the stream, or round trip time of the payload
+	Time time.Duration
+}
+
+// P2PTestOutput is output type of test command
+type P2PTestOutput struct {
+	Peer string
+
+	// Protocol negotiated with the peer
+	Protocol string
+
+	// Set when the peer was connected already, ConnectTime is 0 then
+	Connected   bool
+	ConnectTime time.Duration
+
+	// Time taken to open the stream, and round trip time of the echoed byte
+	// with --echo
+	OpenTime time.Duration
+	EchoTime time.Duration `json:",omitempty"`
+}
+
+// P2PProtocolOutput is a stream handler registered on the host
+type P2PProtocolOutput struct {
+	Protocol string `json:"Protocol"`
+
+	// Main protocol of the listener the handler belongs to
+	Listener string `json:"Listener,omitempty"`
+
+	// Set when no listener owns the handler
+	Orphan bool `json:"Orphan,omitempty"`
+}
+
+// P2PProtocolsOutput is output type of protocols command
+type P2PProtocolsOutput struct {
+	Protocols []P2PProtocolOutput `json:"Protocols"`
+}
+
+// P2PRestoreOutput is the outcome of opening a listener of the config when
+// the daemon started
+type P2PRestoreOutput struct {
+	Protocol string `json:"Protocol"`
+	Address  string `json:"Address"`
+
+	// Why the listener couldn't be opened, empty if it was
+	Error string `json:"Error,omitempty"`
+}
+
+// P2PRestoreStatusOutput is output type of restore-status command
+type P2PRestoreStatusOutput struct {
+	Listeners []P2PRestoreOutput `json:"Listeners"`
 }
 
 // P2PCmd is the 'ipfs p2p' command
@@ -53,8 +339,14 @@ are refined`,
 	},
 
 	Subcommands: map[string]*cmds.Command{
-		"listener": p2pListenerCmd,
-		"stream":   p2pStreamCmd,
+		"listener":       p2pListenerCmd,
+		"stream":         p2pStreamCmd,
+		"stats":          p2pStatsCmd,
+		"ping":           p2pPingCmd,
+		"test":           p2pTestCmd,
+		"protocols":      p2pProtocolsCmd,
+		"debug":          p2pDebugCmd,
+		"restore-status": p2pRestoreStatusCmd,
 	},
 }
 
@@ -66,9 +358,13 @@ var p2pListenerCmd = &cmds.Command{
 	},
 
 	Subcommands: map[string]*cmds.Command{
-		"ls":    p2pListenerLsCmd,
-		"open":  p2pListenerListenCmd,
-		"close": p2pListenerCloseCmd,
+		"ls":       p2pListenerLsCmd,
+		"open":     p2pListenerListenCmd,
+		"group":    p2pListenerGroupCmd,
+		"close":    p2pListenerCloseCmd,
+		"retarget": p2pListenerRetargetCmd,
+		"pause":    p2pListenerPauseCmd,
+		"resume":   p2pListenerResumeCmd,
 	},
 }
 
@@ -83,330 +379,3441 @@ var p2pStreamCmd = &cmds.Command{
 		"ls":    p2pStreamLsCmd,
 		"dial":  p2pStreamDialCmd,
 		"close": p2pStreamCloseCmd,
+		"stat":  p2pStreamStatCmd,
+		"top":   p2pStreamTopCmd,
 	},
 }
 
-var p2pListenerLsCmd = &cmds.Command{
+var p2pStatsCmd = &cmds.Command{
 	Helptext: cmdkit.HelpText{
-		Tagline: "List active p2p listeners.",
-	},
-	Options: []cmdkit.Option{
-		cmdkit.BoolOption("headers", "v", "Print table headers (HandlerID, Protocol, Local, Remote)."),
+		Tagline: "Show p2p stream mounting statistics.",
+		ShortDescription: `
+Show the number of active listeners and streams, the number of streams
+opened and failed and the bytes transferred since the daemon started, and the
+use of the P2P.BandwidthLimit budget shared by all streams.
+		`,
 	},
-	Run: func(req cmds.Request, res cmds.Response) {
-
-		n, err := getNode(req)
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) {
+		n, err := getNode(env)
 		if err != nil {
-			res.SetError(err, cmdkit.ErrNormal)
+			res.SetError(err, getNodeErrorType(err))
 			return
 		}
 
-		output := &P2PLsOutput{}
-
-		for _, listener := range n.P2P.Listeners.Listeners {
-			output.Listeners = append(output.Listeners, P2PListenerInfoOutput{
-				Protocol: listener.Protocol,
-				Address:  listener.Address.String(),
-			})
-		}
-
-		res.SetOutput(output)
+		cmds.EmitOnce(res, statsOutput(n))
 	},
-	Type: P2PLsOutput{},
-	Marshalers: cmds.MarshalerMap{
-		cmds.Text: func(res cmds.Response) (io.Reader, error) {
-			v, err := unwrapOutput(res.Output())
-			if err != nil {
-				return nil, err
-			}
-
-			headers, _, _ := res.Request().Option("headers").Bool()
-			list := v.(*P2PLsOutput)
-			buf := new(bytes.Buffer)
-			w := tabwriter.NewWriter(buf, 1, 2, 1, ' ', 0)
-			for _, listener := range list.Listeners {
-				if headers {
-					fmt.Fprintln(w, "Address\tProtocol")
-				}
-
-				fmt.Fprintf(w, "%s\t%s\n", listener.Address, listener.Protocol)
+	Type: P2PStatsOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeEncoder(func(req *cmds.Request, w io.Writer, v interface{}) error {
+			stats, ok := v.(*P2PStatsOutput)
+			if !ok {
+				return e.TypeErr(stats, v)
 			}
-			w.Flush()
 
-			return buf, nil
-		},
+			writeStats(w, stats)
+			return nil
+		}),
 	},
 }
 
-var p2pStreamLsCmd = &cmds.Command{
+var p2pProtocolsCmd = &cmds.Command{
 	Helptext: cmdkit.HelpText{
-		Tagline: "List active p2p streams.",
+		Tagline: "List the p2p protocol handlers registered on the host.",
+		ShortDescription: `
+List the stream handlers registered on the libp2p host under /p2p/, and those
+of listeners with custom protocols, along with the listener each belongs to.
+Handlers no listener owns are marked as orphans: the host still accepts
+streams on them, but 'ipfs p2p listener ls' doesn't show them and nothing
+forwards their streams.
+		`,
 	},
 	Options: []cmdkit.Option{
-		cmdkit.BoolOption("headers", "v", "Print table headers (HagndlerID, Protocol, Local, Remote)."),
+		cmdkit.BoolOption("headers", "v", "Print table headers (Protocol, Listener)."),
 	},
-	Run: func(req cmds.Request, res cmds.Response) {
-		n, err := getNode(req)
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) {
+		n, err := getNode(env)
 		if err != nil {
-			res.SetError(err, cmdkit.ErrNormal)
+			res.SetError(err, getNodeErrorType(err))
 			return
 		}
 
-		output := &P2PStreamsOutput{}
+		cmds.EmitOnce(res, &P2PProtocolsOutput{Protocols: protocolsOutput(n)})
+	},
+	Type: P2PProtocolsOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeEncoder(func(req *cmds.Request, w io.Writer, v interface{}) error {
+			list, ok := v.(*P2PProtocolsOutput)
+			if !ok {
+				return e.TypeErr(list, v)
+			}
 
-		for _, s := range n.P2P.Streams.Streams {
-			output.Streams = append(output.Streams, P2PStreamInfoOutput{
-				HandlerID: strconv.FormatUint(s.HandlerID, 10),
+			headers, _ := req.Options["headers"].(bool)
+			writeProtocols(w, list.Protocols, headers)
+			return nil
+		}),
+	},
+}
 
-				Protocol: s.Protocol,
+var p2pRestoreStatusCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Show which listeners of the config were opened when the daemon started.",
+		ShortDescription: `
+The daemon opens the listeners of P2P.Listeners when it starts, and keeps
+starting when one of them fails, e.g. because its protocol handler is already
+registered or its address is invalid. List each of them with whether it was
+opened, and the error if it wasn't. 'ipfs p2p listener ls --config' shows
+whether they are open now.
+		`,
+	},
+	Options: []cmdkit.Option{
+		cmdkit.BoolOption("headers", "v", "Print table headers (Protocol, Address, Status)."),
+		cmdkit.BoolOption("failed", "Only list the listeners which failed to open."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) {
+		n, err := getNode(env)
+		if err != nil {
+			res.SetError(err, getNodeErrorType(err))
+			return
+		}
 
-				LocalPeer:    s.LocalPeer.Pretty(),
-				LocalAddress: s.LocalAddr.String(),
+		onlyFailed, _ := req.Options["failed"].(bool)
 
-				RemotePeer:    s.RemotePeer.Pretty(),
-				RemoteAddress: s.RemoteAddr.String(),
-			})
+		output := &P2PRestoreStatusOutput{Listeners: []P2PRestoreOutput{}}
+		for _, r := range n.P2P.Restored {
+			if onlyFailed && r.Err == nil {
+				continue
+			}
+			output.Listeners = append(output.Listeners, restoreOutput(r))
 		}
 
-		res.SetOutput(output)
+		cmds.EmitOnce(res, output)
 	},
-	Type: P2PStreamsOutput{},
-	Marshalers: cmds.MarshalerMap{
-		cmds.Text: func(res cmds.Response) (io.Reader, error) {
-			v, err := unwrapOutput(res.Output())
-			if err != nil {
-				return nil, err
-			}
-
-			headers, _, _ := res.Request().Option("headers").Bool()
-			list := v.(*P2PStreamsOutput)
-			buf := new(bytes.Buffer)
-			w := tabwriter.NewWriter(buf, 1, 2, 1, ' ', 0)
-			for _, stream := range list.Streams {
-				if headers {
-					fmt.Fprintln(w, "HandlerID\tProtocol\tLocal\tRemote")
-				}
-
-				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", stream.HandlerID, stream.Protocol, stream.LocalAddress, stream.RemotePeer)
+	Type: P2PRestoreStatusOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeEncoder(func(req *cmds.Request, w io.Writer, v interface{}) error {
+			status, ok := v.(*P2PRestoreStatusOutput)
+			if !ok {
+				return e.TypeErr(status, v)
 			}
-			w.Flush()
 
-			return buf, nil
-		},
+			headers, _ := req.Options["headers"].(bool)
+			writeRestoreStatus(w, status.Listeners, headers)
+			return nil
+		}),
 	},
 }
 
-var p2pListenerListenCmd = &cmds.Command{
+var p2pPingCmd = &cmds.Command{
 	Helptext: cmdkit.HelpText{
-		Tagline: "Forward p2p connections to a network multiaddr.",
+		Tagline: "Check that a peer handles a protocol.",
 		ShortDescription: `
-Register a p2p connection handler and forward the connections to a specified
-address.
+Open a stream to the protocol of the peer and close it again, without setting
+up a listener. With --payload the payload is sent and the same bytes are
+expected back, like from an echo service, which also tells that the service
+behind the peer's listener is reachable.
 
-Note that the connections originate from the ipfs daemon process.
+Libp2p may only find out that the peer doesn't handle the protocol once data
+is sent, so use --payload for a conclusive answer when the service can echo.
 		`,
 	},
 	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("Peer", true, false, "Peer ID, or address ending with /ipfs/<peer-id>."),
 		cmdkit.StringArg("Protocol", true, false, "Protocol identifier."),
-		cmdkit.StringArg("Address", true, false, "Request handling application address."),
 	},
-	Run: func(req cmds.Request, res cmds.Response) {
-		n, err := getNode(req)
+	Options: []cmdkit.Option{
+		cmdkit.StringOption("payload", "Send this and wait for it to be echoed back."),
+		cmdkit.BoolOption("allow-custom-protocol", "Use the protocol verbatim instead of prefixing it with /p2p/."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) {
+		n, err := getNode(env)
 		if err != nil {
-			res.SetError(err, cmdkit.ErrNormal)
+			res.SetError(err, getNodeErrorType(err))
 			return
 		}
 
-		proto := "/p2p/" + req.Arguments()[0]
-		if n.P2P.CheckProtoExists(proto) {
-			res.SetError(errors.New("protocol handler already registered"), cmdkit.ErrNormal)
+		pid, addr, err := parsePeerTarget(req.Arguments[0])
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
 			return
 		}
 
-		addr, err := ma.NewMultiaddr(req.Arguments()[1])
+		custom, _ := req.Options["allow-custom-protocol"].(bool)
+		proto, err := protocolID(req.Arguments[1], custom)
 		if err != nil {
-			res.SetError(err, cmdkit.ErrNormal)
+			res.SetError(err, cmdkit.ErrClient)
 			return
 		}
 
-		_, err = n.P2P.NewListener(n.Context(), proto, addr)
+		if addr != nil {
+			n.Peerstore.AddAddr(pid, addr, pstore.TempAddrTTL)
+		}
+
+		payload, _ := req.Options["payload"].(string)
+		rtt, err := n.P2P.Probe(req.Context, pid, proto, []byte(payload))
 		if err != nil {
-			res.SetError(err, cmdkit.ErrNormal)
+			res.SetError(fmt.Errorf("probing %s of %s failed: %s", proto, pid.Pretty(), err), cmdkit.ErrNormal)
 			return
 		}
 
-		// Successful response.
-		res.SetOutput(&P2PListenerInfoOutput{
+		cmds.EmitOnce(res, &P2PPingOutput{
+			Peer:     pid.Pretty(),
 			Protocol: proto,
-			Address:  addr.String(),
+			Echoed:   len(payload),
+			Time:     rtt,
 		})
 	},
+	Type: P2PPingOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeEncoder(func(req *cmds.Request, w io.Writer, v interface{}) error {
+			ping, ok := v.(*P2PPingOutput)
+			if !ok {
+				return e.TypeErr(ping, v)
+			}
+
+			writePing(w, ping)
+			return nil
+		}),
+	},
 }
 
-var p2pStreamDialCmd = &cmds.Command{
-	Helptext: cmdkit.HelpText{
-		Tagline: "Dial to a p2p listener.",
+// writePing prints what was checked and how long it took
+func writePing(out io.Writer, ping *P2PPingOutput) {
+	if ping.Echoed == 0 {
+		fmt.Fprintf(out, "Opened a stream to %s of %s in %s\n", ping.Protocol, ping.Peer, ping.Time)
+		return
+	}
+	fmt.Fprintf(out, "%d bytes echoed by %s of %s in %s\n", ping.Echoed, ping.Protocol, ping.Peer, ping.Time)
+}
 
+var p2pTestCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Check that a stream to a peer can be forwarded.",
 		ShortDescription: `
-Establish a new connection to a peer service.
-
-When a connection is made to a peer service the ipfs daemon will setup one
-time TCP listener and return it's bind port, this way a dialing application
-can transparently connect to a p2p service.
+Connect to the peer and open a stream to the protocol the way forwards do, and
+report how long connecting and opening the stream took. Nothing is set up, the
+stream is closed again right away. With --echo a single byte is sent and
+expected back, like from an echo service.
+
+The command fails with the reason when the stream can't be opened: no
+addresses are known for the peer, the dial timed out, or the peer doesn't
+support the protocol. Libp2p may only find out about the latter once data is
+sent, so use --echo for a conclusive answer when the service can echo.
 		`,
 	},
 	Arguments: []cmdkit.Argument{
-		cmdkit.StringArg("Peer", true, false, "Remote peer to connect to"),
+		cmdkit.StringArg("Peer", true, false, "Peer ID, or address ending with /ipfs/<peer-id>."),
 		cmdkit.StringArg("Protocol", true, false, "Protocol identifier."),
-		cmdkit.StringArg("BindAddress", false, false, "Address to listen for connection/s (default: /ip4/127.0.0.1/tcp/0)."),
 	},
-	Run: func(req cmds.Request, res cmds.Response) {
-		n, err := getNode(req)
+	Options: []cmdkit.Option{
+		cmdkit.BoolOption("echo", "Send a byte and wait for it to be echoed back."),
+		cmdkit.StringOption("dial-timeout", "Time to connect to the peer and open the stream, e.g. '10s'. Defaults to P2P.DialTimeout from the config."),
+		cmdkit.BoolOption("allow-custom-protocol", "Use the protocol verbatim instead of prefixing it with /p2p/."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) {
+		n, err := getNode(env)
 		if err != nil {
-			res.SetError(err, cmdkit.ErrNormal)
+			res.SetError(err, getNodeErrorType(err))
 			return
 		}
 
-		addr, peer, err := ParsePeerParam(req.Arguments()[0])
+		pid, addr, err := parsePeerTarget(req.Arguments[0])
 		if err != nil {
-			res.SetError(err, cmdkit.ErrNormal)
+			res.SetError(err, cmdkit.ErrClient)
 			return
 		}
 
-		proto := "/p2p/" + req.Arguments()[1]
+		custom, _ := req.Options["allow-custom-protocol"].(bool)
+		proto, err := protocolID(req.Arguments[1], custom)
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
 
-		bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
-		if len(req.Arguments()) == 3 {
-			bindAddr, err = ma.NewMultiaddr(req.Arguments()[2])
+		var dialTimeout time.Duration
+		if timeout, found := req.Options["dial-timeout"].(string); found {
+			dialTimeout, err = time.ParseDuration(timeout)
 			if err != nil {
-				res.SetError(err, cmdkit.ErrNormal)
+				res.SetError(err, cmdkit.ErrClient)
 				return
 			}
 		}
 
-		listenerInfo, err := n.P2P.Dial(n.Context(), addr, peer, proto, bindAddr)
+		if addr != nil {
+			n.Peerstore.AddAddr(pid, addr, pstore.TempAddrTTL)
+		}
+
+		echo, _ := req.Options["echo"].(bool)
+		result, err := n.P2P.Test(req.Context, pid, proto, dialTimeout, echo)
 		if err != nil {
-			res.SetError(err, cmdkit.ErrNormal)
+			res.SetError(fmt.Errorf("testing %s of %s failed: %s", proto, pid.Pretty(), err), cmdkit.ErrNormal)
 			return
 		}
 
-		output := P2PListenerInfoOutput{
-			Protocol: listenerInfo.Protocol,
-			Address:  listenerInfo.Address.String(),
-		}
+		cmds.EmitOnce(res, &P2PTestOutput{
+			Peer:        pid.Pretty(),
+			Protocol:    result.Protocol,
+			Connected:   result.Connected,
+			ConnectTime: result.Connect,
+			OpenTime:    result.Open,
+			EchoTime:    result.Echo,
+		})
+	},
+	Type: P2PTestOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeEncoder(func(req *cmds.Request, w io.Writer, v interface{}) error {
+			test, ok := v.(*P2PTestOutput)
+			if !ok {
+				return e.TypeErr(test, v)
+			}
 
-		res.SetOutput(&output)
+			writeTest(w, test)
+			return nil
+		}),
 	},
 }
 
-var p2pListenerCloseCmd = &cmds.Command{
+// writeTest prints each step of the test and how long it took
+func writeTest(out io.Writer, test *P2PTestOutput) {
+	if test.Connected {
+		fmt.Fprintf(out, "Already connected to %s\n", test.Peer)
+	} else {
+		fmt.Fprintf(out, "Connected to %s in %s\n", test.Peer, test.ConnectTime)
+	}
+	fmt.Fprintf(out, "Negotiated %s in %s\n", test.Protocol, test.OpenTime)
+	if test.EchoTime > 0 {
+		fmt.Fprintf(out, "Echoed a byte in %s\n", test.EchoTime)
+	}
+}
+
+var p2pListenerLsCmd = &cmds.Command{
 	Helptext: cmdkit.HelpText{
-		Tagline: "Close active p2p listener.",
-	},
-	Arguments: []cmdkit.Argument{
-		cmdkit.StringArg("Protocol", false, false, "P2P listener protocol"),
+		Tagline: "List active p2p listeners.",
+		ShortDescription: `
+List active p2p listeners. With --streams the active streams of each listener
+are listed below it, with their HandlerID, remote peer, age and the bytes
+received and sent.
+
+The Direction column tells listeners opened with 'ipfs p2p listener open',
+which forward the streams of remote peers to a local address ('remote'),
+from the forwards of local connections to a peer opened with
+'ipfs p2p stream dial' ('local'). --direction only lists one of them.
+
+Listeners are sorted by protocol, or by --sort: 'address', or 'age' to list
+the oldest first. Ties are broken by the other keys, so the order is always
+the same. The listeners of a group opened with 'ipfs p2p listener group' are
+listed together, after the listeners opened on their own, with a Group
+column.
+
+--format prints each listener with a Go template instead of the table, e.g.
+'{{.Protocol}} {{.Address}}'. The template has the fields of the JSON output.
+
+With --config the listeners of P2P.Listeners, which the daemon opens when it
+starts, are listed too, followed by the active listeners which aren't in the
+config. This works without a running daemon, and with stream mounting
+disabled. When the daemon runs a State column tells whether each configured
+listener is active or inactive. Entries with an invalid address are always
+in the error state.
+
+With --verify the protocols of each listener are checked against the stream
+handlers of the host. Listeners which can't accept streams on some of their
+protocols, because the host has no handler for them, are flagged with the
+missing protocols. This should never happen, it means the listeners and the
+host got out of sync.
+		`,
 	},
 	Options: []cmdkit.Option{
-		cmdkit.BoolOption("all", "a", "Close all listeners."),
+		cmdkit.BoolOption("headers", "v", "Print table headers (Address, Protocol) and the number of listeners."),
+		cmdkit.BoolOption("quiet", "q", "Don't print the number of listeners below the table with --headers."),
+		cmdkit.BoolOption("streams", "s", "List the active streams of each listener."),
+		cmdkit.StringOption("sort", "Sort listeners by protocol, address or age.").WithDefault("protocol"),
+		cmdkit.BoolOption("count", "Only print the number of listeners."),
+		cmdkit.BoolOption("by-protocol", "Break the number of listeners down by protocol. Implies --count."),
+		cmdkit.StringOption("format", "Print each listener with this Go template."),
+		cmdkit.BoolOption("config", "Also list the listeners of the config, works offline."),
+		cmdkit.BoolOption("meta", "Also list the key/value pairs given to each listener with 'listener open --meta'."),
+		cmdkit.StringOption("direction", "Only list the listeners of this direction: local or remote."),
+		cmdkit.BoolOption("verify", "Flag listeners whose protocols have no stream handler on the host."),
 	},
-	Run: func(req cmds.Request, res cmds.Response) {
-		res.SetOutput(nil)
-
-		n, err := getNode(req)
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) {
+		// the config is read-only, so it may be listed without the checks
+		// of getNode
+		fromConfig, _ := req.Options["config"].(bool)
+		var n *core.IpfsNode
+		var err error
+		if fromConfig {
+			n, err = GetNode(env)
+		} else {
+			n, err = getNode(env)
+		}
 		if err != nil {
-			res.SetError(err, cmdkit.ErrNormal)
+			res.SetError(err, getNodeErrorType(err))
+			return
+		}
+		running := n.OnlineMode() && n.P2P != nil
+
+		direction, _ := req.Options["direction"].(string)
+		switch direction {
+		case "", listenerLocal, listenerRemote:
+		default:
+			res.SetError(fmt.Errorf("invalid direction %q, expected local or remote", direction), cmdkit.ErrClient)
 			return
 		}
 
-		closeAll, _, _ := req.Option("all").Bool()
-		var proto string
+		tmpl, err := parseFormat(req)
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
 
-		if !closeAll {
-			if len(req.Arguments()) == 0 {
-				res.SetError(errors.New("no protocol name specified"), cmdkit.ErrNormal)
+		if count, byProto := countOptions(req); count {
+			if tmpl != nil {
+				res.SetError(errors.New("--count and --format can't be combined"), cmdkit.ErrClient)
+				return
+			}
+			if fromConfig {
+				res.SetError(errors.New("--count and --config can't be combined"), cmdkit.ErrClient)
+				return
+			}
+			if verify, _ := req.Options["verify"].(bool); verify {
+				res.SetError(errors.New("--count and --verify can't be combined"), cmdkit.ErrClient)
 				return
 			}
 
-			proto = "/p2p/" + req.Arguments()[0]
+			var protos []string
+			for _, listener := range listListeners(n, direction) {
+				protos = append(protos, listener.Protocol)
+			}
+			cmds.EmitOnce(res, &P2PLsOutput{
+				Listeners: []P2PListenerInfoOutput{},
+				Count:     countProtocols(protos, byProto),
+			})
+			return
+		}
+
+		sortKey, _ := req.Options["sort"].(string)
+		if !validSortKey(sortKey) {
+			res.SetError(fmt.Errorf("invalid sort key %q, expected one of: %s", sortKey, strings.Join(listenerSortKeys, ", ")), cmdkit.ErrClient)
+			return
+		}
+
+		withStreams, _ := req.Options["streams"].(bool)
+		withMeta, _ := req.Options["meta"].(bool)
+		verify, _ := req.Options["verify"].(bool)
+
+		var streams []*p2p.StreamInfo
+		var live []*p2p.ListenerInfo
+		if running {
+			live = listListeners(n, direction)
+			if withStreams {
+				streams = n.P2P.Streams.Snapshot()
+			}
+		}
+
+		output := &P2PLsOutput{Listeners: []P2PListenerInfoOutput{}}
+
+		for _, listener := range live {
+			info := P2PListenerInfoOutput{
+				Direction: listenerDirection(listener),
+				Protocol:  listener.Protocol,
+				Aliases:   listener.Aliases,
+				Address:   listener.Addr().String(),
+				Created:   listener.Created,
+				Paused:    listener.Paused(),
+				Group:     listener.Group,
+			}
+			if withMeta {
+				info.Meta = listener.Meta
+			}
+			if verify {
+				info.MissingHandlers = n.P2P.MissingHandlers(listener)
+			}
+
+			for _, s := range streams {
+				if s.Listener != listener {
+					continue
+				}
+				info.Streams = append(info.Streams, P2PListenerStreamOutput{
+					HandlerID:  strconv.FormatUint(s.HandlerID, 10),
+					RemotePeer: s.RemotePeer.Pretty(),
+					Age:        time.Since(s.Opened()).Round(time.Second).String(),
+					BytesIn:    s.BytesIn(),
+					BytesOut:   s.BytesOut(),
+				})
+			}
+
+			output.Listeners = append(output.Listeners, info)
 		}
 
-		for _, listener := range n.P2P.Listeners.Listeners {
-			if !closeAll && listener.Protocol != proto {
-				continue
+		if fromConfig {
+			cfg, err := n.Repo.Config()
+			if err != nil {
+				res.SetError(err, cmdkit.ErrNormal)
+				return
 			}
-			listener.Close()
-			if !closeAll {
-				break
+			configured := cfg.P2P.Listeners
+			if direction == listenerLocal {
+				// the listeners of the config are all remote ones
+				configured = nil
+			}
+			output.Listeners = mergeConfiguredListeners(configured, output.Listeners, running)
+		}
+		sortListeners(output.Listeners, sortKey)
+
+		for _, listener := range output.Listeners {
+			if err := formatItem(ioutil.Discard, tmpl, listener); err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
 			}
 		}
+
+		cmds.EmitOnce(res, output)
+	},
+	Type: P2PLsOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeEncoder(func(req *cmds.Request, w io.Writer, v interface{}) error {
+			list, ok := v.(*P2PLsOutput)
+			if !ok {
+				return e.TypeErr(list, v)
+			}
+
+			headers, _ := req.Options["headers"].(bool)
+			if list.Count != nil {
+				writeCount(w, list.Count)
+				return nil
+			}
+
+			tmpl, err := parseFormat(req)
+			if err != nil {
+				return err
+			}
+			if tmpl != nil {
+				for _, listener := range list.Listeners {
+					if err := formatItem(w, tmpl, listener); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			writeListeners(w, list.Listeners, headers)
+			if quiet, _ := req.Options["quiet"].(bool); headers && !quiet {
+				writeTotal(w, len(list.Listeners), "listener")
+			}
+
+			return nil
+		}),
 	},
 }
 
-var p2pStreamCloseCmd = &cmds.Command{
+var p2pStreamLsCmd = &cmds.Command{
 	Helptext: cmdkit.HelpText{
-		Tagline: "Close active p2p stream.",
-	},
-	Arguments: []cmdkit.Argument{
-		cmdkit.StringArg("HandlerID", false, false, "Stream HandlerID"),
+		Tagline: "List active p2p streams.",
+		ShortDescription: `
+List active p2p streams. With --stale only streams which had no traffic in
+either direction for the given duration are listed, to find candidates for
+'ipfs p2p stream close'.
+
+With --protocol-prefix only streams whose protocol starts with the prefix are
+listed, e.g. 'team-a/' for all protocols under /p2p/team-a/. The prefix gets
+/p2p/ prepended unless it starts with a '/'.
+
+With --min-bytes only streams which received and sent at least that many
+bytes together are listed, e.g. '10MB', to find the streams using the most
+bandwidth.
+
+With --verbose (-v) the bytes received and sent by each stream and the time
+since it was opened are added to the table. Unlike the other ls commands,
+--headers has no short flag here.
+
+With --stats the bytes received and sent by each stream are listed, along with
+the round trip time to its peer if the stream was opened with
+--measure-latency. It is measured when the stream opens and refreshed every
+minute.
+
+--format prints each stream with a Go template instead of the table, e.g.
+'{{.HandlerID}} {{.RemotePeer}}'. The template has the fields of the JSON
+output, including those added by --verbose and --stats.
+
+With --total a footer sums up the number of streams listed and the bytes they
+received and sent, under Totals in the JSON output.
+
+With --watch the command prints a line for every stream opened ('+') or
+closed ('-') until it is interrupted, instead of listing the streams. With
+--enc=json one JSON object is printed per event, with its Event field set to
+'opened' or 'closed'.
+		`,
 	},
 	Options: []cmdkit.Option{
-		cmdkit.BoolOption("all", "a", "Close all streams."),
+		cmdkit.BoolOption("headers", "Print table headers (HandlerID, Protocol, Local, Remote) and the number of streams."),
+		cmdkit.BoolOption("quiet", "q", "Don't print the number of streams below the table with --headers."),
+		cmdkit.BoolOption("json-lines", "Stream one JSON object per line for each stream."),
+		cmdkit.StringOption("stale", "Only list streams which had no traffic for this long, e.g. '10m'."),
+		cmdkit.StringOption("protocol-prefix", "Only list streams whose protocol starts with this prefix, e.g. 'team-a/'."),
+		cmdkit.StringOption("min-bytes", "Only list streams which transferred at least this many bytes, e.g. '10MB'."),
+		cmdkit.BoolOption("count", "Only print the number of streams."),
+		cmdkit.BoolOption("by-protocol", "Break the number of streams down by protocol. Implies --count."),
+		cmdkit.BoolOption("verbose", "v", "Also print the bytes received and sent by each stream, and its age."),
+		cmdkit.BoolOption("stats", "Also print the traffic of each stream and the latency measured with --measure-latency."),
+		cmdkit.StringOption("format", "Print each stream with this Go template."),
+		cmdkit.BoolOption("total", "Print the number of streams and their bytes received and sent below the table."),
+		cmdkit.BoolOption("watch", "Print the streams opened and closed until interrupted."),
 	},
-	Run: func(req cmds.Request, res cmds.Response) {
-		res.SetOutput(nil)
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) {
+		n, err := getNode(env)
+		if err != nil {
+			res.SetError(err, getNodeErrorType(err))
+			return
+		}
 
-		n, err := getNode(req)
+		tmpl, err := parseFormat(req)
 		if err != nil {
-			res.SetError(err, cmdkit.ErrNormal)
+			res.SetError(err, cmdkit.ErrClient)
 			return
 		}
 
-		closeAll, _, _ := req.Option("all").Bool()
-		var handlerID uint64
+		streams := n.P2P.Streams.Snapshot()
 
-		if !closeAll {
-			if len(req.Arguments()) == 0 {
-				res.SetError(errors.New("no HandlerID specified"), cmdkit.ErrNormal)
-				return
+		verbose, _ := req.Options["verbose"].(bool)
+		stats, _ := req.Options["stats"].(bool)
+		info := func(s *p2p.StreamInfo) P2PStreamInfoOutput {
+			out := streamInfoOutput(s)
+			if verbose {
+				out.BytesIn = s.BytesIn()
+				out.BytesOut = s.BytesOut()
+				out.Age = time.Since(s.Opened()).Round(time.Second).String()
 			}
+			if stats {
+				out.Stats = streamStatsOutput(s)
+			}
+			return out
+		}
 
-			handlerID, err = strconv.ParseUint(req.Arguments()[0], 10, 64)
-			if err != nil {
-				res.SetError(err, cmdkit.ErrNormal)
+		if watch, _ := req.Options["watch"].(bool); watch {
+			_, stale := req.Options["stale"].(string)
+			_, prefix := req.Options["protocol-prefix"].(string)
+			_, minBytes := req.Options["min-bytes"].(string)
+			jsonLines, _ := req.Options["json-lines"].(bool)
+			total, _ := req.Options["total"].(bool)
+			if count, _ := countOptions(req); count || stale || prefix || minBytes || jsonLines || total || tmpl != nil {
+				res.SetError(errors.New("--watch can't be combined with --stale, --protocol-prefix, --min-bytes, --count, --json-lines, --format or --total"), cmdkit.ErrClient)
 				return
 			}
+
+			watchStreams(req.Context, &n.P2P.Streams, res, info)
+			return
 		}
 
-		for _, stream := range n.P2P.Streams.Streams {
-			if !closeAll && handlerID != stream.HandlerID {
-				continue
+		if staleStr, found := req.Options["stale"].(string); found {
+			stale, err := time.ParseDuration(staleStr)
+			if err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
 			}
-			stream.Close()
-			if !closeAll {
-				break
+
+			var idle []*p2p.StreamInfo
+			for _, s := range streams {
+				if time.Since(s.LastActivity()) > stale {
+					idle = append(idle, s)
+				}
 			}
+			streams = idle
+		}
+
+		if prefix, found := req.Options["protocol-prefix"].(string); found {
+			if !strings.HasPrefix(prefix, "/") {
+				prefix = "/p2p/" + prefix
+			}
+
+			var matched []*p2p.StreamInfo
+			for _, s := range streams {
+				if strings.HasPrefix(s.Protocol, prefix) {
+					matched = append(matched, s)
+				}
+			}
+			streams = matched
+		}
+
+		if size, found := req.Options["min-bytes"].(string); found {
+			min, err := humanize.ParseBytes(size)
+			if err != nil {
+				res.SetError(fmt.Errorf("invalid --min-bytes: %s", err), cmdkit.ErrClient)
+				return
+			}
+
+			var heavy []*p2p.StreamInfo
+			for _, s := range streams {
+				if s.BytesIn()+s.BytesOut() >= min {
+					heavy = append(heavy, s)
+				}
+			}
+			streams = heavy
+		}
+
+		jsonLines, _ := req.Options["json-lines"].(bool)
+		if jsonLines && tmpl != nil {
+			res.SetError(errors.New("--json-lines and --format can't be combined"), cmdkit.ErrClient)
+			return
+		}
+
+		total, _ := req.Options["total"].(bool)
+		if count, _ := countOptions(req); total && (jsonLines || count || tmpl != nil) {
+			res.SetError(errors.New("--total can't be combined with --count, --json-lines or --format"), cmdkit.ErrClient)
+			return
+		}
+
+		if count, byProto := countOptions(req); count {
+			if jsonLines {
+				res.SetError(errors.New("--count and --json-lines can't be combined"), cmdkit.ErrClient)
+				return
+			}
+			if tmpl != nil {
+				res.SetError(errors.New("--count and --format can't be combined"), cmdkit.ErrClient)
+				return
+			}
+
+			var protos []string
+			for _, s := range streams {
+				protos = append(protos, s.Protocol)
+			}
+			cmds.EmitOnce(res, &P2PStreamsOutput{
+				Streams: []P2PStreamInfoOutput{},
+				Count:   countProtocols(protos, byProto),
+			})
+			return
+		}
+
+		if jsonLines {
+			for _, s := range streams {
+				if err := res.Emit(&P2PStreamsOutput{Streams: []P2PStreamInfoOutput{info(s)}}); err != nil {
+					return
+				}
+			}
+			return
+		}
+
+		output := &P2PStreamsOutput{Streams: []P2PStreamInfoOutput{}}
+
+		for _, s := range streams {
+			output.Streams = append(output.Streams, info(s))
+		}
+
+		if total {
+			output.Totals = &P2PStreamTotalsOutput{Streams: len(streams)}
+			for _, s := range streams {
+				output.Totals.BytesIn += s.BytesIn()
+				output.Totals.BytesOut += s.BytesOut()
+			}
+		}
+
+		for _, stream := range output.Streams {
+			if err := formatItem(ioutil.Discard, tmpl, stream); err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+		}
+
+		cmds.EmitOnce(res, output)
+	},
+	Type: P2PStreamsOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeEncoder(func(req *cmds.Request, w io.Writer, v interface{}) error {
+			list, ok := v.(*P2PStreamsOutput)
+			if !ok {
+				return e.TypeErr(list, v)
+			}
+
+			if list.Count != nil {
+				writeCount(w, list.Count)
+				return nil
+			}
+
+			if list.Event != "" {
+				verbose, _ := req.Options["verbose"].(bool)
+				stats, _ := req.Options["stats"].(bool)
+				writeStreamEvent(w, list, verbose, stats)
+				return nil
+			}
+
+			jsonLines, _ := req.Options["json-lines"].(bool)
+			if jsonLines {
+				enc := json.NewEncoder(w)
+				for _, stream := range list.Streams {
+					if err := enc.Encode(stream); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			tmpl, err := parseFormat(req)
+			if err != nil {
+				return err
+			}
+			if tmpl != nil {
+				for _, stream := range list.Streams {
+					if err := formatItem(w, tmpl, stream); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			headers, _ := req.Options["headers"].(bool)
+			verbose, _ := req.Options["verbose"].(bool)
+			stats, _ := req.Options["stats"].(bool)
+			writeStreams(w, list.Streams, headers, verbose, stats)
+			if list.Totals != nil {
+				writeStreamTotals(w, list.Totals)
+			} else if quiet, _ := req.Options["quiet"].(bool); headers && !quiet {
+				writeTotal(w, len(list.Streams), "stream")
+			}
+
+			return nil
+		}),
+	},
+}
+
+var p2pStreamStatCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Show traffic of a p2p stream.",
+		ShortDescription: `
+Print the bytes transferred by a p2p stream in each direction. With --poll the
+counters are sampled at the given interval, printing the throughput since the
+previous sample, until the stream closes or the command is interrupted.
+		`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("HandlerID", true, false, "Stream HandlerID"),
+	},
+	Options: []cmdkit.Option{
+		cmdkit.StringOption("poll", "Sample the stream at this interval, e.g. '1s'."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) {
+		n, err := getNode(env)
+		if err != nil {
+			res.SetError(err, getNodeErrorType(err))
+			return
+		}
+
+		stream, err := lookupStream(n, req.Arguments[0])
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
+
+		var interval time.Duration
+		if poll, found := req.Options["poll"].(string); found {
+			interval, err = time.ParseDuration(poll)
+			if err == nil && interval <= 0 {
+				err = errors.New("poll interval must be positive")
+			}
+			if err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+		}
+
+		if interval == 0 {
+			res.Emit(&P2PStreamStatOutput{
+				HandlerID: req.Arguments[0],
+				BytesIn:   stream.BytesIn(),
+				BytesOut:  stream.BytesOut(),
+			})
+			return
+		}
+		watchStream(req, res, stream, interval)
+	},
+	Type: P2PStreamStatOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeEncoder(func(req *cmds.Request, w io.Writer, v interface{}) error {
+			stat, ok := v.(*P2PStreamStatOutput)
+			if !ok {
+				return e.TypeErr(stat, v)
+			}
+
+			fmt.Fprintf(w, "in: %s (%s/s)\tout: %s (%s/s)\n",
+				humanize.IBytes(stat.BytesIn), humanize.IBytes(uint64(stat.RateIn)),
+				humanize.IBytes(stat.BytesOut), humanize.IBytes(uint64(stat.RateOut)))
+			if stat.Closed {
+				fmt.Fprintf(w, "stream %s closed\n", stat.HandlerID)
+			}
+
+			return nil
+		}),
+	},
+}
+
+var p2pStreamTopCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Watch the throughput of a p2p stream.",
+		ShortDescription: `
+Show the throughput of a p2p stream in each direction, refreshed every
+--interval until the command is interrupted. When the stream closes its final
+counters are printed and the command exits.
+
+Unlike 'ipfs p2p stream stat --poll', which prints a line per sample to keep
+a log, the readout is updated in place.
+		`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("HandlerID", true, false, "Stream HandlerID"),
+	},
+	Options: []cmdkit.Option{
+		cmdkit.StringOption("interval", "Refresh the readout at this interval.").WithDefault("1s"),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) {
+		n, err := getNode(env)
+		if err != nil {
+			res.SetError(err, getNodeErrorType(err))
+			return
+		}
+
+		stream, err := lookupStream(n, req.Arguments[0])
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
+
+		text, _ := req.Options["interval"].(string)
+		interval, err := time.ParseDuration(text)
+		if err == nil && interval <= 0 {
+			err = errors.New("interval must be positive")
+		}
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
+
+		watchStream(req, res, stream, interval)
+	},
+	Type: P2PStreamStatOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeEncoder(func(req *cmds.Request, w io.Writer, v interface{}) error {
+			stat, ok := v.(*P2PStreamStatOutput)
+			if !ok {
+				return e.TypeErr(stat, v)
+			}
+
+			// overwrite the previous readout, the padding covers longer
+			// numbers it had
+			fmt.Fprintf(w, "\rin: %8s/s %10s total   out: %8s/s %10s total    ",
+				humanize.IBytes(uint64(stat.RateIn)), humanize.IBytes(stat.BytesIn),
+				humanize.IBytes(uint64(stat.RateOut)), humanize.IBytes(stat.BytesOut))
+			if stat.Closed {
+				fmt.Fprintf(w, "\nstream %s closed\n", stat.HandlerID)
+			}
+
+			return nil
+		}),
+	},
+}
+
+// lookupStream returns the active stream with the HandlerID given as text
+func lookupStream(n *core.IpfsNode, id string) (*p2p.StreamInfo, error) {
+	handlerID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range n.P2P.Streams.Snapshot() {
+		if s.HandlerID == handlerID {
+			return s, nil
+		}
+	}
+	return nil, ErrNoMatch
+}
+
+// watchStream emits the counters of the stream, then samples them every
+// interval with the throughput since the previous sample. Once the stream
+// closes a last sample with its final counters is emitted, marked Closed.
+func watchStream(req *cmds.Request, res cmds.ResponseEmitter, stream *p2p.StreamInfo, interval time.Duration) {
+	id := strconv.FormatUint(stream.HandlerID, 10)
+	in, out := stream.BytesIn(), stream.BytesOut()
+	last := time.Now()
+
+	if err := res.Emit(&P2PStreamStatOutput{HandlerID: id, BytesIn: in, BytesOut: out}); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	sample := func(now time.Time) *P2PStreamStatOutput {
+		s := &P2PStreamStatOutput{
+			HandlerID: id,
+			BytesIn:   stream.BytesIn(),
+			BytesOut:  stream.BytesOut(),
+		}
+
+		if elapsed := now.Sub(last).Seconds(); elapsed > 0 {
+			s.RateIn = float64(s.BytesIn-in) / elapsed
+			s.RateOut = float64(s.BytesOut-out) / elapsed
+		}
+		in, out, last = s.BytesIn, s.BytesOut, now
+		return s
+	}
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := res.Emit(sample(now)); err != nil {
+				return
+			}
+		case <-stream.Done():
+			s := sample(time.Now())
+			s.Closed = true
+			res.Emit(s)
+			return
+		case <-req.Context.Done():
+			return
+		}
+	}
+}
+
+var p2pListenerListenCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Forward p2p connections to a network multiaddr.",
+		ShortDescription: `
+Register a p2p connection handler and forward the connections to a specified
+address.
+
+Note that the connections originate from the ipfs daemon process.
+
+With --multiplex the listener also accepts streams dialed with
+'ipfs p2p stream dial --multiplex', which carry many connections each. This
+is experimental.
+
+The protocol is registered as /p2p/<Protocol>, unless it is in the /x/
+namespace, e.g. /x/my-app/1.0.0, which avoids confusing it with the /p2p/
+multiaddrs of peers. With --allow-custom-protocol it is registered verbatim,
+so it must start with a '/'. A warning is printed for names which make
+ambiguous protocols under /p2p/, like peer IDs.
+
+With --max-bytes each stream is reset once it transferred that many bytes,
+e.g. to keep a single client of an exposed service from pulling unbounded
+data. --max-bytes-mode decides whether both directions count together
+('combined') or each one is capped on its own ('either').
+
+--rate-limit-up and --rate-limit-down limit the bandwidth of each stream, in
+bytes per second, e.g. '1MB'. Up is data sent from the local address to the
+remote peer, down is data received from the remote peer and written to the
+local address. Each stream has its own limits. P2P.BandwidthLimit still
+applies to all streams together, the stricter limit wins.
+
+--websocket-friendly suits long-lived sessions like websockets. Normally a
+direction ending cleanly is only closed for writing, so that the other one
+can still deliver a response. With the option either side closing ends the
+whole stream, so no session stays open one way only. Streams have no idle
+timeout, and a quiet session stays open however long it is quiet. To notice
+a remote peer that went away, it is pinged every P2P.LivenessInterval
+(default 30s) instead. The stream is reset after three pings in a row fail.
+The pings also measure the latency, making --measure-latency redundant. They
+aren't stream traffic, so 'ipfs p2p stream ls --stale' still lists quiet
+sessions.
+
+With --exists-ok opening a listener which is open already, with the same
+protocols and address, succeeds and prints the existing listener, so that
+scripts may open their listeners every time they run. A listener with the
+same protocol but other aliases or another address still fails.
+
+Forwarding to the API or Gateway address of this node, from Addresses in the
+config, is refused since it would let any peer use them, e.g. the admin RPC
+of the API. --force forwards to them anyway.
+		`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("Protocol", true, false, "Protocol identifier. Multiple comma-separated identifiers may be given to accept aliases."),
+		cmdkit.StringArg("Address", true, false, "Request handling application address, a multiaddr or host:port."),
+	},
+	Options: []cmdkit.Option{
+		cmdkit.IntOption("max-streams-per-peer", "Limit the concurrent streams a single peer opens to the listener. Defaults to P2P.MaxStreamsPerPeer from the config, counted across all listeners."),
+		cmdkit.StringOption("priority", "Priority of the streams under P2P.BandwidthLimit: low, normal or high.").WithDefault("normal"),
+		cmdkit.IntOption("pool-size", "Keep this many warm connections to the target address and reuse them after streams close cleanly.").WithDefault(0),
+		cmdkit.BoolOption("multiplex", "Also accept multiplexed streams carrying many connections each. Experimental."),
+		cmdkit.BoolOption("allow-custom-protocol", "Use the protocol verbatim instead of prefixing it with /p2p/."),
+		cmdkit.BoolOption("measure-latency", "Ping the remote peer of each stream, shown by 'ipfs p2p stream ls --stats'."),
+		cmdkit.StringOption("meta", "Comma-separated key=value pairs stored on the listener, e.g. 'owner=alice,env=staging'."),
+		cmdkit.StringOption("max-bytes", "Reset each stream once it transferred this many bytes, e.g. '100MB'. Unlimited by default."),
+		cmdkit.StringOption("max-bytes-mode", "What --max-bytes counts: both directions 'combined', or 'either' direction on its own.").WithDefault("combined"),
+		cmdkit.StringOption("rate-limit-up", "Bytes per second each stream may send to the remote peer, e.g. '1MB'. Unlimited by default."),
+		cmdkit.StringOption("rate-limit-down", "Bytes per second each stream may receive from the remote peer, e.g. '1MB'. Unlimited by default."),
+		cmdkit.BoolOption("websocket-friendly", "Keep streams open both ways until either side closes them, and ping the remote peer for liveness."),
+		cmdkit.BoolOption("exists-ok", "Succeed if the same listener is open already."),
+		cmdkit.BoolOption("force", "Forward to the API or Gateway address of this node anyway."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) {
+		n, err := getNode(env)
+		if err != nil {
+			res.SetError(err, getNodeErrorType(err))
+			return
+		}
+
+		existsOK, _ := req.Options["exists-ok"].(bool)
+
+		var meta map[string]string
+		if text, found := req.Options["meta"].(string); found {
+			meta, err = parseMeta(text)
+			if err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+		}
+
+		custom, _ := req.Options["allow-custom-protocol"].(bool)
+
+		var protos, warnings []string
+		var existing *p2p.ListenerInfo
+		for _, name := range strings.Split(req.Arguments[0], ",") {
+			proto, err := protocolID(name, custom)
+			if err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+			if warning := protocolWarning(name, proto, custom); warning != "" {
+				warnings = append(warnings, warning)
+			}
+			if err := n.P2P.CheckListenerConflict(proto); err != nil {
+				exists := err.(*p2p.ListenerExistsError)
+				if !existsOK || exists.Listener == nil {
+					res.SetError(err, cmdkit.ErrClient)
+					return
+				}
+				if existing == nil {
+					existing = exists.Listener
+				}
+			}
+			protos = append(protos, proto)
+		}
+
+		addr, err := parseAddrArg("Address", req.Arguments[1])
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
+		if force, _ := req.Options["force"].(bool); !force {
+			if err := checkNodeAddr(n, addr); err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+		}
+
+		if existing != nil {
+			existingProtos := append([]string{existing.Protocol}, existing.Aliases...)
+			if strings.Join(existingProtos, ",") != strings.Join(protos, ",") || !existing.Addr().Equal(addr) {
+				res.SetError(fmt.Errorf("listener %s already exists, forwarding %s to %s", existing.Protocol,
+					strings.Join(existingProtos, ","), existing.Addr()), cmdkit.ErrClient)
+				return
+			}
+
+			cmds.EmitOnce(res, &P2PListenerInfoOutput{
+				Protocol: existing.Protocol,
+				Aliases:  existing.Aliases,
+				Address:  existing.Addr().String(),
+				Created:  existing.Created,
+				Paused:   existing.Paused(),
+				Meta:     existing.Meta,
+				Group:    existing.Group,
+				Existed:  true,
+				Warnings: warnings,
+			})
+			return
+		}
+
+		maxStreams, _ := req.Options["max-streams-per-peer"].(int)
+
+		prioName, _ := req.Options["priority"].(string)
+		prio, err := p2p.ParsePriority(prioName)
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
+
+		poolSize, _ := req.Options["pool-size"].(int)
+
+		multiplex, _ := req.Options["multiplex"].(bool)
+		measureLatency, _ := req.Options["measure-latency"].(bool)
+		wsFriendly, _ := req.Options["websocket-friendly"].(bool)
+
+		maxBytes, maxBytesMode, err := parseMaxBytes(req)
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
+
+		rateUp, rateDown, err := parseRateLimits(req)
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
+
+		listener, err := n.P2P.NewListener(n.Context(), protos[0], addr, p2p.ListenerOpts{
+			Aliases:           protos[1:],
+			MaxStreamsPerPeer: maxStreams,
+			Priority:          prio,
+			PoolSize:          poolSize,
+			Multiplex:         multiplex,
+			MeasureLatency:    measureLatency,
+			Meta:              meta,
+			MaxBytes:          maxBytes,
+			MaxBytesMode:      maxBytesMode,
+			RateLimitUp:       rateUp,
+			RateLimitDown:     rateDown,
+			WebSocketFriendly: wsFriendly,
+		})
+		if err != nil {
+			res.SetError(err, cmdkit.ErrNormal)
+			return
+		}
+
+		// Successful response.
+		cmds.EmitOnce(res, &P2PListenerInfoOutput{
+			Protocol: protos[0],
+			Aliases:  protos[1:],
+			Address:  addr.String(),
+			Created:  listener.Created,
+			Meta:     listener.Meta,
+			Warnings: warnings,
+		})
+	},
+	Type: P2PListenerInfoOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeEncoder(func(req *cmds.Request, w io.Writer, v interface{}) error {
+			listener, ok := v.(*P2PListenerInfoOutput)
+			if !ok {
+				return e.TypeErr(listener, v)
+			}
+
+			if listener.Existed {
+				fmt.Fprintf(w, "Already forwarding %s to %s\n", listener.Protocol, listener.Address)
+			} else if len(req.Arguments) > 1 && isHostPort(req.Arguments[1]) {
+				// teach the multiaddr of addresses given as host:port
+				fmt.Fprintf(w, "Forwarding %s to %s\n", listener.Protocol, listener.Address)
+			}
+			writeWarnings(w, listener.Warnings)
+			return nil
+		}),
+	},
+}
+
+var p2pListenerGroupCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Forward several p2p protocols to the addresses of one backend.",
+		ShortDescription: `
+Open a listener for each Protocol=Address route, all in the named group, e.g.
+to expose the services of one backend under a protocol each:
+
+  ipfs p2p listener group backend /x/api=/ip4/127.0.0.1/tcp/8080 /x/admin=/ip4/127.0.0.1/tcp/9090
+
+Either all routes are opened or none. 'ipfs p2p listener ls' lists the
+listeners of a group together, and 'ipfs p2p listener close --group=backend'
+closes all of them. The protocols are named like for 'ipfs p2p listener open',
+and the options apply to each route. Like there, routes to the API or Gateway
+address of this node are refused unless --force is given.
+		`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("Group", true, false, "Name of the group."),
+		cmdkit.StringArg("Route", true, true, "Protocol=Address route, the address a multiaddr or host:port."),
+	},
+	Options: []cmdkit.Option{
+		cmdkit.IntOption("max-streams-per-peer", "Limit the concurrent streams a single peer opens to the listener. Defaults to P2P.MaxStreamsPerPeer from the config, counted across all listeners."),
+		cmdkit.StringOption("priority", "Priority of the streams under P2P.BandwidthLimit: low, normal or high.").WithDefault("normal"),
+		cmdkit.BoolOption("allow-custom-protocol", "Use the protocols verbatim instead of prefixing them with /p2p/."),
+		cmdkit.StringOption("meta", "Comma-separated key=value pairs stored on each listener, e.g. 'owner=alice,env=staging'."),
+		cmdkit.BoolOption("force", "Forward to the API or Gateway address of this node anyway."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) {
+		n, err := getNode(env)
+		if err != nil {
+			res.SetError(err, getNodeErrorType(err))
+			return
+		}
+
+		var meta map[string]string
+		if text, found := req.Options["meta"].(string); found {
+			meta, err = parseMeta(text)
+			if err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+		}
+
+		custom, _ := req.Options["allow-custom-protocol"].(bool)
+
+		var routes []p2p.Route
+		warnings := make(map[string]string)
+		for _, text := range req.Arguments[1:] {
+			route, warning, err := parseRoute(text, custom)
+			if err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+			if warning != "" {
+				warnings[route.Protocol] = warning
+			}
+			if force, _ := req.Options["force"].(bool); !force {
+				if err := checkNodeAddr(n, route.Address); err != nil {
+					res.SetError(err, cmdkit.ErrClient)
+					return
+				}
+			}
+			routes = append(routes, route)
+		}
+
+		maxStreams, _ := req.Options["max-streams-per-peer"].(int)
+
+		prioName, _ := req.Options["priority"].(string)
+		prio, err := p2p.ParsePriority(prioName)
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
+
+		listeners, err := n.P2P.NewListenerGroup(n.Context(), req.Arguments[0], routes, p2p.ListenerOpts{
+			MaxStreamsPerPeer: maxStreams,
+			Priority:          prio,
+			Meta:              meta,
+		})
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
+
+		output := &P2PLsOutput{Listeners: []P2PListenerInfoOutput{}}
+		for _, listener := range listeners {
+			info := P2PListenerInfoOutput{
+				Protocol: listener.Protocol,
+				Address:  listener.Addr().String(),
+				Created:  listener.Created,
+				Meta:     listener.Meta,
+				Group:    listener.Group,
+			}
+			if warning, ok := warnings[listener.Protocol]; ok {
+				info.Warnings = []string{warning}
+			}
+			output.Listeners = append(output.Listeners, info)
+		}
+		cmds.EmitOnce(res, output)
+	},
+	Type: P2PLsOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeEncoder(func(req *cmds.Request, w io.Writer, v interface{}) error {
+			list, ok := v.(*P2PLsOutput)
+			if !ok {
+				return e.TypeErr(list, v)
+			}
+
+			for _, listener := range list.Listeners {
+				fmt.Fprintf(w, "Forwarding %s to %s\n", listener.Protocol, listener.Address)
+				writeWarnings(w, listener.Warnings)
+			}
+			return nil
+		}),
+	},
+}
+
+// parseRoute parses a Protocol=Address route of listener group, and returns
+// the warning about the protocol name if there is one
+func parseRoute(text string, custom bool) (p2p.Route, string, error) {
+	i := strings.Index(text, "=")
+	if i <= 0 || i == len(text)-1 {
+		return p2p.Route{}, "", fmt.Errorf("invalid route %q, expected Protocol=Address", text)
+	}
+	name := text[:i]
+
+	proto, err := protocolID(name, custom)
+	if err != nil {
+		return p2p.Route{}, "", err
+	}
+	addr, err := parseAddrArg("Route", text[i+1:])
+	if err != nil {
+		return p2p.Route{}, "", err
+	}
+	return p2p.Route{Protocol: proto, Address: addr}, protocolWarning(name, proto, custom), nil
+}
+
+var p2pStreamDialCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Dial to a p2p listener.",
+
+		ShortDescription: `
+Establish a new connection to a peer service.
+
+When a connection is made to a peer service the ipfs daemon will setup one
+time TCP listener and return it's bind port, this way a dialing application
+can transparently connect to a p2p service.
+		`,
+		LongDescription: `
+Establish a new connection to a peer service.
+
+When a connection is made to a peer service the ipfs daemon will setup one
+time TCP listener and return it's bind port, this way a dialing application
+can transparently connect to a p2p service.
+
+With --on-demand the peer is not contacted until a connection is accepted on
+the bind address. The listener then accepts any number of connections, each
+forwarded over its own stream, and goes dormant once it had no active
+connections for --idle-listener-timeout: the port stays bound, and the work
+serving connections is torn down until the next connection wakes it up. Use
+a timeout of 0 to keep it serving until it is closed.
+
+With --max-conn-age every accepted connection is closed, along with its
+stream, once it has been open that long, however busy it is. Clients have to
+reconnect periodically, which rebalances them across backends. This is unlike
+--idle-listener-timeout, which only applies once no connection is left, and
+doesn't depend on any activity on the connection.
+
+By default the stream of each connection is opened as soon as it is accepted.
+With --accept-queue the streams are opened one at a time instead, and up to
+that many accepted connections wait for theirs. Once the queue is full,
+--accept-queue-policy decides whether to stop accepting ('block', leaving
+connections in the kernel backlog), to close the new connection
+('drop-newest') or to close the one which waited the longest ('drop-oldest').
+
+With --append-peer-id several comma-separated peers may be dialed at once, each
+getting its own listener. The bind address must then use port 0, and the port
+picked for each peer is reported under Targets.
+
+With --prefer the peer's addresses of the given family are tried first when
+a new connection is needed, falling back to all of its addresses. This is
+best-effort: an existing connection to the peer is reused whatever its family.
+
+With --multiplex all connections accepted on the bind address are forwarded
+over a single stream to the peer, whose listener must have been opened with
+--multiplex. The listener keeps accepting until it is closed. This is
+experimental.
+
+The peer may be given as an address ending with /ipfs/<peer-id>. The address
+is added to the peerstore for --addr-ttl, by default only a few seconds, so
+later dials of an --on-demand listener may not find it. Use e.g. '24h' or
+'permanent' for long-running forwards. The output reports the address under
+AddedAddress, and whether the peerstore knew the peer before under PeerKnown.
+
+A peer only reachable through a relay may be given with the full relayed
+address, e.g. /ip4/<ip>/tcp/<port>/ipfs/<relay-id>/p2p-circuit/ipfs/<peer-id>.
+This requires relaying not to be disabled with Swarm.DisableRelay.
+
+Peer IDs may be given in base58, e.g. Qm..., or as CIDs of the libp2p-key
+codec, e.g. bafz..., also within addresses. Outputs always print them in
+base58.
+
+The protocol is dialed as /p2p/<Protocol>, unless it is in the /x/ namespace,
+e.g. /x/my-app/1.0.0. With --allow-custom-protocol it is dialed verbatim
+instead, so it must start with a '/'.
+
+--dial-timeout bounds connecting to the peer and opening a stream to it,
+every time the listener does so, e.g. for each connection with --on-demand.
+It defaults to P2P.DialTimeout from the config. The global --timeout option
+only bounds this command, not the dials made later by the listener.
+
+The bind address should be a loopback address, like the default, so that only
+local applications can use the forward. Binding another address prints a
+warning unless --allow-public is given, and fails with --local-only.
+
+With --wait the command prints the bound address as usual, then blocks until
+the first stream of the forward is established and reports it. It fails if
+none was established within --wait-timeout, leaving the forward in place.
+Interrupting the wait leaves the forward in place too, unless
+--close-on-interrupt is given.
+
+--max-bytes and --max-bytes-mode cap the bytes each stream may transfer, and
+--rate-limit-up and --rate-limit-down limit the bandwidth each stream may use
+sending to the peer and receiving from it, like for 'ipfs p2p listener open'.
+
+--websocket-friendly keeps each stream open both ways until either side
+closes it, and pings the peer to notice when it went away, like for 'ipfs p2p
+listener open'. --idle-listener-timeout only applies to an on-demand
+listener without connections, and never closes an open session. --max-conn-age still
+closes every connection once it is that old, websocket sessions included.
+		`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("Peer", true, false, "Remote peer to connect to. Multiple comma-separated peers may be given with --append-peer-id."),
+		cmdkit.StringArg("Protocol", true, false, "Protocol identifier. Multiple comma-separated identifiers are tried in order until the peer supports one."),
+		cmdkit.StringArg("BindAddress", false, false, "Address to listen for connection/s, a multiaddr or host:port (default: /ip4/127.0.0.1/tcp/0)."),
+	},
+	Options: []cmdkit.Option{
+		cmdkit.BoolOption("on-demand", "Only dial the peer once a connection is accepted, and keep accepting."),
+		cmdkit.StringOption("idle-listener-timeout", "Make an on-demand listener dormant after this long without connections, its port stays bound.").WithDefault("5m"),
+		cmdkit.StringOption("priority", "Priority of the stream under P2P.BandwidthLimit: low, normal or high.").WithDefault("normal"),
+		cmdkit.BoolOption("append-peer-id", "Report the bound address of each dialed peer, allows dialing several peers."),
+		cmdkit.StringOption("prefer", "Address family to try first when connecting to the peer: ip4 or ip6. Best-effort."),
+		cmdkit.BoolOption("multiplex", "Forward all connections over a single stream to the peer. Experimental."),
+		cmdkit.IntOption("accept-queue", "Number of accepted connections which may wait for their stream, which are then opened one at a time. Requires --on-demand.").WithDefault(0),
+		cmdkit.StringOption("accept-queue-policy", "What to do with new connections when the accept queue is full: block, drop-newest or drop-oldest.").WithDefault("block"),
+		cmdkit.StringOption("dial-timeout", "Time to connect to the peer and open each stream, e.g. '10s'. Defaults to P2P.DialTimeout from the config."),
+		cmdkit.BoolOption("allow-custom-protocol", "Use the protocol verbatim instead of prefixing it with /p2p/."),
+		cmdkit.StringOption("addr-ttl", "How long to keep the address of the peer, if given, in the peerstore: a duration or 'permanent'. Defaults to a few seconds."),
+		cmdkit.BoolOption("measure-latency", "Ping the peer for each stream, shown by 'ipfs p2p stream ls --stats'."),
+		cmdkit.StringOption("max-conn-age", "Close each accepted connection this long after it was accepted, whether or not it's in use, e.g. '10m'."),
+		cmdkit.StringOption("max-bytes", "Reset each stream once it transferred this many bytes, e.g. '100MB'. Unlimited by default."),
+		cmdkit.StringOption("max-bytes-mode", "What --max-bytes counts: both directions 'combined', or 'either' direction on its own.").WithDefault("combined"),
+		cmdkit.StringOption("rate-limit-up", "Bytes per second each stream may send to the remote peer, e.g. '1MB'. Unlimited by default."),
+		cmdkit.StringOption("rate-limit-down", "Bytes per second each stream may receive from the remote peer, e.g. '1MB'. Unlimited by default."),
+		cmdkit.BoolOption("websocket-friendly", "Keep streams open both ways until either side closes them, and ping the peer for liveness."),
+		cmdkit.BoolOption("local-only", "Refuse bind addresses other than loopback ones."),
+		cmdkit.BoolOption("allow-public", "Don't warn about a bind address other than a loopback one."),
+		cmdkit.BoolOption("wait", "Block until the first stream is established."),
+		cmdkit.StringOption("wait-timeout", "Give up waiting after this long, e.g. '30s'. Requires --wait."),
+		cmdkit.BoolOption("close-on-interrupt", "Close the forward when interrupted while waiting. Requires --wait."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) {
+		n, err := getNode(env)
+		if err != nil {
+			res.SetError(err, getNodeErrorType(err))
+			return
+		}
+
+		perPeer, _ := req.Options["append-peer-id"].(bool)
+		targets := strings.Split(req.Arguments[0], ",")
+		if len(targets) > 1 && !perPeer {
+			res.SetError(errors.New("dialing several peers requires --append-peer-id"), cmdkit.ErrClient)
+			return
+		}
+
+		cfg, err := n.Repo.Config()
+		if err != nil {
+			res.SetError(err, cmdkit.ErrNormal)
+			return
+		}
+
+		// bad peers are the caller's fault, unlike failing to dial them
+		for _, target := range targets {
+			_, addr, err := parsePeerTarget(target)
+			if err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+			if addr != nil && isRelayAddr(addr) && cfg.Swarm.DisableRelay {
+				res.SetError(fmt.Errorf("%s is a relayed address, which requires Swarm.DisableRelay to be false", addr), cmdkit.ErrClient)
+				return
+			}
+		}
+
+		custom, _ := req.Options["allow-custom-protocol"].(bool)
+
+		var protos, warnings []string
+		for _, name := range strings.Split(req.Arguments[1], ",") {
+			proto, err := protocolID(name, custom)
+			if err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+			if warning := protocolWarning(name, proto, custom); warning != "" {
+				warnings = append(warnings, warning)
+			}
+			protos = append(protos, proto)
+		}
+
+		bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+		if len(req.Arguments) == 3 {
+			bindAddr, err = parseAddrArg("BindAddress", req.Arguments[2])
+			if err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+		}
+
+		localOnly, _ := req.Options["local-only"].(bool)
+		allowPublic, _ := req.Options["allow-public"].(bool)
+		if localOnly && allowPublic {
+			res.SetError(errors.New("--local-only and --allow-public can't be combined"), cmdkit.ErrClient)
+			return
+		}
+		loopback := isLoopbackAddr(bindAddr)
+		if localOnly && !loopback {
+			res.SetError(fmt.Errorf("bind address %s isn't a loopback address, refusing it with --local-only", bindAddr), cmdkit.ErrClient)
+			return
+		}
+
+		if len(targets) > 1 {
+			if port, err := bindAddr.ValueForProtocol(ma.P_TCP); err != nil || port != "0" {
+				res.SetError(errors.New("dialing several peers requires a bind address with port 0"), cmdkit.ErrClient)
+				return
+			}
+		}
+
+		var opts p2p.DialOpts
+		prioName, _ := req.Options["priority"].(string)
+		opts.Priority, err = p2p.ParsePriority(prioName)
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
+
+		family, _ := req.Options["prefer"].(string)
+		opts.Prefer, err = p2p.ParseAddrFamily(family)
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
+
+		opts.OnDemand, _ = req.Options["on-demand"].(bool)
+		opts.Multiplex, _ = req.Options["multiplex"].(bool)
+		opts.MeasureLatency, _ = req.Options["measure-latency"].(bool)
+		opts.WebSocketFriendly, _ = req.Options["websocket-friendly"].(bool)
+		if opts.OnDemand && opts.Multiplex {
+			res.SetError(errors.New("--on-demand and --multiplex can't be combined"), cmdkit.ErrClient)
+			return
+		}
+
+		if opts.OnDemand {
+			idle, _ := req.Options["idle-listener-timeout"].(string)
+			opts.IdleTimeout, err = time.ParseDuration(idle)
+			if err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+		}
+
+		if age, found := req.Options["max-conn-age"].(string); found {
+			opts.MaxConnAge, err = time.ParseDuration(age)
+			if err == nil && opts.MaxConnAge <= 0 {
+				err = errors.New("--max-conn-age must be positive")
+			}
+			if err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+		}
+
+		opts.MaxBytes, opts.MaxBytesMode, err = parseMaxBytes(req)
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
+
+		opts.RateLimitUp, opts.RateLimitDown, err = parseRateLimits(req)
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
+
+		opts.AcceptQueue, _ = req.Options["accept-queue"].(int)
+		if opts.AcceptQueue < 0 {
+			res.SetError(errors.New("--accept-queue must not be negative"), cmdkit.ErrClient)
+			return
+		}
+		if opts.AcceptQueue > 0 && !opts.OnDemand {
+			res.SetError(errors.New("--accept-queue requires --on-demand"), cmdkit.ErrClient)
+			return
+		}
+
+		policy, _ := req.Options["accept-queue-policy"].(string)
+		opts.AcceptQueuePolicy, err = p2p.ParseQueuePolicy(policy)
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
+
+		if dialTimeout, found := req.Options["dial-timeout"].(string); found {
+			opts.DialTimeout, err = time.ParseDuration(dialTimeout)
+			if err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+		}
+
+		ttlName, _ := req.Options["addr-ttl"].(string)
+		addrTTL, err := parseAddrTTL(ttlName)
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
+
+		wait, _ := req.Options["wait"].(bool)
+		var waitTimeout time.Duration
+		if timeout, found := req.Options["wait-timeout"].(string); found {
+			waitTimeout, err = time.ParseDuration(timeout)
+			if err == nil && waitTimeout <= 0 {
+				err = errors.New("wait timeout must be positive")
+			}
+			if err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+		}
+		closeOnInterrupt, _ := req.Options["close-on-interrupt"].(bool)
+		if (waitTimeout > 0 || closeOnInterrupt) && !wait {
+			res.SetError(errors.New("--wait-timeout and --close-on-interrupt require --wait"), cmdkit.ErrClient)
+			return
+		}
+
+		// subscribe before dialing, the first stream may come in right away
+		var streams <-chan *p2p.StreamInfo
+		unsubscribe := func() {}
+		if wait {
+			streams, unsubscribe = n.P2P.Streams.Subscribe()
+		}
+
+		opts.Fallbacks = protos[1:]
+		// the forwards outlive the request, but are torn down if it is
+		// cancelled before they are all set up
+		opts.Setup = req.Context
+
+		output := P2PDialOutput{
+			Protocol: protos[0],
+			Aliases:  opts.Fallbacks,
+			Warnings: warnings,
+		}
+
+		var dialed []*p2p.ListenerInfo
+		for _, target := range targets {
+			listenerInfo, dialOut, err := dialTarget(n, target, protos[0], bindAddr, addrTTL, opts)
+			if err != nil {
+				// don't leave the listeners of the other peers behind
+				for _, l := range dialed {
+					l.Closer.Close()
+				}
+				unsubscribe()
+				res.SetError(err, cmdkit.ErrNormal)
+				return
+			}
+
+			dialed = append(dialed, listenerInfo)
+			output.Targets = append(output.Targets, dialOut)
+		}
+		if err := req.Context.Err(); err != nil {
+			// nobody learns the addresses of the forwards, nor could close them
+			for _, l := range dialed {
+				l.Closer.Close()
+			}
+			unsubscribe()
+			res.SetError(err, cmdkit.ErrNormal)
+			return
+		}
+
+		if len(dialed) == 1 {
+			target := output.Targets[0]
+			output.Address = target.Address
+			output.Peer = target.Peer
+			output.PeerKnown = target.PeerKnown
+			output.AddedAddress = target.AddedAddress
+			output.AddedAddressTTL = target.AddedAddressTTL
+		}
+		if !perPeer {
+			output.Targets = nil
+		}
+		if !loopback && !allowPublic {
+			output.Warnings = append(output.Warnings, fmt.Sprintf("%s isn't a loopback address, other hosts may connect to the forward. "+
+				"Use --local-only to refuse such addresses, or --allow-public to silence this warning", bindAddr))
+		}
+
+		if !wait {
+			cmds.EmitOnce(res, &output)
+			return
+		}
+
+		defer unsubscribe()
+
+		if err := res.Emit(&output); err != nil {
+			return
+		}
+
+		result := &P2PDialOutput{Protocol: output.Protocol, Address: output.Address, Peer: output.Peer}
+		s, err := waitFirstStream(req.Context, streams, dialed, waitTimeout)
+		switch {
+		case s != nil:
+			result.FirstStream = strconv.FormatUint(s.HandlerID, 10)
+			result.Address = s.Listener.Addr().String()
+			result.Peer = s.RemotePeer.Pretty()
+		case err == ErrWaitTimeout:
+			// JSON clients get the result, the CLI fails with the error
+			result.WaitTimedOut = true
+			if err := res.Emit(result); err != nil {
+				return
+			}
+			res.SetError(ErrWaitTimeout, cmdkit.ErrNormal)
+			return
+		default:
+			// interrupted, the forward stays unless asked otherwise
+			if closeOnInterrupt {
+				for _, l := range dialed {
+					l.Closer.Close()
+				}
+			}
+			return
+		}
+
+		res.Emit(result)
+	},
+	Type: P2PDialOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeEncoder(func(req *cmds.Request, w io.Writer, v interface{}) error {
+			dial, ok := v.(*P2PDialOutput)
+			if !ok {
+				return e.TypeErr(dial, v)
+			}
+			if dial.WaitTimedOut {
+				// Run reports the error
+				return nil
+			}
+
+			writeDial(w, dial)
+			return nil
+		}),
+	},
+}
+
+// waitFirstStream waits for the first stream of one of the dialed listeners to
+// be registered, for at most timeout unless it is zero. It fails with
+// ErrWaitTimeout or the error of the context.
+func waitFirstStream(ctx context.Context, streams <-chan *p2p.StreamInfo, dialed []*p2p.ListenerInfo, timeout time.Duration) (*p2p.StreamInfo, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		select {
+		case s := <-streams:
+			for _, l := range dialed {
+				if s.Listener == l {
+					return s, nil
+				}
+			}
+		case <-expired:
+			return nil, ErrWaitTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// dialTarget dials a peer given by its ID or by an address ending with it,
+// the address is kept in the peerstore for addrTTL
+func dialTarget(n *core.IpfsNode, target, proto string, bindAddr ma.Multiaddr, addrTTL time.Duration, opts p2p.DialOpts) (*p2p.ListenerInfo, P2PDialTarget, error) {
+	pid, addr, err := parsePeerTarget(target)
+	if err != nil {
+		return nil, P2PDialTarget{}, err
+	}
+
+	out := P2PDialTarget{
+		Peer:      pid.Pretty(),
+		PeerKnown: len(n.Peerstore.Addrs(pid)) > 0,
+	}
+	if addr != nil {
+		n.Peerstore.AddAddr(pid, addr, addrTTL)
+		out.AddedAddress = addr.String()
+		out.AddedAddressTTL = addrTTLString(addrTTL)
+	}
+
+	listenerInfo, err := n.P2P.Dial(n.Context(), addr, pid, proto, bindAddr, opts)
+	if err != nil {
+		return nil, out, err
+	}
+	out.Address = listenerInfo.Addr().String()
+	return listenerInfo, out, nil
+}
+
+// parseMaxBytes parses the --max-bytes and --max-bytes-mode options, a size
+// like '100MB' and the byte cap mode
+func parseMaxBytes(req *cmds.Request) (uint64, p2p.ByteCapMode, error) {
+	var max uint64
+	if size, found := req.Options["max-bytes"].(string); found {
+		var err error
+		max, err = humanize.ParseBytes(size)
+		if err != nil {
+			return 0, p2p.CapCombined, fmt.Errorf("invalid --max-bytes: %s", err)
+		}
+	}
+
+	modeName, _ := req.Options["max-bytes-mode"].(string)
+	mode, err := p2p.ParseByteCapMode(modeName)
+	if err != nil {
+		return 0, p2p.CapCombined, err
+	}
+	return max, mode, nil
+}
+
+// parseRateLimits parses the --rate-limit-up and --rate-limit-down options,
+// sizes like '1MB' which are taken as bytes per second
+func parseRateLimits(req *cmds.Request) (up, down int64, err error) {
+	parse := func(name string) (int64, error) {
+		size, found := req.Options[name].(string)
+		if !found {
+			return 0, nil
+		}
+		rate, err := humanize.ParseBytes(size)
+		if err == nil && (rate == 0 || rate > math.MaxInt64) {
+			err = errors.New("must be positive and below 8EB")
+		}
+		if err != nil {
+			return 0, fmt.Errorf("invalid --%s: %s", name, err)
+		}
+		return int64(rate), nil
+	}
+
+	if up, err = parse("rate-limit-up"); err != nil {
+		return 0, 0, err
+	}
+	if down, err = parse("rate-limit-down"); err != nil {
+		return 0, 0, err
+	}
+	return up, down, nil
+}
+
+// parseAddrTTL parses the --addr-ttl option, a duration or "permanent"
+func parseAddrTTL(s string) (time.Duration, error) {
+	switch s {
+	case "":
+		return pstore.TempAddrTTL, nil
+	case "permanent":
+		return pstore.PermanentAddrTTL, nil
+	}
+
+	ttl, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("address TTL must be positive, got %s", s)
+	}
+	return ttl, nil
+}
+
+func addrTTLString(ttl time.Duration) string {
+	if ttl == pstore.PermanentAddrTTL {
+		return "permanent"
+	}
+	return ttl.String()
+}
+
+// writeDial prints one confirmation line for each dialed peer, or the stream
+// --wait was waiting for
+func writeDial(out io.Writer, output *P2PDialOutput) {
+	if output.FirstStream != "" {
+		fmt.Fprintf(out, "Stream %s established on %s\n", output.FirstStream, output.Address)
+		return
+	}
+
+	targets := output.Targets
+	if len(targets) == 0 {
+		targets = []P2PDialTarget{{
+			Peer:            output.Peer,
+			Address:         output.Address,
+			AddedAddress:    output.AddedAddress,
+			AddedAddressTTL: output.AddedAddressTTL,
+		}}
+	}
+	for _, target := range targets {
+		fmt.Fprintf(out, "Forwarded %s: %s -> /ipfs/%s\n", output.Protocol, target.Address, target.Peer)
+		if target.AddedAddress != "" && target.AddedAddressTTL != "permanent" {
+			fmt.Fprintf(out, "  %s was added to the peerstore for %s only, later dials may not find it\n",
+				target.AddedAddress, target.AddedAddressTTL)
+		}
+	}
+	writeWarnings(out, output.Warnings)
+}
+
+// writeWarnings prints a line for each warning
+func writeWarnings(out io.Writer, warnings []string) {
+	for _, warning := range warnings {
+		fmt.Fprintf(out, "Warning: %s\n", warning)
+	}
+}
+
+var p2pListenerCloseCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Close active p2p listener.",
+		ShortDescription: `
+Close the listeners matching the protocol, the --address and/or the
+--older-than duration given, or all of them with --all. The protocol may be given with or without the /p2p/
+prefix, in the /x/ namespace, or verbatim with --allow-custom-protocol.
+
+--address-contains matches the listeners whose address contains the given
+string, e.g. only the port, and closes all of them.
+
+--group closes all listeners of a group opened with 'ipfs p2p listener group'.
+
+Only the listeners forwarding the streams of remote peers to a local address
+are closed, the 'remote' ones of 'ipfs p2p listener ls'. With
+--direction=local the forwards of local connections to a peer opened with
+'ipfs p2p stream dial' are closed instead. --direction alone closes all
+listeners of the direction.
+
+The protocol may be a pattern with the syntax of Go's path.Match, e.g.
+'myapp-staging*', matched against the protocol and the aliases of each
+listener after the /p2p/ prefix was added. Names without '*', '?' or '['
+only match exactly.
+
+With --dry-run the listeners which would be closed are listed, in the same
+format, without closing them.
+
+With --verbose the closed listeners are printed as a table of their protocols,
+address and age instead. The JSON output always has the details of each closed
+listener.
+
+The command fails when nothing matched, unless --quiet or --ignore-missing is
+given, so that scripts notice cleanups which did nothing.
+		`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("Protocol", false, false, "P2P listener protocol, or a pattern of protocols"),
+	},
+	Options: []cmdkit.Option{
+		cmdkit.BoolOption("all", "a", "Close all listeners."),
+		cmdkit.StringOption("address", "Close the listeners forwarding to this address."),
+		cmdkit.StringOption("address-contains", "Close the listeners whose address contains this string."),
+		cmdkit.StringOption("older-than", "Close the listeners opened longer ago than this, e.g. '24h'."),
+		cmdkit.StringOption("meta", "Close the listeners with all of these comma-separated key=value pairs."),
+		cmdkit.StringOption("group", "Close the listeners of this group."),
+		cmdkit.StringOption("direction", "Close the listeners of this direction: local or remote. Remote by default."),
+		cmdkit.BoolOption("quiet", "q", "Only print the number of closed listeners."),
+		cmdkit.BoolOption("verbose", "Print the protocols, address and age of each closed listener as a table."),
+		cmdkit.BoolOption("dry-run", "List the listeners which would be closed without closing them."),
+		cmdkit.BoolOption("allow-custom-protocol", "Match the protocol verbatim instead of prefixing it with /p2p/."),
+		cmdkit.BoolOption("ignore-missing", "Don't fail when no listener matched. Implied by --quiet."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) {
+		n, err := getNode(env)
+		if err != nil {
+			res.SetError(err, getNodeErrorType(err))
+			return
+		}
+
+		var filter listenerFilter
+		filter.all, _ = req.Options["all"].(bool)
+		if text, found := req.Options["address"].(string); found {
+			// compare addresses the way they are printed, e.g. with IPv6
+			// zeros compressed
+			addr, err := parseAddrArg("address", text)
+			if err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+			filter.addr = addr.String()
+		}
+		filter.addrContains, _ = req.Options["address-contains"].(string)
+		if len(req.Arguments) > 0 {
+			custom, _ := req.Options["allow-custom-protocol"].(bool)
+			if custom {
+				filter.proto, err = protocolID(req.Arguments[0], true)
+				if err != nil {
+					res.SetError(err, cmdkit.ErrClient)
+					return
+				}
+			} else {
+				filter.proto = normalizeProtocol(req.Arguments[0])
+			}
+			if err := checkProtocolPattern(filter.proto); err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+		}
+
+		if olderThan, found := req.Options["older-than"].(string); found {
+			age, err := time.ParseDuration(olderThan)
+			if err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+			filter.createdBefore = time.Now().Add(-age)
+		}
+
+		if text, found := req.Options["meta"].(string); found {
+			filter.meta, err = parseMeta(text)
+			if err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+		}
+
+		filter.group, _ = req.Options["group"].(string)
+
+		filter.direction, _ = req.Options["direction"].(string)
+		switch filter.direction {
+		case "", listenerLocal, listenerRemote:
+		default:
+			res.SetError(fmt.Errorf("invalid direction %q, expected local or remote", filter.direction), cmdkit.ErrClient)
+			return
+		}
+		if filter.direction != "" && filter.all {
+			res.SetError(errors.New("--all and --direction can't be combined"), cmdkit.ErrClient)
+			return
+		}
+
+		if !filter.all && filter.proto == "" && filter.addr == "" && filter.addrContains == "" && filter.createdBefore.IsZero() && filter.meta == nil && filter.group == "" && filter.direction == "" {
+			res.SetError(ErrNoProtocol, cmdkit.ErrClient)
+			return
+		}
+
+		quiet, _ := req.Options["quiet"].(bool)
+		verbose, _ := req.Options["verbose"].(bool)
+		if quiet && verbose {
+			res.SetError(errors.New("--quiet and --verbose can't be combined"), cmdkit.ErrClient)
+			return
+		}
+
+		dryRun, _ := req.Options["dry-run"].(bool)
+
+		// closing a listener removes it from the registry
+		listeners := n.P2P.Listeners.List()
+		if filter.direction == listenerLocal {
+			listeners = n.P2P.ListDialListeners()
+		}
+
+		output := &P2PLsOutput{Listeners: []P2PListenerInfoOutput{}}
+		for _, listener := range listeners {
+			if !filter.match(listener) {
+				continue
+			}
+
+			// record the listener as it was before it is torn down
+			output.Listeners = append(output.Listeners, P2PListenerInfoOutput{
+				Direction: listenerDirection(listener),
+				Protocol:  listener.Protocol,
+				Aliases:   listener.Aliases,
+				Address:   listener.Addr().String(),
+				Created:   listener.Created,
+				Paused:    listener.Paused(),
+				Meta:      listener.Meta,
+				Group:     listener.Group,
+			})
+			if !dryRun {
+				listener.Close()
+			}
+		}
+
+		ignoreMissing, _ := req.Options["ignore-missing"].(bool)
+		if !filter.all && !quiet && !ignoreMissing && len(output.Listeners) == 0 {
+			res.SetError(ErrNoMatch, cmdkit.ErrClient)
+			return
+		}
+
+		cmds.EmitOnce(res, output)
+	},
+	Type: P2PLsOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeEncoder(func(req *cmds.Request, w io.Writer, v interface{}) error {
+			list, ok := v.(*P2PLsOutput)
+			if !ok {
+				return e.TypeErr(list, v)
+			}
+
+			quiet, _ := req.Options["quiet"].(bool)
+			verbose, _ := req.Options["verbose"].(bool)
+			writeClosedListeners(w, list.Listeners, quiet, verbose)
+			return nil
+		}),
+	},
+}
+
+var p2pListenerRetargetCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Forward the connections of a p2p listener to another address.",
+		ShortDescription: `
+Switch the address the listener of the protocol forwards new streams to,
+without closing it. Streams already open keep forwarding to the old address
+until they are closed. The protocol may be given with or without the /p2p/
+prefix, or verbatim with --allow-custom-protocol.
+
+Like for 'ipfs p2p listener open', the API or Gateway address of this node is
+refused unless --force is given.
+		`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("Protocol", true, false, "P2P listener protocol"),
+		cmdkit.StringArg("Address", true, false, "New request handling application address."),
+	},
+	Options: []cmdkit.Option{
+		cmdkit.BoolOption("allow-custom-protocol", "Match the protocol verbatim instead of prefixing it with /p2p/."),
+		cmdkit.BoolOption("force", "Forward to the API or Gateway address of this node anyway."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) {
+		n, err := getNode(env)
+		if err != nil {
+			res.SetError(err, getNodeErrorType(err))
+			return
+		}
+
+		proto, err := listenerProtocolArg(req)
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
+
+		addr, err := parseAddrArg("Address", req.Arguments[1])
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
+		if force, _ := req.Options["force"].(bool); !force {
+			if err := checkNodeAddr(n, addr); err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+		}
+
+		for _, listener := range n.P2P.Listeners.List() {
+			if !listener.HasProtocol(proto) {
+				continue
+			}
+
+			if err := listener.Retarget(addr); err != nil {
+				res.SetError(err, cmdkit.ErrClient)
+				return
+			}
+
+			cmds.EmitOnce(res, &P2PListenerInfoOutput{
+				Protocol: listener.Protocol,
+				Aliases:  listener.Aliases,
+				Address:  addr.String(),
+				Created:  listener.Created,
+			})
+			return
+		}
+
+		res.SetError(ErrNoMatch, cmdkit.ErrClient)
+	},
+	Type: P2PListenerInfoOutput{},
+}
+
+var p2pListenerPauseCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Stop accepting new streams on a p2p listener.",
+		ShortDescription: `
+Pause the listener of the protocol: new streams are reset until it is resumed
+with 'ipfs p2p listener resume'. The listener stays open, with its settings,
+and the streams already open keep forwarding. The protocol may be given with
+or without the /p2p/ prefix, or verbatim with --allow-custom-protocol.
+		`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("Protocol", true, false, "P2P listener protocol"),
+	},
+	Options: []cmdkit.Option{
+		cmdkit.BoolOption("allow-custom-protocol", "Match the protocol verbatim instead of prefixing it with /p2p/."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) {
+		setListenerPaused(req, res, env, true)
+	},
+	Type: P2PListenerInfoOutput{},
+}
+
+var p2pListenerResumeCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Accept new streams on a paused p2p listener again.",
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("Protocol", true, false, "P2P listener protocol"),
+	},
+	Options: []cmdkit.Option{
+		cmdkit.BoolOption("allow-custom-protocol", "Match the protocol verbatim instead of prefixing it with /p2p/."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) {
+		setListenerPaused(req, res, env, false)
+	},
+	Type: P2PListenerInfoOutput{},
+}
+
+// setListenerPaused pauses or resumes the listener named in the request
+func setListenerPaused(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment, paused bool) {
+	n, err := getNode(env)
+	if err != nil {
+		res.SetError(err, getNodeErrorType(err))
+		return
+	}
+
+	proto, err := listenerProtocolArg(req)
+	if err != nil {
+		res.SetError(err, cmdkit.ErrClient)
+		return
+	}
+
+	for _, listener := range n.P2P.Listeners.List() {
+		if !listener.HasProtocol(proto) {
+			continue
+		}
+
+		if paused {
+			listener.Pause()
+		} else {
+			listener.Resume()
+		}
+
+		cmds.EmitOnce(res, &P2PListenerInfoOutput{
+			Protocol: listener.Protocol,
+			Aliases:  listener.Aliases,
+			Address:  listener.Addr().String(),
+			Created:  listener.Created,
+			Paused:   paused,
+		})
+		return
+	}
+
+	res.SetError(ErrNoMatch, cmdkit.ErrClient)
+}
+
+// listenerProtocolArg returns the protocol of the listener named by the
+// first argument
+func listenerProtocolArg(req *cmds.Request) (string, error) {
+	if custom, _ := req.Options["allow-custom-protocol"].(bool); custom {
+		return protocolID(req.Arguments[0], true)
+	}
+	return normalizeProtocol(req.Arguments[0]), nil
+}
+
+var p2pStreamCloseCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Close active p2p stream.",
+		ShortDescription: `
+Close the stream with the given HandlerID, all streams with --all, or the
+streams with a peer with --peer and/or of a protocol with --protocol. The peer
+may be given as a peer ID or as an address ending with /ipfs/<peer-id>, as
+printed by other commands. The protocol may be given with or without the
+/p2p/ prefix, and may be a pattern like for 'ipfs p2p listener close'.
+
+The command fails when no stream matched, unless --ignore-missing is given.
+		`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("HandlerID", false, false, "Stream HandlerID"),
+	},
+	Options: []cmdkit.Option{
+		cmdkit.BoolOption("all", "a", "Close all streams."),
+		cmdkit.StringOption("peer", "p", "Close the streams with this peer."),
+		cmdkit.StringOption("protocol", "Close the streams of this protocol, or of the protocols matching this pattern."),
+		cmdkit.BoolOption("ignore-missing", "Don't fail when no stream matched."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) {
+		n, err := getNode(env)
+		if err != nil {
+			res.SetError(err, getNodeErrorType(err))
+			return
+		}
+
+		ignoreMissing, _ := req.Options["ignore-missing"].(bool)
+
+		closeAll, _ := req.Options["all"].(bool)
+		if closeAll {
+			if err := n.P2P.Streams.CloseAll(req.Context); err != nil {
+				res.SetError(err, cmdkit.ErrNormal)
+			}
+			return
+		}
+
+		target, byPeer := req.Options["peer"].(string)
+		proto, byProto := req.Options["protocol"].(string)
+		if byPeer || byProto {
+			var pid peer.ID
+			if byPeer {
+				pid, _, err = parsePeerTarget(target)
+				if err != nil {
+					res.SetError(err, cmdkit.ErrClient)
+					return
+				}
+			}
+			if byProto {
+				proto = normalizeProtocol(proto)
+				if err := checkProtocolPattern(proto); err != nil {
+					res.SetError(err, cmdkit.ErrClient)
+					return
+				}
+			}
+
+			closed := 0
+			for _, stream := range n.P2P.Streams.Snapshot() {
+				if byPeer && stream.RemotePeer != pid {
+					continue
+				}
+				if byProto && !matchProtocol(proto, stream.Protocol) {
+					continue
+				}
+				stream.Close()
+				closed++
+			}
+			if closed == 0 && !ignoreMissing {
+				res.SetError(ErrNoMatch, cmdkit.ErrClient)
+			}
+			return
+		}
+
+		if len(req.Arguments) == 0 {
+			res.SetError(ErrNoHandlerID, cmdkit.ErrClient)
+			return
+		}
+
+		handlerID, err := strconv.ParseUint(req.Arguments[0], 10, 64)
+		if err != nil {
+			res.SetError(err, cmdkit.ErrClient)
+			return
+		}
+
+		for _, stream := range n.P2P.Streams.Snapshot() {
+			if handlerID != stream.HandlerID {
+				continue
+			}
+			stream.Close()
+			return
+		}
+
+		if !ignoreMissing {
+			res.SetError(ErrNoMatch, cmdkit.ErrClient)
 		}
 	},
 }
 
-func getNode(req cmds.Request) (*core.IpfsNode, error) {
-	n, err := req.InvocContext().GetNode()
+// directions of listener ls
+const (
+	listenerLocal  = "local"
+	listenerRemote = "remote"
+)
+
+// listenerDirection tells whether the listener forwards local connections to
+// a peer, which only dial listeners do
+func listenerDirection(listener *p2p.ListenerInfo) string {
+	if listener.Registry == nil {
+		return listenerLocal
+	}
+	return listenerRemote
+}
+
+// listListeners lists the listeners of the registry and the dial listeners,
+// or only those of the direction unless it is empty
+func listListeners(n *core.IpfsNode, direction string) []*p2p.ListenerInfo {
+	var out []*p2p.ListenerInfo
+	if direction != listenerLocal {
+		out = append(out, n.P2P.Listeners.List()...)
+	}
+	if direction != listenerRemote {
+		out = append(out, n.P2P.ListDialListeners()...)
+	}
+	return out
+}
+
+// writeListeners prints listeners as a table, the header line is printed even
+// if there are no listeners so scripts get a stable shape
+func writeListeners(out io.Writer, listeners []P2PListenerInfoOutput, headers bool) {
+	withDirection, withState, withMeta, withGroup := false, false, false, false
+	for _, listener := range listeners {
+		withDirection = withDirection || listener.Direction != ""
+		withState = withState || listener.State != ""
+		withMeta = withMeta || len(listener.Meta) > 0
+		withGroup = withGroup || listener.Group != ""
+	}
+
+	w := tabwriter.NewWriter(out, 1, 2, 1, ' ', 0)
+	if headers {
+		header := "Address\tProtocol"
+		if withDirection {
+			header = "Direction\t" + header
+		}
+		if withGroup {
+			header += "\tGroup"
+		}
+		if withState {
+			header += "\tState"
+		}
+		if withMeta {
+			header += "\tMeta"
+		}
+		fmt.Fprintln(w, header)
+	}
+	for _, listener := range listeners {
+		protos := append([]string{listener.Protocol}, listener.Aliases...)
+		line := listener.Address + "\t" + strings.Join(protos, ",")
+		if withDirection {
+			line = listener.Direction + "\t" + line
+		}
+		if withGroup {
+			line += "\t" + listener.Group
+		}
+		if withState {
+			line += "\t" + listener.State
+		}
+		if withMeta {
+			line += "\t" + metaString(listener.Meta)
+		}
+		if listener.Paused {
+			line += "\t(paused)"
+		}
+		if len(listener.MissingHandlers) > 0 {
+			line += "\t(no handler: " + strings.Join(listener.MissingHandlers, ",") + ")"
+		}
+		fmt.Fprintln(w, line)
+		for _, stream := range listener.Streams {
+			if withDirection {
+				// keep streams indented below the address
+				fmt.Fprint(w, "\t")
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s in, %s out\n", stream.HandlerID, stream.RemotePeer, stream.Age,
+				humanize.IBytes(stream.BytesIn), humanize.IBytes(stream.BytesOut))
+		}
+	}
+	w.Flush()
+}
+
+// parseMeta parses comma-separated key=value pairs. Keys must not be empty or
+// given twice, values may be empty.
+func parseMeta(text string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(text, ",") {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid metadata %q, expected key=value", pair)
+		}
+		k, v := pair[:i], pair[i+1:]
+		if _, ok := meta[k]; ok {
+			return nil, fmt.Errorf("metadata key %q given twice", k)
+		}
+		meta[k] = v
+	}
+	return meta, nil
+}
+
+// metaString formats key/value pairs the way parseMeta reads them, sorted by
+// key
+func metaString(meta map[string]string) string {
+	pairs := make([]string, 0, len(meta))
+	for k, v := range meta {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// mergeConfiguredListeners lists the listeners of the config, followed by the
+// live listeners which aren't in it. When the daemon is running the state of
+// the configured listeners tells whether a live listener matches them.
+func mergeConfiguredListeners(configured []config.P2PListener, live []P2PListenerInfoOutput, running bool) []P2PListenerInfoOutput {
+	out := make([]P2PListenerInfoOutput, 0, len(configured)+len(live))
+	matched := make([]bool, len(live))
+
+	for _, c := range configured {
+		info := P2PListenerInfoOutput{Protocol: c.Protocol, Address: c.Address, Group: c.Group}
+		addr, err := ma.NewMultiaddr(c.Address)
+		if err != nil {
+			info.State = "error"
+		} else if running {
+			info.State = "inactive"
+			for i, l := range live {
+				if !matched[i] && l.Protocol == c.Protocol && l.Address == addr.String() {
+					matched[i] = true
+					info = l
+					info.State = "active"
+					break
+				}
+			}
+		}
+		info.Configured = true
+		info.Direction = listenerRemote
+		out = append(out, info)
+	}
+
+	for i, l := range live {
+		if !matched[i] {
+			l.State = "active"
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// listenerSortKeys are the values of the --sort option of 'listener ls'
+var listenerSortKeys = []string{"protocol", "address", "age"}
+
+func validSortKey(key string) bool {
+	for _, k := range listenerSortKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// sortListeners sorts listeners by their group and then by the given key, one
+// of listenerSortKeys. Ties are broken by the protocol, the address and then
+// the age.
+func sortListeners(listeners []P2PListenerInfoOutput, key string) {
+	byProto := func(a, b *P2PListenerInfoOutput) int {
+		return strings.Compare(a.Protocol, b.Protocol)
+	}
+	byAddr := func(a, b *P2PListenerInfoOutput) int {
+		return strings.Compare(a.Address, b.Address)
+	}
+	byAge := func(a, b *P2PListenerInfoOutput) int {
+		switch {
+		case a.Created.Before(b.Created):
+			return -1
+		case b.Created.Before(a.Created):
+			return 1
+		}
+		return 0
+	}
+
+	order := []func(a, b *P2PListenerInfoOutput) int{byProto, byAddr, byAge}
+	switch key {
+	case "address":
+		order = []func(a, b *P2PListenerInfoOutput) int{byAddr, byProto, byAge}
+	case "age":
+		order = []func(a, b *P2PListenerInfoOutput) int{byAge, byProto, byAddr}
+	}
+
+	// the listeners of a group stay together
+	byGroup := func(a, b *P2PListenerInfoOutput) int {
+		return strings.Compare(a.Group, b.Group)
+	}
+	order = append([]func(a, b *P2PListenerInfoOutput) int{byGroup}, order...)
+
+	sort.SliceStable(listeners, func(i, j int) bool {
+		for _, cmp := range order {
+			if c := cmp(&listeners[i], &listeners[j]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+// writeTotal prints the footer of a table of listeners or streams
+func writeTotal(out io.Writer, n int, noun string) {
+	fmt.Fprintf(out, "Total: %d %s(s)\n", n, noun)
+}
+
+// countOptions returns whether only counts were requested, and whether they
+// should be broken down by protocol
+func countOptions(req *cmds.Request) (count bool, byProto bool) {
+	count, _ = req.Options["count"].(bool)
+	byProto, _ = req.Options["by-protocol"].(bool)
+	return count || byProto, byProto
+}
+
+// parseFormat parses the --format option of the ls commands, a text/template
+// executed for each listed listener or stream. It returns nil without the
+// option. Errors give the position in the template.
+func parseFormat(req *cmds.Request) (*template.Template, error) {
+	text, found := req.Options["format"].(string)
+	if !found {
+		return nil, nil
+	}
+	return template.New("format").Option("missingkey=error").Parse(text)
+}
+
+// formatItem writes item with the template, followed by a newline. The
+// commands execute it into ioutil.Discard first, so that templates using
+// fields which don't exist fail before any output.
+func formatItem(out io.Writer, tmpl *template.Template, item interface{}) error {
+	if tmpl == nil {
+		return nil
+	}
+	if err := tmpl.Execute(out, item); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(out)
+	return err
+}
+
+// countProtocols counts the given protocols of listeners or streams
+func countProtocols(protos []string, byProto bool) *P2PCountOutput {
+	count := &P2PCountOutput{Total: len(protos)}
+	if byProto {
+		count.ByProtocol = make(map[string]int)
+		for _, proto := range protos {
+			count.ByProtocol[proto]++
+		}
+	}
+	return count
+}
+
+// writeCount prints the total, preceded by a line per protocol if they were
+// counted
+func writeCount(out io.Writer, count *P2PCountOutput) {
+	if count.ByProtocol == nil {
+		fmt.Fprintln(out, count.Total)
+		return
+	}
+
+	protos := make([]string, 0, len(count.ByProtocol))
+	for proto := range count.ByProtocol {
+		protos = append(protos, proto)
+	}
+	sort.Strings(protos)
+
+	w := tabwriter.NewWriter(out, 1, 2, 1, ' ', 0)
+	for _, proto := range protos {
+		fmt.Fprintf(w, "%s\t%d\n", proto, count.ByProtocol[proto])
+	}
+	fmt.Fprintf(w, "total\t%d\n", count.Total)
+	w.Flush()
+}
+
+// writeStats prints the stats as an aligned table
+func writeStats(out io.Writer, stats *P2PStatsOutput) {
+	w := tabwriter.NewWriter(out, 1, 2, 1, ' ', 0)
+	fmt.Fprintf(w, "Listeners:\t%d\n", stats.Listeners)
+	fmt.Fprintf(w, "DialListeners:\t%d\n", stats.DialListeners)
+	fmt.Fprintf(w, "Streams:\t%d\n", stats.Streams)
+	fmt.Fprintf(w, "StreamsOpened:\t%d\n", stats.StreamsOpened)
+	fmt.Fprintf(w, "StreamsFailed:\t%d\n", stats.StreamsFailed)
+	fmt.Fprintf(w, "TotalIn:\t%s\n", humanize.IBytes(stats.BytesIn))
+	fmt.Fprintf(w, "TotalOut:\t%s\n", humanize.IBytes(stats.BytesOut))
+	fmt.Fprintf(w, "Redials:\t%d\n", stats.Redials)
+	if stats.BandwidthLimit > 0 {
+		fmt.Fprintf(w, "Bandwidth:\t%s/s of %s/s (%.0f%%)\n",
+			humanize.IBytes(uint64(stats.BandwidthUsed)),
+			humanize.IBytes(uint64(stats.BandwidthLimit)),
+			100*stats.BandwidthUsed/float64(stats.BandwidthLimit))
+	} else {
+		fmt.Fprintln(w, "Bandwidth:\tunlimited")
+	}
+	w.Flush()
+}
+
+// listenerFilter selects the listeners to close
+type listenerFilter struct {
+	all           bool
+	proto         string
+	addr          string
+	addrContains  string
+	createdBefore time.Time
+	meta          map[string]string
+	group         string
+	direction     string
+}
+
+// match returns whether the listener matches all of the filter's criteria
+func (f listenerFilter) match(listener *p2p.ListenerInfo) bool {
+	if f.all {
+		return true
+	}
+	if f.proto != "" && !listenerHasProtocol(listener, f.proto) {
+		return false
+	}
+	addr := listener.Addr()
+	if f.addr != "" && (addr == nil || addr.String() != f.addr) {
+		return false
+	}
+	if f.addrContains != "" && (addr == nil || !strings.Contains(addr.String(), f.addrContains)) {
+		return false
+	}
+	if !f.createdBefore.IsZero() && !listener.Created.Before(f.createdBefore) {
+		return false
+	}
+	for k, v := range f.meta {
+		if value, ok := listener.Meta[k]; !ok || value != v {
+			return false
+		}
+	}
+	if f.group != "" && listener.Group != f.group {
+		return false
+	}
+	if f.direction != "" && listenerDirection(listener) != f.direction {
+		return false
+	}
+	return true
+}
+
+// listenerHasProtocol returns whether the listener handles the protocol, or a
+// protocol matching it if it is a pattern
+func listenerHasProtocol(listener *p2p.ListenerInfo, proto string) bool {
+	if !isProtocolPattern(proto) {
+		return listener.HasProtocol(proto)
+	}
+	if matchProtocol(proto, listener.Protocol) {
+		return true
+	}
+	for _, alias := range listener.Aliases {
+		if matchProtocol(proto, alias) {
+			return true
+		}
+	}
+	return false
+}
+
+// isProtocolPattern returns whether a protocol given to a close command is a
+// path.Match pattern rather than a literal name
+func isProtocolPattern(proto string) bool {
+	return strings.ContainsAny(proto, "*?[")
+}
+
+// checkProtocolPattern fails if the protocol is a malformed pattern
+func checkProtocolPattern(proto string) error {
+	if !isProtocolPattern(proto) {
+		return nil
+	}
+	if _, err := path.Match(proto, ""); err != nil {
+		return fmt.Errorf("invalid protocol pattern %q: %s", proto, err)
+	}
+	return nil
+}
+
+// matchProtocol returns whether the protocol is the given one, or matches it
+// if it is a pattern
+func matchProtocol(pattern, proto string) bool {
+	if !isProtocolPattern(pattern) {
+		return pattern == proto
+	}
+	ok, _ := path.Match(pattern, proto)
+	return ok
+}
+
+// parsePeerTarget parses a peer the way users paste it: a peer ID, or an
+// address ending with /ipfs/<peer-id> or /p2p/<peer-id>, with or without a
+// transport part and a trailing slash. The transport part may be a relayed
+// address ending with /p2p-circuit. Peer IDs may be base58 multihashes or
+// CIDs, see decodePeerID. It returns the peer ID and the transport address,
+// if there is one.
+func parsePeerTarget(text string) (peer.ID, ma.Multiaddr, error) {
+	text = strings.TrimSuffix(strings.TrimSpace(text), "/")
+	if !strings.HasPrefix(text, "/") {
+		pid, err := decodePeerID(text)
+		return pid, nil, err
+	}
+
+	// multiaddrs only take base58 peer IDs, so the last one is decoded here
+	i := strings.LastIndex(text, "/")
+	rest, id := text[:i], text[i+1:]
+	switch {
+	case strings.HasSuffix(rest, "/ipfs"):
+		rest = strings.TrimSuffix(rest, "/ipfs")
+	case strings.HasSuffix(rest, "/p2p"):
+		rest = strings.TrimSuffix(rest, "/p2p")
+	default:
+		if _, err := ma.NewMultiaddr(text); err != nil {
+			return "", nil, err
+		}
+		return "", nil, fmt.Errorf("%s doesn't end with a peer ID", text)
+	}
+	pid, err := decodePeerID(id)
 	if err != nil {
-		return nil, err
+		return "", nil, err
+	}
+	if rest == "" {
+		return pid, nil, nil
+	}
+
+	addr, err := ma.NewMultiaddr(rest)
+	if err != nil && strings.Contains(rest, "/p2p/") {
+		// /p2p/ is the newer name of the /ipfs/ protocol
+		addr, err = ma.NewMultiaddr(strings.Replace(rest, "/p2p/", "/ipfs/", -1))
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return pid, addr, nil
+}
+
+// libp2pKeyCodec is the multicodec of CIDs of peer IDs
+const libp2pKeyCodec = 0x72
+
+// decodePeerID decodes a peer ID given as a base58 multihash, or as a CIDv1 of
+// the libp2p-key codec in any multibase, e.g. base32 'bafz...'. Commands print
+// peer IDs in base58 only.
+func decodePeerID(text string) (peer.ID, error) {
+	pid, err := peer.IDB58Decode(text)
+	if err == nil {
+		return pid, nil
+	}
+
+	c, cerr := cid.Decode(text)
+	if cerr != nil || c.Prefix().Version != 1 {
+		// the error of the usual form is the more helpful one
+		return "", err
+	}
+	if c.Type() != libp2pKeyCodec {
+		return "", fmt.Errorf("%s is a CID of codec 0x%x, not of a peer ID", text, c.Type())
+	}
+	return peer.IDFromBytes(c.Hash())
+}
+
+// isRelayAddr tells whether the address goes through a circuit relay
+func isRelayAddr(addr ma.Multiaddr) bool {
+	for _, p := range addr.Protocols() {
+		if p.Code == circuit.P_CIRCUIT {
+			return true
+		}
+	}
+	return false
+}
+
+// isLoopbackAddr tells whether the IP of the address is a loopback one, unix
+// sockets count as such. The unspecified address, which binds all interfaces,
+// and other addresses without an IP are not.
+func isLoopbackAddr(addr ma.Multiaddr) bool {
+	if _, err := addr.ValueForProtocol(ma.P_UNIX); err == nil {
+		return true
+	}
+	ip := addrIP(addr)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkNodeAddr fails if connecting to the address reaches the API or the
+// gateway of the node, which forwarding streams to would let peers use
+func checkNodeAddr(n *core.IpfsNode, addr ma.Multiaddr) error {
+	cfg, err := n.Repo.Config()
+	if err != nil {
+		return err
+	}
+
+	services := []struct{ name, addr string }{
+		{"API", cfg.Addresses.API},
+		{"Gateway", cfg.Addresses.Gateway},
+	}
+	for _, s := range services {
+		listen, err := ma.NewMultiaddr(s.addr)
+		if err != nil {
+			// not configured, or the daemon fails to start anyway
+			continue
+		}
+		if sameEndpoint(addr, listen) {
+			return fmt.Errorf("%s is the %s address of this node (Addresses.%s), forwarding streams to it would let any peer use it. "+
+				"Use --force to forward them anyway", addr, s.name, s.name)
+		}
+	}
+	return nil
+}
+
+// sameEndpoint tells whether connecting to target reaches a service listening
+// on listen: their TCP ports are the same, and their IPs too, or listen binds
+// all interfaces and target is a local one. Unix sockets are the same if
+// their paths are.
+func sameEndpoint(target, listen ma.Multiaddr) bool {
+	if path, err := listen.ValueForProtocol(ma.P_UNIX); err == nil {
+		p, err := target.ValueForProtocol(ma.P_UNIX)
+		return err == nil && p == path
+	}
+
+	tport, err := target.ValueForProtocol(ma.P_TCP)
+	if err != nil {
+		return false
+	}
+	lport, err := listen.ValueForProtocol(ma.P_TCP)
+	if err != nil || lport != tport {
+		return false
+	}
+
+	tip, lip := addrIP(target), addrIP(listen)
+	switch {
+	case tip == nil || lip == nil:
+		return false
+	case tip.Equal(lip):
+		return true
+	case lip.IsUnspecified():
+		return tip.IsLoopback() || tip.IsUnspecified()
+	case tip.IsUnspecified():
+		// dialing the unspecified address connects to the local host
+		return lip.IsLoopback()
+	}
+	return false
+}
+
+// addrIP returns the IP of the address, nil if it has none
+func addrIP(addr ma.Multiaddr) gonet.IP {
+	for _, code := range []int{ma.P_IP4, ma.P_IP6} {
+		if v, err := addr.ValueForProtocol(code); err == nil {
+			return gonet.ParseIP(v)
+		}
+	}
+	return nil
+}
+
+// parseAddrArg parses the multiaddr given as the named argument. The error
+// tells which component is wrong and, for the usual typos, what was probably
+// meant.
+func parseAddrArg(name, text string) (ma.Multiaddr, error) {
+	if isHostPort(text) {
+		addr, err := hostPortAddr(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %s", name, text, err)
+		}
+		return addr, nil
+	}
+
+	addr, err := ma.NewMultiaddr(text)
+	if err == nil {
+		return addr, nil
+	}
+
+	msg := fmt.Sprintf("invalid %s %q", name, text)
+	if c := badAddrComponent(text); c != "" {
+		msg += fmt.Sprintf(": bad component %q", c)
+	} else {
+		msg += ": " + err.Error()
+	}
+	if fix := suggestAddr(text); fix != "" {
+		msg += fmt.Sprintf(", did you mean %q?", fix)
+	}
+	return nil, errors.New(msg)
+}
+
+// isHostPort returns whether an address argument is given as host:port rather
+// than as a multiaddr, with or without its leading slash
+func isHostPort(text string) bool {
+	return !strings.Contains(text, "/")
+}
+
+// hostPortAddr converts a TCP address given as host:port, :port or [v6]:port
+// to a multiaddr. An empty host and localhost are 127.0.0.1. Host names are
+// refused, the daemon doesn't resolve them when it listens or dials.
+func hostPortAddr(text string) (ma.Multiaddr, error) {
+	host, port, err := gonet.SplitHostPort(text)
+	if err != nil {
+		if strings.Count(text, ":") > 1 && !strings.HasPrefix(text, "[") {
+			return nil, errors.New("IPv6 addresses must be in brackets, e.g. [::1]:8080")
+		}
+		return nil, errors.New("expected a multiaddr like /ip4/127.0.0.1/tcp/8080, or host:port")
+	}
+
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+
+	if host == "" || host == "localhost" {
+		host = "127.0.0.1"
+	}
+	var zone string
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+	ip := gonet.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("%q isn't an IP address, host names aren't supported", host)
+	}
+
+	text = fmt.Sprintf("/ip4/%s/tcp/%s", ip, port)
+	if ip.To4() == nil {
+		text = fmt.Sprintf("/ip6/%s/tcp/%s", ip, port)
+		if zone != "" {
+			text = "/ip6zone/" + zone + text
+		}
+	} else if zone != "" {
+		return nil, errors.New("only IPv6 addresses have zones")
 	}
+	return ma.NewMultiaddr(text)
+}
+
+// badAddrComponent returns the first component of a multiaddr which doesn't
+// parse: an unknown protocol name, or a protocol with a missing or invalid
+// value
+func badAddrComponent(text string) string {
+	if !strings.HasPrefix(text, "/") {
+		return ""
+	}
+
+	parts := strings.Split(strings.Trim(text, "/"), "/")
+	for i := 0; i < len(parts); i++ {
+		p := ma.ProtocolWithName(parts[i])
+		if p.Code == 0 {
+			return parts[i]
+		}
+		if p.Size == 0 {
+			continue
+		}
+		if i+1 == len(parts) {
+			return parts[i]
+		}
+		if _, err := ma.NewMultiaddr("/" + parts[i] + "/" + parts[i+1]); err != nil {
+			return parts[i] + "/" + parts[i+1]
+		}
+		i++
+	}
+	return ""
+}
+
+// suggestAddr returns the multiaddr probably meant by an invalid one, or ""
+// if there is no good guess. It handles a missing leading slash and
+// misspelled protocol names.
+func suggestAddr(text string) string {
+	parts := strings.Split(strings.Trim(text, "/"), "/")
+	for i := 0; i < len(parts); i++ {
+		p := ma.ProtocolWithName(parts[i])
+		if p.Code == 0 {
+			p = ma.ProtocolWithName(closestProtocol(parts[i]))
+			if p.Code == 0 {
+				return ""
+			}
+			parts[i] = p.Name
+		}
+		if p.Size != 0 {
+			i++
+		}
+	}
+	fix := "/" + strings.Join(parts, "/")
+
+	if fix == text {
+		return ""
+	}
+	if _, err := ma.NewMultiaddr(fix); err != nil {
+		return ""
+	}
+	return fix
+}
+
+// closestProtocol returns the name of the multiaddr protocol a misspelled
+// name was probably meant to be, or ""
+func closestProtocol(name string) string {
+	name = strings.ToLower(name)
+	switch name {
+	case "ipv4":
+		return "ip4"
+	case "ipv6":
+		return "ip6"
+	}
+
+	for _, p := range ma.Protocols {
+		if editDistance(name, p.Name) <= 1 {
+			return p.Name
+		}
+	}
+	return ""
+}
+
+// editDistance is the number of insertions, deletions, substitutions and
+// transpositions of adjacent characters needed to turn a into b
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = minInt(d[i-1][j]+1, minInt(d[i][j-1]+1, d[i-1][j-1]+cost))
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// altProtocolPrefix is the namespace protocol names may be given in instead
+// of /p2p/, which multiaddrs also use for peer IDs. Names in it are used as-is.
+const altProtocolPrefix = "/x/"
+
+// normalizeProtocol adds the /p2p/ prefix to a protocol name unless it
+// already has it, or is in the /x/ namespace
+func normalizeProtocol(name string) string {
+	if strings.HasPrefix(name, "/p2p/") || strings.HasPrefix(name, altProtocolPrefix) {
+		return name
+	}
+	return "/p2p/" + name
+}
+
+// protocolID returns the protocol ID to register or dial for a name given on
+// the command line. Names get the /p2p/ prefix unless they are in the /x/
+// namespace or custom protocols are allowed, in which case they are used as-is
+// and must be absolute.
+func protocolID(name string, custom bool) (string, error) {
+	if !custom {
+		if strings.HasPrefix(name, altProtocolPrefix) {
+			return name, nil
+		}
+		return "/p2p/" + name, nil
+	}
+	if !strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("custom protocol %q must start with '/'", name)
+	}
+	return name, nil
+}
+
+// protocolWarning explains why the protocol ID made of a name is ambiguous,
+// or returns an empty string. Under /p2p/ a name which is a peer ID reads like
+// the multiaddr of that peer, and a name starting with a '/' or 'p2p/' nests
+// namespaces.
+func protocolWarning(name, proto string, custom bool) string {
+	if custom || strings.HasPrefix(name, altProtocolPrefix) {
+		return ""
+	}
+
+	first := strings.SplitN(name, "/", 2)[0]
+	switch {
+	case strings.HasPrefix(name, "/"):
+		return fmt.Sprintf("protocol %q starts with '/' and is used as %s. "+
+			"Use --allow-custom-protocol to use it verbatim", name, proto)
+	case first == "p2p" || first == "ipfs":
+		return fmt.Sprintf("protocol %s looks like a multiaddr. Name it %s%s instead", proto, altProtocolPrefix, name)
+	}
+	if _, err := decodePeerID(first); err == nil {
+		return fmt.Sprintf("protocol %s looks like the multiaddr of peer %s. Name it %s%s instead",
+			proto, first, altProtocolPrefix, name)
+	}
+	return ""
+}
+
+// writeClosedListeners prints a line for each closed listener followed by
+// their count, or only the count when quiet. When verbose the listeners are
+// printed as a table with their age when they were closed instead.
+func writeClosedListeners(out io.Writer, listeners []P2PListenerInfoOutput, quiet, verbose bool) {
+	switch {
+	case quiet:
+	case verbose:
+		w := tabwriter.NewWriter(out, 1, 2, 1, ' ', 0)
+		fmt.Fprintln(w, "Protocol\tAddress\tAge")
+		for _, listener := range listeners {
+			protos := append([]string{listener.Protocol}, listener.Aliases...)
+			age := time.Since(listener.Created).Round(time.Second)
+			fmt.Fprintf(w, "%s\t%s\t%s\n", strings.Join(protos, ","), listener.Address, age)
+		}
+		w.Flush()
+	default:
+		for _, listener := range listeners {
+			protos := append([]string{listener.Protocol}, listener.Aliases...)
+			fmt.Fprintf(out, "Closed %s: %s\n", strings.Join(protos, ","), listener.Address)
+		}
+	}
+	fmt.Fprintf(out, "Closed %d listener(s)\n", len(listeners))
+}
+
+// writeProtocols prints protocol handlers as a table, orphans in place of
+// their listener
+func writeProtocols(out io.Writer, protocols []P2PProtocolOutput, headers bool) {
+	w := tabwriter.NewWriter(out, 1, 2, 1, ' ', 0)
+	if headers {
+		fmt.Fprintln(w, "Protocol\tListener")
+	}
+	for _, proto := range protocols {
+		listener := proto.Listener
+		if proto.Orphan {
+			listener = "(orphan)"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", proto.Protocol, listener)
+	}
+	w.Flush()
+}
+
+func restoreOutput(r p2p.RestoreResult) P2PRestoreOutput {
+	out := P2PRestoreOutput{Protocol: r.Protocol, Address: r.Address}
+	if r.Err != nil {
+		out.Error = r.Err.Error()
+	}
+	return out
+}
+
+// writeRestoreStatus prints the outcome of opening the listeners of the config
+// as a table, with the error of those which failed
+func writeRestoreStatus(out io.Writer, listeners []P2PRestoreOutput, headers bool) {
+	w := tabwriter.NewWriter(out, 1, 2, 1, ' ', 0)
+	if headers {
+		fmt.Fprintln(w, "Protocol\tAddress\tStatus")
+	}
+	for _, l := range listeners {
+		status := "opened"
+		if l.Error != "" {
+			status = "failed: " + l.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", l.Protocol, l.Address, status)
+	}
+	w.Flush()
+}
+
+// writeStreams prints streams as a table, the header line is printed even if
+// there are no streams so scripts get a stable shape. With verbose the traffic
+// and age of each stream are added as columns. With stats the traffic and
+// latency are, '-' standing for a latency which wasn't measured; the traffic
+// is only printed once when both are set.
+func writeStreams(out io.Writer, streams []P2PStreamInfoOutput, headers, verbose, stats bool) {
+	w := tabwriter.NewWriter(out, 1, 2, 1, ' ', 0)
+	if headers {
+		header := "HandlerID\tProtocol\tLocal\tRemote"
+		if verbose {
+			header += "\tBytesIn\tBytesOut\tAge"
+		}
+		if stats {
+			if !verbose {
+				header += "\tIn\tOut"
+			}
+			header += "\tLatency"
+		}
+		fmt.Fprintln(w, header)
+	}
+	for _, stream := range streams {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s", stream.HandlerID, stream.Protocol, stream.LocalAddress, stream.RemotePeer)
+		if verbose {
+			fmt.Fprintf(w, "\t%s\t%s\t%s", humanize.IBytes(stream.BytesIn), humanize.IBytes(stream.BytesOut), stream.Age)
+		}
+		if stats && stream.Stats != nil {
+			if !verbose {
+				fmt.Fprintf(w, "\t%s\t%s", humanize.IBytes(stream.Stats.BytesIn), humanize.IBytes(stream.Stats.BytesOut))
+			}
+			latency := stream.Stats.Latency
+			if latency == "" {
+				latency = "-"
+			}
+			fmt.Fprintf(w, "\t%s", latency)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+}
+
+// watchStreams emits an event for every stream of the registry opened or
+// closed, until ctx is done. Like the subscription to the registry, it misses
+// streams opened faster than the events are consumed.
+func watchStreams(ctx context.Context, reg *p2p.StreamRegistry, res cmds.ResponseEmitter, info func(*p2p.StreamInfo) P2PStreamInfoOutput) {
+	opened, unsubscribe := reg.Subscribe()
+	defer unsubscribe()
+
+	closed := make(chan *p2p.StreamInfo)
+	watching := make(map[*p2p.StreamInfo]bool)
+	watch := func(s *p2p.StreamInfo) {
+		// streams registered while subscribing are also in the snapshot
+		if watching[s] {
+			return
+		}
+		watching[s] = true
+		go func() {
+			select {
+			case <-s.Done():
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case closed <- s:
+			case <-ctx.Done():
+			}
+		}()
+	}
+	for _, s := range reg.Snapshot() {
+		watch(s)
+	}
+
+	for {
+		var event *P2PStreamsOutput
+		select {
+		case s := <-opened:
+			watch(s)
+			event = &P2PStreamsOutput{Event: "opened", Streams: []P2PStreamInfoOutput{info(s)}}
+		case s := <-closed:
+			delete(watching, s)
+			event = &P2PStreamsOutput{Event: "closed", Streams: []P2PStreamInfoOutput{info(s)}}
+		case <-ctx.Done():
+			return
+		}
+
+		if err := res.Emit(event); err != nil {
+			return
+		}
+	}
+}
+
+// writeStreamEvent prints a stream opened or closed with --watch, prefixed
+// with '+' or '-'
+func writeStreamEvent(out io.Writer, event *P2PStreamsOutput, verbose, stats bool) {
+	mark := "+"
+	if event.Event == "closed" {
+		mark = "-"
+	}
+
+	buf := new(bytes.Buffer)
+	writeStreams(buf, event.Streams, false, verbose, stats)
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		if line != "" {
+			fmt.Fprintf(out, "%s %s", mark, line)
+		}
+	}
+}
+
+// writeStreamTotals prints the footer of stream ls --total
+func writeStreamTotals(out io.Writer, totals *P2PStreamTotalsOutput) {
+	fmt.Fprintf(out, "Total: %d stream(s), %s in, %s out\n", totals.Streams,
+		humanize.IBytes(totals.BytesIn), humanize.IBytes(totals.BytesOut))
+}
+
+func streamInfoOutput(s *p2p.StreamInfo) P2PStreamInfoOutput {
+	return P2PStreamInfoOutput{
+		HandlerID: strconv.FormatUint(s.HandlerID, 10),
+
+		Protocol: s.Protocol,
+
+		LocalPeer:    s.LocalPeer.Pretty(),
+		LocalAddress: s.LocalAddr.String(),
+
+		RemotePeer:    s.RemotePeer.Pretty(),
+		RemoteAddress: s.RemoteAddr.String(),
+
+		Priority: s.Priority.String(),
+	}
+}
 
-	config, err := n.Repo.Config()
+// statsOutput sums up the listeners and streams of the node
+func statsOutput(n *core.IpfsNode) *P2PStatsOutput {
+	totals := n.P2P.Streams.Totals()
+	output := &P2PStatsOutput{
+		Listeners:     len(n.P2P.Listeners.List()),
+		DialListeners: n.P2P.DialListeners(),
+		Streams:       len(n.P2P.Streams.Snapshot()),
+		StreamsOpened: totals.Opened,
+		StreamsFailed: totals.Failed,
+		BytesIn:       totals.BytesIn,
+		BytesOut:      totals.BytesOut,
+		Redials:       n.P2P.Redials(),
+	}
+
+	if n.P2P.Limiter != nil {
+		st := n.P2P.Limiter.Stats()
+		output.BandwidthLimit = st.Limit
+		output.BandwidthUsed = st.Rate
+	}
+	return output
+}
+
+// protocolsOutput lists the p2p stream handlers of the host and the listener
+// each belongs to
+func protocolsOutput(n *core.IpfsNode) []P2PProtocolOutput {
+	protocols := []P2PProtocolOutput{}
+	for _, h := range n.P2P.Handlers() {
+		out := P2PProtocolOutput{Protocol: h.Protocol}
+		if h.Listener != nil {
+			out.Listener = h.Listener.Protocol
+		} else {
+			out.Orphan = true
+		}
+		protocols = append(protocols, out)
+	}
+	return protocols
+}
+
+func streamStatsOutput(s *p2p.StreamInfo) *P2PStreamStatsOutput {
+	stats := &P2PStreamStatsOutput{
+		BytesIn:  s.BytesIn(),
+		BytesOut: s.BytesOut(),
+	}
+	if rtt := s.Latency(); rtt > 0 {
+		stats.Latency = rtt.String()
+	}
+	return stats
+}
+
+func getNode(env cmds.Environment) (*core.IpfsNode, error) {
+	n, err := GetNode(env)
 	if err != nil {
 		return nil, err
 	}
 
-	if !config.Experimental.Libp2pStreamMounting {
-		return nil, errors.New("libp2p stream mounting not enabled")
+	if !n.P2PEnabled() {
+		return nil, ErrStreamMountingDisabled
 	}
 
 	if !n.OnlineMode() {
-		return nil, errNotOnline
+		return nil, ErrP2PNotOnline
 	}
 
 	return n, nil
 }
+
+// getNodeErrorType tells the errors of getNode caused by the user's setup
+// apart from internal failures
+func getNodeErrorType(err error) cmdkit.ErrorType {
+	if err == ErrStreamMountingDisabled || err == ErrP2PNotOnline {
+		return cmdkit.ErrClient
+	}
+	return cmdkit.ErrNormal
+}
@@ -0,0 +1,273 @@
+package commands
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	core "github.com/ipfs/go-ipfs/core"
+	e "github.com/ipfs/go-ipfs/core/commands/e"
+	p2p "github.com/ipfs/go-ipfs/p2p"
+	config "github.com/ipfs/go-ipfs/repo/config"
+
+	cmds "gx/ipfs/QmSKYWC84fqkKB54Te5JMcov2MBVzucXaRGxFqByzzCbHe/go-ipfs-cmds"
+	"gx/ipfs/QmceUdzxkimdYsgtX733uNgzf1DLHyBKN6ehGSp85ayppM/go-ipfs-cmdkit"
+)
+
+// P2PDebugDumpOutput is output type of debug dump command
+type P2PDebugDumpOutput struct {
+	// Time the dump was taken
+	Time time.Time
+
+	Listeners []P2PDebugListenerOutput
+	Streams   []P2PDebugStreamOutput
+
+	// Stream handlers registered on the host
+	Handlers []P2PProtocolOutput
+
+	Stats *P2PStatsOutput
+
+	// Listeners of the config opened when the daemon started
+	Restored []P2PRestoreOutput
+
+	Config P2PDebugConfigOutput
+
+	// Goroutines running code of the p2p package, in total and by the
+	// outermost function of the package on their stack
+	Goroutines           int
+	GoroutinesByFunction map[string]int
+}
+
+// P2PDebugListenerOutput is a listener with all of its settings and counters
+type P2PDebugListenerOutput struct {
+	P2PListenerInfoOutput
+
+	Running           bool
+	MaxStreamsPerPeer int `json:",omitempty"`
+	Priority          string
+	Prefer            string `json:",omitempty"`
+	Multiplex         bool
+	DialTimeout       string `json:",omitempty"`
+	MeasureLatency    bool
+	MaxConnAge        string `json:",omitempty"`
+	MaxBytes          uint64 `json:",omitempty"`
+	MaxBytesMode      string `json:",omitempty"`
+	RateLimitUp       int64  `json:",omitempty"`
+	RateLimitDown     int64  `json:",omitempty"`
+	WebSocketFriendly bool   `json:",omitempty"`
+
+	ActiveStreams   int
+	RejectedStreams uint64
+	Redials         uint64
+}
+
+// P2PDebugStreamOutput is a stream with its traffic, age and the listener it
+// belongs to
+type P2PDebugStreamOutput struct {
+	P2PStreamInfoOutput
+
+	Direction string
+
+	// Main protocol of the listener of the stream, empty if it has none
+	Listener string `json:",omitempty"`
+}
+
+// P2PDebugConfigOutput holds the config values the p2p subsystem uses
+type P2PDebugConfigOutput struct {
+	Libp2pStreamMounting bool
+	P2P                  config.P2P
+}
+
+// p2pDebugCmd is the 'ipfs p2p debug' command
+var p2pDebugCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Inspect the p2p subsystem.",
+	},
+
+	Subcommands: map[string]*cmds.Command{
+		"dump": p2pDebugDumpCmd,
+	},
+}
+
+var p2pDebugDumpCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Dump the state of the p2p subsystem, to attach to bug reports.",
+		ShortDescription: `
+Print the listeners with all of their settings and counters, the streams with
+their peers, traffic and age, the p2p stream handlers registered on the host,
+the p2p config values and the number of goroutines of the p2p subsystem, as
+one JSON document. It shows nothing 'ipfs p2p listener ls' and
+'ipfs p2p stream ls' don't.
+		`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) {
+		n, err := getNode(env)
+		if err != nil {
+			res.SetError(err, getNodeErrorType(err))
+			return
+		}
+
+		cfg, err := n.Repo.Config()
+		if err != nil {
+			res.SetError(err, cmdkit.ErrNormal)
+			return
+		}
+
+		cmds.EmitOnce(res, debugDump(n, cfg))
+	},
+	Type: P2PDebugDumpOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeEncoder(func(req *cmds.Request, w io.Writer, v interface{}) error {
+			dump, ok := v.(*P2PDebugDumpOutput)
+			if !ok {
+				return e.TypeErr(dump, v)
+			}
+
+			out, err := json.MarshalIndent(dump, "", "  ")
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(append(out, '\n'))
+			return err
+		}),
+	},
+}
+
+// debugDump collects the state of the p2p subsystem of the node
+func debugDump(n *core.IpfsNode, cfg *config.Config) *P2PDebugDumpOutput {
+	streams := n.P2P.Streams.Snapshot()
+
+	dump := &P2PDebugDumpOutput{
+		Time:      time.Now(),
+		Listeners: []P2PDebugListenerOutput{},
+		Streams:   []P2PDebugStreamOutput{},
+		Handlers:  protocolsOutput(n),
+		Stats:     statsOutput(n),
+		Restored:  []P2PRestoreOutput{},
+		Config: P2PDebugConfigOutput{
+			Libp2pStreamMounting: cfg.Experimental.Libp2pStreamMounting,
+			P2P:                  cfg.P2P,
+		},
+	}
+
+	for _, listener := range listListeners(n, "") {
+		out := debugListenerOutput(listener)
+		for _, s := range streams {
+			if s.Listener == listener {
+				out.ActiveStreams++
+			}
+		}
+		dump.Listeners = append(dump.Listeners, out)
+	}
+
+	for _, s := range streams {
+		out := P2PDebugStreamOutput{
+			P2PStreamInfoOutput: streamInfoOutput(s),
+			Direction:           s.Direction.String(),
+		}
+		out.BytesIn = s.BytesIn()
+		out.BytesOut = s.BytesOut()
+		out.Age = time.Since(s.Opened()).Round(time.Second).String()
+		out.Stats = streamStatsOutput(s)
+		if s.Listener != nil {
+			out.Listener = s.Listener.Protocol
+		}
+		dump.Streams = append(dump.Streams, out)
+	}
+
+	for _, r := range n.P2P.Restored {
+		dump.Restored = append(dump.Restored, restoreOutput(r))
+	}
+
+	dump.GoroutinesByFunction = p2pGoroutines()
+	for _, count := range dump.GoroutinesByFunction {
+		dump.Goroutines += count
+	}
+	return dump
+}
+
+func debugListenerOutput(listener *p2p.ListenerInfo) P2PDebugListenerOutput {
+	out := P2PDebugListenerOutput{
+		P2PListenerInfoOutput: P2PListenerInfoOutput{
+			Direction: listenerDirection(listener),
+			Protocol:  listener.Protocol,
+			Aliases:   listener.Aliases,
+			Address:   listener.Addr().String(),
+			Created:   listener.Created,
+			Paused:    listener.Paused(),
+			Meta:      listener.Meta,
+			Group:     listener.Group,
+		},
+
+		Running:           listener.Running(),
+		MaxStreamsPerPeer: listener.MaxStreamsPerPeer,
+		Priority:          listener.Priority.String(),
+		Multiplex:         listener.Multiplex,
+		MeasureLatency:    listener.MeasureLatency,
+		MaxBytes:          listener.MaxBytes,
+		RateLimitUp:       listener.RateLimitUp,
+		RateLimitDown:     listener.RateLimitDown,
+		WebSocketFriendly: listener.WebSocketFriendly,
+
+		RejectedStreams: atomic.LoadUint64(&listener.RejectedStreams),
+		Redials:         atomic.LoadUint64(&listener.Redials),
+	}
+	if listener.Prefer != p2p.FamilyAny {
+		out.Prefer = listener.Prefer.String()
+	}
+	if listener.DialTimeout > 0 {
+		out.DialTimeout = listener.DialTimeout.String()
+	}
+	if listener.MaxConnAge > 0 {
+		out.MaxConnAge = listener.MaxConnAge.String()
+	}
+	if listener.MaxBytes > 0 {
+		out.MaxBytesMode = listener.MaxBytesMode.String()
+	}
+	return out
+}
+
+// p2pGoroutines counts the goroutines running code of the p2p package by the
+// outermost frame of the package on their stack, without its arguments. For
+// goroutines started in the package that is the function they were started
+// with, not the one which started them.
+func p2pGoroutines() map[string]int {
+	pkg := reflect.TypeOf(p2p.P2P{}).PkgPath() + "."
+
+	buf := make([]byte, 1<<20)
+	for {
+		size := runtime.Stack(buf, true)
+		if size < len(buf) {
+			buf = buf[:size]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	counts := make(map[string]int)
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		var entry string
+		for _, line := range strings.Split(g, "\n") {
+			// frames are listed innermost first, the last one of the
+			// package wins. "created by" lines and the indented file
+			// lines don't start with the package path.
+			if strings.HasPrefix(line, pkg) {
+				entry = line
+			}
+		}
+		if entry == "" {
+			continue
+		}
+
+		entry = strings.TrimPrefix(entry, pkg)
+		if i := strings.LastIndex(entry, "("); i > 0 {
+			entry = entry[:i]
+		}
+		counts[entry]++
+	}
+	return counts
+}
@@ -0,0 +1,106 @@
+package commands
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	oldcmds "github.com/ipfs/go-ipfs/commands"
+	core "github.com/ipfs/go-ipfs/core"
+	coremock "github.com/ipfs/go-ipfs/core/mock"
+	p2p "github.com/ipfs/go-ipfs/p2p"
+
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	cmdkit "gx/ipfs/QmceUdzxkimdYsgtX733uNgzf1DLHyBKN6ehGSp85ayppM/go-ipfs-cmdkit"
+)
+
+func TestP2PDebugDump(t *testing.T) {
+	n, err := coremock.NewMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	cfg, err := n.Repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Experimental.Libp2pStreamMounting = true
+	cfg.P2P.MaxStreamsPerPeer = 3
+
+	env := &oldcmds.Context{
+		Online: true,
+		ConstructNode: func() (*core.IpfsNode, error) {
+			return n, nil
+		},
+	}
+
+	if _, cmdErr := runP2PCommand(t, p2pListenerListenCmd, []string{"app", "/ip4/127.0.0.1/tcp/10101"},
+		cmdkit.OptMap{"max-bytes": "1MB", "priority": "high", "rate-limit-up": "64KiB", "websocket-friendly": true}, env); cmdErr != nil {
+		t.Fatal(cmdErr.Message)
+	}
+
+	values, cmdErr := runP2PCommand(t, p2pDebugDumpCmd, nil, nil, env)
+	if cmdErr != nil {
+		t.Fatal(cmdErr.Message)
+	}
+	dump := values[0].(*P2PDebugDumpOutput)
+
+	if len(dump.Listeners) != 1 {
+		t.Fatalf("expected the listener, got %+v", dump.Listeners)
+	}
+	l := dump.Listeners[0]
+	if l.Protocol != "/p2p/app" || l.Direction != "remote" || l.Priority != "high" || l.MaxBytes != 1000000 || l.MaxBytesMode != "combined" ||
+		l.RateLimitUp != 64*1024 || l.RateLimitDown != 0 || !l.WebSocketFriendly {
+		t.Fatalf("expected the settings of the listener, got %+v", l)
+	}
+	if len(dump.Handlers) != 1 || dump.Handlers[0].Listener != "/p2p/app" {
+		t.Fatalf("expected the handler of the listener, got %+v", dump.Handlers)
+	}
+	if !dump.Config.Libp2pStreamMounting || dump.Config.P2P.MaxStreamsPerPeer != 3 {
+		t.Fatalf("expected the config values, got %+v", dump.Config)
+	}
+	if dump.Stats.Listeners != 1 {
+		t.Fatalf("expected the stats, got %+v", dump.Stats)
+	}
+
+	// the text output is the same document, indented
+	out, err := encodeP2PText(t, p2pDebugDumpCmd, nil, dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded P2PDebugDumpOutput
+	if err := json.Unmarshal([]byte(out), &decoded); err != nil {
+		t.Fatalf("expected JSON, got %s: %s", out, err)
+	}
+}
+
+func TestP2PGoroutines(t *testing.T) {
+	n, err := coremock.NewMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	// a listener accepting streams runs in a goroutine of the p2p package
+	addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/10101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.P2P.NewListener(n.Context(), "/p2p/app", addr, p2p.ListenerOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// goroutines of listeners closed by other tests may still be winding
+	// down, so only look for the one of this listener once it is running
+	for i := 0; ; i++ {
+		counts := p2pGoroutines()
+		if counts["(*P2P).acceptStreams"] > 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("expected the goroutine of the listener to be counted, got %v", counts)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,265 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	oldcmds "github.com/ipfs/go-ipfs/commands"
+	core "github.com/ipfs/go-ipfs/core"
+	coremock "github.com/ipfs/go-ipfs/core/mock"
+	p2p "github.com/ipfs/go-ipfs/p2p"
+
+	cmds "gx/ipfs/QmSKYWC84fqkKB54Te5JMcov2MBVzucXaRGxFqByzzCbHe/go-ipfs-cmds"
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	cmdkit "gx/ipfs/QmceUdzxkimdYsgtX733uNgzf1DLHyBKN6ehGSp85ayppM/go-ipfs-cmdkit"
+)
+
+// encodeP2PText encodes v with the text encoder of the command
+func encodeP2PText(t *testing.T, cmd *cmds.Command, opts cmdkit.OptMap, v interface{}) (string, error) {
+	req, err := cmds.NewRequest(context.Background(), nil, opts, nil, nil, cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	err = cmd.Encoders[cmds.Text](req)(buf).Encode(v)
+	return buf.String(), err
+}
+
+func TestP2PEncoders(t *testing.T) {
+	ls := &P2PLsOutput{Listeners: []P2PListenerInfoOutput{
+		{Protocol: "/p2p/a", Address: "/ip4/127.0.0.1/tcp/10101"},
+	}}
+	lsText := new(bytes.Buffer)
+	writeListeners(lsText, ls.Listeners, false)
+
+	closed := new(bytes.Buffer)
+	writeClosedListeners(closed, ls.Listeners, false, false)
+
+	streams := &P2PStreamsOutput{Streams: []P2PStreamInfoOutput{
+		{HandlerID: "0", Protocol: "/p2p/a", LocalAddress: "/ip4/127.0.0.1/tcp/10101", RemotePeer: "QmPeer"},
+	}}
+	streamsText := new(bytes.Buffer)
+	writeStreams(streamsText, streams.Streams, false, false, false)
+
+	stats := &P2PStatsOutput{Listeners: 1, Streams: 2}
+	statsText := new(bytes.Buffer)
+	writeStats(statsText, stats)
+
+	dial := &P2PDialOutput{Protocol: "/p2p/a", Address: "/ip4/127.0.0.1/tcp/10101", Peer: "QmPeer"}
+	dialText := new(bytes.Buffer)
+	writeDial(dialText, dial)
+
+	cases := []struct {
+		name     string
+		cmd      *cmds.Command
+		output   interface{}
+		expected string
+	}{
+		{"listener ls", p2pListenerLsCmd, ls, lsText.String()},
+		{"listener close", p2pListenerCloseCmd, ls, closed.String()},
+		{"stream ls", p2pStreamLsCmd, streams, streamsText.String()},
+		{"stats", p2pStatsCmd, stats, statsText.String()},
+		{"dial", p2pStreamDialCmd, dial, dialText.String()},
+		// the command fails with ErrWaitTimeout after emitting it
+		{"dial wait timed out", p2pStreamDialCmd, &P2PDialOutput{WaitTimedOut: true}, ""},
+	}
+
+	for _, c := range cases {
+		out, err := encodeP2PText(t, c.cmd, nil, c.output)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if out != c.expected {
+			t.Fatalf("%s: expected:\n%s\ngot:\n%s", c.name, c.expected, out)
+		}
+	}
+
+	// values of another command are an error, not a panic
+	if _, err := encodeP2PText(t, p2pListenerLsCmd, nil, stats); err == nil {
+		t.Fatal("expected an error for the value of another command")
+	}
+}
+
+// TestP2PCommandsRun runs the listener commands against a node and encodes
+// what they emit like the CLI does
+func TestP2PCommandsRun(t *testing.T) {
+	n, err := coremock.NewMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	cfg, err := n.Repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Experimental.Libp2pStreamMounting = true
+
+	env := &oldcmds.Context{
+		Online: true,
+		ConstructNode: func() (*core.IpfsNode, error) {
+			return n, nil
+		},
+	}
+
+	run := func(cmd *cmds.Command, args []string, opts cmdkit.OptMap) []interface{} {
+		values, cmdErr := runP2PCommand(t, cmd, args, opts, env)
+		if cmdErr != nil {
+			t.Fatalf("%v %v: %s", args, opts, cmdErr.Message)
+		}
+		return values
+	}
+
+	values := run(p2pListenerListenCmd, []string{"app,app-v2", "/ip4/127.0.0.1/tcp/10101"}, nil)
+	if len(values) != 1 {
+		t.Fatalf("expected listener open to emit one value, got %d", len(values))
+	}
+	opened := values[0].(*P2PListenerInfoOutput)
+	if opened.Protocol != "/p2p/app" || len(opened.Aliases) != 1 || opened.Aliases[0] != "/p2p/app-v2" {
+		t.Fatalf("unexpected listener: %+v", opened)
+	}
+
+	values = run(p2pListenerPauseCmd, []string{"app"}, nil)
+	if !values[0].(*P2PListenerInfoOutput).Paused {
+		t.Fatal("expected the listener to be paused")
+	}
+
+	values = run(p2pListenerLsCmd, nil, cmdkit.OptMap{"headers": true})
+	list := values[0].(*P2PLsOutput)
+	if len(list.Listeners) != 1 || !list.Listeners[0].Paused {
+		t.Fatalf("expected the paused listener, got %+v", list.Listeners)
+	}
+	out, err := encodeP2PText(t, p2pListenerLsCmd, cmdkit.OptMap{"headers": true}, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := new(bytes.Buffer)
+	writeListeners(expected, list.Listeners, true)
+	writeTotal(expected, 1, "listener")
+	if out != expected.String() {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, out)
+	}
+
+	values = run(p2pListenerLsCmd, nil, cmdkit.OptMap{"direction": "local"})
+	if listed := values[0].(*P2PLsOutput).Listeners; len(listed) != 0 {
+		t.Fatalf("expected no local forward, got %+v", listed)
+	}
+	if list.Listeners[0].Direction != "remote" {
+		t.Fatalf("expected a remote listener, got %q", list.Listeners[0].Direction)
+	}
+
+	values = run(p2pListenerResumeCmd, []string{"app"}, nil)
+	if values[0].(*P2PListenerInfoOutput).Paused {
+		t.Fatal("expected the listener to be resumed")
+	}
+
+	values = run(p2pListenerRetargetCmd, []string{"app", "/ip4/127.0.0.1/tcp/10102"}, nil)
+	if addr := values[0].(*P2PListenerInfoOutput).Address; addr != "/ip4/127.0.0.1/tcp/10102" {
+		t.Fatalf("expected the listener to be retargeted, got %s", addr)
+	}
+
+	values = run(p2pProtocolsCmd, nil, nil)
+	if protos := values[0].(*P2PProtocolsOutput).Protocols; len(protos) != 2 {
+		t.Fatalf("expected the handlers of both protocols, got %+v", protos)
+	}
+
+	n.P2P.Restored = []p2p.RestoreResult{
+		{Protocol: "/p2p/app", Address: "/ip4/127.0.0.1/tcp/10101"},
+		{Protocol: "/p2p/taken", Address: "/ip4/127.0.0.1/tcp/10103", Err: errors.New("already registered")},
+	}
+	values = run(p2pRestoreStatusCmd, nil, cmdkit.OptMap{"failed": true})
+	if restored := values[0].(*P2PRestoreStatusOutput).Listeners; len(restored) != 1 || restored[0].Error != "already registered" {
+		t.Fatalf("expected only the failed listener, got %+v", restored)
+	}
+
+	values = run(p2pStatsCmd, nil, nil)
+	if stats := values[0].(*P2PStatsOutput); stats.Listeners != 1 || stats.Streams != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	values = run(p2pStreamLsCmd, nil, cmdkit.OptMap{"json-lines": true})
+	if len(values) != 0 {
+		t.Fatalf("expected no streams, got %v", values)
+	}
+
+	values = run(p2pListenerCloseCmd, []string{"app"}, nil)
+	out, err = encodeP2PText(t, p2pListenerCloseCmd, nil, values[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected.Reset()
+	writeClosedListeners(expected, values[0].(*P2PLsOutput).Listeners, false, false)
+	if out != expected.String() || len(n.P2P.Listeners.List()) != 0 {
+		t.Fatalf("expected the listener to be closed, got:\n%s", out)
+	}
+}
+
+func TestP2PStreamLsProtocolPrefix(t *testing.T) {
+	n, err := coremock.NewMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	cfg, err := n.Repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Experimental.Libp2pStreamMounting = true
+
+	env := &oldcmds.Context{
+		Online: true,
+		ConstructNode: func() (*core.IpfsNode, error) {
+			return n, nil
+		},
+	}
+
+	addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/10101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, proto := range []string{"/p2p/team-a/ssh", "/p2p/team-a/web", "/p2p/team-b/ssh", "/x/team-a/ssh"} {
+		n.P2P.Streams.Register(&p2p.StreamInfo{Protocol: proto, LocalAddr: addr, RemoteAddr: addr})
+	}
+
+	cases := []struct {
+		prefix string
+		count  int
+	}{
+		{"team-a/", 2},
+		{"/p2p/team-a/", 2},
+		{"team-b/", 1},
+		{"/x/", 1},
+		{"team-c/", 0},
+	}
+	for _, c := range cases {
+		values, cmdErr := runP2PCommand(t, p2pStreamLsCmd, nil, cmdkit.OptMap{"protocol-prefix": c.prefix}, env)
+		if cmdErr != nil {
+			t.Fatalf("%s: %s", c.prefix, cmdErr.Message)
+		}
+		if streams := values[0].(*P2PStreamsOutput).Streams; len(streams) != c.count {
+			t.Errorf("%s: expected %d streams, got %+v", c.prefix, c.count, streams)
+		}
+	}
+
+	// none of the streams transferred anything
+	for _, c := range []struct {
+		min   string
+		count int
+	}{{"0", 4}, {"1B", 0}, {"10MB", 0}} {
+		values, cmdErr := runP2PCommand(t, p2pStreamLsCmd, nil, cmdkit.OptMap{"min-bytes": c.min}, env)
+		if cmdErr != nil {
+			t.Fatalf("%s: %s", c.min, cmdErr.Message)
+		}
+		if streams := values[0].(*P2PStreamsOutput).Streams; len(streams) != c.count {
+			t.Errorf("min %s: expected %d streams, got %+v", c.min, c.count, streams)
+		}
+	}
+	_, cmdErr := runP2PCommand(t, p2pStreamLsCmd, nil, cmdkit.OptMap{"min-bytes": "lots"}, env)
+	if cmdErr == nil || cmdErr.Code != cmdkit.ErrClient {
+		t.Fatalf("expected a client error, got %v", cmdErr)
+	}
+}
@@ -0,0 +1,677 @@
+package commands
+
+import (
+	"context"
+	"io"
+	gonet "net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	oldcmds "github.com/ipfs/go-ipfs/commands"
+	core "github.com/ipfs/go-ipfs/core"
+	coremock "github.com/ipfs/go-ipfs/core/mock"
+	p2p "github.com/ipfs/go-ipfs/p2p"
+	config "github.com/ipfs/go-ipfs/repo/config"
+
+	cmds "gx/ipfs/QmSKYWC84fqkKB54Te5JMcov2MBVzucXaRGxFqByzzCbHe/go-ipfs-cmds"
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	cmdkit "gx/ipfs/QmceUdzxkimdYsgtX733uNgzf1DLHyBKN6ehGSp85ayppM/go-ipfs-cmdkit"
+)
+
+// runP2PCommand runs a command through the cmds machinery, with the defaults
+// of its options filled in like the CLI does. It returns the values the
+// command emitted and its error.
+func runP2PCommand(t *testing.T, cmd *cmds.Command, args []string, opts cmdkit.OptMap, env cmds.Environment) ([]interface{}, *cmdkit.Error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	withDefaults := cmdkit.OptMap{}
+	for _, def := range cmd.Options {
+		if def.Default() != nil {
+			withDefaults[def.Names()[0]] = def.Default()
+		}
+	}
+	for name, v := range opts {
+		withDefaults[name] = v
+	}
+
+	req, err := cmds.NewRequest(ctx, nil, withDefaults, args, nil, cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	re, res := cmds.NewChanResponsePair(req)
+	go func() {
+		defer re.Close()
+		cmd.Run(req, re, env)
+	}()
+
+	var values []interface{}
+	for {
+		v, err := res.Next()
+		switch err {
+		case nil:
+			values = append(values, v)
+		case io.EOF:
+			return values, nil
+		case cmds.ErrRcvdError:
+			return values, res.Error()
+		default:
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestP2PErrorCodes(t *testing.T) {
+	n, err := coremock.NewMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	cfg, err := n.Repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := &oldcmds.Context{
+		Online: true,
+		ConstructNode: func() (*core.IpfsNode, error) {
+			return n, nil
+		},
+	}
+
+	addr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/10101")
+	if _, err := n.P2P.NewListener(n.Context(), "/p2p/taken", addr, p2p.ListenerOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a valid peer ID no peer of the mock network has
+	unknownPeer := "QmPvrhgMzKvcHsaR2bj79VixJeLUkUaXTCnCCbhSUsNtkU"
+
+	cases := []struct {
+		name     string
+		cmd      *cmds.Command
+		args     []string
+		opts     cmdkit.OptMap
+		disabled bool
+		code     cmdkit.ErrorType
+	}{
+		{"mounting disabled", p2pListenerLsCmd, nil, nil, true, cmdkit.ErrClient},
+		{"bad peer ID", p2pStreamDialCmd, []string{"not-a-peer", "app"}, nil, false, cmdkit.ErrClient},
+		{"bad address", p2pListenerListenCmd, []string{"app", "/ip4/127.0.0.1/tcp/port"}, nil, false, cmdkit.ErrClient},
+		{"taken protocol", p2pListenerListenCmd, []string{"taken", "/ip4/127.0.0.1/tcp/10101"}, nil, false, cmdkit.ErrClient},
+		{"bad stream id", p2pStreamCloseCmd, []string{"first"}, nil, false, cmdkit.ErrClient},
+		{"unknown stream id", p2pStreamCloseCmd, []string{"12345"}, nil, false, cmdkit.ErrClient},
+		{"bad format", p2pListenerLsCmd, nil, cmdkit.OptMap{"format": "{{.Protocol"}, false, cmdkit.ErrClient},
+		{"unknown format field", p2pListenerLsCmd, nil, cmdkit.OptMap{"format": "{{.Nope}}"}, false, cmdkit.ErrClient},
+		{"--total with --count", p2pStreamLsCmd, nil, cmdkit.OptMap{"total": true, "count": true}, false, cmdkit.ErrClient},
+		{"--watch with --json-lines", p2pStreamLsCmd, nil, cmdkit.OptMap{"watch": true, "json-lines": true}, false, cmdkit.ErrClient},
+		{"unknown listener", p2pListenerCloseCmd, []string{"missing"}, nil, false, cmdkit.ErrClient},
+		{"bad listener pattern", p2pListenerCloseCmd, []string{"app-[staging"}, nil, false, cmdkit.ErrClient},
+		{"bad stream pattern", p2pStreamCloseCmd, nil, cmdkit.OptMap{"protocol": "app-[staging"}, false, cmdkit.ErrClient},
+		{"bad direction", p2pListenerLsCmd, nil, cmdkit.OptMap{"direction": "inbound"}, false, cmdkit.ErrClient},
+		{"bad max bytes", p2pListenerListenCmd, []string{"app", "/ip4/127.0.0.1/tcp/10101"},
+			cmdkit.OptMap{"max-bytes": "lots"}, false, cmdkit.ErrClient},
+		{"bad max bytes mode", p2pStreamDialCmd, []string{unknownPeer, "app"},
+			cmdkit.OptMap{"max-bytes": "1MB", "max-bytes-mode": "both"}, false, cmdkit.ErrClient},
+		{"bad rate limit", p2pListenerListenCmd, []string{"app", "/ip4/127.0.0.1/tcp/10101"},
+			cmdkit.OptMap{"rate-limit-up": "fast"}, false, cmdkit.ErrClient},
+		{"zero rate limit", p2pStreamDialCmd, []string{unknownPeer, "app"},
+			cmdkit.OptMap{"rate-limit-down": "0"}, false, cmdkit.ErrClient},
+		{"public bind with --local-only", p2pStreamDialCmd, []string{unknownPeer, "app", "/ip4/0.0.0.0/tcp/0"},
+			cmdkit.OptMap{"local-only": true}, false, cmdkit.ErrClient},
+		{"test with bad dial timeout", p2pTestCmd, []string{unknownPeer, "app"},
+			cmdkit.OptMap{"dial-timeout": "soon"}, false, cmdkit.ErrClient},
+		{"test unreachable peer", p2pTestCmd, []string{unknownPeer, "app"},
+			cmdkit.OptMap{"dial-timeout": "100ms"}, false, cmdkit.ErrNormal},
+		{"zero max conn age", p2pStreamDialCmd, []string{unknownPeer, "app"},
+			cmdkit.OptMap{"max-conn-age": "0s"}, false, cmdkit.ErrClient},
+		{"unreachable peer", p2pStreamDialCmd, []string{unknownPeer, "app"},
+			cmdkit.OptMap{"dial-timeout": "100ms"}, false, cmdkit.ErrNormal},
+	}
+
+	for _, c := range cases {
+		cfg.Experimental.Libp2pStreamMounting = !c.disabled
+
+		_, cmdErr := runP2PCommand(t, c.cmd, c.args, c.opts, env)
+		if cmdErr == nil {
+			t.Fatalf("%s: expected an error", c.name)
+		}
+		if cmdErr.Code != c.code {
+			t.Fatalf("%s: expected error code %d, got %d: %s", c.name, c.code, cmdErr.Code, cmdErr.Message)
+		}
+	}
+}
+
+func TestP2PCloseIgnoreMissing(t *testing.T) {
+	n, err := coremock.NewMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	cfg, err := n.Repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Experimental.Libp2pStreamMounting = true
+
+	env := &oldcmds.Context{
+		Online: true,
+		ConstructNode: func() (*core.IpfsNode, error) {
+			return n, nil
+		},
+	}
+
+	unknownPeer := "QmPvrhgMzKvcHsaR2bj79VixJeLUkUaXTCnCCbhSUsNtkU"
+
+	cases := []struct {
+		name string
+		cmd  *cmds.Command
+		args []string
+		opts cmdkit.OptMap
+		fail bool
+	}{
+		{"listener", p2pListenerCloseCmd, []string{"missing"}, nil, true},
+		{"listener ignore missing", p2pListenerCloseCmd, []string{"missing"}, cmdkit.OptMap{"ignore-missing": true}, false},
+		{"listener quiet", p2pListenerCloseCmd, []string{"missing"}, cmdkit.OptMap{"quiet": true}, false},
+		{"stream", p2pStreamCloseCmd, []string{"12345"}, nil, true},
+		{"stream ignore missing", p2pStreamCloseCmd, []string{"12345"}, cmdkit.OptMap{"ignore-missing": true}, false},
+		{"stream peer", p2pStreamCloseCmd, nil, cmdkit.OptMap{"peer": unknownPeer}, true},
+		{"stream protocol", p2pStreamCloseCmd, nil, cmdkit.OptMap{"protocol": "app*"}, true},
+		{"stream peer ignore missing", p2pStreamCloseCmd, nil, cmdkit.OptMap{"peer": unknownPeer, "ignore-missing": true}, false},
+	}
+
+	for _, c := range cases {
+		_, cmdErr := runP2PCommand(t, c.cmd, c.args, c.opts, env)
+		if !c.fail {
+			if cmdErr != nil {
+				t.Fatalf("%s: %s", c.name, cmdErr.Message)
+			}
+			continue
+		}
+		if cmdErr == nil || cmdErr.Code != cmdkit.ErrClient {
+			t.Fatalf("%s: expected a client error, got %v", c.name, cmdErr)
+		}
+	}
+}
+
+func TestP2PListenerOpenExistsOK(t *testing.T) {
+	n, err := coremock.NewMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	cfg, err := n.Repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Experimental.Libp2pStreamMounting = true
+
+	env := &oldcmds.Context{
+		Online: true,
+		ConstructNode: func() (*core.IpfsNode, error) {
+			return n, nil
+		},
+	}
+
+	args := []string{"app,app-old", "/ip4/127.0.0.1/tcp/10101"}
+	if _, cmdErr := runP2PCommand(t, p2pListenerListenCmd, args, nil, env); cmdErr != nil {
+		t.Fatal(cmdErr.Message)
+	}
+
+	values, cmdErr := runP2PCommand(t, p2pListenerListenCmd, args, cmdkit.OptMap{"exists-ok": true}, env)
+	if cmdErr != nil {
+		t.Fatal(cmdErr.Message)
+	}
+	if out := values[0].(*P2PListenerInfoOutput); !out.Existed || out.Protocol != "/p2p/app" {
+		t.Fatalf("expected the existing listener, got %+v", out)
+	}
+	if n := len(n.P2P.Listeners.List()); n != 1 {
+		t.Fatalf("expected 1 listener, got %d", n)
+	}
+
+	cases := []struct {
+		name string
+		args []string
+		opts cmdkit.OptMap
+	}{
+		{"without exists-ok", args, nil},
+		{"other address", []string{"app,app-old", "/ip4/127.0.0.1/tcp/10102"}, cmdkit.OptMap{"exists-ok": true}},
+		{"other aliases", []string{"app", "/ip4/127.0.0.1/tcp/10101"}, cmdkit.OptMap{"exists-ok": true}},
+	}
+	for _, c := range cases {
+		_, cmdErr := runP2PCommand(t, p2pListenerListenCmd, c.args, c.opts, env)
+		if cmdErr == nil || cmdErr.Code != cmdkit.ErrClient {
+			t.Fatalf("%s: expected a client error, got %v", c.name, cmdErr)
+		}
+	}
+}
+
+func TestP2PListenerLsVerify(t *testing.T) {
+	n, err := coremock.NewMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	cfg, err := n.Repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Experimental.Libp2pStreamMounting = true
+
+	env := &oldcmds.Context{
+		Online: true,
+		ConstructNode: func() (*core.IpfsNode, error) {
+			return n, nil
+		},
+	}
+
+	for _, args := range [][]string{
+		{"app,app-old", "/ip4/127.0.0.1/tcp/10101"},
+		{"other", "/ip4/127.0.0.1/tcp/10102"},
+	} {
+		if _, cmdErr := runP2PCommand(t, p2pListenerListenCmd, args, nil, env); cmdErr != nil {
+			t.Fatal(cmdErr.Message)
+		}
+	}
+
+	// the host lost the handler of an alias, the listener is still registered
+	n.PeerHost.RemoveStreamHandler("/p2p/app-old")
+
+	values, cmdErr := runP2PCommand(t, p2pListenerLsCmd, nil, cmdkit.OptMap{"verify": true}, env)
+	if cmdErr != nil {
+		t.Fatal(cmdErr.Message)
+	}
+	listeners := values[0].(*P2PLsOutput).Listeners
+	if len(listeners) != 2 {
+		t.Fatalf("expected 2 listeners, got %+v", listeners)
+	}
+	for _, l := range listeners {
+		missing := strings.Join(l.MissingHandlers, ",")
+		if l.Protocol == "/p2p/app" && missing != "/p2p/app-old" || l.Protocol == "/p2p/other" && missing != "" {
+			t.Fatalf("%s: unexpected missing handlers %v", l.Protocol, l.MissingHandlers)
+		}
+	}
+
+	// without --verify the handlers aren't checked
+	values, cmdErr = runP2PCommand(t, p2pListenerLsCmd, nil, nil, env)
+	if cmdErr != nil {
+		t.Fatal(cmdErr.Message)
+	}
+	for _, l := range values[0].(*P2PLsOutput).Listeners {
+		if l.MissingHandlers != nil {
+			t.Fatalf("expected no verification without --verify, got %+v", l)
+		}
+	}
+
+	_, cmdErr = runP2PCommand(t, p2pListenerLsCmd, nil, cmdkit.OptMap{"verify": true, "count": true}, env)
+	if cmdErr == nil || cmdErr.Code != cmdkit.ErrClient {
+		t.Fatalf("expected a client error for --count with --verify, got %v", cmdErr)
+	}
+}
+
+func TestP2PListenerNodeAddr(t *testing.T) {
+	n, err := coremock.NewMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	cfg, err := n.Repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Experimental.Libp2pStreamMounting = true
+	cfg.Addresses.API = "/ip4/127.0.0.1/tcp/5001"
+	cfg.Addresses.Gateway = "/ip4/0.0.0.0/tcp/8080"
+
+	env := &oldcmds.Context{
+		Online: true,
+		ConstructNode: func() (*core.IpfsNode, error) {
+			return n, nil
+		},
+	}
+
+	cases := []struct {
+		name string
+		cmd  *cmds.Command
+		args []string
+	}{
+		{"api", p2pListenerListenCmd, []string{"api", "/ip4/127.0.0.1/tcp/5001"}},
+		{"gateway", p2pListenerListenCmd, []string{"gateway", "127.0.0.1:8080"}},
+		{"group", p2pListenerGroupCmd, []string{"backend", "app=/ip4/127.0.0.1/tcp/10101", "api=/ip4/127.0.0.1/tcp/5001"}},
+	}
+	for _, c := range cases {
+		_, cmdErr := runP2PCommand(t, c.cmd, c.args, nil, env)
+		if cmdErr == nil || cmdErr.Code != cmdkit.ErrClient || !strings.Contains(cmdErr.Message, "--force") {
+			t.Fatalf("%s: expected a client error suggesting --force, got %v", c.name, cmdErr)
+		}
+	}
+	if n := len(n.P2P.Listeners.List()); n != 0 {
+		t.Fatalf("expected no listener to be opened, got %d", n)
+	}
+
+	if _, cmdErr := runP2PCommand(t, p2pListenerListenCmd, []string{"app", "/ip4/127.0.0.1/tcp/10101"}, nil, env); cmdErr != nil {
+		t.Fatal(cmdErr.Message)
+	}
+	_, cmdErr := runP2PCommand(t, p2pListenerRetargetCmd, []string{"app", "/ip4/127.0.0.1/tcp/5001"}, nil, env)
+	if cmdErr == nil || cmdErr.Code != cmdkit.ErrClient {
+		t.Fatalf("retarget: expected a client error, got %v", cmdErr)
+	}
+
+	if _, cmdErr := runP2PCommand(t, p2pListenerListenCmd, []string{"api", "/ip4/127.0.0.1/tcp/5001"}, cmdkit.OptMap{"force": true}, env); cmdErr != nil {
+		t.Fatalf("expected --force to open the listener, got %s", cmdErr.Message)
+	}
+}
+
+func TestP2PListenerCloseDirection(t *testing.T) {
+	n, err := coremock.NewMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	cfg, err := n.Repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Experimental.Libp2pStreamMounting = true
+
+	env := &oldcmds.Context{
+		Online: true,
+		ConstructNode: func() (*core.IpfsNode, error) {
+			return n, nil
+		},
+	}
+
+	// a target keeping the forwarded connections open
+	target, err := gonet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	open := func() {
+		if _, cmdErr := runP2PCommand(t, p2pListenerListenCmd, []string{"app", target.Addr().String()}, nil, env); cmdErr != nil {
+			t.Fatal(cmdErr.Message)
+		}
+		// a forward of local connections to the listener of this node
+		bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+		if _, err := n.P2P.Dial(n.Context(), nil, n.Identity, "/p2p/app", bindAddr, p2p.DialOpts{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeListeners := func(opts cmdkit.OptMap) []P2PListenerInfoOutput {
+		values, cmdErr := runP2PCommand(t, p2pListenerCloseCmd, nil, opts, env)
+		if cmdErr != nil {
+			t.Fatal(cmdErr.Message)
+		}
+		return values[0].(*P2PLsOutput).Listeners
+	}
+	waitDialListeners := func(count int) {
+		for i := 0; n.P2P.DialListeners() != count; i++ {
+			if i == 100 {
+				t.Fatalf("expected %d dial listeners, got %d", count, n.P2P.DialListeners())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	open()
+	waitDialListeners(1)
+	closed := closeListeners(cmdkit.OptMap{"direction": "local"})
+	if len(closed) != 1 || closed[0].Direction != listenerLocal {
+		t.Fatalf("expected the dial listener to be closed, got %+v", closed)
+	}
+	waitDialListeners(0)
+	if len(n.P2P.Listeners.List()) != 1 {
+		t.Fatal("expected the remote listener to be left open")
+	}
+	closeListeners(cmdkit.OptMap{"all": true})
+
+	open()
+	waitDialListeners(1)
+	closed = closeListeners(cmdkit.OptMap{"direction": "remote"})
+	if len(closed) != 1 || closed[0].Direction != listenerRemote {
+		t.Fatalf("expected the listener to be closed, got %+v", closed)
+	}
+	if len(n.P2P.Listeners.List()) != 0 || n.P2P.DialListeners() != 1 {
+		t.Fatal("expected only the dial listener to be left open")
+	}
+
+	for _, opts := range []cmdkit.OptMap{
+		{"direction": "both"},
+		{"direction": "local", "all": true},
+	} {
+		_, cmdErr := runP2PCommand(t, p2pListenerCloseCmd, nil, opts, env)
+		if cmdErr == nil || cmdErr.Code != cmdkit.ErrClient {
+			t.Fatalf("%v: expected a client error, got %v", opts, cmdErr)
+		}
+	}
+
+	closeListeners(cmdkit.OptMap{"direction": "local"})
+	waitDialListeners(0)
+}
+
+func TestP2PStreamTop(t *testing.T) {
+	n, err := coremock.NewMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	cfg, err := n.Repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Experimental.Libp2pStreamMounting = true
+
+	env := &oldcmds.Context{
+		Online: true,
+		ConstructNode: func() (*core.IpfsNode, error) {
+			return n, nil
+		},
+	}
+
+	// a stream from a forward of this node to its own echo listener
+	target, err := gonet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	if _, cmdErr := runP2PCommand(t, p2pListenerListenCmd, []string{"echo", target.Addr().String()}, nil, env); cmdErr != nil {
+		t.Fatal(cmdErr.Message)
+	}
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	forward, err := n.P2P.Dial(n.Context(), nil, n.Identity, "/p2p/echo", bindAddr, p2p.DialOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := forward.Address.ValueForProtocol(ma.P_TCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := gonet.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	var stream *p2p.StreamInfo
+	for _, s := range n.P2P.Streams.Snapshot() {
+		if s.Direction == p2p.DirOutbound {
+			stream = s
+		}
+	}
+	if stream == nil {
+		t.Fatal("expected the stream of the forward")
+	}
+	id := strconv.FormatUint(stream.HandlerID, 10)
+
+	// the stream closes while it is watched
+	time.AfterFunc(200*time.Millisecond, func() { stream.Close() })
+	values, cmdErr := runP2PCommand(t, p2pStreamTopCmd, []string{id}, cmdkit.OptMap{"interval": "50ms"}, env)
+	if cmdErr != nil {
+		t.Fatal(cmdErr.Message)
+	}
+	if len(values) < 3 {
+		t.Fatalf("expected several samples, got %d", len(values))
+	}
+	for _, v := range values[:len(values)-1] {
+		if v.(*P2PStreamStatOutput).Closed {
+			t.Fatalf("expected only the last sample to be marked closed, got %+v", v)
+		}
+	}
+	last := values[len(values)-1].(*P2PStreamStatOutput)
+	if !last.Closed || last.HandlerID != id || last.BytesIn != 5 || last.BytesOut != 5 {
+		t.Fatalf("expected the final counters of the closed stream, got %+v", last)
+	}
+
+	out, err := encodeP2PText(t, p2pStreamTopCmd, nil, last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "\r") || !strings.HasSuffix(out, "stream "+id+" closed\n") {
+		t.Fatalf("expected the readout to be refreshed and the close reported, got %q", out)
+	}
+
+	for _, c := range []struct {
+		args []string
+		opts cmdkit.OptMap
+	}{
+		{[]string{id}, nil},
+		{[]string{"first"}, nil},
+		{[]string{"12345"}, cmdkit.OptMap{"interval": "1s"}},
+		{[]string{"12345"}, cmdkit.OptMap{"interval": "0s"}},
+	} {
+		_, cmdErr := runP2PCommand(t, p2pStreamTopCmd, c.args, c.opts, env)
+		if cmdErr == nil || cmdErr.Code != cmdkit.ErrClient {
+			t.Fatalf("%v %v: expected a client error, got %v", c.args, c.opts, cmdErr)
+		}
+	}
+}
+
+func TestP2PListenerGroup(t *testing.T) {
+	n, err := coremock.NewMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	cfg, err := n.Repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Experimental.Libp2pStreamMounting = true
+
+	env := &oldcmds.Context{
+		Online: true,
+		ConstructNode: func() (*core.IpfsNode, error) {
+			return n, nil
+		},
+	}
+
+	routes := []string{"backend", "a=/ip4/127.0.0.1/tcp/10101", "b=/ip4/127.0.0.1/tcp/10102"}
+	if _, cmdErr := runP2PCommand(t, p2pListenerGroupCmd, routes, nil, env); cmdErr != nil {
+		t.Fatal(cmdErr.Message)
+	}
+	if _, cmdErr := runP2PCommand(t, p2pListenerListenCmd, []string{"c", "/ip4/127.0.0.1/tcp/10103"}, nil, env); cmdErr != nil {
+		t.Fatal(cmdErr.Message)
+	}
+
+	// a route whose protocol is taken fails the whole group
+	_, cmdErr := runP2PCommand(t, p2pListenerGroupCmd, []string{"other", "d=/ip4/127.0.0.1/tcp/10104", "c=/ip4/127.0.0.1/tcp/10103"}, nil, env)
+	if cmdErr == nil || cmdErr.Code != cmdkit.ErrClient {
+		t.Fatalf("expected a client error, got %v", cmdErr)
+	}
+
+	values, cmdErr := runP2PCommand(t, p2pListenerLsCmd, nil, nil, env)
+	if cmdErr != nil {
+		t.Fatal(cmdErr.Message)
+	}
+	var groups []string
+	for _, l := range values[0].(*P2PLsOutput).Listeners {
+		groups = append(groups, l.Protocol+":"+l.Group)
+	}
+	if expected := "/p2p/c:,/p2p/a:backend,/p2p/b:backend"; strings.Join(groups, ",") != expected {
+		t.Fatalf("expected %s, got %s", expected, strings.Join(groups, ","))
+	}
+
+	values, cmdErr = runP2PCommand(t, p2pListenerCloseCmd, nil, cmdkit.OptMap{"group": "backend"}, env)
+	if cmdErr != nil {
+		t.Fatal(cmdErr.Message)
+	}
+	if closed := values[0].(*P2PLsOutput).Listeners; len(closed) != 2 {
+		t.Fatalf("expected the 2 listeners of the group to be closed, got %v", closed)
+	}
+	if left := n.P2P.Listeners.List(); len(left) != 1 || left[0].Protocol != "/p2p/c" {
+		t.Fatalf("expected only /p2p/c to be left, got %v", left)
+	}
+}
+
+func TestP2PListenerLsConfig(t *testing.T) {
+	n, err := coremock.NewMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	cfg, err := n.Repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Experimental.Libp2pStreamMounting = false
+	cfg.P2P.Listeners = []config.P2PListener{
+		{Protocol: "/p2p/app", Address: "/ip4/127.0.0.1/tcp/10101"},
+	}
+
+	env := &oldcmds.Context{
+		Online: true,
+		ConstructNode: func() (*core.IpfsNode, error) {
+			return n, nil
+		},
+	}
+
+	values, cmdErr := runP2PCommand(t, p2pListenerLsCmd, nil, cmdkit.OptMap{"config": true}, env)
+	if cmdErr != nil {
+		t.Fatalf("expected the config to be listed with stream mounting disabled, got %s", cmdErr.Message)
+	}
+	list := values[0].(*P2PLsOutput)
+	if len(list.Listeners) != 1 || list.Listeners[0].State != "inactive" || !list.Listeners[0].Configured {
+		t.Fatalf("expected the configured listener to be inactive, got %+v", list.Listeners)
+	}
+}
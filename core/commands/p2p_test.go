@@ -0,0 +1,1249 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	p2p "github.com/ipfs/go-ipfs/p2p"
+	config "github.com/ipfs/go-ipfs/repo/config"
+
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	peer "gx/ipfs/QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74/go-libp2p-peer"
+	pstore "gx/ipfs/QmdeiKhUy1TVGBaKxt7y1QmBDLBdisSrLJ1x58Eoj4PXUh/go-libp2p-peerstore"
+)
+
+func TestWriteListenersHeaders(t *testing.T) {
+	listeners := []P2PListenerInfoOutput{
+		{Protocol: "/p2p/a", Address: "/ip4/127.0.0.1/tcp/10101"},
+		{Protocol: "/p2p/b", Aliases: []string{"/p2p/b-old"}, Address: "/ip4/127.0.0.1/tcp/10102"},
+		{Protocol: "/p2p/c", Address: "/ip4/127.0.0.1/tcp/10103"},
+	}
+
+	buf := new(bytes.Buffer)
+	writeListeners(buf, listeners, true)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected a header and 3 rows, got:\n%s", buf)
+	}
+	if !strings.HasPrefix(lines[0], "Address") {
+		t.Fatalf("expected the header first, got %q", lines[0])
+	}
+	if n := strings.Count(buf.String(), "Address"); n != 1 {
+		t.Fatalf("expected exactly one header line, got %d", n)
+	}
+	if !strings.HasSuffix(lines[2], "/p2p/b,/p2p/b-old") {
+		t.Fatalf("expected aliases to be listed, got %q", lines[2])
+	}
+}
+
+func TestWriteListenersHeadersEmpty(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writeListeners(buf, nil, true)
+
+	if out := strings.TrimSpace(buf.String()); out != "Address Protocol" {
+		t.Fatalf("expected a lone header line, got %q", out)
+	}
+}
+
+func TestWriteListenersPaused(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writeListeners(buf, []P2PListenerInfoOutput{
+		{Protocol: "/p2p/a", Address: "/ip4/127.0.0.1/tcp/10101", Paused: true},
+		{Protocol: "/p2p/b", Address: "/ip4/127.0.0.1/tcp/10102"},
+	}, false)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "(paused)") || strings.Contains(lines[1], "paused") {
+		t.Fatalf("expected only the paused listener to be marked, got:\n%s", buf)
+	}
+}
+
+func TestWriteListenersMissingHandlers(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writeListeners(buf, []P2PListenerInfoOutput{
+		{Protocol: "/p2p/a", Aliases: []string{"/p2p/a-old"}, Address: "/ip4/127.0.0.1/tcp/10101", MissingHandlers: []string{"/p2p/a", "/p2p/a-old"}},
+		{Protocol: "/p2p/b", Address: "/ip4/127.0.0.1/tcp/10102"},
+	}, false)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "(no handler: /p2p/a,/p2p/a-old)") || strings.Contains(lines[1], "handler") {
+		t.Fatalf("expected only the listener without handlers to be flagged, got:\n%s", buf)
+	}
+}
+
+func TestWriteListenersMeta(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writeListeners(buf, []P2PListenerInfoOutput{
+		{Protocol: "/p2p/a", Address: "/ip4/127.0.0.1/tcp/10101", Meta: map[string]string{"owner": "alice", "env": "staging"}},
+		{Protocol: "/p2p/b", Address: "/ip4/127.0.0.1/tcp/10102"},
+	}, true)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[0], "Meta") {
+		t.Fatalf("expected a Meta column, got:\n%s", buf)
+	}
+	if !strings.HasSuffix(lines[1], "env=staging,owner=alice") {
+		t.Fatalf("expected sorted key/value pairs, got %q", lines[1])
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	route, warning, err := parseRoute("api=127.0.0.1:8080", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Protocol != "/p2p/api" || route.Address.String() != "/ip4/127.0.0.1/tcp/8080" || warning != "" {
+		t.Fatalf("unexpected route %s=%s, warning %q", route.Protocol, route.Address, warning)
+	}
+
+	for _, text := range []string{"api", "=/ip4/127.0.0.1/tcp/8080", "api=", "api=nonsense"} {
+		if _, _, err := parseRoute(text, false); err == nil {
+			t.Fatalf("%s: expected an error", text)
+		}
+	}
+}
+
+func TestParseMeta(t *testing.T) {
+	meta, err := parseMeta("owner=alice,env=,url=http://x/?a=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"owner": "alice", "env": "", "url": "http://x/?a=b"}
+	if !reflect.DeepEqual(meta, expected) {
+		t.Fatalf("expected %v, got %v", expected, meta)
+	}
+
+	for _, text := range []string{"", "owner", "=alice", "owner=alice,", "owner=alice,owner=bob"} {
+		if _, err := parseMeta(text); err == nil {
+			t.Errorf("expected an error for %q", text)
+		}
+	}
+}
+
+func TestMergeConfiguredListeners(t *testing.T) {
+	configured := []config.P2PListener{
+		{Protocol: "/p2p/a", Address: "/ip4/127.0.0.1/tcp/10101"},
+		{Protocol: "/p2p/b", Address: "/ip4/127.0.0.1/tcp/10102"},
+		{Protocol: "/p2p/c", Address: "not an address"},
+		{Protocol: "/p2p/a", Address: "/ip4/127.0.0.1/tcp/10101"},
+	}
+	live := []P2PListenerInfoOutput{
+		{Protocol: "/p2p/a", Address: "/ip4/127.0.0.1/tcp/10101", Paused: true},
+		{Protocol: "/p2p/d", Address: "/ip4/127.0.0.1/tcp/10104"},
+	}
+
+	got := mergeConfiguredListeners(configured, live, true)
+	expected := []struct {
+		proto, state string
+		configured   bool
+	}{
+		{"/p2p/a", "active", true},
+		{"/p2p/b", "inactive", true},
+		{"/p2p/c", "error", true},
+		{"/p2p/a", "inactive", true},
+		{"/p2p/d", "active", false},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d listeners, got %d: %v", len(expected), len(got), got)
+	}
+	for i, e := range expected {
+		if got[i].Protocol != e.proto || got[i].State != e.state || got[i].Configured != e.configured {
+			t.Fatalf("listener %d: expected %s %s configured=%t, got %+v", i, e.proto, e.state, e.configured, got[i])
+		}
+	}
+	if !got[0].Paused {
+		t.Fatal("expected the active listener to keep its live details")
+	}
+
+	// without a daemon only broken entries have a state
+	got = mergeConfiguredListeners(configured, nil, false)
+	if len(got) != len(configured) {
+		t.Fatalf("expected only the configured listeners, got %v", got)
+	}
+	for i, state := range []string{"", "", "error", ""} {
+		if got[i].State != state {
+			t.Fatalf("listener %d: expected state %q, got %q", i, state, got[i].State)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	writeListeners(buf, got, true)
+	if header := strings.SplitN(buf.String(), "\n", 2)[0]; !strings.Contains(header, "State") {
+		t.Fatalf("expected a State column, got %q", header)
+	}
+}
+
+func TestWriteListenersStreams(t *testing.T) {
+	listeners := []P2PListenerInfoOutput{
+		{Protocol: "/p2p/a", Address: "/ip4/127.0.0.1/tcp/10101", Streams: []P2PListenerStreamOutput{
+			{HandlerID: "0", RemotePeer: "QmA", Age: "5s", BytesIn: 1000, BytesOut: 2000},
+			{HandlerID: "3", RemotePeer: "QmB", Age: "1m0s"},
+		}},
+		{Protocol: "/p2p/b", Address: "/ip4/127.0.0.1/tcp/10102"},
+	}
+
+	buf := new(bytes.Buffer)
+	writeListeners(buf, listeners, false)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 2 listeners and 2 streams, got:\n%s", buf)
+	}
+	if !strings.HasPrefix(lines[1], "  0 ") || !strings.Contains(lines[1], "QmA") {
+		t.Fatalf("expected the first stream nested under its listener, got %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[1], "1000 B in, 2.0 KiB out") {
+		t.Fatalf("expected byte counts, got %q", lines[1])
+	}
+	if !strings.HasPrefix(lines[3], "/ip4/127.0.0.1/tcp/10102") {
+		t.Fatalf("expected the second listener last, got %q", lines[3])
+	}
+}
+
+func TestSortListeners(t *testing.T) {
+	now := time.Now()
+	listeners := []P2PListenerInfoOutput{
+		{Protocol: "/p2p/b", Address: "/ip4/127.0.0.1/tcp/10101", Created: now.Add(-time.Minute)},
+		{Protocol: "/p2p/a", Address: "/ip4/127.0.0.1/tcp/10103", Created: now},
+		{Protocol: "/p2p/a", Address: "/ip4/127.0.0.1/tcp/10102", Created: now.Add(-time.Hour)},
+		{Protocol: "/p2p/c", Address: "/ip4/127.0.0.1/tcp/10100", Created: now.Add(-time.Minute)},
+	}
+
+	cases := []struct {
+		key   string
+		order []string
+	}{
+		{"protocol", []string{"10102", "10103", "10101", "10100"}},
+		{"address", []string{"10100", "10101", "10102", "10103"}},
+		{"age", []string{"10102", "10101", "10100", "10103"}},
+	}
+
+	for _, c := range cases {
+		if !validSortKey(c.key) {
+			t.Fatalf("%s: expected a valid key", c.key)
+		}
+
+		sorted := append([]P2PListenerInfoOutput{}, listeners...)
+		sortListeners(sorted, c.key)
+		for i, port := range c.order {
+			if !strings.HasSuffix(sorted[i].Address, port) {
+				t.Fatalf("%s: expected %s at %d, got %s", c.key, port, i, sorted[i].Address)
+			}
+		}
+	}
+
+	// the listeners of a group are listed together after the others
+	grouped := append([]P2PListenerInfoOutput{}, listeners...)
+	grouped[0].Group = "backend"
+	grouped[3].Group = "backend"
+	sortListeners(grouped, "address")
+	for i, port := range []string{"10102", "10103", "10100", "10101"} {
+		if !strings.HasSuffix(grouped[i].Address, port) {
+			t.Fatalf("grouped: expected %s at %d, got %s", port, i, grouped[i].Address)
+		}
+	}
+
+	empty := []P2PListenerInfoOutput{}
+	sortListeners(empty, "protocol")
+	if len(empty) != 0 {
+		t.Fatal("expected sorting no listeners to do nothing")
+	}
+
+	if validSortKey("target") {
+		t.Fatal("expected an unknown key to be invalid")
+	}
+}
+
+func TestWriteStreamsHeaders(t *testing.T) {
+	streams := []P2PStreamInfoOutput{
+		{HandlerID: "0", Protocol: "/p2p/a", LocalAddress: "/ip4/127.0.0.1/tcp/10101", RemotePeer: "QmA"},
+		{HandlerID: "1", Protocol: "/p2p/a", LocalAddress: "/ip4/127.0.0.1/tcp/10101", RemotePeer: "QmB"},
+		{HandlerID: "12", Protocol: "/p2p/long-protocol", LocalAddress: "/ip4/127.0.0.1/tcp/10102", RemotePeer: "QmC"},
+	}
+
+	buf := new(bytes.Buffer)
+	writeStreams(buf, streams, true, false, false)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected a header and 3 rows, got:\n%s", buf)
+	}
+	if n := strings.Count(buf.String(), "HandlerID"); n != 1 {
+		t.Fatalf("expected exactly one header line, got %d", n)
+	}
+
+	// columns are aligned
+	col := strings.Index(lines[0], "Protocol")
+	for _, line := range lines[1:] {
+		if strings.Index(line, "/p2p/") != col {
+			t.Fatalf("misaligned row %q", line)
+		}
+	}
+}
+
+func TestWriteStreamsStats(t *testing.T) {
+	streams := []P2PStreamInfoOutput{
+		{HandlerID: "0", Protocol: "/p2p/a", LocalAddress: "/ip4/127.0.0.1/tcp/10101", RemotePeer: "QmA",
+			Stats: &P2PStreamStatsOutput{BytesIn: 2000, BytesOut: 10, Latency: "12.5ms"}},
+		{HandlerID: "1", Protocol: "/p2p/a", LocalAddress: "/ip4/127.0.0.1/tcp/10101", RemotePeer: "QmB",
+			Stats: &P2PStreamStatsOutput{}},
+	}
+
+	buf := new(bytes.Buffer)
+	writeStreams(buf, streams, true, false, true)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[0], "Latency") {
+		t.Fatalf("expected a header with the stats columns and 2 rows, got:\n%s", buf)
+	}
+	if !strings.Contains(lines[1], "2.0 KiB") || !strings.HasSuffix(lines[1], "12.5ms") {
+		t.Fatalf("unexpected stats in %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[2], "-") {
+		t.Fatalf("expected an unmeasured latency to be shown as '-', got %q", lines[2])
+	}
+}
+
+func TestWriteStreamsVerbose(t *testing.T) {
+	streams := []P2PStreamInfoOutput{
+		{HandlerID: "0", Protocol: "/p2p/a", LocalAddress: "/ip4/127.0.0.1/tcp/10101", RemotePeer: "QmA",
+			BytesIn: 5 << 30, BytesOut: 1536, Age: "1h2m3s"},
+		{HandlerID: "1", Protocol: "/p2p/a", LocalAddress: "/ip4/127.0.0.1/tcp/10101", RemotePeer: "QmB",
+			Age: "0s"},
+	}
+
+	buf := new(bytes.Buffer)
+	writeStreams(buf, streams, true, true, false)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[0], "BytesOut Age") {
+		t.Fatalf("expected a header with the verbose columns and 2 rows, got:\n%s", buf)
+	}
+	if !strings.Contains(lines[1], "5.0 GiB") || !strings.Contains(lines[1], "1.5 KiB") {
+		t.Fatalf("expected humanized byte counts in %q", lines[1])
+	}
+
+	// columns stay aligned whatever the width of the byte counts
+	col := strings.Index(lines[0], "Age")
+	if strings.Index(lines[1], "1h2m3s") != col || strings.Index(lines[2], "0s") != col {
+		t.Fatalf("misaligned age column:\n%s", buf)
+	}
+
+	// with --stats too the traffic isn't repeated
+	for i := range streams {
+		streams[i].Stats = &P2PStreamStatsOutput{Latency: "3ms"}
+	}
+	buf.Reset()
+	writeStreams(buf, streams, true, true, true)
+	if header := strings.Fields(strings.SplitN(buf.String(), "\n", 2)[0]); strings.Join(header[4:], " ") != "BytesIn BytesOut Age Latency" {
+		t.Fatalf("unexpected columns %q", header)
+	}
+}
+
+func TestWriteRestoreStatus(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writeRestoreStatus(buf, []P2PRestoreOutput{
+		{Protocol: "/p2p/a", Address: "/ip4/127.0.0.1/tcp/10101"},
+		{Protocol: "/p2p/b", Address: "/ip4/127.0.0.1/tcp/10102", Error: "protocol already registered"},
+	}, true)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "Protocol") {
+		t.Fatalf("expected a header and 2 rows, got:\n%s", buf)
+	}
+	if !strings.HasSuffix(lines[1], "opened") || !strings.HasSuffix(lines[2], "failed: protocol already registered") {
+		t.Fatalf("expected the status of each listener, got:\n%s", buf)
+	}
+}
+
+func TestWriteProtocols(t *testing.T) {
+	protocols := []P2PProtocolOutput{
+		{Protocol: "/p2p/app", Listener: "/p2p/app"},
+		{Protocol: "/p2p/app-old", Listener: "/p2p/app"},
+		{Protocol: "/p2p/gone", Orphan: true},
+	}
+
+	buf := new(bytes.Buffer)
+	writeProtocols(buf, protocols, true)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "Protocol") {
+		t.Fatalf("expected a header and 3 rows, got:\n%s", buf)
+	}
+	if !strings.HasSuffix(lines[2], " /p2p/app") {
+		t.Fatalf("expected an alias to show its listener, got %q", lines[2])
+	}
+	if !strings.HasSuffix(lines[3], "(orphan)") {
+		t.Fatalf("expected an orphan to be flagged, got %q", lines[3])
+	}
+}
+
+func TestFormatItem(t *testing.T) {
+	tmpl, err := template.New("format").Option("missingkey=error").Parse("{{.Protocol}} {{.Address}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	listener := P2PListenerInfoOutput{Protocol: "/p2p/a", Address: "/ip4/127.0.0.1/tcp/10101"}
+	if err := formatItem(buf, tmpl, listener); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "/p2p/a /ip4/127.0.0.1/tcp/10101\n" {
+		t.Fatalf("unexpected output: %q", buf)
+	}
+
+	tmpl, err = template.New("format").Parse("{{.HandlerID}} {{.Stats.Latency}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	stream := P2PStreamInfoOutput{HandlerID: "7", Stats: &P2PStreamStatsOutput{Latency: "12ms"}}
+	if err := formatItem(buf, tmpl, stream); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "7 12ms\n" {
+		t.Fatalf("unexpected output: %q", buf)
+	}
+
+	// unknown fields fail at execution, with their position
+	tmpl, err = template.New("format").Parse("{{.Protocol}} {{.Nope}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = formatItem(ioutil.Discard, tmpl, listener)
+	if err == nil || !strings.Contains(err.Error(), "format:1:") || !strings.Contains(err.Error(), "Nope") {
+		t.Fatalf("expected an error at the position of the field, got %v", err)
+	}
+}
+
+func TestWaitFirstStream(t *testing.T) {
+	var reg p2p.StreamRegistry
+	dialed := []*p2p.ListenerInfo{{Protocol: "/p2p/a"}, {Protocol: "/p2p/a"}}
+	other := &p2p.ListenerInfo{Protocol: "/p2p/b"}
+
+	streams, cancel := reg.Subscribe()
+	defer cancel()
+
+	// streams of other listeners are ignored
+	reg.Register(&p2p.StreamInfo{Listener: other})
+	first := &p2p.StreamInfo{Listener: dialed[1]}
+	reg.Register(first)
+
+	s, err := waitFirstStream(context.Background(), streams, dialed, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != first {
+		t.Fatal("expected the stream of a dialed listener")
+	}
+
+	reg.Register(&p2p.StreamInfo{Listener: other})
+	if _, err := waitFirstStream(context.Background(), streams, dialed, 50*time.Millisecond); err != ErrWaitTimeout {
+		t.Fatalf("expected %v, got %v", ErrWaitTimeout, err)
+	}
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	cancelCtx()
+	if _, err := waitFirstStream(ctx, streams, dialed, 0); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestWriteStreamTotals(t *testing.T) {
+	streams := []P2PStreamInfoOutput{
+		{HandlerID: "0", Protocol: "/p2p/a", LocalAddress: "/ip4/127.0.0.1/tcp/10101", RemotePeer: "QmPeer"},
+		{HandlerID: "1", Protocol: "/p2p/b", LocalAddress: "/ip4/127.0.0.1/tcp/10102", RemotePeer: "QmPeer"},
+	}
+
+	buf := new(bytes.Buffer)
+	writeStreams(buf, streams, false, false, false)
+	writeStreamTotals(buf, &P2PStreamTotalsOutput{Streams: 2, BytesIn: 1500, BytesOut: 2000000})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 2 rows and a footer, got:\n%s", buf)
+	}
+	if footer := "Total: 2 stream(s), 1.5 KiB in, 1.9 MiB out"; lines[2] != footer {
+		t.Fatalf("expected %q, got %q", footer, lines[2])
+	}
+}
+
+func TestWriteStreamEvent(t *testing.T) {
+	stream := P2PStreamInfoOutput{HandlerID: "3", Protocol: "/p2p/a", LocalAddress: "/ip4/127.0.0.1/tcp/10101", RemotePeer: "QmPeer"}
+
+	for event, mark := range map[string]string{"opened": "+ 3 ", "closed": "- 3 "} {
+		buf := new(bytes.Buffer)
+		writeStreamEvent(buf, &P2PStreamsOutput{Event: event, Streams: []P2PStreamInfoOutput{stream}}, false, false)
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != 1 || !strings.HasPrefix(lines[0], mark) || !strings.HasSuffix(lines[0], "QmPeer") {
+			t.Fatalf("%s: expected a line starting with %q, got:\n%s", event, mark, buf)
+		}
+	}
+}
+
+func TestWriteTotal(t *testing.T) {
+	listener := P2PListenerInfoOutput{Protocol: "/p2p/a", Address: "/ip4/127.0.0.1/tcp/10101"}
+	stream := P2PStreamInfoOutput{HandlerID: "0", Protocol: "/p2p/a", LocalAddress: "/ip4/127.0.0.1/tcp/10101", RemotePeer: "QmPeer"}
+
+	for _, n := range []int{0, 1, 3} {
+		var listeners []P2PListenerInfoOutput
+		var streams []P2PStreamInfoOutput
+		for i := 0; i < n; i++ {
+			listeners = append(listeners, listener)
+			streams = append(streams, stream)
+		}
+
+		buf := new(bytes.Buffer)
+		writeListeners(buf, listeners, true)
+		writeTotal(buf, len(listeners), "listener")
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != n+2 || !strings.HasPrefix(lines[0], "Address") {
+			t.Fatalf("%d listeners: expected a header, %d rows and a footer, got:\n%s", n, n, buf)
+		}
+		if footer := fmt.Sprintf("Total: %d listener(s)", n); lines[n+1] != footer {
+			t.Fatalf("%d listeners: expected %q, got %q", n, footer, lines[n+1])
+		}
+
+		buf.Reset()
+		writeStreams(buf, streams, true, false, false)
+		writeTotal(buf, len(streams), "stream")
+		lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != n+2 || !strings.HasPrefix(lines[0], "HandlerID") {
+			t.Fatalf("%d streams: expected a header, %d rows and a footer, got:\n%s", n, n, buf)
+		}
+		if footer := fmt.Sprintf("Total: %d stream(s)", n); lines[n+1] != footer {
+			t.Fatalf("%d streams: expected %q, got %q", n, footer, lines[n+1])
+		}
+	}
+}
+
+func TestWriteDial(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writeDial(buf, &P2PDialOutput{
+		Protocol: "/p2p/myproto",
+		Address:  "/ip4/127.0.0.1/tcp/1234",
+		Peer:     "QmPeer",
+	})
+
+	if out := buf.String(); out != "Forwarded /p2p/myproto: /ip4/127.0.0.1/tcp/1234 -> /ipfs/QmPeer\n" {
+		t.Fatalf("unexpected confirmation %q", out)
+	}
+
+	buf.Reset()
+	writeDial(buf, &P2PDialOutput{
+		Protocol: "/p2p/myproto",
+		Targets: []P2PDialTarget{
+			{Peer: "QmA", Address: "/ip4/127.0.0.1/tcp/1234"},
+			{Peer: "QmB", Address: "/ip4/127.0.0.1/tcp/1235"},
+		},
+	})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[1], "/ip4/127.0.0.1/tcp/1235 -> /ipfs/QmB") {
+		t.Fatalf("expected a line per target, got:\n%s", buf)
+	}
+
+	buf.Reset()
+	writeDial(buf, &P2PDialOutput{
+		Protocol:        "/p2p/myproto",
+		Address:         "/ip4/127.0.0.1/tcp/1234",
+		Peer:            "QmPeer",
+		AddedAddress:    "/ip4/10.0.0.1/tcp/4001",
+		AddedAddressTTL: "10s",
+	})
+
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], "/ip4/10.0.0.1/tcp/4001 was added to the peerstore for 10s") {
+		t.Fatalf("expected a note about the temporary address, got:\n%s", buf)
+	}
+
+	buf.Reset()
+	writeDial(buf, &P2PDialOutput{
+		Protocol:        "/p2p/myproto",
+		Address:         "/ip4/127.0.0.1/tcp/1234",
+		Peer:            "QmPeer",
+		AddedAddress:    "/ip4/10.0.0.1/tcp/4001",
+		AddedAddressTTL: "permanent",
+	})
+
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 1 {
+		t.Fatalf("expected no note about a permanent address, got:\n%s", buf)
+	}
+
+	buf.Reset()
+	writeDial(buf, &P2PDialOutput{
+		Protocol: "/p2p/myproto",
+		Address:  "/ip4/0.0.0.0/tcp/1234",
+		Peer:     "QmPeer",
+		Warnings: []string{"exposed"},
+	})
+
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || lines[1] != "Warning: exposed" {
+		t.Fatalf("expected the warning below the confirmation, got:\n%s", buf)
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	cases := map[string]bool{
+		"/ip4/127.0.0.1/tcp/0":    true,
+		"/ip4/127.1.2.3/tcp/8080": true,
+		"/ip6/::1/tcp/0":          true,
+		"/ip4/0.0.0.0/tcp/0":      false,
+		"/ip6/::/tcp/0":           false,
+		"/ip4/192.168.1.5/tcp/0":  false,
+		"/ip6/fe80::1/tcp/0":      false,
+		"/unix/@ipfs":             true,
+	}
+
+	for text, loopback := range cases {
+		addr, err := ma.NewMultiaddr(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isLoopbackAddr(addr) != loopback {
+			t.Fatalf("%s: expected loopback to be %t", text, loopback)
+		}
+	}
+}
+
+func TestParseAddrTTL(t *testing.T) {
+	cases := []struct {
+		in  string
+		ttl time.Duration
+		err bool
+	}{
+		{"", pstore.TempAddrTTL, false},
+		{"permanent", pstore.PermanentAddrTTL, false},
+		{"24h", 24 * time.Hour, false},
+		{"0s", 0, true},
+		{"-1m", 0, true},
+		{"forever", 0, true},
+	}
+
+	for _, c := range cases {
+		ttl, err := parseAddrTTL(c.in)
+		if (err != nil) != c.err {
+			t.Fatalf("%q: unexpected error %v", c.in, err)
+		}
+		if ttl != c.ttl {
+			t.Fatalf("%q: expected %s, got %s", c.in, c.ttl, ttl)
+		}
+	}
+
+	if s := addrTTLString(pstore.PermanentAddrTTL); s != "permanent" {
+		t.Fatalf("expected the permanent TTL to be formatted as such, got %q", s)
+	}
+}
+
+func TestWritePing(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writePing(buf, &P2PPingOutput{Peer: "QmPeer", Protocol: "/p2p/echo", Time: 12 * time.Millisecond})
+	if out := buf.String(); out != "Opened a stream to /p2p/echo of QmPeer in 12ms\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	buf.Reset()
+	writePing(buf, &P2PPingOutput{Peer: "QmPeer", Protocol: "/p2p/echo", Echoed: 5, Time: 3 * time.Millisecond})
+	if out := buf.String(); out != "5 bytes echoed by /p2p/echo of QmPeer in 3ms\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestWriteTest(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writeTest(buf, &P2PTestOutput{Peer: "QmPeer", Protocol: "/p2p/echo", ConnectTime: 20 * time.Millisecond, OpenTime: 5 * time.Millisecond})
+	if out := buf.String(); out != "Connected to QmPeer in 20ms\nNegotiated /p2p/echo in 5ms\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	buf.Reset()
+	writeTest(buf, &P2PTestOutput{Peer: "QmPeer", Protocol: "/p2p/echo", Connected: true, OpenTime: 5 * time.Millisecond, EchoTime: 2 * time.Millisecond})
+	if out := buf.String(); out != "Already connected to QmPeer\nNegotiated /p2p/echo in 5ms\nEchoed a byte in 2ms\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestWriteClosedListeners(t *testing.T) {
+	listeners := []P2PListenerInfoOutput{
+		{Protocol: "/p2p/a", Address: "/ip4/127.0.0.1/tcp/10101"},
+		{Protocol: "/p2p/b", Aliases: []string{"/p2p/b-old"}, Address: "/ip4/127.0.0.1/tcp/10102"},
+	}
+
+	buf := new(bytes.Buffer)
+	writeClosedListeners(buf, listeners, false, false)
+
+	expected := "Closed /p2p/a: /ip4/127.0.0.1/tcp/10101\n" +
+		"Closed /p2p/b,/p2p/b-old: /ip4/127.0.0.1/tcp/10102\n" +
+		"Closed 2 listener(s)\n"
+	if buf.String() != expected {
+		t.Fatalf("unexpected output:\n%s", buf)
+	}
+
+	buf.Reset()
+	writeClosedListeners(buf, listeners, true, false)
+	if buf.String() != "Closed 2 listener(s)\n" {
+		t.Fatalf("expected only the count, got %q", buf)
+	}
+
+	for i := range listeners {
+		listeners[i].Created = time.Now().Add(-90 * time.Second)
+	}
+	buf.Reset()
+	writeClosedListeners(buf, listeners, false, true)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "Protocol") || lines[3] != "Closed 2 listener(s)" {
+		t.Fatalf("expected a table of 2 listeners and the count, got:\n%s", buf)
+	}
+	if fields := strings.Fields(lines[2]); len(fields) != 3 || fields[0] != "/p2p/b,/p2p/b-old" || fields[2] != "1m30s" {
+		t.Fatalf("unexpected row %q", lines[2])
+	}
+}
+
+func TestWriteCount(t *testing.T) {
+	protos := []string{"/p2p/b", "/p2p/a", "/p2p/b"}
+
+	buf := new(bytes.Buffer)
+	writeCount(buf, countProtocols(protos, false))
+	if buf.String() != "3\n" {
+		t.Fatalf("expected a lone total, got %q", buf)
+	}
+
+	buf.Reset()
+	writeCount(buf, countProtocols(protos, true))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 2 protocols and a total, got:\n%s", buf)
+	}
+	if strings.Fields(lines[0])[0] != "/p2p/a" || strings.Fields(lines[1])[1] != "2" {
+		t.Fatalf("expected protocols sorted with their counts, got:\n%s", buf)
+	}
+	if strings.Join(strings.Fields(lines[2]), " ") != "total 3" {
+		t.Fatalf("expected the total last, got %q", lines[2])
+	}
+}
+
+func TestWriteStats(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writeStats(buf, &P2PStatsOutput{
+		Listeners:     2,
+		DialListeners: 1,
+		Streams:       3,
+		StreamsOpened: 10,
+		StreamsFailed: 1,
+		BytesIn:       2000,
+		BytesOut:      1000,
+	})
+
+	expected := `Listeners:     2
+DialListeners: 1
+Streams:       3
+StreamsOpened: 10
+StreamsFailed: 1
+TotalIn:       2.0 KiB
+TotalOut:      1000 B
+Redials:       0
+Bandwidth:     unlimited
+`
+	if buf.String() != expected {
+		t.Fatalf("unexpected output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestListenerFilter(t *testing.T) {
+	addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/10101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &p2p.ListenerInfo{
+		Protocol: "/p2p/myproto",
+		Aliases:  []string{"/p2p/myproto-old"},
+		Address:  addr,
+		Created:  time.Now().Add(-time.Hour),
+		Meta:     map[string]string{"owner": "alice", "env": "staging"},
+		Group:    "backend",
+	}
+
+	cases := []struct {
+		name   string
+		filter listenerFilter
+		match  bool
+	}{
+		{"protocol", listenerFilter{proto: normalizeProtocol("myproto")}, true},
+		{"prefixed protocol", listenerFilter{proto: normalizeProtocol("/p2p/myproto")}, true},
+		{"alias", listenerFilter{proto: normalizeProtocol("myproto-old")}, true},
+		{"other protocol", listenerFilter{proto: normalizeProtocol("other")}, false},
+		{"address", listenerFilter{addr: "/ip4/127.0.0.1/tcp/10101"}, true},
+		{"other address", listenerFilter{addr: "/ip4/127.0.0.1/tcp/10102"}, false},
+		{"protocol and address", listenerFilter{proto: "/p2p/myproto", addr: "/ip4/127.0.0.1/tcp/10101"}, true},
+		{"protocol and other address", listenerFilter{proto: "/p2p/myproto", addr: "/ip4/127.0.0.1/tcp/10102"}, false},
+		{"other protocol and address", listenerFilter{proto: "/p2p/other", addr: "/ip4/127.0.0.1/tcp/10101"}, false},
+		{"address contains", listenerFilter{addrContains: "tcp/10101"}, true},
+		{"address contains other", listenerFilter{addrContains: "tcp/10102"}, false},
+		{"protocol and address contains", listenerFilter{proto: "/p2p/myproto", addrContains: "10101"}, true},
+		{"older", listenerFilter{createdBefore: time.Now().Add(-time.Minute)}, true},
+		{"newer", listenerFilter{createdBefore: time.Now().Add(-2 * time.Hour)}, false},
+		{"protocol and newer", listenerFilter{proto: "/p2p/myproto", createdBefore: time.Now().Add(-2 * time.Hour)}, false},
+		{"pattern", listenerFilter{proto: normalizeProtocol("my*")}, true},
+		{"pattern of alias", listenerFilter{proto: normalizeProtocol("*-old")}, true},
+		{"other pattern", listenerFilter{proto: normalizeProtocol("other*")}, false},
+		{"prefix is not a pattern", listenerFilter{proto: normalizeProtocol("my")}, false},
+		{"meta", listenerFilter{meta: map[string]string{"owner": "alice"}}, true},
+		{"all of meta", listenerFilter{meta: map[string]string{"owner": "alice", "env": "staging"}}, true},
+		{"other meta value", listenerFilter{meta: map[string]string{"owner": "bob"}}, false},
+		{"missing meta key", listenerFilter{meta: map[string]string{"owner": "alice", "team": "ops"}}, false},
+		{"protocol and meta", listenerFilter{proto: "/p2p/other", meta: map[string]string{"owner": "alice"}}, false},
+		{"group", listenerFilter{group: "backend"}, true},
+		{"other group", listenerFilter{group: "frontend"}, false},
+		{"protocol and group", listenerFilter{proto: "/p2p/other", group: "backend"}, false},
+		{"direction", listenerFilter{direction: listenerLocal}, true},
+		{"other direction", listenerFilter{direction: listenerRemote}, false},
+		{"protocol and direction", listenerFilter{proto: "/p2p/myproto", direction: listenerRemote}, false},
+		{"all", listenerFilter{all: true}, true},
+		{"all ignores criteria", listenerFilter{all: true, proto: "/p2p/other"}, true},
+	}
+
+	for _, c := range cases {
+		if m := c.filter.match(listener); m != c.match {
+			t.Errorf("%s: expected match to be %t, got %t", c.name, c.match, m)
+		}
+	}
+}
+
+func TestListenerFilterZone(t *testing.T) {
+	addr, err := ma.NewMultiaddr("/ip6zone/lo/ip6/::1/tcp/10101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &p2p.ListenerInfo{Protocol: "/p2p/myproto", Address: addr}
+
+	cases := map[string]bool{
+		"/ip6zone/lo/ip6/::1/tcp/10101":    true,
+		"/ip6zone/lo/ip6/0:0::1/tcp/10101": true,
+		"/ip6zone/eth0/ip6/::1/tcp/10101":  false,
+		"/ip6/::1/tcp/10101":               false,
+	}
+
+	for text, match := range cases {
+		filterAddr, err := parseAddrArg("address", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filter := listenerFilter{addr: filterAddr.String()}
+		if m := filter.match(listener); m != match {
+			t.Errorf("%s: expected match to be %t, got %t", text, match, m)
+		}
+	}
+}
+
+func TestMatchProtocol(t *testing.T) {
+	cases := []struct {
+		pattern, proto string
+		match          bool
+	}{
+		{"/p2p/myapp-staging", "/p2p/myapp-staging", true},
+		{"/p2p/myapp-staging", "/p2p/myapp-staging-1", false},
+		{"/p2p/myapp-staging*", "/p2p/myapp-staging-1", true},
+		{"/p2p/myapp-staging*", "/p2p/myapp-prod-1", false},
+		{"/p2p/myapp-prod-?", "/p2p/myapp-prod-1", true},
+		{"/p2p/myapp-[ps]*", "/p2p/myapp-staging", true},
+		{"/p2p/*", "/x/myapp", false},
+	}
+
+	for _, c := range cases {
+		if m := matchProtocol(c.pattern, c.proto); m != c.match {
+			t.Errorf("%s against %s: expected match to be %t, got %t", c.pattern, c.proto, c.match, m)
+		}
+	}
+
+	if err := checkProtocolPattern("/p2p/myapp-[staging"); err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+}
+
+func TestNormalizeProtocol(t *testing.T) {
+	for _, name := range []string{"myproto", "/p2p/myproto"} {
+		if proto := normalizeProtocol(name); proto != "/p2p/myproto" {
+			t.Fatalf("%q: expected /p2p/myproto, got %q", name, proto)
+		}
+	}
+	if proto := normalizeProtocol("/x/myproto"); proto != "/x/myproto" {
+		t.Fatalf("expected /x/myproto to be kept, got %q", proto)
+	}
+}
+
+func TestProtocolID(t *testing.T) {
+	cases := []struct {
+		name   string
+		custom bool
+		proto  string
+		err    bool
+	}{
+		{name: "myproto", proto: "/p2p/myproto"},
+		{name: "/x/my-app/1.0.0", proto: "/x/my-app/1.0.0"},
+		{name: "/y/my-app/1.0.0", proto: "/p2p//y/my-app/1.0.0"},
+		{name: "/x/my-app/1.0.0", custom: true, proto: "/x/my-app/1.0.0"},
+		{name: "x/my-app/1.0.0", custom: true, err: true},
+	}
+
+	for _, c := range cases {
+		proto, err := protocolID(c.name, c.custom)
+		if c.err {
+			if err == nil {
+				t.Fatalf("%q: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", c.name, err)
+		}
+		if proto != c.proto {
+			t.Fatalf("%q: expected %q, got %q", c.name, c.proto, proto)
+		}
+	}
+}
+
+func TestProtocolWarning(t *testing.T) {
+	cases := []struct {
+		name   string
+		custom bool
+		warn   bool
+	}{
+		{name: "myproto"},
+		{name: "my-app/1.0.0"},
+		{name: "/x/my-app/1.0.0"},
+		{name: "/y/my-app", warn: true},
+		{name: "/y/my-app", custom: true},
+		{name: "p2p/my-app", warn: true},
+		{name: "ipfs", warn: true},
+		{name: "QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74", warn: true},
+		{name: "QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74/1.0.0", warn: true},
+	}
+
+	for _, c := range cases {
+		proto, err := protocolID(c.name, c.custom)
+		if err != nil {
+			t.Fatalf("%q: %s", c.name, err)
+		}
+		warning := protocolWarning(c.name, proto, c.custom)
+		if (warning != "") != c.warn {
+			t.Fatalf("%q: expected a warning: %t, got %q", c.name, c.warn, warning)
+		}
+	}
+}
+
+// p2pGoldenCases are ls outputs whose encodings are kept in testdata, any
+// change to them is a change of the API
+var p2pGoldenCases = []struct {
+	name   string
+	typ    interface{}
+	output interface{}
+	text   func(buf *bytes.Buffer, v interface{})
+}{
+	{
+		name: "p2p_ls",
+		typ:  p2pListenerLsCmd.Type,
+		output: &P2PLsOutput{
+			Listeners: []P2PListenerInfoOutput{
+				{
+					Direction: "remote",
+					Protocol:  "/x/ssh",
+					Address:   "/ip4/127.0.0.1/tcp/2222",
+					Created:   time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC),
+					Streams: []P2PListenerStreamOutput{
+						{HandlerID: "18446744073709551615", RemotePeer: "QmRemote", Age: "1m5s", BytesIn: 1024, BytesOut: 2048},
+					},
+				},
+				{
+					Direction: "local",
+					Protocol:  "/x/web",
+					Aliases:   []string{"/x/http"},
+					Address:   "/ip4/127.0.0.1/tcp/8080",
+					Created:   time.Date(2018, 5, 1, 12, 30, 0, 0, time.UTC),
+				},
+			},
+		},
+		text: func(buf *bytes.Buffer, v interface{}) {
+			writeListeners(buf, v.(*P2PLsOutput).Listeners, true)
+		},
+	},
+	{
+		name:   "p2p_ls_empty",
+		typ:    p2pListenerLsCmd.Type,
+		output: &P2PLsOutput{Listeners: []P2PListenerInfoOutput{}},
+		text: func(buf *bytes.Buffer, v interface{}) {
+			writeListeners(buf, v.(*P2PLsOutput).Listeners, true)
+		},
+	},
+	{
+		name: "p2p_listener_close",
+		typ:  p2pListenerCloseCmd.Type,
+		output: &P2PLsOutput{
+			Listeners: []P2PListenerInfoOutput{
+				{
+					Protocol: "/x/web",
+					Aliases:  []string{"/x/http"},
+					Address:  "/ip4/127.0.0.1/tcp/8080",
+					Created:  time.Date(2018, 5, 1, 12, 30, 0, 0, time.UTC),
+					Meta:     map[string]string{"owner": "web"},
+				},
+			},
+		},
+		text: func(buf *bytes.Buffer, v interface{}) {
+			writeClosedListeners(buf, v.(*P2PLsOutput).Listeners, false, false)
+		},
+	},
+	{
+		name: "p2p_stream_ls",
+		typ:  p2pStreamLsCmd.Type,
+		output: &P2PStreamsOutput{
+			Streams: []P2PStreamInfoOutput{
+				{
+					HandlerID:     "0",
+					Protocol:      "/x/ssh",
+					LocalPeer:     "QmLocal",
+					LocalAddress:  "/ip4/127.0.0.1/tcp/2222",
+					RemotePeer:    "QmRemote",
+					RemoteAddress: "/ipfs/QmRemote",
+					Priority:      "normal",
+				},
+			},
+		},
+		text: func(buf *bytes.Buffer, v interface{}) {
+			writeStreams(buf, v.(*P2PStreamsOutput).Streams, true, false, false)
+		},
+	},
+	{
+		name: "p2p_stream_ls_count",
+		typ:  p2pStreamLsCmd.Type,
+		output: &P2PStreamsOutput{
+			Streams: []P2PStreamInfoOutput{},
+			Count:   &P2PCountOutput{Total: 3, ByProtocol: map[string]int{"/x/ssh": 2, "/x/web": 1}},
+		},
+		text: func(buf *bytes.Buffer, v interface{}) {
+			writeCount(buf, v.(*P2PStreamsOutput).Count)
+		},
+	},
+}
+
+func checkGolden(t *testing.T, file string, got []byte) {
+	want, err := ioutil.ReadFile(filepath.Join("testdata", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s: expected:\n%s\ngot:\n%s", file, want, got)
+	}
+}
+
+func TestP2PLsGolden(t *testing.T) {
+	for _, c := range p2pGoldenCases {
+		buf := new(bytes.Buffer)
+		if err := json.NewEncoder(buf).Encode(c.output); err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, c.name+".json", buf.Bytes())
+
+		// Over HTTP the client decodes the response into the command's
+		// Type, encoding that again must give the same output as in-process
+		decoded := reflect.New(reflect.TypeOf(c.typ)).Interface()
+		if err := json.Unmarshal(buf.Bytes(), decoded); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if !reflect.DeepEqual(decoded, c.output) {
+			t.Fatalf("%s: decoded %#v, expected %#v", c.name, decoded, c.output)
+		}
+		again := new(bytes.Buffer)
+		if err := json.NewEncoder(again).Encode(decoded); err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, c.name+".json", again.Bytes())
+
+		text := new(bytes.Buffer)
+		c.text(text, c.output)
+		checkGolden(t, c.name+".txt", text.Bytes())
+	}
+}
+
+func TestParsePeerTarget(t *testing.T) {
+	const id = "QmSoLueR4xBeUbY9WZ9xGUUxunbKWcrNFTDAadQJmocnWm"
+	const relay = "QmPvrhgMzKvcHsaR2bj79VixJeLUkUaXTCnCCbhSUsNtkU"
+	// the peer ID as a CIDv1 of the libp2p-key codec, in base32 and base58
+	const cid32 = "bafzbeiccivgulb4l7mkgwvs3erabgkzilek6tcficgd4n4z3ovtrnhgxvi"
+	const cid58 = "zdvgq5sg5r4fsyNAEf91LsNfhcVpau8VCePE2r4Y2ignDkLAV"
+	expected, err := peer.IDB58Decode(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		in        string
+		transport string
+	}{
+		{id, ""},
+		{" " + id + "\n", ""},
+		{id + "/", ""},
+		{"/ipfs/" + id, ""},
+		{"/ipfs/" + id + "/", ""},
+		{"/p2p/" + id, ""},
+		{"/ip4/104.131.131.82/tcp/4001/ipfs/" + id, "/ip4/104.131.131.82/tcp/4001"},
+		{"/ip4/104.131.131.82/tcp/4001/p2p/" + id + "/", "/ip4/104.131.131.82/tcp/4001"},
+		{"/ip6/::1/tcp/4001/ipfs/" + id, "/ip6/::1/tcp/4001"},
+		{"/ip4/104.131.131.82/tcp/4001/ipfs/" + relay + "/p2p-circuit/ipfs/" + id,
+			"/ip4/104.131.131.82/tcp/4001/ipfs/" + relay + "/p2p-circuit"},
+		{"/p2p/" + relay + "/p2p-circuit/p2p/" + id, "/ipfs/" + relay + "/p2p-circuit"},
+		{"/p2p-circuit/ipfs/" + id, "/p2p-circuit"},
+		{cid32, ""},
+		{cid58, ""},
+		{"/p2p/" + cid32, ""},
+		{"/ipfs/" + cid32 + "/", ""},
+		{"/ip4/104.131.131.82/tcp/4001/p2p/" + cid32, "/ip4/104.131.131.82/tcp/4001"},
+		{"/p2p/" + relay + "/p2p-circuit/p2p/" + cid32, "/ipfs/" + relay + "/p2p-circuit"},
+	}
+
+	for _, c := range cases {
+		pid, addr, err := parsePeerTarget(c.in)
+		if err != nil {
+			t.Fatalf("%q: %s", c.in, err)
+		}
+		if pid != expected {
+			t.Fatalf("%q: expected peer %s, got %s", c.in, expected.Pretty(), pid.Pretty())
+		}
+		if c.transport == "" && addr != nil {
+			t.Fatalf("%q: expected no transport address, got %s", c.in, addr)
+		}
+		if c.transport != "" && (addr == nil || addr.String() != c.transport) {
+			t.Fatalf("%q: expected transport address %s, got %v", c.in, c.transport, addr)
+		}
+	}
+
+	// a CID of something else than a peer ID
+	const dagCID = "bafybeiccivgulb4l7mkgwvs3erabgkzilek6tcficgd4n4z3ovtrnhgxvi"
+
+	for _, in := range []string{"", "QmNotAPeer", "/ip4/127.0.0.1/tcp/4001", "/ipfs/" + id + "/tcp/4001", "/ipfs/" + relay + "/p2p-circuit", dagCID, "/p2p/" + dagCID} {
+		if _, _, err := parsePeerTarget(in); err == nil {
+			t.Fatalf("%q: expected an error", in)
+		}
+	}
+}
+
+func TestSameEndpoint(t *testing.T) {
+	cases := []struct {
+		target, listen string
+		same           bool
+	}{
+		{"/ip4/127.0.0.1/tcp/5001", "/ip4/127.0.0.1/tcp/5001", true},
+		{"/ip4/127.0.0.1/tcp/5001", "/ip4/0.0.0.0/tcp/5001", true},
+		{"/ip6/::1/tcp/5001", "/ip6/::/tcp/5001", true},
+		{"/ip4/0.0.0.0/tcp/5001", "/ip4/127.0.0.1/tcp/5001", true},
+		{"/ip4/127.0.0.1/tcp/5002", "/ip4/127.0.0.1/tcp/5001", false},
+		{"/ip4/127.0.0.2/tcp/5001", "/ip4/127.0.0.1/tcp/5001", false},
+		{"/ip4/10.0.0.1/tcp/5001", "/ip4/0.0.0.0/tcp/5001", false},
+		{"/ip4/127.0.0.1/udp/5001", "/ip4/127.0.0.1/tcp/5001", false},
+		{"/unix/tmp/api.sock", "/unix/tmp/api.sock", true},
+		{"/unix/tmp/app.sock", "/unix/tmp/api.sock", false},
+	}
+
+	for _, c := range cases {
+		target, err := ma.NewMultiaddr(c.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listen, err := ma.NewMultiaddr(c.listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if same := sameEndpoint(target, listen); same != c.same {
+			t.Errorf("%s and %s: expected %t, got %t", c.target, c.listen, c.same, same)
+		}
+	}
+}
+
+func TestParseAddrArg(t *testing.T) {
+	cases := []struct {
+		in        string
+		component string
+		fix       string
+	}{
+		{"/ip4/127.0.0.1/tpc/8080", "tpc", "/ip4/127.0.0.1/tcp/8080"},
+		{"/ipv4/127.0.0.1/tcp/8080", "ipv4", "/ip4/127.0.0.1/tcp/8080"},
+		{"/IP4/127.0.0.1/TCP/8080", "IP4", "/ip4/127.0.0.1/tcp/8080"},
+		{"ip4/127.0.0.1/tcp/8080", "", "/ip4/127.0.0.1/tcp/8080"},
+		{"127.0.0.1", "", ""},
+		{"8080", "", ""},
+		{"::1:8080", "", ""},
+		{"127.0.0.1:http", "", ""},
+		{"example.com:8080", "", ""},
+		{"/ip4/127.0.0.1/tcp/80800", "tcp/80800", ""},
+		{"/ip4/127.0.0.1/tcp", "tcp", ""},
+		{"/ip4/localhost/tcp/8080", "ip4/localhost", ""},
+	}
+
+	for _, c := range cases {
+		_, err := parseAddrArg("Address", c.in)
+		if err == nil {
+			t.Fatalf("%q: expected an error", c.in)
+		}
+		msg := err.Error()
+		if !strings.HasPrefix(msg, fmt.Sprintf("invalid Address %q", c.in)) {
+			t.Fatalf("%q: expected the argument to be named, got %q", c.in, msg)
+		}
+		if c.component != "" && !strings.Contains(msg, fmt.Sprintf("bad component %q", c.component)) {
+			t.Fatalf("%q: expected %q to be blamed, got %q", c.in, c.component, msg)
+		}
+		hasFix := strings.Contains(msg, "did you mean")
+		if c.fix == "" && hasFix {
+			t.Fatalf("%q: expected no suggestion, got %q", c.in, msg)
+		}
+		if c.fix != "" && !strings.Contains(msg, fmt.Sprintf("did you mean %q?", c.fix)) {
+			t.Fatalf("%q: expected %q to be suggested, got %q", c.in, c.fix, msg)
+		}
+	}
+
+	valid := map[string]string{
+		"/ip4/127.0.0.1/tcp/8080": "/ip4/127.0.0.1/tcp/8080",
+		"127.0.0.1:8080":          "/ip4/127.0.0.1/tcp/8080",
+		"localhost:8080":          "/ip4/127.0.0.1/tcp/8080",
+		":8080":                   "/ip4/127.0.0.1/tcp/8080",
+		"0.0.0.0:0":               "/ip4/0.0.0.0/tcp/0",
+		"[::1]:8080":              "/ip6/::1/tcp/8080",
+		"[fe80::1%lo]:8080":       "/ip6zone/lo/ip6/fe80::1/tcp/8080",
+	}
+	for in, expected := range valid {
+		addr, err := parseAddrArg("Address", in)
+		if err != nil || addr.String() != expected {
+			t.Fatalf("%q: expected %s, got %v, %v", in, expected, addr, err)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	cases := []struct {
+		a, b string
+		d    int
+	}{
+		{"tcp", "tcp", 0},
+		{"tpc", "tcp", 1},
+		{"tc", "tcp", 1},
+		{"tcpp", "tcp", 1},
+		{"udp", "tcp", 2},
+		{"", "ip4", 3},
+	}
+	for _, c := range cases {
+		if d := editDistance(c.a, c.b); d != c.d {
+			t.Fatalf("distance of %q and %q: expected %d, got %d", c.a, c.b, c.d, d)
+		}
+	}
+}
@@ -147,6 +147,9 @@ type IpfsNode struct {
 
 	mode         mode
 	localModeSet bool
+
+	// set by the "p2p" ExtraOpts of BuildCfg, see P2PEnabled
+	p2pEnabled bool
 }
 
 // Mounts defines what the node's mount state is. This should
@@ -157,7 +160,7 @@ type Mounts struct {
 	Ipns mount.Mount
 }
 
-func (n *IpfsNode) startOnlineServices(ctx context.Context, routingOption RoutingOption, hostOption HostOption, do DiscoveryOption, pubsub, ipnsps, mplex bool) error {
+func (n *IpfsNode) startOnlineServices(ctx context.Context, routingOption RoutingOption, hostOption HostOption, do DiscoveryOption, pubsub, ipnsps, mplex bool, listenAddrs []ma.Multiaddr) error {
 
 	if n.PeerHost != nil { // already online.
 		return errors.New("node already online")
@@ -238,7 +241,9 @@ func (n *IpfsNode) startOnlineServices(ctx context.Context, routingOption Routin
 		EnableRelayHop:    cfg.Swarm.EnableRelayHop,
 		ConnectionManager: connmgr,
 	}
-	peerhost, err := hostOption(ctx, n.Identity, n.Peerstore, n.Reporter,
+	// the network dials from a peerstore p2p forwards can hide addresses in
+	dialPeerstore := p2p.NewFilteredPeerstore(n.Peerstore)
+	peerhost, err := hostOption(ctx, n.Identity, dialPeerstore, n.Reporter,
 		addrfilter, tpt, protec, hostopts)
 
 	if err != nil {
@@ -250,11 +255,42 @@ func (n *IpfsNode) startOnlineServices(ctx context.Context, routingOption Routin
 	}
 
 	// Ok, now we're ready to listen.
-	if err := startListening(n.PeerHost, cfg); err != nil {
+	if len(listenAddrs) == 0 {
+		listenAddrs, err = listenAddresses(cfg)
+		if err != nil {
+			return err
+		}
+	}
+	if err := startListening(n.PeerHost, listenAddrs); err != nil {
 		return err
 	}
 
-	n.P2P = p2p.NewP2P(n.Identity, n.PeerHost, n.Peerstore)
+	n.P2P = p2p.NewP2P(n.Identity, n.PeerHost, dialPeerstore)
+	n.P2P.MaxStreamsPerPeer = cfg.P2P.MaxStreamsPerPeer
+	n.P2P.Streams.JSONLog = cfg.P2P.JSONLog
+	if cfg.P2P.BandwidthLimit > 0 {
+		n.P2P.Limiter = p2p.NewRateLimiter(cfg.P2P.BandwidthLimit)
+	}
+	if cfg.P2P.ResetStreamsOnDisconnect {
+		n.P2P.ResetStreamsOnDisconnect()
+	}
+	if cfg.P2P.DialTimeout != "" {
+		d, err := time.ParseDuration(cfg.P2P.DialTimeout)
+		if err != nil {
+			return fmt.Errorf("parsing P2P.DialTimeout: %s", err)
+		}
+		n.P2P.DialTimeout = d
+	}
+	if cfg.P2P.LivenessInterval != "" {
+		d, err := time.ParseDuration(cfg.P2P.LivenessInterval)
+		if err != nil {
+			return fmt.Errorf("parsing P2P.LivenessInterval: %s", err)
+		}
+		n.P2P.LivenessInterval = d
+	}
+	if n.p2pEnabled || cfg.Experimental.Libp2pStreamMounting {
+		n.openConfiguredListeners(ctx, cfg.P2P.Listeners)
+	}
 
 	// setup local discovery
 	if do != nil {
@@ -270,6 +306,37 @@ func (n *IpfsNode) startOnlineServices(ctx context.Context, routingOption Routin
 	return n.Bootstrap(DefaultBootstrapConfig)
 }
 
+// openConfiguredListeners opens the p2p listeners of the config. Failing to
+// open one doesn't keep the node from starting, the outcome of each is kept
+// in P2P.Restored for 'ipfs p2p restore-status'.
+func (n *IpfsNode) openConfiguredListeners(ctx context.Context, listeners []config.P2PListener) {
+	restored := make([]p2p.RestoreResult, 0, len(listeners))
+	failed := 0
+	for _, l := range listeners {
+		addr, err := ma.NewMultiaddr(l.Address)
+		if err == nil {
+			// another entry for the protocol would take over the stream
+			// handler of the listener opened first
+			err = n.P2P.CheckListenerConflict(l.Protocol)
+		}
+		if err == nil {
+			_, err = n.P2P.NewListener(ctx, l.Protocol, addr, p2p.ListenerOpts{Group: l.Group})
+		}
+		if err != nil {
+			log.Errorf("opening p2p listener %s from the config: %s", l.Protocol, err)
+			failed++
+		}
+		restored = append(restored, p2p.RestoreResult{Protocol: l.Protocol, Address: l.Address, Err: err})
+	}
+	n.P2P.Restored = restored
+
+	if failed > 0 {
+		log.Errorf("%d of %d p2p listeners from the config failed to open, see 'ipfs p2p restore-status'", failed, len(listeners))
+	} else if len(listeners) > 0 {
+		log.Infof("opened %d p2p listeners from the config", len(listeners))
+	}
+}
+
 func constructConnMgr(cfg config.ConnMgr) (ifconnmgr.ConnManager, error) {
 	switch cfg.Type {
 	case "":
@@ -623,6 +690,20 @@ func (n *IpfsNode) OnlineMode() bool {
 	return n.mode == onlineMode
 }
 
+// P2PEnabled returns whether libp2p stream mounting is enabled, either by
+// Experimental.Libp2pStreamMounting in the config or by the "p2p" ExtraOpts
+// the node was built with
+func (n *IpfsNode) P2PEnabled() bool {
+	if n.p2pEnabled {
+		return true
+	}
+	cfg, err := n.Repo.Config()
+	if err != nil {
+		return false
+	}
+	return cfg.Experimental.Libp2pStreamMounting
+}
+
 // SetLocal will set the IpfsNode to local mode
 func (n *IpfsNode) SetLocal(isLocal bool) {
 	if isLocal {
@@ -930,18 +1011,13 @@ func composeAddrsFactory(f, g p2pbhost.AddrsFactory) p2pbhost.AddrsFactory {
 }
 
 // startListening on the network addresses
-func startListening(host p2phost.Host, cfg *config.Config) error {
-	listenAddrs, err := listenAddresses(cfg)
-	if err != nil {
-		return err
-	}
-
-	// make sure we error out if our config does not have addresses we can use
-	log.Debugf("Config.Addresses.Swarm:%s", listenAddrs)
+func startListening(host p2phost.Host, listenAddrs []ma.Multiaddr) error {
+	// make sure we error out if we weren't given addresses we can use
+	log.Debugf("Swarm listen addresses:%s", listenAddrs)
 	filteredAddrs := addrutil.FilterUsableAddrs(listenAddrs)
-	log.Debugf("Config.Addresses.Swarm:%s (filtered)", filteredAddrs)
+	log.Debugf("Swarm listen addresses:%s (filtered)", filteredAddrs)
 	if len(filteredAddrs) < 1 {
-		return fmt.Errorf("addresses in config not usable: %s", listenAddrs)
+		return fmt.Errorf("swarm listen addresses not usable: %s", listenAddrs)
 	}
 
 	// Actually start listening:
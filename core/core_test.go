@@ -1,13 +1,20 @@
 package core
 
 import (
+	"crypto/rand"
+	"io/ioutil"
 	"testing"
 
 	context "context"
 
+	"github.com/ipfs/go-ipfs/p2p"
 	"github.com/ipfs/go-ipfs/repo"
 	config "github.com/ipfs/go-ipfs/repo/config"
 
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	peer "gx/ipfs/QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74/go-libp2p-peer"
+	pstore "gx/ipfs/QmdeiKhUy1TVGBaKxt7y1QmBDLBdisSrLJ1x58Eoj4PXUh/go-libp2p-peerstore"
+	ci "gx/ipfs/Qme1knMqwt1hKZbc1BmQFmnm9f36nyQGwXxPGVpVJ9rMK5/go-libp2p-crypto"
 	datastore "gx/ipfs/QmeiCcJfDW1GJnWUArudsv5rQsihpi4oyddPhdqo3CfX6i/go-datastore"
 	syncds "gx/ipfs/QmeiCcJfDW1GJnWUArudsv5rQsihpi4oyddPhdqo3CfX6i/go-datastore/sync"
 )
@@ -61,7 +68,190 @@ func TestInitialization(t *testing.T) {
 	}
 }
 
+func TestP2PEnabledExtraOpt(t *testing.T) {
+	ctx := context.Background()
+
+	for _, enable := range []bool{false, true} {
+		r := &repo.Mock{
+			C: config.Config{Identity: testIdentity},
+			D: syncds.MutexWrap(datastore.NewMapDatastore()),
+		}
+		n, err := NewNode(ctx, &BuildCfg{Repo: r, ExtraOpts: map[string]bool{"p2p": enable}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.P2PEnabled() != enable {
+			t.Fatalf("expected P2PEnabled to be %t with the p2p option set to %t", enable, enable)
+		}
+		n.Close()
+	}
+
+	// the config enables it without the option
+	r := &repo.Mock{
+		C: config.Config{Identity: testIdentity, Experimental: config.Experiments{Libp2pStreamMounting: true}},
+		D: syncds.MutexWrap(datastore.NewMapDatastore()),
+	}
+	n, err := NewNode(ctx, &BuildCfg{Repo: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	if !n.P2PEnabled() {
+		t.Fatal("expected Experimental.Libp2pStreamMounting to enable p2p")
+	}
+}
+
+func TestListenAddrs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listen, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two nodes with the same swarm addresses in their config, which would
+	// conflict without ListenAddrs
+	var nodes []*IpfsNode
+	for i := 0; i < 2; i++ {
+		c, err := config.Init(ioutil.Discard, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Bootstrap = nil
+		c.Discovery.MDNS.Enabled = false
+
+		r := &repo.Mock{
+			C: *c,
+			D: syncds.MutexWrap(datastore.NewMapDatastore()),
+		}
+		n, err := NewNode(ctx, &BuildCfg{Repo: r, Online: true, ListenAddrs: []ma.Multiaddr{listen}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer n.Close()
+		nodes = append(nodes, n)
+	}
+
+	ports := make(map[string]bool)
+	for i, n := range nodes {
+		for _, addr := range n.PeerHost.Addrs() {
+			port, err := addr.ValueForProtocol(ma.P_TCP)
+			if err != nil {
+				continue
+			}
+			if port == "0" || port == "4001" {
+				t.Fatalf("node %d: expected an ephemeral port, got %s", i, addr)
+			}
+			ports[port] = true
+		}
+	}
+	if len(ports) != 2 {
+		t.Fatalf("expected a port per node, got %v", ports)
+	}
+
+	// the addresses are usable
+	second := pstore.PeerInfo{ID: nodes[1].Identity, Addrs: nodes[1].PeerHost.Addrs()}
+	if err := nodes[0].PeerHost.Connect(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeerstoreOption(t *testing.T) {
+	ctx := context.Background()
+
+	sk, pk, err := ci.GenerateKeyPairWithReader(ci.RSA, 512, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	known, err := peer.IDFromPublicKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := ma.NewMultiaddr("/ip4/1.2.3.4/tcp/4001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newRepo := func() repo.Repo {
+		return &repo.Mock{
+			C: config.Config{Identity: testIdentity},
+			D: syncds.MutexWrap(datastore.NewMapDatastore()),
+		}
+	}
+
+	// the node starts out with the addresses of the peers it knows
+	ps := pstore.NewPeerstore()
+	ps.AddAddr(known, addr, pstore.PermanentAddrTTL)
+	n, err := NewNode(ctx, &BuildCfg{Repo: newRepo(), Peerstore: ps})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	if n.Peerstore != ps {
+		t.Fatal("expected the node to use the given peerstore")
+	}
+	if addrs := n.Peerstore.Addrs(known); len(addrs) != 1 || !addrs[0].Equal(addr) {
+		t.Fatalf("expected the address of the known peer, got %v", addrs)
+	}
+
+	// a peerstore holding the key of another node is in use by that node
+	shared := pstore.NewPeerstore()
+	shared.AddPrivKey(known, sk)
+	if _, err := NewNode(ctx, &BuildCfg{Repo: newRepo(), Peerstore: shared}); err == nil {
+		t.Fatal("expected a peerstore with the key of another node to be refused")
+	}
+}
+
 var testIdentity = config.Identity{
 	PeerID:  "QmNgdzLieYi8tgfo2WfTUzNVH5hQK9oAYGVf6dxN12NrHt",
 	PrivKey: "CAASrRIwggkpAgEAAoICAQCwt67GTUQ8nlJhks6CgbLKOx7F5tl1r9zF4m3TUrG3Pe8h64vi+ILDRFd7QJxaJ/n8ux9RUDoxLjzftL4uTdtv5UXl2vaufCc/C0bhCRvDhuWPhVsD75/DZPbwLsepxocwVWTyq7/ZHsCfuWdoh/KNczfy+Gn33gVQbHCnip/uhTVxT7ARTiv8Qa3d7qmmxsR+1zdL/IRO0mic/iojcb3Oc/PRnYBTiAZFbZdUEit/99tnfSjMDg02wRayZaT5ikxa6gBTMZ16Yvienq7RwSELzMQq2jFA4i/TdiGhS9uKywltiN2LrNDBcQJSN02pK12DKoiIy+wuOCRgs2NTQEhU2sXCk091v7giTTOpFX2ij9ghmiRfoSiBFPJA5RGwiH6ansCHtWKY1K8BS5UORM0o3dYk87mTnKbCsdz4bYnGtOWafujYwzueGx8r+IWiys80IPQKDeehnLW6RgoyjszKgL/2XTyP54xMLSW+Qb3BPgDcPaPO0hmop1hW9upStxKsefW2A2d46Ds4HEpJEry7PkS5M4gKL/zCKHuxuXVk14+fZQ1rstMuvKjrekpAC2aVIKMI9VRA3awtnje8HImQMdj+r+bPmv0N8rTTr3eS4J8Yl7k12i95LLfK+fWnmUh22oTNzkRlaiERQrUDyE4XNCtJc0xs1oe1yXGqazCIAQIDAQABAoICAQCk1N/ftahlRmOfAXk//8wNl7FvdJD3le6+YSKBj0uWmN1ZbUSQk64chr12iGCOM2WY180xYjy1LOS44PTXaeW5bEiTSnb3b3SH+HPHaWCNM2EiSogHltYVQjKW+3tfH39vlOdQ9uQ+l9Gh6iTLOqsCRyszpYPqIBwi1NMLY2Ej8PpVU7ftnFWouHZ9YKS7nAEiMoowhTu/7cCIVwZlAy3AySTuKxPMVj9LORqC32PVvBHZaMPJ+X1Xyijqg6aq39WyoztkXg3+Xxx5j5eOrK6vO/Lp6ZUxaQilHDXoJkKEJjgIBDZpluss08UPfOgiWAGkW+L4fgUxY0qDLDAEMhyEBAn6KOKVL1JhGTX6GjhWziI94bddSpHKYOEIDzUy4H8BXnKhtnyQV6ELS65C2hj9D0IMBTj7edCF1poJy0QfdK0cuXgMvxHLeUO5uc2YWfbNosvKxqygB9rToy4b22YvNwsZUXsTY6Jt+p9V2OgXSKfB5VPeRbjTJL6xqvvUJpQytmII/C9JmSDUtCbYceHj6X9jgigLk20VV6nWHqCTj3utXD6NPAjoycVpLKDlnWEgfVELDIk0gobxUqqSm3jTPEKRPJgxkgPxbwxYumtw++1UY2y35w3WRDc2xYPaWKBCQeZy+mL6ByXp9bWlNvxS3Knb6oZp36/ovGnf2pGvdQKCAQEAyKpipz2lIUySDyE0avVWAmQb2tWGKXALPohzj7AwkcfEg2GuwoC6GyVE2sTJD1HRazIjOKn3yQORg2uOPeG7sx7EKHxSxCKDrbPawkvLCq8JYSy9TLvhqKUVVGYPqMBzu2POSLEA81QXas+aYjKOFWA2Zrjq26zV9ey3+6Lc6WULePgRQybU8+RHJc6fdjUCCfUxgOrUO2IQOuTJ+FsDpVnrMUGlokmWn23OjL4qTL9wGDnWGUs2pjSzNbj3qA0d8iqaiMUyHX/D/VS0wpeT1osNBSm8suvSibYBn+7wbIApbwXUxZaxMv2OHGz3empae4ckvNZs7r8wsI9UwFt8mwKCAQEA4XK6gZkv9t+3YCcSPw2ensLvL/xU7i2bkC9tfTGdjnQfzZXIf5KNdVuj/SerOl2S1s45NMs3ysJbADwRb4ahElD/V71nGzV8fpFTitC20ro9fuX4J0+twmBolHqeH9pmeGTjAeL1rvt6vxs4FkeG/yNft7GdXpXTtEGaObn8Mt0tPY+aB3UnKrnCQoQAlPyGHFrVRX0UEcp6wyyNGhJCNKeNOvqCHTFObhbhO+KWpWSN0MkVHnqaIBnIn1Te8FtvP/iTwXGnKc0YXJUG6+LM6LmOguW6tg8ZqiQeYyyR+e9eCFH4csLzkrTl1GxCxwEsoSLIMm7UDcjttW6tYEghkwKCAQEAmeCO5lCPYImnN5Lu71ZTLmI2OgmjaANTnBBnDbi+hgv61gUCToUIMejSdDCTPfwv61P3TmyIZs0luPGxkiKYHTNqmOE9Vspgz8Mr7fLRMNApESuNvloVIY32XVImj/GEzh4rAfM6F15U1sN8T/EUo6+0B/Glp+9R49QzAfRSE2g48/rGwgf1JVHYfVWFUtAzUA+GdqWdOixo5cCsYJbqpNHfWVZN/bUQnBFIYwUwysnC29D+LUdQEQQ4qOm+gFAOtrWU62zMkXJ4iLt8Ify6kbrvsRXgbhQIzzGS7WH9XDarj0eZciuslr15TLMC1Azadf+cXHLR9gMHA13mT9vYIQKCAQA/DjGv8cKCkAvf7s2hqROGYAs6Jp8yhrsN1tYOwAPLRhtnCs+rLrg17M2vDptLlcRuI/vIElamdTmylRpjUQpX7yObzLO73nfVhpwRJVMdGU394iBIDncQ+JoHfUwgqJskbUM40dvZdyjbrqc/Q/4z+hbZb+oN/GXb8sVKBATPzSDMKQ/xqgisYIw+wmDPStnPsHAaIWOtni47zIgilJzD0WEk78/YjmPbUrboYvWziK5JiRRJFA1rkQqV1c0M+OXixIm+/yS8AksgCeaHr0WUieGcJtjT9uE8vyFop5ykhRiNxy9wGaq6i7IEecsrkd6DqxDHWkwhFuO1bSE83q/VAoIBAEA+RX1i/SUi08p71ggUi9WFMqXmzELp1L3hiEjOc2AklHk2rPxsaTh9+G95BvjhP7fRa/Yga+yDtYuyjO99nedStdNNSg03aPXILl9gs3r2dPiQKUEXZJ3FrH6tkils/8BlpOIRfbkszrdZIKTO9GCdLWQ30dQITDACs8zV/1GFGrHFrqnnMe/NpIFHWNZJ0/WZMi8wgWO6Ik8jHEpQtVXRiXLqy7U6hk170pa4GHOzvftfPElOZZjy9qn7KjdAQqy6spIrAE94OEL+fBgbHQZGLpuTlj6w6YGbMtPU8uo7sXKoc6WOCb68JWft3tejGLDa1946HAWqVM9B/UcneNc=",
 }
+
+func TestConfiguredListenerConflict(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listen, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := config.Init(ioutil.Discard, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Bootstrap = nil
+	c.Discovery.MDNS.Enabled = false
+	c.Experimental.Libp2pStreamMounting = true
+	c.P2P.Listeners = []config.P2PListener{
+		{Protocol: "/p2p/app", Address: "/ip4/127.0.0.1/tcp/10101"},
+		{Protocol: "/p2p/app", Address: "/ip4/127.0.0.1/tcp/10102"},
+	}
+
+	r := &repo.Mock{
+		C: *c,
+		D: syncds.MutexWrap(datastore.NewMapDatastore()),
+	}
+	n, err := NewNode(ctx, &BuildCfg{Repo: r, Online: true, ListenAddrs: []ma.Multiaddr{listen}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	restored := n.P2P.Restored
+	if len(restored) != 2 {
+		t.Fatalf("expected both listeners to be reported, got %+v", restored)
+	}
+	if restored[0].Err != nil {
+		t.Fatalf("expected the first listener to open, got %s", restored[0].Err)
+	}
+	if _, ok := restored[1].Err.(*p2p.ListenerExistsError); !ok {
+		t.Fatalf("expected the second listener to conflict, got %v", restored[1].Err)
+	}
+
+	listeners := n.P2P.Listeners.List()
+	if len(listeners) != 1 || listeners[0].Address.String() != "/ip4/127.0.0.1/tcp/10101" {
+		t.Fatalf("expected only the first listener to be open, got %+v", listeners)
+	}
+}
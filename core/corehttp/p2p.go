@@ -0,0 +1,62 @@
+package corehttp
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	core "github.com/ipfs/go-ipfs/core"
+)
+
+// P2PHealth is the response of the p2p health endpoint
+type P2PHealth struct {
+	// Healthy is true when stream mounting is enabled, the node is online
+	// and all listeners are running
+	Healthy bool
+
+	Enabled   bool
+	Listeners int
+	Streams   int
+
+	// Protocols of the listeners which stopped accepting streams
+	FailedListeners []string `json:",omitempty"`
+}
+
+// P2PHealthOption adds an endpoint reporting the state of libp2p stream
+// mounting, for load balancers and monitoring. It answers 503 when unhealthy.
+func P2PHealthOption(path string) ServeOption {
+	return func(n *core.IpfsNode, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			health := p2pHealth(n)
+
+			w.Header().Set("Content-Type", "application/json")
+			if !health.Healthy {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			json.NewEncoder(w).Encode(health)
+		})
+		return mux, nil
+	}
+}
+
+func p2pHealth(n *core.IpfsNode) *P2PHealth {
+	health := &P2PHealth{
+		Enabled: n.P2PEnabled(),
+	}
+	if !health.Enabled || n.P2P == nil {
+		return health
+	}
+
+	listeners := n.P2P.Listeners.List()
+	health.Listeners = len(listeners)
+	health.Streams = len(n.P2P.Streams.Snapshot())
+
+	for _, l := range listeners {
+		if !l.Running() {
+			health.FailedListeners = append(health.FailedListeners, l.Protocol)
+		}
+	}
+
+	health.Healthy = n.OnlineMode() && len(health.FailedListeners) == 0
+	return health
+}
@@ -0,0 +1,42 @@
+package corehttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestP2PHealthDisabled(t *testing.T) {
+	n, err := newNodeWithMockNamesys(mockNamesys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dh := &delegatedHandler{}
+	ts := httptest.NewServer(dh)
+	defer ts.Close()
+
+	dh.Handler, err = makeHandler(n, ts.Listener, P2PHealthOption("/p2p/health"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get(ts.URL + "/p2p/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, res.StatusCode)
+	}
+
+	var health P2PHealth
+	if err := json.NewDecoder(res.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	if health.Enabled || health.Healthy {
+		t.Fatalf("expected stream mounting to be reported disabled, got %+v", health)
+	}
+}
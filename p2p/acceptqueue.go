@@ -0,0 +1,91 @@
+package p2p
+
+import (
+	"fmt"
+
+	manet "gx/ipfs/QmRK2LxanhK2gZq6k6R7vk5ZoYZk8ULSSTB7FzDsMUX6CB/go-multiaddr-net"
+)
+
+// QueuePolicy decides what happens to a connection accepted by an on-demand
+// listener while its accept queue is full
+type QueuePolicy int
+
+const (
+	// QueueBlock stops accepting until there is room in the queue, leaving
+	// new connections in the kernel backlog
+	QueueBlock QueuePolicy = iota
+	// QueueDropNewest closes the connection which was just accepted
+	QueueDropNewest
+	// QueueDropOldest closes the connection which waited the longest, to
+	// make room for the new one
+	QueueDropOldest
+)
+
+// ParseQueuePolicy parses the block, drop-newest and drop-oldest policy names
+func ParseQueuePolicy(s string) (QueuePolicy, error) {
+	switch s {
+	case "", "block":
+		return QueueBlock, nil
+	case "drop-newest":
+		return QueueDropNewest, nil
+	case "drop-oldest":
+		return QueueDropOldest, nil
+	default:
+		return QueueBlock, fmt.Errorf("invalid queue policy %q, expected block, drop-newest or drop-oldest", s)
+	}
+}
+
+func (p QueuePolicy) String() string {
+	switch p {
+	case QueueBlock:
+		return "block"
+	case QueueDropNewest:
+		return "drop-newest"
+	case QueueDropOldest:
+		return "drop-oldest"
+	default:
+		return "unknown"
+	}
+}
+
+// enqueue hands an accepted connection to the dial worker following the
+// policy when the queue is full. It returns false if quit was closed while
+// blocking, the connection is closed then. Only one goroutine may enqueue.
+func (p QueuePolicy) enqueue(queue chan manet.Conn, c manet.Conn, quit <-chan struct{}) bool {
+	switch p {
+	case QueueDropNewest:
+		select {
+		case queue <- c:
+		default:
+			log.Debugf("p2p: accept queue full, dropping connection from %s", c.RemoteMultiaddr())
+			c.Close()
+		}
+		return true
+
+	case QueueDropOldest:
+		for {
+			select {
+			case queue <- c:
+				return true
+			default:
+			}
+
+			// the dial worker may have emptied the queue in the meantime
+			select {
+			case old := <-queue:
+				log.Debugf("p2p: accept queue full, dropping connection from %s", old.RemoteMultiaddr())
+				old.Close()
+			default:
+			}
+		}
+
+	default:
+		select {
+		case queue <- c:
+			return true
+		case <-quit:
+			c.Close()
+			return false
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package p2p
+
+import (
+	"testing"
+
+	manet "gx/ipfs/QmRK2LxanhK2gZq6k6R7vk5ZoYZk8ULSSTB7FzDsMUX6CB/go-multiaddr-net"
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+)
+
+type queuedConn struct {
+	manet.Conn
+	id     int
+	closed bool
+}
+
+func (c *queuedConn) RemoteMultiaddr() ma.Multiaddr { return nil }
+
+func (c *queuedConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestParseQueuePolicy(t *testing.T) {
+	for _, name := range []string{"block", "drop-newest", "drop-oldest"} {
+		p, err := ParseQueuePolicy(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.String() != name {
+			t.Fatalf("expected %q, got %q", name, p)
+		}
+	}
+
+	if p, err := ParseQueuePolicy(""); err != nil || p != QueueBlock {
+		t.Fatalf("expected the default policy to block, got %s, %v", p, err)
+	}
+	if _, err := ParseQueuePolicy("drop-all"); err == nil {
+		t.Fatal("expected an error for an unknown policy")
+	}
+}
+
+func TestQueuePolicyEnqueue(t *testing.T) {
+	cases := []struct {
+		policy  QueuePolicy
+		queued  []int
+		dropped []int
+	}{
+		{QueueDropNewest, []int{0, 1}, []int{2, 3}},
+		{QueueDropOldest, []int{2, 3}, []int{0, 1}},
+	}
+
+	for _, c := range cases {
+		queue := make(chan manet.Conn, 2)
+		conns := make([]*queuedConn, 4)
+		for i := range conns {
+			conns[i] = &queuedConn{id: i}
+			if !c.policy.enqueue(queue, conns[i], nil) {
+				t.Fatalf("%s: enqueue failed", c.policy)
+			}
+		}
+		close(queue)
+
+		var queued []int
+		for conn := range queue {
+			queued = append(queued, conn.(*queuedConn).id)
+		}
+		if len(queued) != len(c.queued) || queued[0] != c.queued[0] || queued[1] != c.queued[1] {
+			t.Fatalf("%s: expected %v to be queued, got %v", c.policy, c.queued, queued)
+		}
+		for _, i := range c.dropped {
+			if !conns[i].closed {
+				t.Fatalf("%s: expected connection %d to be closed", c.policy, i)
+			}
+		}
+		for _, i := range c.queued {
+			if conns[i].closed {
+				t.Fatalf("%s: connection %d was queued but closed", c.policy, i)
+			}
+		}
+	}
+}
+
+func TestQueuePolicyBlock(t *testing.T) {
+	queue := make(chan manet.Conn, 1)
+	quit := make(chan struct{})
+
+	if !QueueBlock.enqueue(queue, &queuedConn{}, quit) {
+		t.Fatal("enqueue failed")
+	}
+
+	close(quit)
+	blocked := &queuedConn{id: 1}
+	if QueueBlock.enqueue(queue, blocked, quit) {
+		t.Fatal("expected enqueue to a full queue to give up on quit")
+	}
+	if !blocked.closed {
+		t.Fatal("expected the connection to be closed")
+	}
+}
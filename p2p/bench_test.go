@@ -0,0 +1,91 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	manet "gx/ipfs/QmRK2LxanhK2gZq6k6R7vk5ZoYZk8ULSSTB7FzDsMUX6CB/go-multiaddr-net"
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	mocknet "gx/ipfs/QmY6iAoG9DVgZwh5ZRcQEpa2uErAe1Hbei8qXPCjpDS9Ge/go-libp2p/p2p/net/mock"
+)
+
+// BenchmarkForwardThroughput measures the data echoed through a forward
+// between two peers: a connection to the dial listener of one peer, a stream
+// over mocknet, and the listener of the other peer forwarding to an echo
+// service. Each op is a payload sent and received back.
+func BenchmarkForwardThroughput(b *testing.B) {
+	for _, size := range []int{1 << 10, 32 << 10, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			benchmarkForwardThroughput(b, size)
+		})
+	}
+}
+
+func benchmarkForwardThroughput(b *testing.B, size int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h1, err := mn.GenPeer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	h2, err := mn.GenPeer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		b.Fatal(err)
+	}
+
+	echo := startEcho(b)
+	defer echo.Close()
+
+	server := NewP2P(h2.ID(), h2, h2.Peerstore())
+	if _, err := server.NewListener(ctx, "/p2p/bench", echo.Multiaddr(), ListenerOpts{}); err != nil {
+		b.Fatal(err)
+	}
+
+	client := NewP2P(h1.ID(), h1, h1.Peerstore())
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	listenerInfo, err := client.Dial(ctx, nil, h2.ID(), "/p2p/bench", bindAddr, DialOpts{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listenerInfo.Closer.Close()
+
+	c, err := manet.Dial(listenerInfo.Address)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+
+	payload := make([]byte, size)
+	buf := make([]byte, size)
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	written := make(chan error, 1)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := c.Write(payload); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := io.ReadFull(c, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := <-written; err != nil {
+		b.Fatal(err)
+	}
+}
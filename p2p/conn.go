@@ -0,0 +1,91 @@
+package p2p
+
+import (
+	gonet "net"
+
+	manet "gx/ipfs/QmRK2LxanhK2gZq6k6R7vk5ZoYZk8ULSSTB7FzDsMUX6CB/go-multiaddr-net"
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+)
+
+// halfConn is a manet.Conn which keeps the net.Conn it wraps at hand.
+// go-multiaddr-net embeds the net.Conn in a struct, which hides its
+// CloseWrite.
+type halfConn struct {
+	manet.Conn
+	nc gonet.Conn
+}
+
+func wrapConn(nc gonet.Conn) (manet.Conn, error) {
+	c, err := manet.WrapNetConn(nc)
+	if err != nil {
+		return nil, err
+	}
+	return &halfConn{Conn: c, nc: nc}, nil
+}
+
+func (c *halfConn) CloseWrite() error {
+	return forwardCloseWrite(c.nc)
+}
+
+// dial connects to addr like manet.Dial, the connection can be closed for
+// writing if its transport supports it
+func dial(addr ma.Multiaddr) (manet.Conn, error) {
+	network, host, err := manet.DialArgs(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	nc, err := gonet.Dial(network, host)
+	if err != nil {
+		return nil, err
+	}
+	c, err := wrapConn(nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// halfListener is a manet.Listener accepting halfConns
+type halfListener struct {
+	manet.Listener
+	nl gonet.Listener
+}
+
+func wrapListener(nl gonet.Listener) (manet.Listener, error) {
+	l, err := manet.WrapNetListener(nl)
+	if err != nil {
+		nl.Close()
+		return nil, err
+	}
+	return &halfListener{Listener: l, nl: nl}, nil
+}
+
+func (l *halfListener) Accept() (manet.Conn, error) {
+	nc, err := l.nl.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c, err := wrapConn(nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// netListen binds addr like manet.Listen, the connections it accepts can be
+// closed for writing if their transport supports it
+func netListen(addr ma.Multiaddr) (manet.Listener, error) {
+	network, host, err := manet.DialArgs(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	nl, err := gonet.Listen(network, host)
+	if err != nil {
+		return nil, err
+	}
+	return wrapListener(nl)
+}
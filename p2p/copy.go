@@ -0,0 +1,72 @@
+package p2p
+
+import (
+	"io"
+)
+
+// size of the buffer of each copy loop, the same as io.Copy uses
+const copyBufferSize = 32 * 1024
+
+// number of temporary write errors in a row, without any byte written in
+// between, after which copyStream gives up
+const maxWriteRetries = 5
+
+type temporary interface {
+	Temporary() bool
+}
+
+// copyStream copies src to dst until src returns EOF or an error occurs. A
+// buffer read from src is always written out completely, continuing from the
+// position of a short write, so wrappers of dst which interrupt writes, like
+// deadlines or throttling, never cause data to be lost or sent twice.
+func copyStream(dst io.Writer, src io.Reader) (int64, error) {
+	buf := make([]byte, copyBufferSize)
+	var written int64
+	for {
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			n, err := writeFull(dst, buf[:nr])
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// writeFull writes all of b to w, retrying after short writes and temporary
+// errors
+func writeFull(w io.Writer, b []byte) (int, error) {
+	pos := 0
+	retries := 0
+	for pos < len(b) {
+		n, err := w.Write(b[pos:])
+		if n < 0 || n > len(b)-pos {
+			return pos, io.ErrShortWrite
+		}
+		pos += n
+		if n > 0 {
+			retries = 0
+		}
+
+		if err != nil {
+			if t, ok := err.(temporary); !ok || !t.Temporary() || retries >= maxWriteRetries {
+				return pos, err
+			}
+			retries++
+			continue
+		}
+		if n == 0 {
+			// a writer making no progress without an error would keep us
+			// spinning forever
+			return pos, io.ErrShortWrite
+		}
+	}
+	return pos, nil
+}
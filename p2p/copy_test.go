@@ -0,0 +1,116 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// flakyWriter accepts at most max bytes per write, and fails every other
+// write with a timeout, after writing part of it
+type flakyWriter struct {
+	buf   bytes.Buffer
+	max   int
+	calls int
+}
+
+func (w *flakyWriter) Write(b []byte) (int, error) {
+	w.calls++
+	n := len(b)
+	if n > w.max {
+		n = w.max
+	}
+	if w.calls%2 == 0 {
+		n /= 2
+		w.buf.Write(b[:n])
+		return n, timeoutError{}
+	}
+	w.buf.Write(b[:n])
+	return n, nil
+}
+
+// stuckWriter never makes progress
+type stuckWriter struct {
+	err   error
+	calls int
+}
+
+func (w *stuckWriter) Write(b []byte) (int, error) {
+	w.calls++
+	return 0, w.err
+}
+
+func TestCopyStreamShortWrites(t *testing.T) {
+	data := make([]byte, 3*copyBufferSize+123)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, max := range []int{1, 7, 1000, copyBufferSize} {
+		w := &flakyWriter{max: max}
+		n, err := copyStream(w, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("max %d: %s", max, err)
+		}
+		if n != int64(len(data)) {
+			t.Fatalf("max %d: expected %d bytes copied, got %d", max, len(data), n)
+		}
+		if !bytes.Equal(w.buf.Bytes(), data) {
+			t.Fatalf("max %d: data was lost or duplicated", max)
+		}
+	}
+}
+
+func TestCopyStreamWriteError(t *testing.T) {
+	errBroken := errors.New("broken pipe")
+	w := &stuckWriter{err: errBroken}
+	if _, err := copyStream(w, bytes.NewReader([]byte("hello"))); err != errBroken {
+		t.Fatalf("expected %v, got %v", errBroken, err)
+	}
+	if w.calls != 1 {
+		t.Fatalf("expected a permanent error not to be retried, got %d writes", w.calls)
+	}
+}
+
+func TestCopyStreamStuck(t *testing.T) {
+	w := &stuckWriter{err: timeoutError{}}
+	if _, err := copyStream(w, bytes.NewReader([]byte("hello"))); err != (timeoutError{}) {
+		t.Fatalf("expected the timeout, got %v", err)
+	}
+	if w.calls != maxWriteRetries+1 {
+		t.Fatalf("expected %d writes, got %d", maxWriteRetries+1, w.calls)
+	}
+
+	w = &stuckWriter{}
+	if _, err := copyStream(w, bytes.NewReader([]byte("hello"))); err != io.ErrShortWrite {
+		t.Fatalf("expected %v, got %v", io.ErrShortWrite, err)
+	}
+}
+
+// failingReader returns data along with an error
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	return copy(b, r.data), r.err
+}
+
+func TestCopyStreamReadError(t *testing.T) {
+	errReset := errors.New("stream reset")
+	buf := new(bytes.Buffer)
+	n, err := copyStream(buf, &failingReader{data: []byte("last"), err: errReset})
+	if err != errReset {
+		t.Fatalf("expected %v, got %v", errReset, err)
+	}
+	if n != 4 || buf.String() != "last" {
+		t.Fatalf("expected the data read along with the error to be written, got %q", buf)
+	}
+}
@@ -0,0 +1,47 @@
+package p2p
+
+import (
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	net "gx/ipfs/QmXoz9o2PT3tEzf7hicegwex5UgVP54n3k82K7jrWFyN86/go-libp2p-net"
+	peer "gx/ipfs/QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74/go-libp2p-peer"
+)
+
+// ResetStreamsOnDisconnect makes the node reset the streams of a remote peer
+// as soon as it is no longer connected to it, instead of waiting for the
+// next read or write on them to fail.
+func (p2p *P2P) ResetStreamsOnDisconnect() {
+	p2p.peerHost.Network().Notify((*disconnectNotifiee)(p2p))
+}
+
+// resetPeerStreams resets all streams with the given remote peer
+func (p2p *P2P) resetPeerStreams(p peer.ID) {
+	for _, s := range p2p.Streams.Snapshot() {
+		if s.RemotePeer != p {
+			continue
+		}
+		log.Debugf("p2p: resetting stream %d, peer %s disconnected", s.HandlerID, p.Pretty())
+		s.Reset()
+	}
+}
+
+type disconnectNotifiee P2P
+
+func (nn *disconnectNotifiee) p2p() *P2P {
+	return (*P2P)(nn)
+}
+
+func (nn *disconnectNotifiee) Disconnected(n net.Network, v net.Conn) {
+	p := v.RemotePeer()
+
+	// the peer may still be reachable over another connection
+	if n.Connectedness(p) == net.Connected {
+		return
+	}
+	go nn.p2p().resetPeerStreams(p)
+}
+
+func (nn *disconnectNotifiee) Connected(n net.Network, v net.Conn)       {}
+func (nn *disconnectNotifiee) OpenedStream(n net.Network, v net.Stream)  {}
+func (nn *disconnectNotifiee) ClosedStream(n net.Network, v net.Stream)  {}
+func (nn *disconnectNotifiee) Listen(n net.Network, a ma.Multiaddr)      {}
+func (nn *disconnectNotifiee) ListenClose(n net.Network, a ma.Multiaddr) {}
@@ -0,0 +1,59 @@
+package p2p
+
+import (
+	"context"
+	gonet "net"
+	"testing"
+	"time"
+
+	mocknet "gx/ipfs/QmY6iAoG9DVgZwh5ZRcQEpa2uErAe1Hbei8qXPCjpDS9Ge/go-libp2p/p2p/net/mock"
+)
+
+func TestResetStreamsOnDisconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h1, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mn.ConnectPeers(h1.ID(), h2.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h1.ID(), h1, h1.Peerstore())
+	p2p.ResetStreamsOnDisconnect()
+
+	// the stream endpoints aren't tied to the connection, only the
+	// notification can tear it down
+	local, _ := gonet.Pipe()
+	remote, _ := gonet.Pipe()
+	r := &testRemote{Conn: remote}
+
+	s := NewStream(local, r, "/p2p/test", DirOutbound)
+	s.RemotePeer = h2.ID()
+	s.Registry = &p2p.Streams
+	p2p.Streams.Register(s)
+	s.startStreaming()
+
+	if err := mn.DisconnectPeers(h1.ID(), h2.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stream wasn't reset after the peer disconnected")
+	}
+	if len(p2p.Streams.Snapshot()) != 0 {
+		t.Fatal("stream wasn't deregistered")
+	}
+}
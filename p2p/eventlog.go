@@ -0,0 +1,76 @@
+package p2p
+
+import (
+	"encoding/json"
+	"strconv"
+
+	peer "gx/ipfs/QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74/go-libp2p-peer"
+)
+
+// Names of the events logged with StreamRegistry.JSONLog
+const (
+	EventStreamOpened = "stream_opened"
+	EventStreamClosed = "stream_closed"
+	EventDialFailed   = "dial_failed"
+)
+
+// Event is a lifecycle event logged as a JSON object with
+// StreamRegistry.JSONLog. The field names are meant for log pipelines and
+// don't change between events, fields which don't apply are left out.
+type Event struct {
+	Event string `json:"event"`
+
+	// StreamID is the HandlerID of the stream, as a decimal string like in
+	// the JSON output of the commands
+	StreamID string `json:"stream_id,omitempty"`
+
+	Protocol string      `json:"protocol,omitempty"`
+	Peer     string      `json:"peer,omitempty"`
+	Bytes    *EventBytes `json:"bytes,omitempty"`
+
+	// Error is why a stream was reset or a dial failed
+	Error string `json:"error,omitempty"`
+}
+
+// EventBytes are the bytes a closed stream received and sent
+type EventBytes struct {
+	In  uint64 `json:"in"`
+	Out uint64 `json:"out"`
+}
+
+// logJSON writes the JSON objects of the events, tests replace it
+var logJSON = log.Info
+
+func (c *StreamRegistry) logEvent(ev *Event) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		log.Errorf("p2p: encoding %s event: %s", ev.Event, err)
+		return
+	}
+	logJSON(string(data))
+}
+
+func streamEvent(name string, s *StreamInfo) *Event {
+	return &Event{
+		Event:    name,
+		StreamID: strconv.FormatUint(s.HandlerID, 10),
+		Protocol: s.Protocol,
+		Peer:     s.RemotePeer.Pretty(),
+	}
+}
+
+// logDialFailed logs a stream to the peer which couldn't be opened for the
+// listener, as a JSON event if enabled. Otherwise the callers log it in
+// their own words.
+func (p2p *P2P) logDialFailed(listenerInfo *ListenerInfo, p peer.ID, err error) bool {
+	if !p2p.Streams.JSONLog {
+		return false
+	}
+	p2p.Streams.logEvent(&Event{
+		Event:    EventDialFailed,
+		Protocol: listenerInfo.Protocol,
+		Peer:     p.Pretty(),
+		Error:    err.Error(),
+	})
+	return true
+}
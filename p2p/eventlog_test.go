@@ -0,0 +1,104 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	manet "gx/ipfs/QmRK2LxanhK2gZq6k6R7vk5ZoYZk8ULSSTB7FzDsMUX6CB/go-multiaddr-net"
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	mocknet "gx/ipfs/QmY6iAoG9DVgZwh5ZRcQEpa2uErAe1Hbei8qXPCjpDS9Ge/go-libp2p/p2p/net/mock"
+)
+
+func TestJSONLog(t *testing.T) {
+	events := make(chan map[string]interface{}, 16)
+	logJSON = func(args ...interface{}) {
+		ev := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(fmt.Sprint(args...)), &ev); err != nil {
+			t.Errorf("expected a JSON object, got %v: %s", args, err)
+		}
+		events <- ev
+	}
+	defer func() { logJSON = log.Info }()
+
+	next := func() map[string]interface{} {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected an event")
+			return nil
+		}
+	}
+	hasFields := func(ev map[string]interface{}, fields ...string) {
+		for _, f := range fields {
+			if _, ok := ev[f]; !ok {
+				t.Fatalf("expected field %q in %s event %v", f, ev["event"], ev)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h.ID(), h, h.Peerstore())
+	p2p.Streams.JSONLog = true
+
+	echo := startEcho(t)
+	defer echo.Close()
+	if _, err := p2p.NewListener(ctx, "/p2p/echo", echo.Multiaddr(), ListenerOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	if _, err := p2p.Dial(ctx, nil, h.ID(), "/p2p/missing", bindAddr, DialOpts{}); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	ev := next()
+	if ev["event"] != EventDialFailed {
+		t.Fatalf("expected a %s event, got %v", EventDialFailed, ev)
+	}
+	hasFields(ev, "protocol", "peer", "error")
+
+	listenerInfo, err := p2p.Dial(ctx, nil, h.ID(), "/p2p/echo", bindAddr, DialOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := manet.Dial(listenerInfo.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoRoundTrip(t, c, "hello")
+	c.Close()
+
+	// the inbound and the outbound stream of the self dial
+	var opened, closed int
+	for opened+closed < 4 {
+		ev := next()
+		switch ev["event"] {
+		case EventStreamOpened:
+			opened++
+			hasFields(ev, "stream_id", "protocol", "peer")
+		case EventStreamClosed:
+			closed++
+			hasFields(ev, "stream_id", "protocol", "peer", "bytes")
+			bytes := ev["bytes"].(map[string]interface{})
+			if bytes["in"] != float64(5) || bytes["out"] != float64(5) {
+				t.Fatalf("expected 5 bytes in and out, got %v", bytes)
+			}
+		default:
+			t.Fatalf("unexpected event %v", ev)
+		}
+	}
+	if opened != 2 || closed != 2 {
+		t.Fatalf("expected 2 streams opened and closed, got %d and %d", opened, closed)
+	}
+}
@@ -0,0 +1,172 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	net "gx/ipfs/QmXoz9o2PT3tEzf7hicegwex5UgVP54n3k82K7jrWFyN86/go-libp2p-net"
+	peer "gx/ipfs/QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74/go-libp2p-peer"
+	pstore "gx/ipfs/QmdeiKhUy1TVGBaKxt7y1QmBDLBdisSrLJ1x58Eoj4PXUh/go-libp2p-peerstore"
+)
+
+// AddrFamily is the IP address family to prefer when connecting to a peer
+type AddrFamily int
+
+const (
+	// FamilyAny lets the swarm pick any of the peer's addresses
+	FamilyAny AddrFamily = iota
+	// FamilyIP4 prefers the peer's IPv4 addresses
+	FamilyIP4
+	// FamilyIP6 prefers the peer's IPv6 addresses
+	FamilyIP6
+)
+
+// ParseAddrFamily parses the ip4 and ip6 family names, an empty string means
+// no preference
+func ParseAddrFamily(s string) (AddrFamily, error) {
+	switch s {
+	case "":
+		return FamilyAny, nil
+	case "ip4":
+		return FamilyIP4, nil
+	case "ip6":
+		return FamilyIP6, nil
+	default:
+		return FamilyAny, fmt.Errorf("invalid address family %q, expected ip4 or ip6", s)
+	}
+}
+
+func (f AddrFamily) String() string {
+	switch f {
+	case FamilyIP4:
+		return "ip4"
+	case FamilyIP6:
+		return "ip6"
+	default:
+		return ""
+	}
+}
+
+// matches returns whether the address starts with an IP of the family
+func (f AddrFamily) matches(a ma.Multiaddr) bool {
+	protos := a.Protocols()
+	if len(protos) == 0 {
+		return false
+	}
+	switch f {
+	case FamilyIP4:
+		return protos[0].Code == ma.P_IP4
+	case FamilyIP6:
+		return protos[0].Code == ma.P_IP6
+	default:
+		return true
+	}
+}
+
+// FilteredPeerstore wraps the peerstore the network dials from, so that
+// addresses of a peer can be hidden from it for the duration of a dial. The
+// addresses and their TTLs stay in the wrapped peerstore untouched.
+type FilteredPeerstore struct {
+	pstore.Peerstore
+
+	lk      sync.Mutex
+	filters map[peer.ID][]*addrFilter
+}
+
+type addrFilter struct {
+	keep func(ma.Multiaddr) bool
+}
+
+// NewFilteredPeerstore wraps ps, which the network should be given instead
+// of ps for connectPreferring to have an effect
+func NewFilteredPeerstore(ps pstore.Peerstore) *FilteredPeerstore {
+	return &FilteredPeerstore{
+		Peerstore: ps,
+		filters:   make(map[peer.ID][]*addrFilter),
+	}
+}
+
+// Addrs returns the addresses of the peer no dial in progress hides
+func (ps *FilteredPeerstore) Addrs(p peer.ID) []ma.Multiaddr {
+	addrs := ps.Peerstore.Addrs(p)
+
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	for _, f := range ps.filters[p] {
+		kept := addrs[:0:0]
+		for _, a := range addrs {
+			if f.keep(a) {
+				kept = append(kept, a)
+			}
+		}
+		addrs = kept
+	}
+	return addrs
+}
+
+// hide hides the addresses of the peer keep rejects until the returned
+// function is called
+func (ps *FilteredPeerstore) hide(p peer.ID, keep func(ma.Multiaddr) bool) func() {
+	f := &addrFilter{keep: keep}
+
+	ps.lk.Lock()
+	ps.filters[p] = append(ps.filters[p], f)
+	ps.lk.Unlock()
+
+	return func() {
+		ps.lk.Lock()
+		defer ps.lk.Unlock()
+
+		fs := ps.filters[p]
+		for i := range fs {
+			if fs[i] == f {
+				fs = append(fs[:i:i], fs[i+1:]...)
+				break
+			}
+		}
+		if len(fs) == 0 {
+			delete(ps.filters, p)
+		} else {
+			ps.filters[p] = fs
+		}
+	}
+}
+
+// connectPreferring connects to the peer over the addresses of the preferred
+// family first, and over all of its addresses if that fails.
+//
+// The host offers no way to pick addresses for a single dial, so the other
+// addresses are hidden while dialing when the peerstore of P2P is a
+// FilteredPeerstore, and the preference is ignored otherwise. This is
+// best-effort: a connection which already exists is used whatever its
+// family, and other dials of the peer see the same addresses meanwhile.
+func (p2p *P2P) connectPreferring(ctx context.Context, p peer.ID, family AddrFamily) error {
+	fps, ok := p2p.peerstore.(*FilteredPeerstore)
+	if !ok || family == FamilyAny || p2p.peerHost.Network().Connectedness(p) == net.Connected {
+		return p2p.connect(ctx, p)
+	}
+
+	var preferred, others int
+	for _, a := range fps.Peerstore.Addrs(p) {
+		if family.matches(a) {
+			preferred++
+		} else {
+			others++
+		}
+	}
+	if preferred == 0 || others == 0 {
+		return p2p.connect(ctx, p)
+	}
+
+	restore := fps.hide(p, family.matches)
+	err := p2p.connect(ctx, p)
+	restore()
+	if err == nil {
+		return nil
+	}
+
+	log.Debugf("p2p: connecting to %s over %s failed, trying all addresses: %s", p.Pretty(), family, err)
+	return p2p.connect(ctx, p)
+}
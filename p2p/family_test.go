@@ -0,0 +1,115 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	mocknet "gx/ipfs/QmY6iAoG9DVgZwh5ZRcQEpa2uErAe1Hbei8qXPCjpDS9Ge/go-libp2p/p2p/net/mock"
+	peer "gx/ipfs/QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74/go-libp2p-peer"
+	pstore "gx/ipfs/QmdeiKhUy1TVGBaKxt7y1QmBDLBdisSrLJ1x58Eoj4PXUh/go-libp2p-peerstore"
+)
+
+func TestParseAddrFamily(t *testing.T) {
+	for _, name := range []string{"", "ip4", "ip6"} {
+		f, err := ParseAddrFamily(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.String() != name {
+			t.Fatalf("expected %q, got %q", name, f)
+		}
+	}
+
+	if _, err := ParseAddrFamily("ipx"); err == nil {
+		t.Fatal("expected an error for an unknown family")
+	}
+}
+
+func TestAddrFamilyMatches(t *testing.T) {
+	ip4, err := ma.NewMultiaddr("/ip4/1.2.3.4/tcp/4001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip6, err := ma.NewMultiaddr("/ip6/::1/tcp/4001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !FamilyIP4.matches(ip4) || FamilyIP4.matches(ip6) {
+		t.Fatal("ip4 should only match IPv4 addresses")
+	}
+	if !FamilyIP6.matches(ip6) || FamilyIP6.matches(ip4) {
+		t.Fatal("ip6 should only match IPv6 addresses")
+	}
+	if !FamilyAny.matches(ip4) || !FamilyAny.matches(ip6) {
+		t.Fatal("any should match all addresses")
+	}
+}
+
+func TestFilteredPeerstoreHide(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := NewFilteredPeerstore(h.Peerstore())
+
+	ip4, _ := ma.NewMultiaddr("/ip4/1.2.3.4/tcp/4001")
+	ip6, _ := ma.NewMultiaddr("/ip6/2001:db8::1/tcp/4001")
+	p := peer.ID("peer")
+	ps.AddAddrs(p, []ma.Multiaddr{ip4, ip6}, pstore.PermanentAddrTTL)
+
+	restore := ps.hide(p, FamilyIP4.matches)
+	if addrs := ps.Addrs(p); len(addrs) != 1 || !addrs[0].Equal(ip4) {
+		t.Fatalf("expected only %s while hiding, got %v", ip4, addrs)
+	}
+	if addrs := h.Peerstore().Addrs(p); len(addrs) != 2 {
+		t.Fatalf("expected the wrapped peerstore to keep both addresses, got %v", addrs)
+	}
+	restore()
+	if addrs := ps.Addrs(p); len(addrs) != 2 {
+		t.Fatalf("expected both addresses once restored, got %v", addrs)
+	}
+}
+
+func TestConnectPreferringKeepsTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h1, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	ps := NewFilteredPeerstore(h1.Peerstore())
+	p2p := NewP2P(h1.ID(), h1, ps)
+
+	ip4, _ := ma.NewMultiaddr("/ip4/1.2.3.4/tcp/4001")
+	ip6, _ := ma.NewMultiaddr("/ip6/2001:db8::1/tcp/4001")
+	ps.ClearAddrs(h2.ID())
+	ps.AddAddrs(h2.ID(), []ma.Multiaddr{ip4, ip6}, pstore.PermanentAddrTTL)
+
+	if err := p2p.connectPreferring(ctx, h2.ID(), FamilyIP4); err != nil {
+		t.Fatal(err)
+	}
+
+	// expiring the permanent addresses leaves none of them behind
+	ps.UpdateAddrs(h2.ID(), pstore.PermanentAddrTTL, 0)
+	for _, a := range ps.Addrs(h2.ID()) {
+		if a.Equal(ip4) || a.Equal(ip6) {
+			t.Fatalf("expected %s to still be permanent", a)
+		}
+	}
+}
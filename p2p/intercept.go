@@ -0,0 +1,119 @@
+package p2p
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+)
+
+// StreamInterceptor hooks into the streams of a protocol, for application
+// protocols which negotiate secondary connections over their main one, like
+// FTP. It is experimental.
+type StreamInterceptor interface {
+	// InterceptStream is called when a stream of the protocol is opened,
+	// before any data is forwarded. It may watch the data of the stream with
+	// ObserveIn and ObserveOut, and open auxiliary forwards with
+	// OpenAuxiliary. Returning an error resets the stream.
+	InterceptStream(p2p *P2P, s *StreamInfo) error
+}
+
+// StreamInterceptorFunc adapts a function to a StreamInterceptor
+type StreamInterceptorFunc func(p2p *P2P, s *StreamInfo) error
+
+// InterceptStream calls f
+func (f StreamInterceptorFunc) InterceptStream(p2p *P2P, s *StreamInfo) error {
+	return f(p2p, s)
+}
+
+// interceptors holds the stream interceptors by protocol
+type interceptors struct {
+	lk     sync.Mutex
+	byProt map[string]StreamInterceptor
+}
+
+// RegisterInterceptor sets the interceptor of the streams of listeners whose
+// main protocol is proto, replacing the previous one. Only streams opened
+// afterwards are intercepted.
+func (p2p *P2P) RegisterInterceptor(proto string, i StreamInterceptor) {
+	p2p.interceptors.lk.Lock()
+	defer p2p.interceptors.lk.Unlock()
+
+	if p2p.interceptors.byProt == nil {
+		p2p.interceptors.byProt = make(map[string]StreamInterceptor)
+	}
+	p2p.interceptors.byProt[proto] = i
+}
+
+// UnregisterInterceptor removes the interceptor of the protocol, if any
+func (p2p *P2P) UnregisterInterceptor(proto string) {
+	p2p.interceptors.lk.Lock()
+	defer p2p.interceptors.lk.Unlock()
+
+	delete(p2p.interceptors.byProt, proto)
+}
+
+func (p2p *P2P) interceptor(proto string) StreamInterceptor {
+	p2p.interceptors.lk.Lock()
+	defer p2p.interceptors.lk.Unlock()
+
+	return p2p.interceptors.byProt[proto]
+}
+
+// OpenAuxiliary binds bindAddr and forwards each connection accepted there
+// over a new stream of proto to the remote peer of s, until s is done. The
+// streams have the priority and dial timeout of the listener of s.
+func (p2p *P2P) OpenAuxiliary(ctx context.Context, s *StreamInfo, proto string, bindAddr ma.Multiaddr) (*ListenerInfo, error) {
+	opts := DialOpts{OnDemand: true}
+	if s.Listener != nil {
+		opts.Priority = s.Listener.Priority
+		opts.DialTimeout = s.Listener.DialTimeout
+	}
+
+	listenerInfo, err := p2p.Dial(ctx, nil, s.RemotePeer, proto, bindAddr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		<-s.Done()
+		listenerInfo.Closer.Close()
+	}()
+	return listenerInfo, nil
+}
+
+// ObserveIn sets fn to be called with the data received from the remote
+// peer, before it is forwarded to the local endpoint. It must be set by an
+// interceptor, fn must neither keep nor modify the data.
+func (s *StreamInfo) ObserveIn(fn func([]byte)) {
+	s.observeIn = fn
+}
+
+// ObserveOut sets fn to be called with the data read from the local endpoint,
+// before it is sent to the remote peer, like ObserveIn
+func (s *StreamInfo) ObserveOut(fn func([]byte)) {
+	s.observeOut = fn
+}
+
+// observe wraps one of the stream endpoints for the copy loops, passing the
+// data read to fn if set
+func observe(r io.Reader, fn func([]byte)) io.Reader {
+	if fn == nil {
+		return r
+	}
+	return &observingReader{r: r, fn: fn}
+}
+
+type observingReader struct {
+	r  io.Reader
+	fn func([]byte)
+}
+
+func (o *observingReader) Read(b []byte) (int, error) {
+	n, err := o.r.Read(b)
+	if n > 0 {
+		o.fn(b[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,172 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	net "gx/ipfs/QmXoz9o2PT3tEzf7hicegwex5UgVP54n3k82K7jrWFyN86/go-libp2p-net"
+	mocknet "gx/ipfs/QmY6iAoG9DVgZwh5ZRcQEpa2uErAe1Hbei8qXPCjpDS9Ge/go-libp2p/p2p/net/mock"
+)
+
+// TestInterceptorAuxiliary uses a protocol where the server announces a data
+// connection with "PASV" on the control stream, like passive FTP
+func TestInterceptorAuxiliary(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h1, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	h2.SetStreamHandler("/p2p/ctrl", func(s net.Stream) {
+		s.Write([]byte("PASV\n"))
+		io.Copy(ioutil.Discard, s)
+		s.Close()
+	})
+	h2.SetStreamHandler("/p2p/data", func(s net.Stream) {
+		s.Write([]byte("hello"))
+		s.Close()
+	})
+
+	p2p := NewP2P(h1.ID(), h1, h1.Peerstore())
+	mem := newMemNet()
+	p2p.ListenFunc = mem.listen
+
+	dataAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/10102")
+	aux := make(chan *ListenerInfo, 1)
+	p2p.RegisterInterceptor("/p2p/ctrl", StreamInterceptorFunc(func(p2p *P2P, s *StreamInfo) error {
+		s.ObserveIn(func(b []byte) {
+			if !bytes.Contains(b, []byte("PASV")) {
+				return
+			}
+			l, err := p2p.OpenAuxiliary(ctx, s, "/p2p/data", dataAddr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			aux <- l
+		})
+		return nil
+	}))
+
+	ctrlAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/10101")
+	listenerInfo, err := p2p.Dial(ctx, nil, h2.ID(), "/p2p/ctrl", ctrlAddr, DialOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl, err := mem.dial(listenerInfo.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(ctrl, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var l *ListenerInfo
+	select {
+	case l = <-aux:
+	case <-time.After(time.Second):
+		t.Fatal("auxiliary forward wasn't opened")
+	}
+
+	data, err := mem.dial(l.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("expected 'hello' over the auxiliary forward, got %q", got)
+	}
+
+	// the auxiliary forward goes away with the control stream
+	ctrl.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		c, err := mem.dial(l.Address)
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("expected the auxiliary forward to be closed with its stream")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInterceptorReject(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h.ID(), h, h.Peerstore())
+	mem := newMemNet()
+	p2p.ListenFunc = mem.listen
+
+	echo := startEcho(t)
+	defer echo.Close()
+	if _, err := p2p.NewListener(ctx, "/p2p/echo", echo.Multiaddr(), ListenerOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	p2p.RegisterInterceptor("/p2p/echo", StreamInterceptorFunc(func(p2p *P2P, s *StreamInfo) error {
+		return errors.New("not today")
+	}))
+
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/10101")
+	listenerInfo, err := p2p.Dial(ctx, nil, h.ID(), "/p2p/echo", bindAddr, DialOpts{OnDemand: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := mem.dial(listenerInfo.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("hello"))
+	if _, err := io.ReadFull(c, make([]byte, 5)); err == nil {
+		t.Fatal("expected the rejected stream to be reset")
+	}
+	c.Close()
+
+	if n := len(p2p.Streams.Snapshot()); n != 0 {
+		t.Fatalf("expected no stream to be registered, got %d", n)
+	}
+
+	// without the interceptor streams are forwarded again
+	p2p.UnregisterInterceptor("/p2p/echo")
+	c, err = mem.dial(listenerInfo.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("hello"))
+	if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+}
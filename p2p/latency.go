@@ -0,0 +1,66 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	ping "gx/ipfs/QmY6iAoG9DVgZwh5ZRcQEpa2uErAe1Hbei8qXPCjpDS9Ge/go-libp2p/p2p/protocol/ping"
+	peer "gx/ipfs/QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74/go-libp2p-peer"
+)
+
+// DefaultLatencyInterval is how often the latency of a stream is measured
+// again when the node doesn't set an interval
+const DefaultLatencyInterval = time.Minute
+
+var errPingFailed = errors.New("ping failed")
+
+// measureLatency pings the remote peer of the stream when it starts, and
+// again every latency interval until the stream is done. Failed pings keep the
+// previous measurement.
+func (p2p *P2P) measureLatency(s *StreamInfo) {
+	interval := p2p.LatencyInterval
+	if interval <= 0 {
+		interval = DefaultLatencyInterval
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-timer.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), p2p.dialTimeout(s.Listener))
+		rtt, err := p2p.ping(ctx, s.RemotePeer)
+		cancel()
+		if err != nil {
+			log.Debugf("%s: measuring latency to %s: %s", s.Protocol, s.RemotePeer.Pretty(), err)
+		} else {
+			atomic.StoreInt64(&s.latency, int64(rtt))
+		}
+
+		timer.Reset(interval)
+	}
+}
+
+// ping measures a single round trip to the peer with the host's ping service
+func (p2p *P2P) ping(ctx context.Context, p peer.ID) (time.Duration, error) {
+	rtts, err := ping.Ping(ctx, p2p.peerHost, p)
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case rtt, ok := <-rtts:
+		if !ok {
+			return 0, errPingFailed
+		}
+		return rtt, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
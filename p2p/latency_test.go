@@ -0,0 +1,70 @@
+package p2p
+
+import (
+	"context"
+	gonet "net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mocknet "gx/ipfs/QmY6iAoG9DVgZwh5ZRcQEpa2uErAe1Hbei8qXPCjpDS9Ge/go-libp2p/p2p/net/mock"
+	ping "gx/ipfs/QmY6iAoG9DVgZwh5ZRcQEpa2uErAe1Hbei8qXPCjpDS9Ge/go-libp2p/p2p/protocol/ping"
+)
+
+func TestMeasureLatency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	mn.SetLinkDefaults(mocknet.LinkOptions{Latency: 10 * time.Millisecond})
+	h1, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	ping.NewPingService(h2)
+
+	p2p := NewP2P(h1.ID(), h1, h1.Peerstore())
+	p2p.LatencyInterval = 50 * time.Millisecond
+
+	local, _ := gonet.Pipe()
+	remote, _ := gonet.Pipe()
+	s := NewStream(local, &testRemote{Conn: remote}, "/p2p/test", DirOutbound)
+	s.RemotePeer = h2.ID()
+	s.Listener = &ListenerInfo{Protocol: "/p2p/test", MeasureLatency: true}
+	s.Registry = &p2p.Streams
+	p2p.Streams.Register(s)
+	s.startStreaming()
+	defer s.Close()
+
+	waitLatency := func() time.Duration {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if rtt := s.Latency(); rtt > 0 {
+				return rtt
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("latency wasn't measured")
+		return 0
+	}
+
+	if s.Latency() != 0 {
+		t.Fatal("expected no latency before it is measured")
+	}
+	go p2p.measureLatency(s)
+
+	if rtt := waitLatency(); rtt < 10*time.Millisecond {
+		t.Fatalf("expected the link latency to be included, got %s", rtt)
+	}
+
+	// the measurement is refreshed for as long as the stream is open
+	atomic.StoreInt64(&s.latency, 0)
+	waitLatency()
+}
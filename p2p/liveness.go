@@ -0,0 +1,56 @@
+package p2p
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLivenessInterval is how often the remote peer of a websocket-friendly
+// stream is pinged when the node doesn't set an interval
+const DefaultLivenessInterval = 30 * time.Second
+
+// livenessFailures is the number of pings in a row the remote peer may fail to
+// answer before its stream is reset
+const livenessFailures = 3
+
+// checkLiveness pings the remote peer of the stream every liveness interval
+// until the stream is done. Websocket sessions may stay quiet for hours, so
+// a peer which went away is noticed by its pings failing rather than by the
+// stream: once livenessFailures pings in a row failed the stream is reset.
+// Answered pings update the latency of the stream.
+func (p2p *P2P) checkLiveness(s *StreamInfo) {
+	interval := p2p.LivenessInterval
+	if interval <= 0 {
+		interval = DefaultLivenessInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failed := 0
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), p2p.dialTimeout(s.Listener))
+		rtt, err := p2p.ping(ctx, s.RemotePeer)
+		cancel()
+		if err == nil {
+			failed = 0
+			atomic.StoreInt64(&s.latency, int64(rtt))
+			continue
+		}
+
+		failed++
+		log.Debugf("%s: pinging %s: %s", s.Protocol, s.RemotePeer.Pretty(), err)
+		if failed >= livenessFailures {
+			log.Infof("%s: resetting stream %d, %s didn't answer %d pings", s.Protocol, s.HandlerID, s.RemotePeer.Pretty(), failed)
+			s.Reset()
+			return
+		}
+	}
+}
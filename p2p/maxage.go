@@ -0,0 +1,20 @@
+package p2p
+
+import "time"
+
+// expireStream closes the stream once it has been open for age. Unlike the
+// idle timeout of on-demand listeners, which only applies to a listener
+// without connections, it doesn't matter how busy the stream is. Clients have to
+// reconnect periodically, which rebalances them when the peer spreads
+// streams over several backends.
+func expireStream(s *StreamInfo, age time.Duration) {
+	timer := time.NewTimer(age)
+	defer timer.Stop()
+
+	select {
+	case <-s.done:
+	case <-timer.C:
+		log.Debugf("%s: closing stream with %s after %s", s.Protocol, s.RemotePeer.Pretty(), age)
+		s.Close()
+	}
+}
@@ -0,0 +1,112 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// ByteCapMode decides which bytes of a stream count toward the MaxBytes of
+// its listener
+type ByteCapMode int
+
+const (
+	// CapCombined counts the bytes of both directions together
+	CapCombined ByteCapMode = iota
+	// CapEither caps each direction on its own
+	CapEither
+)
+
+// ParseByteCapMode parses the combined and either mode names
+func ParseByteCapMode(s string) (ByteCapMode, error) {
+	switch s {
+	case "", "combined":
+		return CapCombined, nil
+	case "either":
+		return CapEither, nil
+	default:
+		return CapCombined, fmt.Errorf("invalid byte cap mode %q, expected combined or either", s)
+	}
+}
+
+func (m ByteCapMode) String() string {
+	switch m {
+	case CapCombined:
+		return "combined"
+	case CapEither:
+		return "either"
+	default:
+		return "unknown"
+	}
+}
+
+// maxBytesError resets a stream which transferred more than its cap
+type maxBytesError struct {
+	max  uint64
+	mode ByteCapMode
+}
+
+func (e *maxBytesError) Error() string {
+	if e.mode == CapEither {
+		return fmt.Sprintf("exceeded the limit of %d bytes in one direction", e.max)
+	}
+	return fmt.Sprintf("exceeded the limit of %d bytes", e.max)
+}
+
+// cappedWriter writes until the bytes counted in used reach max, and fails
+// the write which would go past it after writing the bytes still allowed
+type cappedWriter struct {
+	w    io.Writer
+	used *uint64
+	max  uint64
+	mode ByteCapMode
+}
+
+// cappedWriter wraps w so that the copy loop writing to it fails once the
+// stream transferred more than the MaxBytes of its listener. With CapCombined
+// both directions count against the same budget.
+func (s *StreamInfo) cappedWriter(w io.Writer, n *uint64) io.Writer {
+	l := s.Listener
+	if l == nil || l.MaxBytes == 0 {
+		return w
+	}
+
+	used := &s.capUsedIn
+	if l.MaxBytesMode == CapEither && n == &s.bytesOut {
+		used = &s.capUsedOut
+	}
+	return &cappedWriter{w: w, used: used, max: l.MaxBytes, mode: l.MaxBytesMode}
+}
+
+func (cw *cappedWriter) Write(p []byte) (int, error) {
+	// reserve the bytes up front, the other direction may write meanwhile
+	size := uint64(len(p))
+	used := atomic.AddUint64(cw.used, size)
+
+	allowed := size
+	if used > cw.max {
+		over := used - cw.max
+		if over > size {
+			over = size
+		}
+		allowed -= over
+	}
+
+	var n int
+	var err error
+	if allowed > 0 {
+		n, err = cw.w.Write(p[:allowed])
+	}
+	if uint64(n) < size {
+		// give back what wasn't written, a short write is retried
+		atomic.AddUint64(cw.used, ^(size - uint64(n) - 1))
+	}
+	if err == nil && allowed < size {
+		err = &maxBytesError{max: cw.max, mode: cw.mode}
+	}
+	return n, err
+}
+
+func (cw *cappedWriter) CloseWrite() error {
+	return forwardCloseWrite(cw.w)
+}
@@ -0,0 +1,93 @@
+package p2p
+
+import (
+	gonet "net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseByteCapMode(t *testing.T) {
+	for _, m := range []ByteCapMode{CapCombined, CapEither} {
+		parsed, err := ParseByteCapMode(m.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != m {
+			t.Fatalf("expected %s, got %s", m, parsed)
+		}
+	}
+
+	if _, err := ParseByteCapMode("both"); err == nil {
+		t.Fatal("expected an error for an unknown mode")
+	}
+}
+
+// flood keeps sending data to c and reading what it receives until it fails
+func flood(c gonet.Conn) {
+	go func() {
+		buf := make([]byte, 1000)
+		for {
+			if _, err := c.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 1000)
+		for {
+			if _, err := c.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// newFloodedStream creates a stream with both ends sending data until it is
+// torn down, setup adjusts the stream before it starts
+func newFloodedStream(setup func(s *StreamInfo)) (*StreamInfo, *testRemote) {
+	local, localEnd := gonet.Pipe()
+	remote, remoteEnd := gonet.Pipe()
+	flood(localEnd)
+	flood(remoteEnd)
+
+	r := &testRemote{Conn: remote}
+	s := NewStream(local, r, "/p2p/test", DirInbound)
+	setup(s)
+	s.startStreaming()
+	return s, r
+}
+
+// newCappedStream starts a stream of a listener capped at max bytes, with both
+// ends sending data until it is torn down
+func newCappedStream(max uint64, mode ByteCapMode) (*StreamInfo, *testRemote) {
+	return newFloodedStream(func(s *StreamInfo) {
+		s.Listener = &ListenerInfo{MaxBytes: max, MaxBytesMode: mode}
+	})
+}
+
+func TestStreamMaxBytesCombined(t *testing.T) {
+	s, r := newCappedStream(4500, CapCombined)
+	waitDone(t, s)
+
+	if n := atomic.LoadInt32(&r.resets); n == 0 {
+		t.Fatal("expected the stream to be reset")
+	}
+	if total := s.BytesIn() + s.BytesOut(); total == 0 || total > 4500 {
+		t.Fatalf("expected at most 4500 bytes in both directions, got %d", total)
+	}
+}
+
+func TestStreamMaxBytesEither(t *testing.T) {
+	s, r := newCappedStream(4500, CapEither)
+	waitDone(t, s)
+
+	if n := atomic.LoadInt32(&r.resets); n == 0 {
+		t.Fatal("expected the stream to be reset")
+	}
+	if s.BytesIn() > 4500 || s.BytesOut() > 4500 {
+		t.Fatalf("expected at most 4500 bytes in each direction, got %d in, %d out", s.BytesIn(), s.BytesOut())
+	}
+	if s.BytesIn() != 4500 && s.BytesOut() != 4500 {
+		t.Fatalf("expected one direction to reach the cap, got %d in, %d out", s.BytesIn(), s.BytesOut())
+	}
+}
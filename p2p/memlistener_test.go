@@ -0,0 +1,116 @@
+package p2p
+
+import (
+	"errors"
+	gonet "net"
+	"sync"
+
+	manet "gx/ipfs/QmRK2LxanhK2gZq6k6R7vk5ZoYZk8ULSSTB7FzDsMUX6CB/go-multiaddr-net"
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+)
+
+var errMemRefused = errors.New("connection refused")
+
+// memNet hands out in-memory listeners in place of manet.Listen, so that
+// dial listeners can be tested without OS sockets. Listeners are looked up
+// by the exact address they were bound to.
+type memNet struct {
+	lk        sync.Mutex
+	listeners map[string]*memListener
+}
+
+func newMemNet() *memNet {
+	return &memNet{listeners: make(map[string]*memListener)}
+}
+
+func (n *memNet) listen(addr ma.Multiaddr) (manet.Listener, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+
+	if _, ok := n.listeners[addr.String()]; ok {
+		return nil, errors.New("address already in use")
+	}
+
+	l := &memListener{
+		net:    n,
+		addr:   addr,
+		conns:  make(chan manet.Conn),
+		closed: make(chan struct{}),
+	}
+	n.listeners[addr.String()] = l
+	return l, nil
+}
+
+// dial connects to the listener bound to the address, or fails like a
+// refused connection if there is none
+func (n *memNet) dial(addr ma.Multiaddr) (manet.Conn, error) {
+	n.lk.Lock()
+	l, ok := n.listeners[addr.String()]
+	n.lk.Unlock()
+	if !ok {
+		return nil, errMemRefused
+	}
+
+	client, server := gonet.Pipe()
+	select {
+	case l.conns <- &memConn{Conn: server, laddr: addr}:
+		return &memConn{Conn: client, raddr: addr}, nil
+	case <-l.closed:
+		return nil, errMemRefused
+	}
+}
+
+type memListener struct {
+	net    *memNet
+	addr   ma.Multiaddr
+	conns  chan manet.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *memListener) Accept() (manet.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+
+		l.net.lk.Lock()
+		delete(l.net.listeners, l.addr.String())
+		l.net.lk.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Multiaddr() ma.Multiaddr {
+	return l.addr
+}
+
+func (l *memListener) Addr() gonet.Addr {
+	return memAddr(l.addr.String())
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+// memConn is one end of an in-memory connection
+type memConn struct {
+	gonet.Conn
+	laddr, raddr ma.Multiaddr
+}
+
+func (c *memConn) LocalMultiaddr() ma.Multiaddr {
+	return c.laddr
+}
+
+func (c *memConn) RemoteMultiaddr() ma.Multiaddr {
+	return c.raddr
+}
@@ -0,0 +1,489 @@
+package p2p
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	manet "gx/ipfs/QmRK2LxanhK2gZq6k6R7vk5ZoYZk8ULSSTB7FzDsMUX6CB/go-multiaddr-net"
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	net "gx/ipfs/QmXoz9o2PT3tEzf7hicegwex5UgVP54n3k82K7jrWFyN86/go-libp2p-net"
+	peer "gx/ipfs/QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74/go-libp2p-peer"
+)
+
+// MuxSuffix is appended to the protocol of multiplexed forwards. A stream
+// negotiated with it carries many local connections, each in its own
+// channel.
+const MuxSuffix = "/mux"
+
+// Frames start with a 9 byte header: the channel id and the payload length
+// as big endian uint32s around the frame type.
+const (
+	frameOpen byte = iota
+	frameData
+	frameClose
+	frameReset
+)
+
+const (
+	muxHeaderSize = 9
+
+	// maxFrameSize bounds the payload of a single data frame
+	maxFrameSize = 32 * 1024
+
+	// Number of data frames buffered for a channel. Once a channel's buffer
+	// is full the whole session stops reading until it is drained.
+	channelBuffer = 64
+)
+
+var (
+	errChannelReset  = errors.New("p2p: multiplexed channel reset")
+	errChannelClosed = errors.New("p2p: multiplexed channel closed")
+	errFrameTooLarge = errors.New("p2p: multiplexed frame too large")
+)
+
+// muxSession frames any number of channels over a single stream
+type muxSession struct {
+	rw io.ReadWriteCloser
+
+	// called for channels opened by the other side, nil to refuse them
+	accept func(*muxChannel)
+
+	wlk sync.Mutex
+
+	lk       sync.Mutex
+	channels map[uint32]*muxChannel
+	nextID   uint32
+	err      error
+	done     chan struct{}
+}
+
+func newMuxSession(rw io.ReadWriteCloser, accept func(*muxChannel)) *muxSession {
+	s := &muxSession{
+		rw:       rw,
+		accept:   accept,
+		channels: make(map[uint32]*muxChannel),
+		done:     make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+// openChannel opens a new channel to the other side
+func (s *muxSession) openChannel() (*muxChannel, error) {
+	s.lk.Lock()
+	if s.err != nil {
+		s.lk.Unlock()
+		return nil, s.err
+	}
+	s.nextID++
+	ch := s.newChannelLocked(s.nextID)
+	s.lk.Unlock()
+
+	if err := s.writeFrame(ch.id, frameOpen, nil); err != nil {
+		s.remove(ch.id)
+		return nil, err
+	}
+	return ch, nil
+}
+
+// closed returns whether the underlying stream failed or was closed
+func (s *muxSession) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the underlying stream, failing all channels
+func (s *muxSession) Close() error {
+	return s.rw.Close()
+}
+
+func (s *muxSession) newChannelLocked(id uint32) *muxChannel {
+	ch := &muxChannel{
+		id:        id,
+		session:   s,
+		in:        make(chan []byte, channelBuffer),
+		eof:       make(chan struct{}),
+		localDone: make(chan struct{}),
+	}
+	s.channels[id] = ch
+	return ch
+}
+
+func (s *muxSession) channel(id uint32) *muxChannel {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.channels[id]
+}
+
+func (s *muxSession) remove(id uint32) {
+	s.lk.Lock()
+	delete(s.channels, id)
+	s.lk.Unlock()
+}
+
+func (s *muxSession) writeFrame(id uint32, typ byte, payload []byte) error {
+	frame := make([]byte, muxHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], id)
+	frame[4] = typ
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(payload)))
+	copy(frame[muxHeaderSize:], payload)
+
+	s.wlk.Lock()
+	defer s.wlk.Unlock()
+
+	if s.closed() {
+		return s.err
+	}
+	_, err := s.rw.Write(frame)
+	return err
+}
+
+func (s *muxSession) readLoop() {
+	var hdr [muxHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(s.rw, hdr[:]); err != nil {
+			s.fail(err)
+			return
+		}
+
+		id := binary.BigEndian.Uint32(hdr[0:4])
+		typ := hdr[4]
+		n := binary.BigEndian.Uint32(hdr[5:9])
+		if n > maxFrameSize {
+			s.fail(errFrameTooLarge)
+			return
+		}
+
+		var payload []byte
+		if n > 0 {
+			payload = make([]byte, n)
+			if _, err := io.ReadFull(s.rw, payload); err != nil {
+				s.fail(err)
+				return
+			}
+		}
+
+		switch typ {
+		case frameOpen:
+			s.lk.Lock()
+			_, exists := s.channels[id]
+			var ch *muxChannel
+			if !exists && s.accept != nil {
+				ch = s.newChannelLocked(id)
+			}
+			s.lk.Unlock()
+
+			if ch == nil {
+				s.writeFrame(id, frameReset, nil)
+				continue
+			}
+			go s.accept(ch)
+
+		case frameData:
+			if ch := s.channel(id); ch != nil {
+				ch.push(payload)
+			}
+
+		case frameClose:
+			if ch := s.channel(id); ch != nil {
+				ch.remoteClose(io.EOF)
+			}
+
+		case frameReset:
+			if ch := s.channel(id); ch != nil {
+				ch.remoteClose(errChannelReset)
+				s.remove(id)
+			}
+		}
+	}
+}
+
+// fail tears the session down after the underlying stream failed
+func (s *muxSession) fail(err error) {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	s.lk.Lock()
+	s.err = err
+	channels := s.channels
+	s.channels = make(map[uint32]*muxChannel)
+	s.lk.Unlock()
+
+	close(s.done)
+	s.rw.Close()
+
+	for _, ch := range channels {
+		ch.remoteClose(err)
+	}
+}
+
+// muxChannel is a single local connection carried over a muxSession
+type muxChannel struct {
+	id      uint32
+	session *muxSession
+
+	in  chan []byte
+	buf []byte
+
+	lk           sync.Mutex
+	readErr      error
+	eof          chan struct{}
+	writeClosed  bool
+	localClosed  bool
+	remoteClosed bool
+	localDone    chan struct{}
+}
+
+// push queues data received for the channel, dropping it once the channel
+// was closed locally
+func (c *muxChannel) push(b []byte) {
+	select {
+	case c.in <- b:
+	case <-c.localDone:
+	}
+}
+
+func (c *muxChannel) remoteClose(err error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if c.remoteClosed {
+		return
+	}
+	c.remoteClosed = true
+	c.readErr = err
+	close(c.eof)
+
+	if c.localClosed {
+		c.session.remove(c.id)
+	}
+}
+
+func (c *muxChannel) Read(b []byte) (int, error) {
+	select {
+	case <-c.localDone:
+		return 0, errChannelClosed
+	default:
+	}
+
+	if len(c.buf) == 0 {
+		select {
+		case c.buf = <-c.in:
+		case <-c.localDone:
+			return 0, errChannelClosed
+		case <-c.eof:
+			// data received before the close is still queued
+			select {
+			case c.buf = <-c.in:
+			default:
+				return 0, c.readErr
+			}
+		}
+	}
+
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *muxChannel) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		if err := c.writeErr(); err != nil {
+			return written, err
+		}
+
+		chunk := b
+		if len(chunk) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+		if err := c.session.writeFrame(c.id, frameData, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *muxChannel) writeErr() error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if c.writeClosed {
+		return errChannelClosed
+	}
+	if c.remoteClosed && c.readErr != io.EOF {
+		return c.readErr
+	}
+	return nil
+}
+
+// markClosed marks the channel closed locally, it returns whether the other
+// side still needs to be told that no more data will be sent
+func (c *muxChannel) markClosed() bool {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if c.localClosed {
+		return false
+	}
+	c.localClosed = true
+	close(c.localDone)
+
+	if c.remoteClosed {
+		c.session.remove(c.id)
+	}
+
+	notify := !c.writeClosed
+	c.writeClosed = true
+	return notify
+}
+
+// CloseWrite tells the other side no more data will be sent, data it sends
+// can still be read. The other side reads the data sent so far followed by
+// io.EOF.
+func (c *muxChannel) CloseWrite() error {
+	c.lk.Lock()
+	notify := !c.writeClosed
+	c.writeClosed = true
+	c.lk.Unlock()
+
+	if !notify {
+		return nil
+	}
+	return c.session.writeFrame(c.id, frameClose, nil)
+}
+
+// Close closes the channel in both directions
+func (c *muxChannel) Close() error {
+	if !c.markClosed() {
+		return nil
+	}
+	return c.session.writeFrame(c.id, frameClose, nil)
+}
+
+// Reset aborts the channel in both directions
+func (c *muxChannel) Reset() error {
+	c.markClosed()
+	c.remoteClose(errChannelReset)
+	c.session.remove(c.id)
+	return c.session.writeFrame(c.id, frameReset, nil)
+}
+
+// muxProtocols returns the multiplexed variants of the protocols
+func muxProtocols(protos []string) []string {
+	out := make([]string, len(protos))
+	for i, proto := range protos {
+		out[i] = proto + MuxSuffix
+	}
+	return out
+}
+
+// serveMux forwards each channel of a multiplexed stream to the listener's
+// target address as a stream of its own
+func (p2p *P2P) serveMux(listenerInfo *ListenerInfo, remote net.Stream) {
+	conn := remote.Conn()
+	proto := string(remote.Protocol())
+
+	newMuxSession(remote, func(ch *muxChannel) {
+		if !p2p.allowStream(listenerInfo, conn.RemotePeer()) {
+			atomic.AddUint64(&listenerInfo.RejectedStreams, 1)
+			ch.Reset()
+			return
+		}
+
+		local, target, err := listenerInfo.dialTarget()
+		if err != nil {
+			ch.Reset()
+			return
+		}
+
+		p2p.startStream(listenerInfo, local, target, ch, conn, proto, DirInbound)
+	})
+}
+
+func (p2p *P2P) dialMultiplexed(ctx, setup context.Context, lnet string, listenerInfo *ListenerInfo, peer peer.ID, bindAddr ma.Multiaddr) (*ListenerInfo, error) {
+	switch lnet {
+	case "tcp", "tcp4", "tcp6", "unix":
+		listener, err := p2p.bindDialListener(setup, bindAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		listenerInfo.Address = boundAddr(bindAddr, listener)
+		listenerInfo.Closer = listener
+		listenerInfo.setRunning(true)
+
+		go p2p.acceptMultiplexed(ctx, listenerInfo, listener, peer, p2p.dialListenerOpened(listenerInfo))
+
+	default:
+		return nil, errors.New("unsupported protocol: " + lnet)
+	}
+
+	return listenerInfo, nil
+}
+
+// acceptMultiplexed accepts local connections until the listener is closed,
+// forwarding all of them over a single stream to the peer. The stream is
+// opened with the first connection, and re-opened with the next one if it
+// failed.
+func (p2p *P2P) acceptMultiplexed(ctx context.Context, listenerInfo *ListenerInfo, listener manet.Listener, peer peer.ID, done func()) {
+	defer done()
+	defer listener.Close()
+
+	var session *muxSession
+	var conn net.Conn
+	var proto string
+	defer func() {
+		if session != nil {
+			session.Close()
+		}
+	}()
+
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			listenerInfo.setRunning(false)
+			return
+		}
+
+		if session == nil || session.closed() {
+			remote, err := p2p.newStreamTo(ctx, peer, listenerInfo, muxProtocols(listenerInfo.protocols())...)
+			if err != nil {
+				if !p2p.logDialFailed(listenerInfo, peer, err) {
+					log.Debugf("p2p: multiplexed dial to %s failed: %s", peer.Pretty(), err)
+				}
+				local.Close()
+				continue
+			}
+
+			session = newMuxSession(remote, nil)
+			conn = remote.Conn()
+			proto = string(remote.Protocol())
+		}
+
+		ch, err := session.openChannel()
+		if err != nil {
+			local.Close()
+			continue
+		}
+
+		p2p.startStream(listenerInfo, local, listenerInfo.Addr(), ch, conn, proto, DirOutbound)
+	}
+}
+
+// isMuxProtocol returns whether the protocol is a multiplexed variant
+func isMuxProtocol(proto string) bool {
+	return strings.HasSuffix(proto, MuxSuffix)
+}
@@ -0,0 +1,215 @@
+package p2p
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	gonet "net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newMuxPair(accept func(*muxChannel)) (*muxSession, *muxSession) {
+	a, b := gonet.Pipe()
+	return newMuxSession(a, nil), newMuxSession(b, accept)
+}
+
+func echoChannel(ch *muxChannel) {
+	io.Copy(ch, ch)
+	ch.Close()
+}
+
+func TestMuxInterleavedChannels(t *testing.T) {
+	client, server := newMuxPair(echoChannel)
+	defer client.Close()
+	defer server.Close()
+
+	const channels = 4
+	const chunks = 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, channels)
+	for i := 0; i < channels; i++ {
+		ch, err := client.openChannel()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var sent bytes.Buffer
+		for j := 0; j < chunks; j++ {
+			fmt.Fprintf(&sent, "channel %d chunk %d;", i, j)
+		}
+		// larger than a frame, so it gets split
+		sent.Write(bytes.Repeat([]byte{byte(i)}, maxFrameSize+100))
+		expected := sent.Bytes()
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			data := expected
+			for len(data) > 0 {
+				n := 7 + len(data)%13
+				if n > len(data) {
+					n = len(data)
+				}
+				if _, err := ch.Write(data[:n]); err != nil {
+					errs <- err
+					return
+				}
+				data = data[n:]
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			defer ch.Close()
+
+			got := make([]byte, len(expected))
+			if _, err := io.ReadFull(ch, got); err != nil {
+				errs <- fmt.Errorf("channel %d: %s", i, err)
+				return
+			}
+			if !bytes.Equal(got, expected) {
+				errs <- fmt.Errorf("channel %d: got different data back", i)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestMuxChannelClose(t *testing.T) {
+	received := make(chan string, 1)
+	client, server := newMuxPair(func(ch *muxChannel) {
+		defer ch.Close()
+		fmt.Fprint(ch, "hi")
+
+		// data sent before the close must arrive before the EOF
+		data, err := ioutil.ReadAll(ch)
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		received <- string(data)
+	})
+	defer client.Close()
+	defer server.Close()
+
+	ch, err := client.openChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(ch, greeting); err != nil {
+		t.Fatal(err)
+	}
+	if string(greeting) != "hi" {
+		t.Fatalf("unexpected greeting %q", greeting)
+	}
+
+	ch.Write([]byte("hello"))
+	if err := ch.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-received:
+		if data != "hello" {
+			t.Fatalf("unexpected data %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the other side didn't see the channel closing")
+	}
+
+	if _, err := ch.Write([]byte("x")); err == nil {
+		t.Fatal("expected writing to a closed channel to fail")
+	}
+	if _, err := ch.Read(make([]byte, 1)); err != errChannelClosed {
+		t.Fatalf("expected reading a closed channel to fail, got %v", err)
+	}
+}
+
+func TestMuxChannelCloseWrite(t *testing.T) {
+	client, server := newMuxPair(func(ch *muxChannel) {
+		req, _ := ioutil.ReadAll(ch)
+		fmt.Fprintf(ch, "re: %s", req)
+		ch.Close()
+	})
+	defer client.Close()
+	defer server.Close()
+
+	ch, err := client.openChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch.Write([]byte("ping"))
+	if err := ch.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.Write([]byte("x")); err == nil {
+		t.Fatal("expected writing after CloseWrite to fail")
+	}
+
+	resp, err := ioutil.ReadAll(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "re: ping" {
+		t.Fatalf("expected the response to arrive, got %q", resp)
+	}
+}
+
+func TestMuxChannelRefused(t *testing.T) {
+	a, b := gonet.Pipe()
+	client := newMuxSession(a, nil)
+	server := newMuxSession(b, nil)
+	defer client.Close()
+	defer server.Close()
+
+	ch, err := client.openChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ch.Read(make([]byte, 1)); err != errChannelReset {
+		t.Fatalf("expected the channel to be reset, got %v", err)
+	}
+}
+
+func TestMuxSessionFailure(t *testing.T) {
+	opened := make(chan *muxChannel, 1)
+	client, server := newMuxPair(func(ch *muxChannel) {
+		opened <- ch
+	})
+	defer client.Close()
+
+	ch, err := client.openChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel wasn't accepted")
+	}
+
+	server.Close()
+
+	if _, err := ch.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Fatalf("expected the channel to fail with the session, got %v", err)
+	}
+	if !client.closed() {
+		t.Fatal("expected the session to be closed")
+	}
+	if _, err := client.openChannel(); err == nil {
+		t.Fatal("expected opening a channel on a failed session to fail")
+	}
+}
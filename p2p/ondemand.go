@@ -0,0 +1,324 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	manet "gx/ipfs/QmRK2LxanhK2gZq6k6R7vk5ZoYZk8ULSSTB7FzDsMUX6CB/go-multiaddr-net"
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	peer "gx/ipfs/QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74/go-libp2p-peer"
+)
+
+// DialOpts are the options for Dial
+type DialOpts struct {
+	// OnDemand keeps the local listener open for any number of connections
+	// and only opens a stream to the remote peer once a connection has been
+	// accepted, instead of dialing the peer up front for a single connection.
+	OnDemand bool
+
+	// IdleTimeout makes an on-demand listener dormant after it has had no
+	// active connections for this long, see acceptOnDemand. Its port stays
+	// bound either way. Zero keeps it serving until it is closed.
+	IdleTimeout time.Duration
+
+	// Priority of the dialed streams under the bandwidth limit
+	Priority Priority
+
+	// Fallbacks are protocols to negotiate, in order of preference, when
+	// the remote peer doesn't support the dialed one
+	Fallbacks []string
+
+	// Prefer is the address family tried first when connecting to the
+	// remote peer. It is best-effort, see connectPreferring.
+	Prefer AddrFamily
+
+	// Multiplex forwards all connections accepted by the local listener
+	// over a single stream to the peer, which must have a listener opened
+	// with multiplexing. The listener keeps accepting until it is closed.
+	Multiplex bool
+
+	// AcceptQueue is the number of connections accepted by an on-demand
+	// listener which may wait for their stream. When set, streams are opened
+	// one at a time in the order connections were accepted, instead of all
+	// at once as soon as they are accepted.
+	AcceptQueue int
+
+	// AcceptQueuePolicy applies when the accept queue is full
+	AcceptQueuePolicy QueuePolicy
+
+	// DialTimeout bounds connecting to the peer and opening each stream to
+	// it. Zero means the node's dial timeout applies.
+	DialTimeout time.Duration
+
+	// MeasureLatency pings the remote peer of each stream, see
+	// StreamInfo.Latency
+	MeasureLatency bool
+
+	// MaxConnAge closes each accepted local connection, and its stream, once
+	// it has been open this long, however busy it is. Zero keeps connections
+	// open until either side closes them.
+	MaxConnAge time.Duration
+
+	// MaxBytes resets each stream once it transferred this many bytes,
+	// counted as MaxBytesMode says. Zero means unlimited.
+	MaxBytes     uint64
+	MaxBytesMode ByteCapMode
+
+	// RateLimitUp and RateLimitDown limit the bandwidth of each stream, see
+	// ListenerInfo.RateLimitUp
+	RateLimitUp   int64
+	RateLimitDown int64
+
+	// WebSocketFriendly keeps each stream open both ways until either side
+	// closes it, see ListenerInfo.WebSocketFriendly
+	WebSocketFriendly bool
+
+	// Setup bounds creating the forward, unlike the context given to Dial
+	// which the forward lives on. When it is done before Dial returns, what
+	// was created so far is torn down and Dial fails with its error. Nil
+	// means only the context of Dial applies.
+	Setup context.Context
+}
+
+// setup returns the context bounding the creation of the forward
+func (opts DialOpts) setup(ctx context.Context) context.Context {
+	if opts.Setup == nil {
+		return ctx
+	}
+	return opts.Setup
+}
+
+func (p2p *P2P) dialOnDemand(ctx context.Context, lnet string, listenerInfo *ListenerInfo, peer peer.ID, bindAddr ma.Multiaddr, opts DialOpts) (*ListenerInfo, error) {
+	switch lnet {
+	case "tcp", "tcp4", "tcp6", "unix":
+		listener, err := p2p.bindDialListener(opts.setup(ctx), bindAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		listenerInfo.Address = boundAddr(bindAddr, listener)
+		listenerInfo.Closer = listener
+		listenerInfo.setRunning(true)
+
+		go p2p.acceptOnDemand(ctx, listenerInfo, listener, peer, opts, p2p.dialListenerOpened(listenerInfo))
+
+	default:
+		return nil, errors.New("unsupported protocol: " + lnet)
+	}
+
+	return listenerInfo, nil
+}
+
+// acceptOnDemand accepts local connections until the listener is closed,
+// opening a new stream to the peer for each of them.
+//
+// Once no connection was active for the idle timeout the listener goes
+// dormant: the local port stays bound, but the accept queue and the work
+// opening streams to the peer are torn down. They are set up again when the
+// next connection is accepted.
+func (p2p *P2P) acceptOnDemand(ctx context.Context, listenerInfo *ListenerInfo, listener manet.Listener, peer peer.ID, opts DialOpts, done func()) {
+	defer done()
+	defer listenerInfo.setRunning(false)
+
+	quit := make(chan struct{})
+	defer close(quit)
+	defer listener.Close()
+
+	accepted := make(chan manet.Conn)
+	go func() {
+		defer close(accepted)
+		for {
+			local, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			select {
+			case accepted <- local:
+			case <-quit:
+				local.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case local, ok := <-accepted:
+			if !ok {
+				return
+			}
+			if !p2p.serveOnDemand(ctx, listenerInfo, peer, opts, local, accepted, quit) {
+				return
+			}
+			log.Debugf("p2p: on-demand listener %s idle for %s, dormant until the next connection", listenerInfo.Addr(), opts.IdleTimeout)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serveOnDemand opens streams for the first connection and the ones accepted
+// after it. It returns true once none was active for the idle timeout, and
+// false once the listener or the node shut down.
+//
+// With an accept queue the streams are opened one at a time by this loop,
+// connections accepted meanwhile wait in the queue.
+func (p2p *P2P) serveOnDemand(ctx context.Context, listenerInfo *ListenerInfo, peer peer.ID, opts DialOpts, first manet.Conn, accepted <-chan manet.Conn, quit <-chan struct{}) bool {
+	queued := opts.AcceptQueue > 0
+	policy := QueueBlock
+	if queued {
+		policy = opts.AcceptQueuePolicy
+	}
+
+	// Accepted connections wait in conns for their stream. Queuing only
+	// stops between connections, closed tells whether it stopped because
+	// the listener was closed.
+	conns := make(chan manet.Conn, opts.AcceptQueue)
+	var stop, stopped chan struct{}
+	var closed bool
+	queue := func() {
+		stop, stopped = make(chan struct{}), make(chan struct{})
+		go func(stop, stopped chan struct{}) {
+			defer close(stopped)
+			for {
+				select {
+				case local, ok := <-accepted:
+					if !ok {
+						closed = true
+						return
+					}
+					if !policy.enqueue(conns, local, quit) {
+						return
+					}
+				case <-stop:
+					return
+				case <-quit:
+					return
+				}
+			}
+		}(stop, stopped)
+	}
+	queue()
+
+	finished := make(chan struct{})
+	active := 0
+	serve := func(local manet.Conn) {
+		active++
+		if queued {
+			stream := p2p.dialOnDemandStream(ctx, listenerInfo, peer, local)
+			go p2p.waitOnDemand(stream, finished, quit)
+		} else {
+			go func() {
+				stream := p2p.dialOnDemandStream(ctx, listenerInfo, peer, local)
+				p2p.waitOnDemand(stream, finished, quit)
+			}()
+		}
+	}
+	serve(first)
+
+	// stopQueuing stops queuing and returns the connections still waiting
+	stopQueuing := func() []manet.Conn {
+		close(stop)
+		var waiting []manet.Conn
+		for {
+			select {
+			case local := <-conns:
+				waiting = append(waiting, local)
+			case <-stopped:
+				for {
+					select {
+					case local := <-conns:
+						waiting = append(waiting, local)
+					default:
+						return waiting
+					}
+				}
+			}
+		}
+	}
+	closeAll := func(conns []manet.Conn) {
+		for _, local := range conns {
+			local.Close()
+		}
+	}
+
+	var timer *time.Timer
+	var idleC <-chan time.Time
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case local := <-conns:
+			if timer != nil {
+				timer.Stop()
+				timer, idleC = nil, nil
+			}
+			serve(local)
+
+		case <-finished:
+			active--
+			if active == 0 && opts.IdleTimeout > 0 {
+				timer = time.NewTimer(opts.IdleTimeout)
+				idleC = timer.C
+			}
+
+		case <-idleC:
+			timer, idleC = nil, nil
+			waiting := stopQueuing()
+			if closed {
+				closeAll(waiting)
+				return false
+			}
+			if len(waiting) == 0 {
+				return true
+			}
+
+			// connections came in while queuing stopped
+			queue()
+			for _, local := range waiting {
+				serve(local)
+			}
+
+		case <-stopped:
+			// the listener was closed
+			closeAll(stopQueuing())
+			return false
+
+		case <-ctx.Done():
+			closeAll(stopQueuing())
+			return false
+		}
+	}
+}
+
+// dialOnDemandStream opens a stream to the peer for an accepted connection,
+// it returns nil and closes the connection if that fails
+func (p2p *P2P) dialOnDemandStream(ctx context.Context, listenerInfo *ListenerInfo, peer peer.ID, local manet.Conn) *StreamInfo {
+	remote, err := p2p.newStreamTo(ctx, peer, listenerInfo, listenerInfo.protocols()...)
+	if err != nil {
+		if !p2p.logDialFailed(listenerInfo, peer, err) {
+			log.Debugf("p2p: on-demand dial to %s failed: %s", peer.Pretty(), err)
+		}
+		local.Close()
+		return nil
+	}
+
+	return p2p.newOutboundStream(ctx, listenerInfo, local, remote)
+}
+
+// waitOnDemand reports to the accept loop once the stream is done
+func (p2p *P2P) waitOnDemand(stream *StreamInfo, finished chan<- struct{}, quit <-chan struct{}) {
+	if stream != nil {
+		<-stream.done
+	}
+	select {
+	case finished <- struct{}{}:
+	case <-quit:
+	}
+}
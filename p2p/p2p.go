@@ -3,9 +3,16 @@ package p2p
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	manet "gx/ipfs/QmRK2LxanhK2gZq6k6R7vk5ZoYZk8ULSSTB7FzDsMUX6CB/go-multiaddr-net"
+	logging "gx/ipfs/QmTG23dvpBCBjqQwyDxV8CQT6jmS4PSftNr1VqHhE3MLy7/go-log"
 	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
 	net "gx/ipfs/QmXoz9o2PT3tEzf7hicegwex5UgVP54n3k82K7jrWFyN86/go-libp2p-net"
 	pro "gx/ipfs/QmZNkThpqfVXs9GNbexPrfBbXSLNYeKrE7jwFM2oqHbyqN/go-libp2p-protocol"
@@ -14,37 +21,245 @@ import (
 	pstore "gx/ipfs/QmdeiKhUy1TVGBaKxt7y1QmBDLBdisSrLJ1x58Eoj4PXUh/go-libp2p-peerstore"
 )
 
+var log = logging.Logger("p2p-mount")
+
 // P2P structure holds information on currently running streams/listeners
 type P2P struct {
+	// Number of outgoing streams re-opened after failing right away.
+	// Accessed atomically, kept first for 64-bit alignment.
+	redials uint64
+
 	Listeners ListenerRegistry
 	Streams   StreamRegistry
 
+	// MaxStreamsPerPeer limits the concurrent streams a single remote peer
+	// may have open to the listeners without a limit of their own, counted
+	// across all of them. Zero means unlimited.
+	MaxStreamsPerPeer int
+
+	// Limiter caps the bandwidth used by all streams. Nil means unlimited.
+	Limiter *RateLimiter
+
+	// DialTimeout bounds connecting to a peer and opening a stream to it,
+	// for listeners without a dial timeout of their own. Zero means
+	// DefaultDialTimeout.
+	DialTimeout time.Duration
+
+	// LatencyInterval is how often the latency of streams measuring it is
+	// refreshed. Zero means DefaultLatencyInterval.
+	LatencyInterval time.Duration
+
+	// LivenessInterval is how often the remote peer of websocket-friendly
+	// streams is pinged. Zero means DefaultLivenessInterval.
+	LivenessInterval time.Duration
+
+	// ListenFunc binds the local listeners of Dial, tests replace it with
+	// an in-memory implementation. Defaults to manet.Listen, plus Linux
+	// abstract namespace sockets, written /unix/@name.
+	ListenFunc func(ma.Multiaddr) (manet.Listener, error)
+
+	// Restored are the listeners of the config the node tried to open when
+	// it started, in the order of the config. It is set once at startup and
+	// not changed after.
+	Restored []RestoreResult
+
+	interceptors interceptors
+
+	// dial listeners still accepting local connections
+	dialLk  sync.Mutex
+	dialSet map[*ListenerInfo]struct{}
+
 	identity  peer.ID
 	peerHost  p2phost.Host
 	peerstore pstore.Peerstore
 }
 
+// RestoreResult is the outcome of opening a listener of the config when the
+// node started
+type RestoreResult struct {
+	Protocol string
+	Address  string
+
+	// Err is why the listener couldn't be opened, nil if it was
+	Err error
+}
+
 // NewP2P creates new P2P struct
 func NewP2P(identity peer.ID, peerHost p2phost.Host, peerstore pstore.Peerstore) *P2P {
 	return &P2P{
+		ListenFunc: listen,
+
 		identity:  identity,
 		peerHost:  peerHost,
 		peerstore: peerstore,
 	}
 }
 
-func (p2p *P2P) newStreamTo(ctx2 context.Context, p peer.ID, protocol string) (net.Stream, error) {
-	ctx, cancel := context.WithTimeout(ctx2, time.Second*30) //TODO: configurable?
+// DefaultDialTimeout is the dial timeout used when neither the node nor the
+// listener set one
+const DefaultDialTimeout = 30 * time.Second
+
+// dialTimeout returns the time the listener may spend connecting to a peer
+// and opening a stream to it
+func (p2p *P2P) dialTimeout(listenerInfo *ListenerInfo) time.Duration {
+	if listenerInfo.DialTimeout > 0 {
+		return listenerInfo.DialTimeout
+	}
+	if p2p.DialTimeout > 0 {
+		return p2p.DialTimeout
+	}
+	return DefaultDialTimeout
+}
+
+// newStreamTo opens a stream to the peer for the listener, negotiating the
+// first of the given protocols the peer supports. If it has to connect, the
+// addresses of the listener's preferred family are tried first. All of it is
+// bounded by the listener's dial timeout.
+func (p2p *P2P) newStreamTo(ctx2 context.Context, p peer.ID, listenerInfo *ListenerInfo, protocols ...string) (net.Stream, error) {
+	ctx, cancel := context.WithTimeout(ctx2, p2p.dialTimeout(listenerInfo))
 	defer cancel()
-	err := p2p.peerHost.Connect(ctx, pstore.PeerInfo{ID: p})
+
+	if p == p2p.identity {
+		return p2p.newSelfStream(ctx, protocols...)
+	}
+
+	pids := make([]pro.ID, len(protocols))
+	for i, proto := range protocols {
+		pids[i] = pro.ID(proto)
+	}
+
+	// Opening a stream over an existing connection avoids a round trip
+	// through Connect and the peerstore for every forwarded connection.
+	if p2p.peerHost.Network().Connectedness(p) == net.Connected {
+		s, err := p2p.peerHost.NewStream(ctx, p, pids...)
+		if err == nil {
+			return s, nil
+		}
+		log.Debugf("p2p: stream to connected peer %s failed, reconnecting: %s", p.Pretty(), err)
+	}
+
+	if err := p2p.connectPreferring(ctx, p, listenerInfo.Prefer); err != nil {
+		return nil, err
+	}
+	return p2p.peerHost.NewStream(ctx, p, pids...)
+}
+
+// connect connects to the peer, the caller bounds it with the dial timeout
+func (p2p *P2P) connect(ctx context.Context, p peer.ID) error {
+	return p2p.peerHost.Connect(ctx, pstore.PeerInfo{ID: p})
+}
+
+// Redials returns the number of outgoing streams which failed before any data
+// was sent and were re-opened over a fresh connection
+func (p2p *P2P) Redials() uint64 {
+	return atomic.LoadUint64(&p2p.redials)
+}
+
+// DialListeners returns the number of listeners opened by Dial which still
+// accept local connections. Unlike the other listeners they aren't kept in
+// the registry.
+func (p2p *P2P) DialListeners() int {
+	p2p.dialLk.Lock()
+	defer p2p.dialLk.Unlock()
+	return len(p2p.dialSet)
+}
+
+// ListDialListeners returns the listeners opened by Dial which still accept
+// local connections, oldest first
+func (p2p *P2P) ListDialListeners() []*ListenerInfo {
+	p2p.dialLk.Lock()
+	out := make([]*ListenerInfo, 0, len(p2p.dialSet))
+	for l := range p2p.dialSet {
+		out = append(out, l)
+	}
+	p2p.dialLk.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Created.Before(out[j].Created)
+	})
+	return out
+}
+
+// boundAddr returns the address a dial listener is bound to. The kernel drops
+// the IPv6 zone of addresses which don't need one, like ::1, so the zone of
+// the bind address is added back to show the listener the way it was given.
+func boundAddr(bindAddr ma.Multiaddr, listener manet.Listener) ma.Multiaddr {
+	addr := listener.Multiaddr()
+	zone, err := bindAddr.ValueForProtocol(ma.P_IP6ZONE)
+	if err != nil {
+		return addr
+	}
+	if _, err := addr.ValueForProtocol(ma.P_IP6ZONE); err == nil {
+		return addr
+	}
+	if _, err := addr.ValueForProtocol(ma.P_IP6); err != nil {
+		return addr
+	}
+
+	zoneAddr, err := ma.NewMultiaddr("/ip6zone/" + zone)
+	if err != nil {
+		return addr
+	}
+	return zoneAddr.Encapsulate(addr)
+}
+
+// afterBind is called once the local address of a dial listener is bound,
+// tests replace it to abandon the forward right then
+var afterBind = func() {}
+
+// bindDialListener binds the local address of a dial listener. When setup is
+// done by then the listener is closed again, instead of staying bound with
+// nothing accepting on it, and the error of setup is returned.
+func (p2p *P2P) bindDialListener(setup context.Context, bindAddr ma.Multiaddr) (manet.Listener, error) {
+	listener, err := p2p.ListenFunc(bindAddr)
 	if err != nil {
 		return nil, err
 	}
-	return p2p.peerHost.NewStream(ctx2, p, pro.ID(protocol))
+	afterBind()
+
+	if err := setup.Err(); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// withSetup derives a context from ctx which is also cancelled once setup is
+// done, to give up dialing when the forward is abandoned
+func withSetup(ctx, setup context.Context) (context.Context, context.CancelFunc) {
+	dialCtx, cancel := context.WithCancel(ctx)
+	if setup == ctx {
+		return dialCtx, cancel
+	}
+	go func() {
+		select {
+		case <-setup.Done():
+			cancel()
+		case <-dialCtx.Done():
+		}
+	}()
+	return dialCtx, cancel
+}
+
+// dialListenerOpened keeps track of a dial listener until the returned
+// function is called once it stopped accepting
+func (p2p *P2P) dialListenerOpened(listenerInfo *ListenerInfo) func() {
+	p2p.dialLk.Lock()
+	defer p2p.dialLk.Unlock()
+	if p2p.dialSet == nil {
+		p2p.dialSet = make(map[*ListenerInfo]struct{})
+	}
+	p2p.dialSet[listenerInfo] = struct{}{}
+
+	return func() {
+		p2p.dialLk.Lock()
+		defer p2p.dialLk.Unlock()
+		delete(p2p.dialSet, listenerInfo)
+	}
 }
 
 // Dial creates new P2P stream to a remote listener
-func (p2p *P2P) Dial(ctx context.Context, addr ma.Multiaddr, peer peer.ID, proto string, bindAddr ma.Multiaddr) (*ListenerInfo, error) {
+func (p2p *P2P) Dial(ctx context.Context, addr ma.Multiaddr, peer peer.ID, proto string, bindAddr ma.Multiaddr, opts DialOpts) (*ListenerInfo, error) {
 	lnet, _, err := manet.DialArgs(bindAddr)
 	if err != nil {
 		return nil, err
@@ -53,16 +268,43 @@ func (p2p *P2P) Dial(ctx context.Context, addr ma.Multiaddr, peer peer.ID, proto
 	listenerInfo := ListenerInfo{
 		Identity: p2p.identity,
 		Protocol: proto,
+		Aliases:  opts.Fallbacks,
+		Priority: opts.Priority,
+		Prefer:   opts.Prefer,
+		Created:  time.Now(),
+
+		DialTimeout:       opts.DialTimeout,
+		MeasureLatency:    opts.MeasureLatency,
+		MaxConnAge:        opts.MaxConnAge,
+		MaxBytes:          opts.MaxBytes,
+		MaxBytesMode:      opts.MaxBytesMode,
+		RateLimitUp:       opts.RateLimitUp,
+		RateLimitDown:     opts.RateLimitDown,
+		WebSocketFriendly: opts.WebSocketFriendly,
+	}
+
+	setup := opts.setup(ctx)
+	if opts.Multiplex {
+		return p2p.dialMultiplexed(ctx, setup, lnet, &listenerInfo, peer, bindAddr)
+	}
+	if opts.OnDemand {
+		return p2p.dialOnDemand(ctx, lnet, &listenerInfo, peer, bindAddr, opts)
 	}
 
-	remote, err := p2p.newStreamTo(ctx, peer, proto)
+	dialCtx, cancel := withSetup(ctx, setup)
+	remote, err := p2p.newStreamTo(dialCtx, peer, &listenerInfo, listenerInfo.protocols()...)
+	cancel()
 	if err != nil {
+		if setupErr := setup.Err(); setupErr != nil {
+			return nil, setupErr
+		}
+		p2p.logDialFailed(&listenerInfo, peer, err)
 		return nil, err
 	}
 
 	switch lnet {
-	case "tcp", "tcp4", "tcp6":
-		listener, err := manet.Listen(bindAddr)
+	case "tcp", "tcp4", "tcp6", "unix":
+		listener, err := p2p.bindDialListener(setup, bindAddr)
 		if err != nil {
 			if err2 := remote.Reset(); err2 != nil {
 				return nil, err2
@@ -70,11 +312,11 @@ func (p2p *P2P) Dial(ctx context.Context, addr ma.Multiaddr, peer peer.ID, proto
 			return nil, err
 		}
 
-		listenerInfo.Address = listener.Multiaddr()
+		listenerInfo.Address = boundAddr(bindAddr, listener)
 		listenerInfo.Closer = listener
-		listenerInfo.Running = true
+		listenerInfo.setRunning(true)
 
-		go p2p.doAccept(&listenerInfo, remote, listener)
+		go p2p.doAccept(ctx, &listenerInfo, remote, listener, p2p.dialListenerOpened(&listenerInfo))
 
 	default:
 		return nil, errors.New("unsupported protocol: " + lnet)
@@ -83,31 +325,71 @@ func (p2p *P2P) Dial(ctx context.Context, addr ma.Multiaddr, peer peer.ID, proto
 	return &listenerInfo, nil
 }
 
-func (p2p *P2P) doAccept(listenerInfo *ListenerInfo, remote net.Stream, listener manet.Listener) {
+func (p2p *P2P) doAccept(ctx context.Context, listenerInfo *ListenerInfo, remote net.Stream, listener manet.Listener, done func()) {
+	defer done()
 	defer listener.Close()
 
 	local, err := listener.Accept()
 	if err != nil {
+		// the listener was closed before a connection came in
+		remote.Reset()
 		return
 	}
 
-	stream := StreamInfo{
-		Protocol: listenerInfo.Protocol,
+	p2p.newOutboundStream(ctx, listenerInfo, local, remote)
+}
+
+// newOutboundStream registers and starts a stream between a connection
+// accepted on a dial listener and a stream to the remote peer
+func (p2p *P2P) newOutboundStream(ctx context.Context, listenerInfo *ListenerInfo, local manet.Conn, remote net.Stream) *StreamInfo {
+	return p2p.startStream(listenerInfo, local, listenerInfo.Addr(), p2p.redialOnce(ctx, listenerInfo, remote), remote.Conn(), string(remote.Protocol()), DirOutbound)
+}
 
-		LocalPeer: listenerInfo.Identity,
-		LocalAddr: listenerInfo.Address,
+// startStream registers and starts a stream of the listener, forwarding
+// between the local endpoint at localAddr and the remote one carried over conn.
+// It returns nil if the interceptor of the protocol rejected the stream.
+func (p2p *P2P) startStream(listenerInfo *ListenerInfo, local io.ReadWriteCloser, localAddr ma.Multiaddr, remote RemoteStream, conn net.Conn, proto string, dir Direction) *StreamInfo {
+	stream := NewStream(local, remote, proto, dir)
 
-		RemotePeer: remote.Conn().RemotePeer(),
-		RemoteAddr: remote.Conn().RemoteMultiaddr(),
+	stream.LocalPeer = listenerInfo.Identity
+	stream.LocalAddr = localAddr
 
-		Local:  local,
-		Remote: remote,
+	stream.RemotePeer = conn.RemotePeer()
+	stream.RemoteAddr = conn.RemoteMultiaddr()
 
-		Registry: &p2p.Streams,
+	stream.Priority = listenerInfo.Priority
+	stream.Limiter = p2p.Limiter
+	if listenerInfo.RateLimitUp > 0 {
+		stream.UpLimiter = NewRateLimiter(listenerInfo.RateLimitUp)
+	}
+	if listenerInfo.RateLimitDown > 0 {
+		stream.DownLimiter = NewRateLimiter(listenerInfo.RateLimitDown)
+	}
+	stream.Listener = listenerInfo
+
+	if i := p2p.interceptor(listenerInfo.Protocol); i != nil {
+		if err := i.InterceptStream(p2p, stream); err != nil {
+			log.Debugf("%s: stream with %s rejected by interceptor: %s", listenerInfo.Protocol, stream.RemotePeer.Pretty(), err)
+			stream.Reset()
+			return nil
+		}
 	}
 
-	p2p.Streams.Register(&stream)
+	stream.Registry = &p2p.Streams
+
+	p2p.Streams.Register(stream)
 	stream.startStreaming()
+
+	if listenerInfo.MeasureLatency && stream.RemotePeer != p2p.identity {
+		go p2p.measureLatency(stream)
+	}
+	if listenerInfo.WebSocketFriendly && stream.RemotePeer != p2p.identity {
+		go p2p.checkLiveness(stream)
+	}
+	if listenerInfo.MaxConnAge > 0 {
+		go expireStream(stream, listenerInfo.MaxConnAge)
+	}
+	return stream
 }
 
 // Listener wraps stream handler into a listener
@@ -120,9 +402,13 @@ type Listener interface {
 type P2PListener struct {
 	peerHost p2phost.Host
 	conCh    chan net.Stream
-	proto    pro.ID
+	protos   []pro.ID
 	ctx      context.Context
 	cancel   func()
+
+	// the accept loop closes the listener again when it ends, which must not
+	// remove the handlers of a listener reopened on the same protocols
+	closeOnce sync.Once
 }
 
 // Accept waits for a connection from the listener
@@ -137,37 +423,95 @@ func (il *P2PListener) Accept() (net.Stream, error) {
 
 // Close closes the listener and removes stream handler
 func (il *P2PListener) Close() error {
-	il.cancel()
-	il.peerHost.RemoveStreamHandler(il.proto)
+	il.closeOnce.Do(func() {
+		il.cancel()
+		for _, proto := range il.protos {
+			il.peerHost.RemoveStreamHandler(proto)
+		}
+	})
 	return nil
 }
 
-// Listen creates new P2PListener
-func (p2p *P2P) registerStreamHandler(ctx2 context.Context, protocol string) (*P2PListener, error) {
+// Listen creates new P2PListener accepting streams on all given protocols
+func (p2p *P2P) registerStreamHandler(ctx2 context.Context, protocols ...string) (*P2PListener, error) {
 	ctx, cancel := context.WithCancel(ctx2)
 
 	list := &P2PListener{
 		peerHost: p2p.peerHost,
-		proto:    pro.ID(protocol),
 		conCh:    make(chan net.Stream),
 		ctx:      ctx,
 		cancel:   cancel,
 	}
 
-	p2p.peerHost.SetStreamHandler(list.proto, func(s net.Stream) {
+	handler := func(s net.Stream) {
 		select {
 		case list.conCh <- s:
 		case <-ctx.Done():
 			s.Reset()
 		}
-	})
+	}
+
+	for _, protocol := range protocols {
+		list.protos = append(list.protos, pro.ID(protocol))
+		p2p.peerHost.SetStreamHandler(pro.ID(protocol), handler)
+	}
 
 	return list, nil
 }
 
+// ListenerOpts holds optional settings of a p2p listener
+type ListenerOpts struct {
+	// Aliases are additional protocol ids the listener accepts streams on
+	Aliases []string
+
+	// MaxStreamsPerPeer overrides the node-wide per-peer stream limit when
+	// non-zero.
+	MaxStreamsPerPeer int
+
+	// Priority of the listener's streams under the bandwidth limit
+	Priority Priority
+
+	// PoolSize is the number of warm connections to the target address kept
+	// for reuse by short-lived streams. Zero dials a connection per stream.
+	PoolSize int
+
+	// Multiplex also accepts multiplexed streams, carrying many connections
+	// each, on the protocols suffixed with MuxSuffix
+	Multiplex bool
+
+	// MeasureLatency pings the remote peer of each stream, see
+	// StreamInfo.Latency
+	MeasureLatency bool
+
+	// Meta is stored on the listener, see ListenerInfo.Meta
+	Meta map[string]string
+
+	// MaxBytes resets each stream once it transferred this many bytes,
+	// counted as MaxBytesMode says. Zero means unlimited.
+	MaxBytes     uint64
+	MaxBytesMode ByteCapMode
+
+	// RateLimitUp and RateLimitDown limit the bandwidth of each stream, see
+	// ListenerInfo.RateLimitUp
+	RateLimitUp   int64
+	RateLimitDown int64
+
+	// WebSocketFriendly keeps each stream open both ways until either side
+	// closes it, see ListenerInfo.WebSocketFriendly
+	WebSocketFriendly bool
+
+	// Group is stored on the listener, see ListenerInfo.Group
+	Group string
+}
+
 // NewListener creates new p2p listener
-func (p2p *P2P) NewListener(ctx context.Context, proto string, addr ma.Multiaddr) (*ListenerInfo, error) {
-	listener, err := p2p.registerStreamHandler(ctx, proto)
+func (p2p *P2P) NewListener(ctx context.Context, proto string, addr ma.Multiaddr, opts ListenerOpts) (*ListenerInfo, error) {
+	protos := append([]string{proto}, opts.Aliases...)
+	if opts.Multiplex {
+		protos = append(protos, muxProtocols(protos)...)
+	}
+
+	listener, err := p2p.registerStreamHandler(ctx, protos...)
 	if err != nil {
 		return nil, err
 	}
@@ -175,10 +519,28 @@ func (p2p *P2P) NewListener(ctx context.Context, proto string, addr ma.Multiaddr
 	listenerInfo := ListenerInfo{
 		Identity: p2p.identity,
 		Protocol: proto,
+		Aliases:  opts.Aliases,
 		Address:  addr,
 		Closer:   listener,
-		Running:  true,
+		running:  1,
 		Registry: &p2p.Listeners,
+		Created:  time.Now(),
+
+		MaxStreamsPerPeer: opts.MaxStreamsPerPeer,
+		Priority:          opts.Priority,
+		Multiplex:         opts.Multiplex,
+		MeasureLatency:    opts.MeasureLatency,
+		Meta:              opts.Meta,
+		MaxBytes:          opts.MaxBytes,
+		MaxBytesMode:      opts.MaxBytesMode,
+		RateLimitUp:       opts.RateLimitUp,
+		RateLimitDown:     opts.RateLimitDown,
+		WebSocketFriendly: opts.WebSocketFriendly,
+		Group:             opts.Group,
+	}
+
+	if opts.PoolSize > 0 {
+		listenerInfo.pool = newBackendPool(addr, opts.PoolSize)
 	}
 
 	go p2p.acceptStreams(&listenerInfo, listener)
@@ -188,39 +550,194 @@ func (p2p *P2P) NewListener(ctx context.Context, proto string, addr ma.Multiaddr
 	return &listenerInfo, nil
 }
 
+// Route forwards the streams of a protocol to an address
+type Route struct {
+	Protocol string
+	Address  ma.Multiaddr
+}
+
+// NewListenerGroup opens a listener for each route, all in the named group so
+// that they can be listed and closed together. Either all of them are opened
+// or none.
+func (p2p *P2P) NewListenerGroup(ctx context.Context, group string, routes []Route, opts ListenerOpts) ([]*ListenerInfo, error) {
+	if group == "" {
+		return nil, errors.New("listener group needs a name")
+	}
+	for _, l := range p2p.Listeners.List() {
+		if l.Group == group {
+			return nil, fmt.Errorf("listener group %s already exists", group)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, r := range routes {
+		if err := p2p.CheckListenerConflict(r.Protocol); err != nil {
+			return nil, err
+		}
+		if seen[r.Protocol] {
+			return nil, &ListenerExistsError{Protocol: r.Protocol}
+		}
+		seen[r.Protocol] = true
+	}
+
+	opts.Group = group
+	listeners := make([]*ListenerInfo, 0, len(routes))
+	for _, r := range routes {
+		listener, err := p2p.NewListener(ctx, r.Protocol, r.Address, opts)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("%s: %s", r.Protocol, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
 func (p2p *P2P) acceptStreams(listenerInfo *ListenerInfo, listener Listener) {
-	for listenerInfo.Running {
+	for listenerInfo.Running() {
 		remote, err := listener.Accept()
 		if err != nil {
 			listener.Close()
 			break
 		}
 
-		local, err := manet.Dial(listenerInfo.Address)
+		if listenerInfo.Paused() {
+			log.Debugf("%s: rejecting stream from %s, listener paused", listenerInfo.Protocol, remote.Conn().RemotePeer().Pretty())
+			remote.Reset()
+			continue
+		}
+
+		if listenerInfo.Multiplex && isMuxProtocol(string(remote.Protocol())) {
+			// stream limits apply to each channel
+			go p2p.serveMux(listenerInfo, remote)
+			continue
+		}
+
+		if !p2p.allowStream(listenerInfo, remote.Conn().RemotePeer()) {
+			atomic.AddUint64(&listenerInfo.RejectedStreams, 1)
+			remote.Reset()
+			continue
+		}
+
+		local, target, err := listenerInfo.dialTarget()
 		if err != nil {
 			remote.Reset()
 			continue
 		}
 
-		stream := StreamInfo{
-			Protocol: listenerInfo.Protocol,
+		p2p.startStream(listenerInfo, local, target, remote, remote.Conn(), string(remote.Protocol()), DirInbound)
+	}
+	listenerInfo.closePool()
+	p2p.Listeners.remove(listenerInfo)
+}
+
+// allowStream checks whether the remote peer may open another stream to the
+// listener. A limit of the listener counts the streams the peer opened to it,
+// the node-wide one those it opened to all listeners. Streams we opened to the
+// peer don't count.
+func (p2p *P2P) allowStream(listenerInfo *ListenerInfo, p peer.ID) bool {
+	limit := listenerInfo.MaxStreamsPerPeer
+	count := func() int { return p2p.Streams.listenerStreams(listenerInfo, p) }
+	if limit == 0 {
+		limit = p2p.MaxStreamsPerPeer
+		count = func() int { return p2p.Streams.InboundStreams(p) }
+	}
+	if limit <= 0 {
+		return true
+	}
+
+	if count() >= limit {
+		log.Debugf("%s: rejecting stream from %s, stream limit of %d reached", listenerInfo.Protocol, p.Pretty(), limit)
+		return false
+	}
+	return true
+}
+
+// ProtocolHandler is a stream handler registered on the host
+type ProtocolHandler struct {
+	Protocol string
+
+	// Listener the handler belongs to, nil if there is none, which means
+	// the handler was left behind when its listener was closed
+	Listener *ListenerInfo
+}
+
+// Handlers lists the stream handlers registered on the host under the /p2p/
+// namespace, and those of listeners with custom protocols, sorted by
+// protocol
+func (p2p *P2P) Handlers() []ProtocolHandler {
+	listeners := p2p.Listeners.List()
+
+	var handlers []ProtocolHandler
+	for _, proto := range p2p.peerHost.Mux().Protocols() {
+		h := ProtocolHandler{Protocol: proto}
+		for _, listener := range listeners {
+			if listener.HasProtocol(proto) {
+				h.Listener = listener
+				break
+			}
+		}
+		if h.Listener == nil && !strings.HasPrefix(proto, "/p2p/") {
+			continue
+		}
+		handlers = append(handlers, h)
+	}
+
+	sort.Slice(handlers, func(i, j int) bool {
+		return handlers[i].Protocol < handlers[j].Protocol
+	})
+	return handlers
+}
 
-			LocalPeer: listenerInfo.Identity,
-			LocalAddr: listenerInfo.Address,
+// MissingHandlers returns the protocols of the listener which have no stream
+// handler registered on the host, i.e. which the listener can't accept streams
+// on although it is still registered. Dial listeners have no handlers.
+func (p2p *P2P) MissingHandlers(listener *ListenerInfo) []string {
+	if listener.Registry == nil {
+		return nil
+	}
 
-			RemotePeer: remote.Conn().RemotePeer(),
-			RemoteAddr: remote.Conn().RemoteMultiaddr(),
+	registered := make(map[string]bool)
+	for _, proto := range p2p.peerHost.Mux().Protocols() {
+		registered[proto] = true
+	}
 
-			Local:  local,
-			Remote: remote,
+	protos := listener.protocols()
+	if listener.Multiplex {
+		protos = append(protos, muxProtocols(protos)...)
+	}
 
-			Registry: &p2p.Streams,
+	var missing []string
+	for _, proto := range protos {
+		if !registered[proto] {
+			missing = append(missing, proto)
 		}
+	}
+	return missing
+}
+
+// ListenerExistsError is returned when opening a listener on a protocol which
+// is already handled
+type ListenerExistsError struct {
+	Protocol string
+
+	// Listener handling the protocol, nil if its handler wasn't registered
+	// by a listener
+	Listener *ListenerInfo
+}
+
+func (e *ListenerExistsError) Error() string {
+	return "protocol handler already registered: " + e.Protocol
+}
 
-		p2p.Streams.Register(&stream)
-		stream.startStreaming()
+// CheckListenerConflict returns a *ListenerExistsError with the listener
+// handling the protocol if it is handled already, nil otherwise
+func (p2p *P2P) CheckListenerConflict(proto string) error {
+	if !p2p.CheckProtoExists(proto) {
+		return nil
 	}
-	p2p.Listeners.Deregister(listenerInfo.Protocol)
+	return &ListenerExistsError{Protocol: proto, Listener: p2p.Listeners.Lookup(proto)}
 }
 
 // CheckProtoExists checks whether a protocol handler is registered to
@@ -0,0 +1,1050 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	gonet "net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	manet "gx/ipfs/QmRK2LxanhK2gZq6k6R7vk5ZoYZk8ULSSTB7FzDsMUX6CB/go-multiaddr-net"
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	net "gx/ipfs/QmXoz9o2PT3tEzf7hicegwex5UgVP54n3k82K7jrWFyN86/go-libp2p-net"
+	mocknet "gx/ipfs/QmY6iAoG9DVgZwh5ZRcQEpa2uErAe1Hbei8qXPCjpDS9Ge/go-libp2p/p2p/net/mock"
+	peer "gx/ipfs/QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74/go-libp2p-peer"
+)
+
+// startEcho starts a TCP service echoing back everything it receives
+func startEcho(t testing.TB) manet.Listener {
+	addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := manet.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	return l
+}
+
+func TestDialSelf(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h.ID(), h, h.Peerstore())
+
+	echo := startEcho(t)
+	defer echo.Close()
+
+	if _, err := p2p.NewListener(ctx, "/p2p/echo", echo.Multiaddr(), ListenerOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	listenerInfo, err := p2p.Dial(ctx, nil, h.ID(), "/p2p/echo", bindAddr, DialOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := manet.Dial(listenerInfo.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("expected 'hello', got %q", buf)
+	}
+
+	// a client closing its side once it sent its request still gets the
+	// whole response
+	listenerInfo, err = p2p.Dial(ctx, nil, h.ID(), "/p2p/echo", bindAddr, DialOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := manet.ToNetAddr(listenerInfo.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc, err := gonet.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hc.Close()
+
+	hc.Write([]byte("request"))
+	hc.(*gonet.TCPConn).CloseWrite()
+
+	hc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := ioutil.ReadAll(hc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "request" {
+		t.Fatalf("expected the whole response, got %q", resp)
+	}
+}
+
+// TestDialRemoteClosesFirst forwards a request/response exchange where the
+// service closes its side once it answered, while the client still sends
+func TestDialRemoteClosesFirst(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h1, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewP2P(h1.ID(), h1, h1.Peerstore())
+	server := NewP2P(h2.ID(), h2, h2.Peerstore())
+
+	ln, err := gonet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	trailer := make(chan string, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		r := bufio.NewReader(c)
+		if _, err := r.ReadString('\n'); err != nil {
+			return
+		}
+		c.Write([]byte("response"))
+		c.(*gonet.TCPConn).CloseWrite()
+
+		rest, _ := ioutil.ReadAll(r)
+		trailer <- string(rest)
+	}()
+
+	target, err := manet.FromNetAddr(ln.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.NewListener(ctx, "/p2p/reqresp", target, ListenerOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	listenerInfo, err := client.Dial(ctx, nil, h2.ID(), "/p2p/reqresp", bindAddr, DialOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := manet.ToNetAddr(listenerInfo.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := gonet.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Write([]byte("request\n"))
+
+	// the response ends with an EOF, not a reset
+	resp, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "response" {
+		t.Fatalf("expected the whole response, got %q", resp)
+	}
+
+	// the client may still finish sending
+	if _, err := c.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	c.(*gonet.TCPConn).CloseWrite()
+
+	select {
+	case got := <-trailer:
+		if got != "bye" {
+			t.Fatalf("expected the service to read the rest of the request, got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the service didn't see the end of the request")
+	}
+}
+
+func TestDialSelfNoListener(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h.ID(), h, h.Peerstore())
+
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	if _, err := p2p.Dial(ctx, nil, h.ID(), "/p2p/missing", bindAddr, DialOpts{}); err != ErrNoSelfListener {
+		t.Fatalf("expected ErrNoSelfListener, got %v", err)
+	}
+}
+
+func BenchmarkNewStreamConnected(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h1, err := mn.GenPeer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	h2, err := mn.GenPeer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := mn.ConnectPeers(h1.ID(), h2.ID()); err != nil {
+		b.Fatal(err)
+	}
+
+	h2.SetStreamHandler("/p2p/bench", func(s net.Stream) {
+		s.Close()
+	})
+
+	p2p := NewP2P(h1.ID(), h1, h1.Peerstore())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s, err := p2p.newStreamTo(ctx, h2.ID(), &ListenerInfo{}, "/p2p/bench")
+		if err != nil {
+			b.Fatal(err)
+		}
+		s.Close()
+	}
+}
+
+func TestDialOnDemand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h.ID(), h, h.Peerstore())
+	mem := newMemNet()
+	p2p.ListenFunc = mem.listen
+
+	echo := startEcho(t)
+	defer echo.Close()
+
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	opts := DialOpts{OnDemand: true, IdleTimeout: 100 * time.Millisecond}
+
+	// nothing is listening on the protocol yet, which is fine until the
+	// first connection comes in
+	listenerInfo, err := p2p.Dial(ctx, nil, h.ID(), "/p2p/echo", bindAddr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p2p.NewListener(ctx, "/p2p/echo", echo.Multiaddr(), ListenerOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		c, err := mem.dial(listenerInfo.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "hello" {
+			t.Fatalf("expected 'hello', got %q", buf)
+		}
+		c.Close()
+	}
+
+	// an idle listener goes dormant, keeping its port, and wakes up for the
+	// next connection
+	for i := 0; i < 2; i++ {
+		time.Sleep(300 * time.Millisecond)
+		if !listenerInfo.Running() || p2p.DialListeners() != 1 {
+			t.Fatal("expected the idle on-demand listener to stay open")
+		}
+
+		c, err := mem.dial(listenerInfo.Address)
+		if err != nil {
+			t.Fatalf("expected the dormant listener to accept connections: %s", err)
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		echoRoundTrip(t, c, "awake")
+		c.Close()
+	}
+
+	// closing it ends it, dormant or not
+	time.Sleep(300 * time.Millisecond)
+	listenerInfo.Closer.Close()
+	for i := 0; listenerInfo.Running() || p2p.DialListeners() != 0; i++ {
+		if i == 100 {
+			t.Fatal("expected the closed on-demand listener to stop")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDialOnDemandFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h.ID(), h, h.Peerstore())
+	mem := newMemNet()
+	p2p.ListenFunc = mem.listen
+
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	listenerInfo, err := p2p.Dial(ctx, nil, h.ID(), "/p2p/missing", bindAddr, DialOpts{OnDemand: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := mem.dial(listenerInfo.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// nothing handles the protocol, the connection is closed
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+
+	if n := p2p.DialListeners(); n != 1 {
+		t.Fatalf("expected the listener to keep accepting, got %d dial listeners", n)
+	}
+	if listed := p2p.ListDialListeners(); len(listed) != 1 || listed[0] != listenerInfo {
+		t.Fatalf("expected the listener to be listed, got %v", listed)
+	}
+	if totals := p2p.Streams.Totals(); totals.Opened != 0 {
+		t.Fatalf("expected no stream to be opened, got %d", totals.Opened)
+	}
+}
+
+func TestDialSetupCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h.ID(), h, h.Peerstore())
+	mem := newMemNet()
+	p2p.ListenFunc = mem.listen
+
+	echo := startEcho(t)
+	defer echo.Close()
+	if _, err := p2p.NewListener(ctx, "/p2p/echo", echo.Multiaddr(), ListenerOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { afterBind = func() {} }()
+
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	for _, opts := range []DialOpts{{}, {OnDemand: true}, {Multiplex: true}} {
+		// the request goes away between binding and handing out the forward
+		setup, abandon := context.WithCancel(ctx)
+		afterBind = abandon
+		opts.Setup = setup
+
+		if _, err := p2p.Dial(ctx, nil, h.ID(), "/p2p/echo", bindAddr, opts); err != context.Canceled {
+			t.Fatalf("%+v: expected the dial to be cancelled, got %v", opts, err)
+		}
+		if p2p.DialListeners() != 0 {
+			t.Fatalf("%+v: expected no dial listener to be left", opts)
+		}
+
+		// the address must have been released
+		l, err := mem.listen(bindAddr)
+		if err != nil {
+			t.Fatalf("%+v: expected the address to be free, got %s", opts, err)
+		}
+		l.Close()
+	}
+
+	// cancelled before dialing, nothing gets bound
+	afterBind = func() { t.Fatal("expected nothing to be bound") }
+	setup, abandon := context.WithCancel(ctx)
+	abandon()
+	if _, err := p2p.Dial(ctx, nil, h.ID(), "/p2p/echo", bindAddr, DialOpts{Setup: setup}); err != context.Canceled {
+		t.Fatalf("expected the dial to be cancelled, got %v", err)
+	}
+}
+
+func TestDialOnDemandQueued(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h.ID(), h, h.Peerstore())
+
+	echo := startEcho(t)
+	defer echo.Close()
+
+	if _, err := p2p.NewListener(ctx, "/p2p/echo", echo.Multiaddr(), ListenerOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	opts := DialOpts{OnDemand: true, AcceptQueue: 2, AcceptQueuePolicy: QueueBlock, IdleTimeout: 50 * time.Millisecond}
+	listenerInfo, err := p2p.Dial(ctx, nil, h.ID(), "/p2p/echo", bindAddr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// more connections than the queue holds, all of them get their stream
+	var conns []manet.Conn
+	for i := 0; i < 4; i++ {
+		c, err := manet.Dial(listenerInfo.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+
+	for i, c := range conns {
+		msg := fmt.Sprintf("hello %d", i)
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != msg {
+			t.Fatalf("expected %q, got %q", msg, buf)
+		}
+	}
+
+	// the queue is set up again once the dormant listener wakes up
+	for _, c := range conns {
+		c.Close()
+	}
+	time.Sleep(200 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		c, err := manet.Dial(listenerInfo.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		echoRoundTrip(t, c, fmt.Sprintf("again %d", i))
+	}
+}
+
+func TestDialFallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h.ID(), h, h.Peerstore())
+
+	echo := startEcho(t)
+	defer echo.Close()
+
+	if _, err := p2p.NewListener(ctx, "/p2p/echo/1.0", echo.Multiaddr(), ListenerOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	opts := DialOpts{Fallbacks: []string{"/p2p/echo/1.0"}}
+	listenerInfo, err := p2p.Dial(ctx, nil, h.ID(), "/p2p/echo/2.0", bindAddr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := manet.Dial(listenerInfo.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range p2p.Streams.Snapshot() {
+		if s.Direction == DirOutbound && s.Protocol != "/p2p/echo/1.0" {
+			t.Fatalf("expected the fallback protocol to be negotiated, got %s", s.Protocol)
+		}
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the peer is reachable, but too slow to answer within the timeout
+	mn := mocknet.New(ctx)
+	mn.SetLinkDefaults(mocknet.LinkOptions{Latency: 10 * time.Second})
+	h1, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h1.ID(), h1, h1.Peerstore())
+
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	start := time.Now()
+	_, err = p2p.Dial(ctx, nil, h2.ID(), "/p2p/echo", bindAddr, DialOpts{DialTimeout: time.Second})
+	if err == nil {
+		t.Fatal("expected the dial to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the dial to fail after about a second, took %s", elapsed)
+	}
+}
+
+func echoRoundTrip(t *testing.T, c manet.Conn, msg string) {
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("expected %q, got %q", msg, buf)
+	}
+}
+
+func TestListenerRetarget(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h.ID(), h, h.Peerstore())
+
+	var acceptedOld, acceptedNew int32
+	oldEcho := startCountingEcho(t, &acceptedOld)
+	defer oldEcho.Close()
+	newEcho := startCountingEcho(t, &acceptedNew)
+	defer newEcho.Close()
+
+	listener, err := p2p.NewListener(ctx, "/p2p/echo", oldEcho.Multiaddr(), ListenerOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	dial, err := p2p.Dial(ctx, nil, h.ID(), "/p2p/echo", bindAddr, DialOpts{OnDemand: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := manet.Dial(dial.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer before.Close()
+	echoRoundTrip(t, before, "before")
+
+	invalid, _ := ma.NewMultiaddr("/ip4/127.0.0.1/udp/1/utp")
+	if err := listener.Retarget(invalid); err == nil {
+		t.Fatal("expected retargeting to an invalid address to fail")
+	}
+	if err := listener.Retarget(newEcho.Multiaddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := manet.Dial(dial.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer after.Close()
+	echoRoundTrip(t, after, "after")
+
+	// the stream opened before keeps its backend
+	echoRoundTrip(t, before, "still before")
+
+	if n := atomic.LoadInt32(&acceptedOld); n != 1 {
+		t.Fatalf("expected 1 connection to the old target, got %d", n)
+	}
+	if n := atomic.LoadInt32(&acceptedNew); n != 1 {
+		t.Fatalf("expected 1 connection to the new target, got %d", n)
+	}
+}
+
+func TestListenerPause(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h.ID(), h, h.Peerstore())
+
+	echo := startEcho(t)
+	defer echo.Close()
+
+	listener, err := p2p.NewListener(ctx, "/p2p/echo", echo.Multiaddr(), ListenerOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	dial, err := p2p.Dial(ctx, nil, h.ID(), "/p2p/echo", bindAddr, DialOpts{OnDemand: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := manet.Dial(dial.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer before.Close()
+	echoRoundTrip(t, before, "before")
+
+	listener.Pause()
+	if !listener.Paused() {
+		t.Fatal("expected the listener to be paused")
+	}
+
+	paused, err := manet.Dial(dial.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer paused.Close()
+	paused.Write([]byte("paused"))
+	paused.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(paused, make([]byte, 6)); err == nil {
+		t.Fatal("expected the stream to be rejected while paused")
+	}
+
+	// the stream opened before keeps flowing, the listener stays registered
+	echoRoundTrip(t, before, "still before")
+	if len(p2p.Listeners.List()) != 1 {
+		t.Fatal("expected the paused listener to stay registered")
+	}
+
+	listener.Resume()
+	after, err := manet.Dial(dial.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer after.Close()
+	echoRoundTrip(t, after, "after")
+}
+
+func TestHandlers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h.ID(), h, h.Peerstore())
+	addr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/10101")
+
+	listener, err := p2p.NewListener(ctx, "/p2p/app", addr, ListenerOpts{Aliases: []string{"/p2p/app-old"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom, err := p2p.NewListener(ctx, "/x/custom", addr, ListenerOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a handler without a listener, and one outside of the namespace
+	h.SetStreamHandler("/p2p/orphan", func(s net.Stream) { s.Reset() })
+	h.SetStreamHandler("/other/1.0.0", func(s net.Stream) { s.Reset() })
+
+	expected := []struct {
+		proto    string
+		listener *ListenerInfo
+	}{
+		{"/p2p/app", listener},
+		{"/p2p/app-old", listener},
+		{"/p2p/orphan", nil},
+		{"/x/custom", custom},
+	}
+
+	handlers := p2p.Handlers()
+	if len(handlers) != len(expected) {
+		t.Fatalf("expected %d handlers, got %v", len(expected), handlers)
+	}
+	for i, e := range expected {
+		if handlers[i].Protocol != e.proto || handlers[i].Listener != e.listener {
+			t.Fatalf("handler %d: expected %s of %v, got %s of %v", i, e.proto, e.listener, handlers[i].Protocol, handlers[i].Listener)
+		}
+	}
+}
+
+func TestMissingHandlers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h.ID(), h, h.Peerstore())
+	addr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/10101")
+
+	listener, err := p2p.NewListener(ctx, "/p2p/app", addr, ListenerOpts{Aliases: []string{"/p2p/app-old"}, Multiplex: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing := p2p.MissingHandlers(listener); len(missing) != 0 {
+		t.Fatalf("expected all handlers to be registered, got %v missing", missing)
+	}
+
+	// the host lost handlers behind the back of the listener
+	h.RemoveStreamHandler("/p2p/app-old")
+	h.RemoveStreamHandler("/p2p/app" + MuxSuffix)
+
+	missing := p2p.MissingHandlers(listener)
+	if strings.Join(missing, " ") != "/p2p/app-old /p2p/app/mux" {
+		t.Fatalf("expected the removed handlers to be missing, got %v", missing)
+	}
+}
+
+func TestListenerGroup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h.ID(), h, h.Peerstore())
+	a, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/10101")
+	b, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/10102")
+
+	listeners, err := p2p.NewListenerGroup(ctx, "backend", []Route{
+		{Protocol: "/p2p/a", Address: a},
+		{Protocol: "/p2p/b", Address: b},
+	}, ListenerOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 || !listeners[0].Address.Equal(a) || !listeners[1].Address.Equal(b) {
+		t.Fatalf("expected a listener for each route, got %v", listeners)
+	}
+	for _, l := range listeners {
+		if l.Group != "backend" {
+			t.Fatalf("expected %s in group backend, got %q", l.Protocol, l.Group)
+		}
+	}
+
+	// groups are all or nothing
+	if _, err := p2p.NewListenerGroup(ctx, "other", []Route{
+		{Protocol: "/p2p/c", Address: a},
+		{Protocol: "/p2p/b", Address: b},
+	}, ListenerOpts{}); err == nil {
+		t.Fatal("expected the taken protocol to fail the group")
+	}
+	if p2p.CheckProtoExists("/p2p/c") {
+		t.Fatal("expected no route of a failed group to be opened")
+	}
+	if _, err := p2p.NewListenerGroup(ctx, "backend", []Route{{Protocol: "/p2p/c", Address: a}}, ListenerOpts{}); err == nil {
+		t.Fatal("expected an existing group name to fail")
+	}
+	if n := len(p2p.Listeners.List()); n != 2 {
+		t.Fatalf("expected 2 listeners, got %d", n)
+	}
+
+	err = p2p.CheckListenerConflict("/p2p/b")
+	if exists, ok := err.(*ListenerExistsError); !ok || exists.Listener != listeners[1] {
+		t.Fatalf("expected the conflict to name the listener of /p2p/b, got %v", err)
+	}
+	if err := p2p.CheckListenerConflict("/p2p/c"); err != nil {
+		t.Fatalf("expected no conflict, got %s", err)
+	}
+}
+
+func TestDialIP6Zone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h.ID(), h, h.Peerstore())
+
+	echo := startEcho(t)
+	defer echo.Close()
+	if _, err := p2p.NewListener(ctx, "/p2p/echo", echo.Multiaddr(), ListenerOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// ::1 needs no zone, but accepts one, so this works without knowing the
+	// name of a link-local interface
+	bindAddr, err := ma.NewMultiaddr("/ip6zone/lo/ip6/::1/tcp/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := manet.Listen(bindAddr); err != nil {
+		t.Skipf("no IPv6 loopback: %s", err)
+	} else {
+		l.Close()
+	}
+
+	listenerInfo, err := p2p.Dial(ctx, nil, h.ID(), "/p2p/echo", bindAddr, DialOpts{OnDemand: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listenerInfo.Closer.Close()
+
+	if zone, err := listenerInfo.Address.ValueForProtocol(ma.P_IP6ZONE); err != nil || zone != "lo" {
+		t.Fatalf("expected the zone to be kept in %s", listenerInfo.Address)
+	}
+
+	c, err := manet.Dial(listenerInfo.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	echoRoundTrip(t, c, "hello")
+}
+
+func TestListenZoneError(t *testing.T) {
+	// 2001:db8::/32 is reserved for documentation, no interface has it
+	addr, err := ma.NewMultiaddr("/ip6zone/lo/ip6/2001:db8::1/tcp/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(addr); err == nil || !strings.Contains(err.Error(), "interface lo") {
+		t.Fatalf("expected an error naming the interface, got %v", err)
+	}
+}
+
+func TestDialMaxConnAge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h.ID(), h, h.Peerstore())
+	mem := newMemNet()
+	p2p.ListenFunc = mem.listen
+
+	echo := startEcho(t)
+	defer echo.Close()
+	if _, err := p2p.NewListener(ctx, "/p2p/echo", echo.Multiaddr(), ListenerOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	opts := DialOpts{OnDemand: true, MaxConnAge: 100 * time.Millisecond}
+	listenerInfo, err := p2p.Dial(ctx, nil, h.ID(), "/p2p/echo", bindAddr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		c, err := mem.dial(listenerInfo.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		echoRoundTrip(t, c, "hello")
+
+		// the connection is closed although it's still in use
+		done := make(chan error, 1)
+		go func() {
+			_, err := ioutil.ReadAll(c)
+			done <- err
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected the connection to be closed after its max age")
+		}
+		c.Close()
+	}
+}
+
+func TestAllowStream(t *testing.T) {
+	a := peer.ID("peer-a")
+	p2p := NewP2P(peer.ID("self"), nil, nil)
+	p2p.MaxStreamsPerPeer = 2
+
+	l1 := &ListenerInfo{Protocol: "/p2p/one"}
+	l2 := &ListenerInfo{Protocol: "/p2p/two"}
+	strict := &ListenerInfo{Protocol: "/p2p/strict", MaxStreamsPerPeer: 1}
+
+	// dialing the peer doesn't use up its limit
+	p2p.Streams.Register(&StreamInfo{RemotePeer: a, Direction: DirOutbound, Listener: l1})
+	p2p.Streams.Register(&StreamInfo{RemotePeer: a, Direction: DirOutbound, Listener: l1})
+	if !p2p.allowStream(l1, a) {
+		t.Fatal("expected outbound streams not to count")
+	}
+
+	// the node-wide limit counts the streams to all listeners
+	p2p.Streams.Register(&StreamInfo{RemotePeer: a, Direction: DirInbound, Listener: l1})
+	if !p2p.allowStream(l2, a) {
+		t.Fatal("expected a second stream to be allowed")
+	}
+	p2p.Streams.Register(&StreamInfo{RemotePeer: a, Direction: DirInbound, Listener: l2})
+	if p2p.allowStream(l1, a) || p2p.allowStream(l2, a) {
+		t.Fatal("expected the node-wide limit to be reached")
+	}
+	if !p2p.allowStream(l1, peer.ID("peer-b")) {
+		t.Fatal("expected other peers to have limits of their own")
+	}
+
+	// a listener's own limit only counts its streams
+	if !p2p.allowStream(strict, a) {
+		t.Fatal("expected the listener limit to override the node-wide one")
+	}
+	p2p.Streams.Register(&StreamInfo{RemotePeer: a, Direction: DirInbound, Listener: strict})
+	if p2p.allowStream(strict, a) {
+		t.Fatal("expected the listener limit to be reached")
+	}
+}
+
+// TestListenerMuxSuffixRaw forwards raw bytes on a listener which isn't
+// multiplexed, even though its protocol ends like multiplexed ones
+func TestListenerMuxSuffixRaw(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h.ID(), h, h.Peerstore())
+
+	echo := startEcho(t)
+	defer echo.Close()
+
+	proto := "/p2p/echo" + MuxSuffix
+	if _, err := p2p.NewListener(ctx, proto, echo.Multiaddr(), ListenerOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	listenerInfo, err := p2p.Dial(ctx, nil, h.ID(), proto, bindAddr, DialOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := manet.Dial(listenerInfo.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	echoRoundTrip(t, c, "raw bytes")
+}
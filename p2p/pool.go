@@ -0,0 +1,238 @@
+package p2p
+
+import (
+	"errors"
+	"io"
+	gonet "net"
+	"sync"
+	"time"
+
+	manet "gx/ipfs/QmRK2LxanhK2gZq6k6R7vk5ZoYZk8ULSSTB7FzDsMUX6CB/go-multiaddr-net"
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+)
+
+// backendPool keeps warm connections to the target address of a listener.
+// Connections of streams which ended cleanly are put back into the pool,
+// connections which saw an error or whose response was still to come are
+// dropped.
+//
+// Reusing connections only makes sense for request/response protocols where
+// the stream closing means the backend is done with the exchange.
+type backendPool struct {
+	addr ma.Multiaddr
+	idle chan manet.Conn
+
+	lk     sync.Mutex
+	closed bool
+}
+
+func newBackendPool(addr ma.Multiaddr, size int) *backendPool {
+	p := &backendPool{
+		addr: addr,
+		idle: make(chan manet.Conn, size),
+	}
+	go p.fill()
+	return p
+}
+
+// fill warms the pool up
+func (p *backendPool) fill() {
+	for i := 0; i < cap(p.idle); i++ {
+		c, err := dial(p.addr)
+		if err != nil {
+			log.Debugf("p2p: failed to warm up connection pool to %s: %s", p.addr, err)
+			return
+		}
+		p.put(c)
+	}
+}
+
+// get returns an idle connection to the target, or dials a new one if there
+// is none left
+func (p *backendPool) get() (*pooledConn, error) {
+	for {
+		select {
+		case c := <-p.idle:
+			if !alive(c) {
+				c.Close()
+				continue
+			}
+			return &pooledConn{Conn: c, pool: p}, nil
+		default:
+			c, err := dial(p.addr)
+			if err != nil {
+				return nil, err
+			}
+			return &pooledConn{Conn: c, pool: p}, nil
+		}
+	}
+}
+
+func (p *backendPool) put(c manet.Conn) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if p.closed {
+		c.Close()
+		return
+	}
+
+	select {
+	case p.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+// close closes all idle connections. Connections in use are closed instead
+// of being returned once their streams end.
+func (p *backendPool) close() {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	p.closed = true
+	for {
+		select {
+		case c := <-p.idle:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
+
+// dialTarget connects to the listener's target address, using the
+// connection pool if there is one. It returns the address it connected to,
+// as the listener may be retargeted at any time.
+func (c *ListenerInfo) dialTarget() (io.ReadWriteCloser, ma.Multiaddr, error) {
+	c.targetLk.Lock()
+	addr, pool := c.Address, c.pool
+	c.targetLk.Unlock()
+
+	if pool != nil {
+		pc, err := pool.get()
+		if err != nil {
+			return nil, nil, err
+		}
+		return pc, addr, nil
+	}
+
+	conn, err := dial(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, addr, nil
+}
+
+// alive checks whether the backend closed an idle connection
+func alive(c manet.Conn) bool {
+	c.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer c.SetReadDeadline(time.Time{})
+
+	var b [1]byte
+	_, err := c.Read(b[:])
+	return isTimeout(err)
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(gonet.Error)
+	return ok && ne.Timeout()
+}
+
+var errPooledCloseWrite = errors.New("pooled connections are reused, not closed for writing")
+
+// pooledConn is the local endpoint of a stream using a pooled connection.
+// Closing it only interrupts the copy loop reading from it, the connection
+// goes back to the pool once the stream released it, provided the backend
+// answered what was last written to it.
+type pooledConn struct {
+	manet.Conn
+	pool *backendPool
+
+	lk      sync.Mutex
+	closing bool
+	broken  bool
+
+	// bytes were written which the backend didn't answer yet
+	pending bool
+}
+
+func (c *pooledConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+
+	c.lk.Lock()
+	if n > 0 {
+		c.pending = false
+	}
+	if err != nil && !isTimeout(err) {
+		c.broken = true
+	}
+	c.lk.Unlock()
+	return n, err
+}
+
+func (c *pooledConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+
+	c.lk.Lock()
+	if n > 0 {
+		c.pending = true
+	}
+	if err != nil {
+		c.broken = true
+	}
+	c.lk.Unlock()
+	return n, err
+}
+
+func (c *pooledConn) setBroken() {
+	c.lk.Lock()
+	c.broken = true
+	c.lk.Unlock()
+}
+
+func (c *pooledConn) Close() error {
+	c.lk.Lock()
+	c.closing = true
+	c.lk.Unlock()
+	return c.Conn.SetReadDeadline(time.Now())
+}
+
+// CloseWrite is called once the remote side sent all it had to. A
+// connection the backend answered already is left open to be reused. One
+// whose response is still to come is closed for writing instead, so that
+// the response still reaches the remote side, and evicted from the pool:
+// reused, it would hand the response to the next stream.
+func (c *pooledConn) CloseWrite() error {
+	c.lk.Lock()
+	pending := c.pending
+	if pending {
+		c.broken = true
+	}
+	c.lk.Unlock()
+
+	if !pending {
+		return errPooledCloseWrite
+	}
+	return forwardCloseWrite(c.Conn)
+}
+
+func (c *pooledConn) Reset() error {
+	c.setBroken()
+	return c.Conn.Close()
+}
+
+func (c *pooledConn) release() {
+	c.lk.Lock()
+	reuse := c.closing && !c.broken && !c.pending
+	c.lk.Unlock()
+
+	// nothing the backend sent may be left for the next stream to read
+	if !reuse || !alive(c.Conn) {
+		c.Conn.Close()
+		return
+	}
+
+	c.Conn.SetReadDeadline(time.Time{})
+	c.pool.put(c.Conn)
+}
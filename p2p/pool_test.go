@@ -0,0 +1,205 @@
+package p2p
+
+import (
+	"io"
+	"io/ioutil"
+	gonet "net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	manet "gx/ipfs/QmRK2LxanhK2gZq6k6R7vk5ZoYZk8ULSSTB7FzDsMUX6CB/go-multiaddr-net"
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+)
+
+// startCountingEcho starts an echo service counting accepted connections
+func startCountingEcho(t *testing.T, accepted *int32) manet.Listener {
+	return startDelayedEcho(t, accepted, 0)
+}
+
+// startDelayedEcho starts a counting echo service which waits for delay
+// before answering a new connection
+func startDelayedEcho(t *testing.T, accepted *int32, delay time.Duration) manet.Listener {
+	addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := manet.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			go func() {
+				time.Sleep(delay)
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	return l
+}
+
+func waitAccepted(t *testing.T, accepted *int32, n int32) {
+	for i := 0; atomic.LoadInt32(accepted) < n; i++ {
+		if i == 100 {
+			t.Fatalf("expected %d backend connections, got %d", n, atomic.LoadInt32(accepted))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBackendPoolReuse(t *testing.T) {
+	var accepted int32
+	echo := startCountingEcho(t, &accepted)
+	defer echo.Close()
+
+	pool := newBackendPool(echo.Multiaddr(), 1)
+	defer pool.close()
+
+	// wait for the pool to warm up
+	waitAccepted(t, &accepted, 1)
+
+	for i := 0; i < 3; i++ {
+		c, err := pool.get()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close()
+		c.release()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Fatalf("expected a single backend connection, got %d", n)
+	}
+}
+
+func TestBackendPoolEvictsBroken(t *testing.T) {
+	var accepted int32
+	echo := startCountingEcho(t, &accepted)
+	defer echo.Close()
+
+	pool := newBackendPool(echo.Multiaddr(), 1)
+	defer pool.close()
+	waitAccepted(t, &accepted, 1)
+
+	c, err := pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Reset()
+	c.release()
+
+	c, err = pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	c.release()
+
+	// the reset connection must have been replaced
+	waitAccepted(t, &accepted, 2)
+}
+
+func TestBackendPoolHalfCloseBeforeResponse(t *testing.T) {
+	var accepted int32
+	echo := startDelayedEcho(t, &accepted, 50*time.Millisecond)
+	defer echo.Close()
+
+	pool := newBackendPool(echo.Multiaddr(), 1)
+	defer pool.close()
+	waitAccepted(t, &accepted, 1)
+
+	c, err := pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, peerOut := gonet.Pipe()
+	out, peerIn := gonet.Pipe()
+	s := NewStream(c, &halfRemote{in: in, out: out}, "/p2p/test", DirInbound)
+	s.startStreaming()
+
+	// the remote side is done sending before the backend answers
+	go func() {
+		peerOut.Write([]byte("req"))
+		peerOut.Close()
+	}()
+
+	resp, err := ioutil.ReadAll(peerIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "req" {
+		t.Fatalf("expected the late response to reach the remote side, got %q", resp)
+	}
+	waitDone(t, s)
+
+	// the connection was evicted, the next stream doesn't read the response
+	// of the previous one
+	next, err := pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Reset()
+	if _, err := next.Write([]byte("next")); err != nil {
+		t.Fatal(err)
+	}
+	next.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(next, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "next" {
+		t.Fatalf("expected the next stream to read its own response, got %q", buf)
+	}
+	if n := atomic.LoadInt32(&accepted); n != 2 {
+		t.Fatalf("expected the connection to be replaced, got %d backend connections", n)
+	}
+}
+
+func TestBackendPoolClosedBeforeResponse(t *testing.T) {
+	var accepted int32
+	echo := startDelayedEcho(t, &accepted, 50*time.Millisecond)
+	defer echo.Close()
+
+	pool := newBackendPool(echo.Multiaddr(), 1)
+	defer pool.close()
+	waitAccepted(t, &accepted, 1)
+
+	c, err := pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("req")); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	c.release()
+
+	// the unanswered connection isn't reused
+	c, err = pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	c.release()
+	waitAccepted(t, &accepted, 2)
+}
@@ -0,0 +1,166 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	net "gx/ipfs/QmXoz9o2PT3tEzf7hicegwex5UgVP54n3k82K7jrWFyN86/go-libp2p-net"
+	pro "gx/ipfs/QmZNkThpqfVXs9GNbexPrfBbXSLNYeKrE7jwFM2oqHbyqN/go-libp2p-protocol"
+	peer "gx/ipfs/QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74/go-libp2p-peer"
+)
+
+// ErrProbeMismatch is returned by Probe when the peer answered with something
+// else than the payload
+var ErrProbeMismatch = errors.New("peer didn't echo the payload back")
+
+// Errors returned by Test, telling why the stream couldn't be opened
+var (
+	ErrNoAddresses          = errors.New("no addresses known for the peer")
+	ErrDialTimeout          = errors.New("dial timed out")
+	ErrProtocolNotSupported = errors.New("protocol not supported by the peer")
+)
+
+// TestResult is what Test found out about the peer
+type TestResult struct {
+	// Time taken to connect to the peer, 0 if it was connected already
+	Connect   time.Duration
+	Connected bool
+
+	// Time taken to open the stream and negotiate the protocol
+	Open     time.Duration
+	Protocol string
+
+	// Round trip time of the echoed byte, 0 without echo
+	Echo time.Duration
+}
+
+// Probe opens a stream to the protocol of the peer and closes it again,
+// without leaving a listener behind. Without a payload it only checks that the
+// stream can be opened, and returns the time it took. With a payload, it is
+// sent and the same bytes are expected back, as from an echo service, and the
+// round trip time of the payload is returned.
+func (p2p *P2P) Probe(ctx context.Context, p peer.ID, proto string, payload []byte) (time.Duration, error) {
+	listenerInfo := &ListenerInfo{
+		Identity: p2p.identity,
+		Protocol: proto,
+	}
+
+	res, err := p2p.probe(ctx, p, listenerInfo, payload)
+	if len(payload) == 0 {
+		return res.Connect + res.Open, err
+	}
+	return res.Echo, err
+}
+
+// Test connects to the peer and opens a stream to the protocol the way
+// forwards do, timing both steps separately, then closes the stream again.
+// With echo a single byte is sent and expected back. Nothing is registered,
+// so it leaves no listener or stream behind. The dial timeout is the node's
+// unless one is given.
+func (p2p *P2P) Test(ctx context.Context, p peer.ID, proto string, dialTimeout time.Duration, echo bool) (*TestResult, error) {
+	listenerInfo := &ListenerInfo{
+		Identity:    p2p.identity,
+		Protocol:    proto,
+		DialTimeout: dialTimeout,
+	}
+
+	var payload []byte
+	if echo {
+		payload = []byte{'?'}
+	}
+	return p2p.probe(ctx, p, listenerInfo, payload)
+}
+
+// probe connects to the peer and opens a stream to the protocol of the
+// listener, then sends the payload if there is one and expects it back. The
+// stream is closed again in any case. Failures are reported as the errors
+// declared above when they are one of those reasons.
+func (p2p *P2P) probe(ctx2 context.Context, p peer.ID, listenerInfo *ListenerInfo, payload []byte) (*TestResult, error) {
+	ctx, cancel := context.WithTimeout(ctx2, p2p.dialTimeout(listenerInfo))
+	defer cancel()
+
+	proto := listenerInfo.Protocol
+	res := &TestResult{}
+	var s net.Stream
+	var err error
+	if p == p2p.identity {
+		res.Connected = true
+		start := time.Now()
+		s, err = p2p.newSelfStream(ctx, proto)
+		res.Open = time.Since(start)
+	} else {
+		res.Connected = p2p.peerHost.Network().Connectedness(p) == net.Connected
+		if !res.Connected {
+			start := time.Now()
+			err = p2p.connectPreferring(ctx, p, listenerInfo.Prefer)
+			res.Connect = time.Since(start)
+			if err != nil {
+				return res, testError(ctx, err, len(p2p.peerstore.Addrs(p)) == 0)
+			}
+		}
+
+		start := time.Now()
+		s, err = p2p.peerHost.NewStream(ctx, p, pro.ID(proto))
+		res.Open = time.Since(start)
+	}
+	if err != nil {
+		return res, testError(ctx, err, false)
+	}
+	res.Protocol = string(s.Protocol())
+
+	if len(payload) == 0 {
+		s.Close()
+		return res, nil
+	}
+
+	s.SetDeadline(time.Now().Add(p2p.dialTimeout(listenerInfo)))
+	start := time.Now()
+	reply := make([]byte, len(payload))
+	_, err = s.Write(payload)
+	if err == nil {
+		_, err = io.ReadFull(s, reply)
+	}
+	if err != nil {
+		s.Reset()
+		// the protocol may only be negotiated once data is sent
+		if notSupported(err) {
+			return res, ErrProtocolNotSupported
+		}
+		return res, fmt.Errorf("echo failed: %s", err)
+	}
+	res.Echo = time.Since(start)
+	s.Close()
+
+	if !bytes.Equal(reply, payload) {
+		return res, ErrProbeMismatch
+	}
+	return res, nil
+}
+
+// testError tells why the stream couldn't be opened, when it's one of the
+// reasons probe reports
+func testError(ctx context.Context, err error, noAddrs bool) error {
+	switch {
+	case noAddrs:
+		return ErrNoAddresses
+	case ctx.Err() == context.DeadlineExceeded:
+		return ErrDialTimeout
+	case notSupported(err):
+		return ErrProtocolNotSupported
+	}
+	return err
+}
+
+// errMultistreamNotSupported is the error value multistream refuses a
+// protocol with. go-multistream isn't a dependency of its own, so its
+// ErrNotSupported can't be referred to and is recognized by its value.
+var errMultistreamNotSupported = errors.New("protocol not supported")
+
+// notSupported tells whether the error says the peer refused the protocol
+func notSupported(err error) bool {
+	return err == ErrNoSelfListener || err.Error() == errMultistreamNotSupported.Error()
+}
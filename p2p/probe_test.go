@@ -0,0 +1,119 @@
+package p2p
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	net "gx/ipfs/QmXoz9o2PT3tEzf7hicegwex5UgVP54n3k82K7jrWFyN86/go-libp2p-net"
+	mocknet "gx/ipfs/QmY6iAoG9DVgZwh5ZRcQEpa2uErAe1Hbei8qXPCjpDS9Ge/go-libp2p/p2p/net/mock"
+)
+
+func TestProbe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h1, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	h2.SetStreamHandler("/p2p/echo", func(s net.Stream) {
+		io.Copy(s, s)
+		s.Close()
+	})
+	h2.SetStreamHandler("/p2p/upper", func(s net.Stream) {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(s, buf); err == nil {
+			s.Write([]byte("HELLO"))
+		}
+		s.Close()
+	})
+
+	p2p := NewP2P(h1.ID(), h1, h1.Peerstore())
+
+	if _, err := p2p.Probe(ctx, h2.ID(), "/p2p/echo", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p2p.Probe(ctx, h2.ID(), "/p2p/echo", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p2p.Probe(ctx, h2.ID(), "/p2p/upper", []byte("hello")); err != ErrProbeMismatch {
+		t.Fatalf("expected %v, got %v", ErrProbeMismatch, err)
+	}
+	if _, err := p2p.Probe(ctx, h2.ID(), "/p2p/missing", []byte("hello")); err == nil {
+		t.Fatal("expected probing an unsupported protocol to fail")
+	}
+
+	if n := len(p2p.Listeners.List()); n != 0 {
+		t.Fatalf("expected no listener to be left behind, got %d", n)
+	}
+}
+
+func TestTest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h1, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	// not linked, and none of its addresses are known to h1
+	h3, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h2.SetStreamHandler("/p2p/echo", func(s net.Stream) {
+		io.Copy(s, s)
+		s.Close()
+	})
+
+	p2p := NewP2P(h1.ID(), h1, h1.Peerstore())
+
+	res, err := p2p.Test(ctx, h2.ID(), "/p2p/echo", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Connected || res.Protocol != "/p2p/echo" || res.Echo == 0 {
+		t.Fatalf("expected a fresh connection and an echo over /p2p/echo, got %+v", res)
+	}
+
+	res, err = p2p.Test(ctx, h2.ID(), "/p2p/echo", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Connected || res.Connect != 0 || res.Echo != 0 {
+		t.Fatalf("expected the existing connection to be used without echo, got %+v", res)
+	}
+
+	if _, err := p2p.Test(ctx, h2.ID(), "/p2p/missing", 0, true); err != ErrProtocolNotSupported {
+		t.Fatalf("expected %v, got %v", ErrProtocolNotSupported, err)
+	}
+	if _, err := p2p.Test(ctx, h3.ID(), "/p2p/echo", 0, false); err != ErrNoAddresses {
+		t.Fatalf("expected %v, got %v", ErrNoAddresses, err)
+	}
+
+	if n := len(p2p.Listeners.List()); n != 0 {
+		t.Fatalf("expected no listener to be left behind, got %d", n)
+	}
+	if n := len(p2p.Streams.Snapshot()); n != 0 {
+		t.Fatalf("expected no stream to be registered, got %d", n)
+	}
+}
@@ -0,0 +1,236 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// Priority is the scheduling class of a stream when the node has a bandwidth
+// limit configured. Without a limit it has no effect.
+type Priority int
+
+const (
+	// PriorityLow is meant for bulk transfers, like backups
+	PriorityLow Priority = -1
+	// PriorityNormal is the default priority
+	PriorityNormal Priority = 0
+	// PriorityHigh is meant for interactive traffic, like ssh sessions
+	PriorityHigh Priority = 1
+)
+
+// share of the bandwidth each priority gets when all of them are busy
+var priorityWeights = map[Priority]float64{
+	PriorityLow:    1,
+	PriorityNormal: 4,
+	PriorityHigh:   16,
+}
+
+// ParsePriority parses the low, normal and high priority names
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "low":
+		return PriorityLow, nil
+	case "", "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	default:
+		return PriorityNormal, fmt.Errorf("invalid priority %q, expected low, normal or high", s)
+	}
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+// RateLimiter is a token bucket shared by all streams of a node. Writers
+// waiting for bandwidth are served using weighted fair queuing over their
+// priorities, so high priority streams keep a low latency while a bulk
+// transfer saturates the limit, and low priority ones still make progress.
+type RateLimiter struct {
+	rate  float64 // bytes per second
+	burst float64
+
+	lk      sync.Mutex
+	tokens  float64
+	last    time.Time
+	vtime   float64
+	finish  map[Priority]float64
+	waiters []*rateWaiter
+	timer   *time.Timer
+
+	// bytes granted since windowStart, and the rate over the previous window
+	windowStart time.Time
+	windowBytes float64
+	lastRate    float64
+}
+
+// RateStats describes the current use of a RateLimiter
+type RateStats struct {
+	// Configured limit, in bytes per second
+	Limit int64
+
+	// Bandwidth granted over roughly the last second, in bytes per second
+	Rate float64
+
+	// Number of writers waiting for bandwidth
+	Waiting int
+}
+
+type rateWaiter struct {
+	n   float64
+	tag float64
+	ch  chan struct{}
+}
+
+// NewRateLimiter creates a limiter allowing rate bytes per second, in bursts
+// of up to a tenth of a second worth of data
+func NewRateLimiter(rate int64) *RateLimiter {
+	burst := math.Max(float64(rate)/10, 1024)
+	now := time.Now()
+	return &RateLimiter{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+		finish: make(map[Priority]float64),
+
+		windowStart: now,
+	}
+}
+
+// Stats returns the current utilization of the limiter
+func (l *RateLimiter) Stats() RateStats {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	rate := l.lastRate
+	if elapsed := time.Since(l.windowStart); elapsed >= time.Second {
+		// nothing was granted for a while, the current window is the
+		// better estimate
+		rate = l.windowBytes / elapsed.Seconds()
+	}
+
+	return RateStats{
+		Limit:   int64(l.rate),
+		Rate:    rate,
+		Waiting: len(l.waiters),
+	}
+}
+
+func (l *RateLimiter) recordLocked(n float64, now time.Time) {
+	if elapsed := now.Sub(l.windowStart); elapsed >= time.Second {
+		l.lastRate = l.windowBytes / elapsed.Seconds()
+		l.windowStart = now
+		l.windowBytes = 0
+	}
+	l.windowBytes += n
+}
+
+// Wait blocks until n bytes may be sent by a stream of the given priority.
+// Requests larger than the burst size are only charged the burst size.
+func (l *RateLimiter) Wait(prio Priority, n int) {
+	weight, ok := priorityWeights[prio]
+	if !ok {
+		weight = priorityWeights[PriorityNormal]
+	}
+
+	l.lk.Lock()
+	w := &rateWaiter{
+		n:  math.Min(float64(n), l.burst),
+		ch: make(chan struct{}),
+	}
+
+	start := math.Max(l.vtime, l.finish[prio])
+	w.tag = start + w.n/weight
+	l.finish[prio] = w.tag
+
+	l.waiters = append(l.waiters, w)
+	l.dispatchLocked()
+	l.lk.Unlock()
+
+	<-w.ch
+}
+
+func (l *RateLimiter) dispatch() {
+	l.lk.Lock()
+	l.timer = nil
+	l.dispatchLocked()
+	l.lk.Unlock()
+}
+
+// dispatchLocked releases waiters in virtual finish time order for as long
+// as there are tokens, and schedules itself to run again once the next
+// waiter can be served
+func (l *RateLimiter) dispatchLocked() {
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	for len(l.waiters) > 0 {
+		next := 0
+		for i, w := range l.waiters {
+			if w.tag < l.waiters[next].tag {
+				next = i
+			}
+		}
+
+		w := l.waiters[next]
+		if w.n > l.tokens {
+			if l.timer == nil {
+				wait := time.Duration((w.n - l.tokens) / l.rate * float64(time.Second))
+				l.timer = time.AfterFunc(wait, l.dispatch)
+			}
+			return
+		}
+
+		l.tokens -= w.n
+		l.vtime = w.tag
+		l.recordLocked(w.n, now)
+		l.waiters = append(l.waiters[:next], l.waiters[next+1:]...)
+		close(w.ch)
+	}
+}
+
+// limitedWriter throttles writes to the underlying writer through a
+// RateLimiter
+type limitedWriter struct {
+	w    io.Writer
+	l    *RateLimiter
+	prio Priority
+}
+
+func (w *limitedWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := len(b)
+		if max := int(w.l.burst); chunk > max {
+			chunk = max
+		}
+
+		w.l.Wait(w.prio, chunk)
+		n, err := w.w.Write(b[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[chunk:]
+	}
+	return written, nil
+}
+
+func (w *limitedWriter) CloseWrite() error {
+	return forwardCloseWrite(w.w)
+}
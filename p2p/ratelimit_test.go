@@ -0,0 +1,160 @@
+package p2p
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParsePriority(t *testing.T) {
+	for _, p := range []Priority{PriorityLow, PriorityNormal, PriorityHigh} {
+		parsed, err := ParsePriority(p.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != p {
+			t.Fatalf("expected %s, got %s", p, parsed)
+		}
+	}
+
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Fatal("expected an error for an unknown priority")
+	}
+}
+
+func TestRateLimiterInteractiveLatency(t *testing.T) {
+	// 64KiB/s with 6.4KiB bursts
+	l := NewRateLimiter(64 * 1024)
+	chunk := int(l.burst)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			l.Wait(PriorityLow, chunk)
+		}
+	}()
+
+	// let the bulk transfer saturate the limit
+	time.Sleep(300 * time.Millisecond)
+
+	var worst time.Duration
+	for i := 0; i < 10; i++ {
+		start := time.Now()
+		l.Wait(PriorityHigh, 100)
+		if d := time.Since(start); d > worst {
+			worst = d
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	close(stop)
+	wg.Wait()
+
+	// the interactive stream should never have to wait for more than the
+	// bulk chunk being sent when it arrived
+	chunkTime := time.Duration(float64(chunk) / l.rate * float64(time.Second))
+	if worst > 2*chunkTime {
+		t.Fatalf("interactive write waited %s, expected at most %s", worst, 2*chunkTime)
+	}
+}
+
+func TestRateLimiterRate(t *testing.T) {
+	l := NewRateLimiter(100 * 1024)
+	chunk := int(l.burst)
+
+	start := time.Now()
+	// the first burst is free
+	for sent := 0; sent < 50*1024+chunk; sent += chunk {
+		l.Wait(PriorityNormal, chunk)
+	}
+
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatalf("sent 50KiB in %s, limit not applied", d)
+	}
+}
+
+func TestRateLimiterStats(t *testing.T) {
+	l := NewRateLimiter(100 * 1024)
+	chunk := int(l.burst)
+
+	for start := time.Now(); time.Since(start) < 1500*time.Millisecond; {
+		l.Wait(PriorityNormal, chunk)
+	}
+
+	st := l.Stats()
+	if st.Limit != 100*1024 {
+		t.Fatalf("expected limit %d, got %d", 100*1024, st.Limit)
+	}
+	if st.Rate < 80*1024 || st.Rate > 120*1024 {
+		t.Fatalf("expected rate close to the limit, got %f", st.Rate)
+	}
+}
+
+// throughput floods a stream set up by setup for a second and returns the
+// bytes per second it received and sent
+func throughput(t *testing.T, setup func(s *StreamInfo)) (in, out float64) {
+	s, _ := newFloodedStream(setup)
+	start := time.Now()
+	time.Sleep(time.Second)
+	in, out = float64(s.BytesIn()), float64(s.BytesOut())
+	elapsed := time.Since(start).Seconds()
+	s.Reset()
+	waitDone(t, s)
+	return in / elapsed, out / elapsed
+}
+
+func TestStreamRateLimitPerDirection(t *testing.T) {
+	const limit = 64 * 1024
+
+	in, out := throughput(t, func(s *StreamInfo) {
+		s.UpLimiter = NewRateLimiter(limit)
+	})
+	if out < limit/2 || out > 1.5*limit {
+		t.Fatalf("expected about %d bytes/s sent, got %.0f", limit, out)
+	}
+	if in < 4*limit {
+		t.Fatalf("expected receiving to be unlimited, got %.0f bytes/s", in)
+	}
+
+	in, out = throughput(t, func(s *StreamInfo) {
+		s.DownLimiter = NewRateLimiter(limit)
+	})
+	if in < limit/2 || in > 1.5*limit {
+		t.Fatalf("expected about %d bytes/s received, got %.0f", limit, in)
+	}
+	if out < 4*limit {
+		t.Fatalf("expected sending to be unlimited, got %.0f bytes/s", out)
+	}
+}
+
+func TestStreamRateLimitStricterApplies(t *testing.T) {
+	const limit = 64 * 1024
+
+	// the node-wide limit is shared by both directions and below the limit
+	// of the stream
+	in, out := throughput(t, func(s *StreamInfo) {
+		s.Limiter = NewRateLimiter(limit)
+		s.UpLimiter = NewRateLimiter(4 * limit)
+		s.DownLimiter = NewRateLimiter(4 * limit)
+	})
+	if in+out > 1.5*limit {
+		t.Fatalf("expected at most about %d bytes/s in total, got %.0f in, %.0f out", limit, in, out)
+	}
+
+	// the limit of the stream is below the node-wide one
+	_, out = throughput(t, func(s *StreamInfo) {
+		s.Limiter = NewRateLimiter(8 * limit)
+		s.UpLimiter = NewRateLimiter(limit)
+	})
+	if out < limit/2 || out > 1.5*limit {
+		t.Fatalf("expected about %d bytes/s sent, got %.0f", limit, out)
+	}
+}
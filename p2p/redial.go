@@ -0,0 +1,175 @@
+package p2p
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	net "gx/ipfs/QmXoz9o2PT3tEzf7hicegwex5UgVP54n3k82K7jrWFyN86/go-libp2p-net"
+	pro "gx/ipfs/QmZNkThpqfVXs9GNbexPrfBbXSLNYeKrE7jwFM2oqHbyqN/go-libp2p-protocol"
+)
+
+// redialStream wraps an outgoing stream which may have been opened over a
+// dying connection. If the stream fails before any data went through it, it
+// is re-opened over a fresh connection, once.
+type redialStream struct {
+	net.Stream
+
+	lk     sync.Mutex
+	used   bool
+	closed bool
+
+	// closed once the re-dial in progress is over, nil when there is none
+	redialing chan struct{}
+
+	reopen   func() (net.Stream, error)
+	onRedial func()
+}
+
+func (p2p *P2P) redialOnce(ctx context.Context, listenerInfo *ListenerInfo, remote net.Stream) *redialStream {
+	p := remote.Conn().RemotePeer()
+	proto := remote.Protocol()
+
+	return &redialStream{
+		Stream: remote,
+		reopen: func() (net.Stream, error) {
+			ctx, cancel := context.WithTimeout(ctx, p2p.dialTimeout(listenerInfo))
+			defer cancel()
+
+			if err := p2p.connectPreferring(ctx, p, listenerInfo.Prefer); err != nil {
+				return nil, err
+			}
+			return p2p.peerHost.NewStream(ctx, p, proto)
+		},
+		onRedial: func() {
+			atomic.AddUint64(&listenerInfo.Redials, 1)
+			atomic.AddUint64(&p2p.redials, 1)
+		},
+	}
+}
+
+// current returns the stream in use and whether it may still be replaced
+func (s *redialStream) current() (net.Stream, bool) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.Stream, !s.used
+}
+
+func (s *redialStream) markUsed() {
+	s.lk.Lock()
+	s.used = true
+	s.lk.Unlock()
+}
+
+// retry replaces the failed stream, unless data was already exchanged or it
+// was already replaced once. It returns the stream to retry the operation on.
+// The lock isn't held while re-dialing, a copy loop failing meanwhile waits
+// for the outcome.
+func (s *redialStream) retry(failed net.Stream) (net.Stream, bool) {
+	s.lk.Lock()
+	for s.redialing != nil {
+		wait := s.redialing
+		s.lk.Unlock()
+		<-wait
+		s.lk.Lock()
+	}
+
+	if s.closed {
+		s.lk.Unlock()
+		return nil, false
+	}
+	if cur := s.Stream; cur != failed {
+		// the other copy loop already replaced it
+		s.lk.Unlock()
+		return cur, true
+	}
+	if s.used {
+		s.lk.Unlock()
+		return nil, false
+	}
+	s.used = true
+	done := make(chan struct{})
+	s.redialing = done
+	s.lk.Unlock()
+
+	log.Debugf("p2p: stream to %s failed before any data was sent, re-dialing", failed.Conn().RemotePeer().Pretty())
+	failed.Reset()
+
+	fresh, err := s.reopen()
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.redialing = nil
+	close(done)
+
+	if err != nil {
+		log.Debugf("p2p: re-dial failed: %s", err)
+		return nil, false
+	}
+	if s.closed {
+		// the stream was closed while re-dialing
+		fresh.Reset()
+		return nil, false
+	}
+
+	s.Stream = fresh
+	s.onRedial()
+	return fresh, true
+}
+
+func (s *redialStream) Read(b []byte) (int, error) {
+	cur, retriable := s.current()
+	n, err := cur.Read(b)
+	if n > 0 {
+		s.markUsed()
+		return n, err
+	}
+	if err != nil && err != io.EOF && retriable {
+		if fresh, ok := s.retry(cur); ok {
+			return fresh.Read(b)
+		}
+	}
+	return n, err
+}
+
+func (s *redialStream) Write(b []byte) (int, error) {
+	cur, retriable := s.current()
+	n, err := cur.Write(b)
+	if n > 0 {
+		s.markUsed()
+		return n, err
+	}
+	if err != nil && retriable {
+		if fresh, ok := s.retry(cur); ok {
+			return fresh.Write(b)
+		}
+	}
+	return n, err
+}
+
+// stop prevents any further re-dial and returns the stream in use
+func (s *redialStream) stop() net.Stream {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.closed = true
+	return s.Stream
+}
+
+func (s *redialStream) Close() error {
+	return s.stop().Close()
+}
+
+func (s *redialStream) Reset() error {
+	return s.stop().Reset()
+}
+
+func (s *redialStream) Protocol() pro.ID {
+	cur, _ := s.current()
+	return cur.Protocol()
+}
+
+func (s *redialStream) Conn() net.Conn {
+	cur, _ := s.current()
+	return cur.Conn()
+}
@@ -0,0 +1,125 @@
+package p2p
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	net "gx/ipfs/QmXoz9o2PT3tEzf7hicegwex5UgVP54n3k82K7jrWFyN86/go-libp2p-net"
+	peer "gx/ipfs/QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74/go-libp2p-peer"
+)
+
+func TestRedialStream(t *testing.T) {
+	conn := &selfConn{id: peer.ID("remote")}
+
+	dead, deadEnd := newSelfStreams(conn, "")
+	deadEnd.Reset()
+	live, liveEnd := newSelfStreams(conn, "")
+
+	redials := 0
+	s := &redialStream{
+		Stream: dead,
+		reopen: func() (net.Stream, error) {
+			return live, nil
+		},
+		onRedial: func() {
+			redials++
+		},
+	}
+
+	received := make(chan string)
+	go func() {
+		buf := make([]byte, 5)
+		io.ReadFull(liveEnd, buf)
+		received <- string(buf)
+	}()
+
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-received; msg != "hello" {
+		t.Fatalf("expected 'hello', got %q", msg)
+	}
+	if redials != 1 {
+		t.Fatalf("expected 1 redial, got %d", redials)
+	}
+
+	// data went through, failures aren't retried anymore
+	liveEnd.Reset()
+	if _, err := s.Write([]byte("hello")); err == nil {
+		t.Fatal("expected write to a closed stream to fail")
+	}
+	if redials != 1 {
+		t.Fatalf("expected 1 redial, got %d", redials)
+	}
+}
+
+func TestRedialStreamClosed(t *testing.T) {
+	conn := &selfConn{id: peer.ID("remote")}
+	stream, _ := newSelfStreams(conn, "")
+
+	s := &redialStream{
+		Stream: stream,
+		reopen: func() (net.Stream, error) {
+			t.Fatal("closed stream was re-dialed")
+			return nil, nil
+		},
+	}
+
+	s.Close()
+	if _, err := s.Write([]byte("hello")); err == nil {
+		t.Fatal("expected write to a closed stream to fail")
+	}
+}
+
+func TestRedialStreamClosedWhileRedialing(t *testing.T) {
+	conn := &selfConn{id: peer.ID("remote")}
+
+	dead, deadEnd := newSelfStreams(conn, "")
+	deadEnd.Reset()
+	fresh, freshEnd := newSelfStreams(conn, "")
+
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	s := &redialStream{
+		Stream: dead,
+		reopen: func() (net.Stream, error) {
+			close(dialing)
+			<-release
+			return fresh, nil
+		},
+		onRedial: func() {
+			t.Error("a stream closed while re-dialing was replaced")
+		},
+	}
+
+	failed := make(chan error)
+	go func() {
+		_, err := s.Write([]byte("hello"))
+		failed <- err
+	}()
+
+	// closing doesn't wait for the dial
+	<-dialing
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected closing not to wait for the re-dial")
+	}
+
+	close(release)
+	if err := <-failed; err == nil {
+		t.Fatal("expected the write to fail once the stream was closed")
+	}
+
+	// the fresh stream was given up
+	freshEnd.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := freshEnd.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the fresh stream to be reset")
+	}
+}
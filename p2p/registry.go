@@ -1,20 +1,38 @@
 package p2p
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	manet "gx/ipfs/QmRK2LxanhK2gZq6k6R7vk5ZoYZk8ULSSTB7FzDsMUX6CB/go-multiaddr-net"
+	logging "gx/ipfs/QmTG23dvpBCBjqQwyDxV8CQT6jmS4PSftNr1VqHhE3MLy7/go-log"
 	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
-	net "gx/ipfs/QmXoz9o2PT3tEzf7hicegwex5UgVP54n3k82K7jrWFyN86/go-libp2p-net"
 	peer "gx/ipfs/QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74/go-libp2p-peer"
 )
 
 // ListenerInfo holds information on a p2p listener.
 type ListenerInfo struct {
+	// Number of incoming streams reset because of the per-peer limit.
+	// Accessed atomically, kept first for 64-bit alignment.
+	RejectedStreams uint64
+
+	// Number of outgoing streams re-opened after failing before any data
+	// was sent. Accessed atomically.
+	Redials uint64
+
 	// Application protocol identifier.
 	Protocol string
 
+	// Additional protocol identifiers accepted by this listener, or tried
+	// in order when dialing if the main one isn't supported.
+	Aliases []string
+
 	// Node identity
 	Identity peer.ID
 
@@ -24,16 +42,182 @@ type ListenerInfo struct {
 	// Local protocol stream listener.
 	Closer io.Closer
 
-	// Flag indicating whether we're still accepting incoming connections, or
-	// whether this application listener has been shutdown.
-	Running bool
+	// Maximum number of concurrent streams a single remote peer may have
+	// open to this listener. Zero means the node-wide default applies.
+	MaxStreamsPerPeer int
+
+	// Priority given to the streams of this listener.
+	Priority Priority
+
+	// Address family preferred when a dial listener connects to its peer.
+	Prefer AddrFamily
+
+	// Whether the listener also accepts multiplexed streams.
+	Multiplex bool
+
+	// Time the listener was opened.
+	Created time.Time
+
+	// Time a dial listener may spend connecting to its peer and opening a
+	// stream to it. Zero means the node's dial timeout applies.
+	DialTimeout time.Duration
+
+	// Whether the round trip time to the remote peer of each stream is
+	// measured, see StreamInfo.Latency.
+	MeasureLatency bool
+
+	// Time after which a dial listener closes each connection it accepted.
+	// Zero means connections aren't closed because of their age.
+	MaxConnAge time.Duration
+
+	// Number of bytes each stream may transfer before it's reset, counted
+	// as MaxBytesMode says. Zero means unlimited.
+	MaxBytes     uint64
+	MaxBytesMode ByteCapMode
+
+	// Bandwidth each stream may use sending to the remote peer (up) and
+	// receiving from it (down), in bytes per second. Zero means unlimited.
+	// The node-wide limit applies as well.
+	RateLimitUp   int64
+	RateLimitDown int64
+
+	// Whether streams stay open both ways until either side closes them,
+	// for long-lived sessions like websockets: a direction ending closes
+	// the whole stream instead of only half of it, and the remote peer is
+	// pinged to notice when it went away.
+	WebSocketFriendly bool
+
+	// Meta are key/value pairs given by whoever opened the listener, e.g.
+	// its owner, to find it later. It isn't changed once the listener is
+	// open.
+	Meta map[string]string
+
+	// Name of the group the listener was opened in with its other routes to
+	// the same backend, empty if it was opened on its own.
+	Group string
+
+	// Pool of connections to Address, nil if every stream dials its own.
+	pool *backendPool
+
+	// guards Address and pool, which Retarget replaces
+	targetLk sync.Mutex
+
+	// set while the listener is paused, accessed atomically
+	paused int32
+
+	// set while the listener accepts incoming connections, accessed
+	// atomically
+	running int32
 
 	Registry *ListenerRegistry
 }
 
+// HasProtocol returns true if the listener accepts streams on the protocol,
+// either as its main protocol or as an alias
+func (c *ListenerInfo) HasProtocol(proto string) bool {
+	if c.Multiplex && isMuxProtocol(proto) {
+		proto = strings.TrimSuffix(proto, MuxSuffix)
+	}
+	if c.Protocol == proto {
+		return true
+	}
+	for _, alias := range c.Aliases {
+		if alias == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// Addr returns the address the listener forwards new streams to, or binds
+// for listeners opened by Dial. It may change at any time, see Retarget.
+func (c *ListenerInfo) Addr() ma.Multiaddr {
+	c.targetLk.Lock()
+	defer c.targetLk.Unlock()
+	return c.Address
+}
+
+// Retarget switches the address new streams of the listener are forwarded
+// to, without closing the listener. Streams already open keep their
+// connection to the old address, idle pooled connections to it are closed.
+func (c *ListenerInfo) Retarget(addr ma.Multiaddr) error {
+	if c.Registry == nil {
+		return errors.New("only listeners forwarding to a local address can be retargeted")
+	}
+	lnet, _, err := manet.DialArgs(addr)
+	if err != nil {
+		return err
+	}
+	switch lnet {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return errors.New("unsupported protocol: " + lnet)
+	}
+
+	c.targetLk.Lock()
+	defer c.targetLk.Unlock()
+
+	c.Address = addr
+	if c.pool != nil {
+		c.pool.close()
+		c.pool = newBackendPool(addr, cap(c.pool.idle))
+	}
+	return nil
+}
+
+// Pause makes the listener reset new streams until Resume is called. The
+// listener stays registered and the streams already open keep flowing.
+func (c *ListenerInfo) Pause() {
+	atomic.StoreInt32(&c.paused, 1)
+}
+
+// Resume makes a paused listener accept new streams again
+func (c *ListenerInfo) Resume() {
+	atomic.StoreInt32(&c.paused, 0)
+}
+
+// Paused returns whether the listener is paused
+func (c *ListenerInfo) Paused() bool {
+	return atomic.LoadInt32(&c.paused) == 1
+}
+
+// Running returns whether the listener still accepts incoming connections,
+// or was shut down
+func (c *ListenerInfo) Running() bool {
+	return atomic.LoadInt32(&c.running) == 1
+}
+
+func (c *ListenerInfo) setRunning(running bool) {
+	var v int32
+	if running {
+		v = 1
+	}
+	atomic.StoreInt32(&c.running, v)
+}
+
+// closePool closes the connection pool of the listener, if it has one
+func (c *ListenerInfo) closePool() {
+	c.targetLk.Lock()
+	defer c.targetLk.Unlock()
+
+	if c.pool != nil {
+		c.pool.close()
+	}
+}
+
+// protocols returns the main protocol followed by the aliases
+func (c *ListenerInfo) protocols() []string {
+	return append([]string{c.Protocol}, c.Aliases...)
+}
+
 // Close closes the listener. Does not affect child streams
 func (c *ListenerInfo) Close() error {
 	c.Closer.Close()
+	if c.Registry == nil {
+		// dial listeners aren't registered, they are forgotten once their
+		// accept loop ends
+		return nil
+	}
 	err := c.Registry.Deregister(c.Protocol)
 	return err
 }
@@ -41,15 +225,44 @@ func (c *ListenerInfo) Close() error {
 // ListenerRegistry is a collection of local application protocol listeners.
 type ListenerRegistry struct {
 	Listeners []*ListenerInfo
+
+	// guards Listeners against streams dialing this node itself, which look
+	// listeners up while others are registered
+	lk sync.Mutex
 }
 
 // Register registers listenerInfo2 in this registry
 func (c *ListenerRegistry) Register(listenerInfo *ListenerInfo) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
 	c.Listeners = append(c.Listeners, listenerInfo)
 }
 
+// List returns a snapshot of the registered listeners
+func (c *ListenerRegistry) List() []*ListenerInfo {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return append([]*ListenerInfo(nil), c.Listeners...)
+}
+
+// Lookup returns the listener accepting streams on the protocol, nil if there
+// is none
+func (c *ListenerRegistry) Lookup(proto string) *ListenerInfo {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	for _, l := range c.Listeners {
+		if l.HasProtocol(proto) {
+			return l
+		}
+	}
+	return nil
+}
+
 // Deregister removes p2p listener from this registry
 func (c *ListenerRegistry) Deregister(proto string) error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
 	foundAt := -1
 	for i, a := range c.Listeners {
 		if a.Protocol == proto {
@@ -66,11 +279,111 @@ func (c *ListenerRegistry) Deregister(proto string) error {
 	return fmt.Errorf("failed to deregister proto %s", proto)
 }
 
+// remove removes listenerInfo from this registry if it is still registered,
+// leaving alone a listener registered since on the same protocol
+func (c *ListenerRegistry) remove(listenerInfo *ListenerInfo) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	for i, l := range c.Listeners {
+		if l == listenerInfo {
+			c.Listeners = append(c.Listeners[:i], c.Listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+// Direction describes which side opened a p2p stream
+type Direction int
+
+const (
+	// DirInbound is a stream opened by a remote peer to one of our listeners
+	DirInbound Direction = iota
+	// DirOutbound is a stream we opened to a remote peer
+	DirOutbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirInbound:
+		return "inbound"
+	case DirOutbound:
+		return "outbound"
+	default:
+		return "unknown"
+	}
+}
+
+// RemoteStream is the remote endpoint of a p2p stream, usually a net.Stream
+type RemoteStream interface {
+	io.ReadWriteCloser
+	Reset() error
+}
+
+// resetter is implemented by local endpoints which tell an abortive close
+// from a clean one
+type resetter interface {
+	Reset() error
+}
+
+// releaser is implemented by local endpoints which need to know when the copy
+// loops are done with them, like pooled backend connections
+type releaser interface {
+	release()
+}
+
+// closeWriter is implemented by endpoints which can be closed for writing
+// while data is still read from them, like TCP connections. Types wrapping
+// an endpoint implement it by forwarding to the one they wrap.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+var errNoCloseWrite = errors.New("endpoint can't be closed for writing")
+
+// forwardCloseWrite closes w for writing, if it can be
+func forwardCloseWrite(w interface{}) error {
+	if cw, ok := w.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errNoCloseWrite
+}
+
+// closeWrite closes the endpoint for writing if it can be, and tells whether
+// it did
+func closeWrite(c io.Closer) bool {
+	return forwardCloseWrite(c) == nil
+}
+
 // StreamInfo holds information on active incoming and outgoing p2p streams.
 type StreamInfo struct {
+	// Bytes copied from the remote to the local endpoint and vice versa.
+	// Accessed atomically, kept first for 64-bit alignment.
+	bytesIn  uint64
+	bytesOut uint64
+
+	// Bytes counted against the MaxBytes of the listener, in both
+	// directions or only in and out depending on its mode. Unlike bytesIn
+	// and bytesOut they include writes in progress. Accessed atomically.
+	capUsedIn  uint64
+	capUsedOut uint64
+
+	// Time data was last copied in either direction, in unix nanoseconds.
+	// Accessed atomically.
+	lastActivity int64
+
+	// Last measured round trip time to the remote peer in nanoseconds, zero
+	// if it isn't measured. Accessed atomically.
+	latency int64
+
+	// Set once the stream was closed on purpose, the copy loops failing
+	// because of it isn't an error. Accessed atomically.
+	closing int32
+
 	HandlerID uint64
 
-	Protocol string
+	Protocol  string
+	Direction Direction
 
 	LocalPeer peer.ID
 	LocalAddr ma.Multiaddr
@@ -78,64 +391,448 @@ type StreamInfo struct {
 	RemotePeer peer.ID
 	RemoteAddr ma.Multiaddr
 
-	Local  manet.Conn
-	Remote net.Stream
+	Local  io.ReadWriteCloser
+	Remote RemoteStream
+
+	// Priority of the stream under the bandwidth limit.
+	Priority Priority
+
+	// Node-wide bandwidth limiter, nil when there's no limit.
+	Limiter *RateLimiter
+
+	// Limiters of the stream alone for data sent to the remote peer and
+	// received from it, nil when the direction has no limit of its own.
+	UpLimiter   *RateLimiter
+	DownLimiter *RateLimiter
+
+	// Listener the stream was accepted or dialed through, nil if none.
+	Listener *ListenerInfo
 
 	Registry *StreamRegistry
+
+	opened time.Time
+
+	// set by interceptors, see ObserveIn and ObserveOut
+	observeIn, observeOut func([]byte)
+
+	// closed once both copy loops have exited
+	done chan struct{}
+
+	// removes the stream from Registry only once, however often it's closed
+	// or reset
+	deregisterOnce sync.Once
+}
+
+// NewStream creates a stream forwarding data between the local and remote
+// endpoints. Peer and address information is left for the caller to fill in
+// before the stream is registered and started.
+func NewStream(local io.ReadWriteCloser, remote RemoteStream, proto string, dir Direction) *StreamInfo {
+	return &StreamInfo{
+		Protocol:  proto,
+		Direction: dir,
+
+		Local:  local,
+		Remote: remote,
+
+		opened: time.Now(),
+		done:   make(chan struct{}),
+	}
 }
 
 // Close closes stream endpoints and deregisters it
 func (s *StreamInfo) Close() error {
+	atomic.StoreInt32(&s.closing, 1)
 	s.Local.Close()
 	s.Remote.Close()
-	s.Registry.Deregister(s.HandlerID)
+	s.deregister()
 	return nil
 }
 
 // Reset closes stream endpoints and deregisters it
 func (s *StreamInfo) Reset() error {
-	s.Local.Close()
+	if r, ok := s.Local.(resetter); ok {
+		r.Reset()
+	} else {
+		s.Local.Close()
+	}
 	s.Remote.Reset()
-	s.Registry.Deregister(s.HandlerID)
+	s.deregister()
 	return nil
 }
 
+func (s *StreamInfo) deregister() {
+	s.deregisterOnce.Do(func() {
+		if s.Registry != nil {
+			s.Registry.Deregister(s.HandlerID)
+		}
+	})
+}
+
+// CloseAndWait closes the stream and blocks until both of its copy loops
+// have exited and the stream is deregistered, or the context expires
+func (s *StreamInfo) CloseAndWait(ctx context.Context) error {
+	s.Close()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done returns a channel which is closed once both copy loops of the stream
+// have exited
+func (s *StreamInfo) Done() <-chan struct{} {
+	return s.done
+}
+
+// LastActivity returns the time data was last copied over the stream, or the
+// time it was opened if no data was copied yet
+func (s *StreamInfo) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActivity))
+}
+
+// Opened returns the time the stream was opened
+func (s *StreamInfo) Opened() time.Time {
+	return s.opened
+}
+
+// BytesIn returns the number of bytes copied from the remote peer so far
+func (s *StreamInfo) BytesIn() uint64 {
+	return atomic.LoadUint64(&s.bytesIn)
+}
+
+// BytesOut returns the number of bytes copied to the remote peer so far
+func (s *StreamInfo) BytesOut() uint64 {
+	return atomic.LoadUint64(&s.bytesOut)
+}
+
+// Latency returns the round trip time to the remote peer last measured for
+// the stream, or zero if it wasn't measured (yet)
+func (s *StreamInfo) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.latency))
+}
+
+// OriginAddr returns the address of the side which opened the stream
+func (s *StreamInfo) OriginAddr() ma.Multiaddr {
+	if s.Direction == DirInbound {
+		return s.RemoteAddr
+	}
+	return s.LocalAddr
+}
+
+// TargetAddr returns the address the stream is forwarded to
+func (s *StreamInfo) TargetAddr() ma.Multiaddr {
+	if s.Direction == DirInbound {
+		return s.LocalAddr
+	}
+	return s.RemoteAddr
+}
+
+func (s *StreamInfo) loggable() logging.LoggableMap {
+	return logging.LoggableMap{
+		"id":         s.HandlerID,
+		"protocol":   s.Protocol,
+		"direction":  s.Direction.String(),
+		"remotePeer": s.RemotePeer.Pretty(),
+		"origin":     addrString(s.OriginAddr()),
+		"target":     addrString(s.TargetAddr()),
+	}
+}
+
 func (s *StreamInfo) startStreaming() {
+	if s.opened.IsZero() {
+		s.opened = time.Now()
+	}
+	atomic.StoreInt64(&s.lastActivity, s.opened.UnixNano())
+	log.Event(context.TODO(), "P2P.StreamOpened", s.loggable())
+	if s.Registry != nil && s.Registry.JSONLog {
+		s.Registry.logEvent(streamEvent(EventStreamOpened, s))
+	} else {
+		log.Debugf("stream %d opened: %s %s with %s", s.HandlerID, s.Direction, s.Protocol, s.RemotePeer.Pretty())
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// A direction ending cleanly is only closed for writing, so that the
+	// other one can still deliver the response of a request/response
+	// protocol. Websocket-friendly streams close entirely instead, a
+	// session only open one way is of no use to either side.
+	var t teardown
+	var localClosed bool
+	fullClose := s.Listener != nil && s.Listener.WebSocketFriendly
+
 	go func() {
-		_, err := io.Copy(s.Local, s.Remote)
-		if err != nil {
-			s.Reset()
-		} else {
-			s.Close()
+		defer wg.Done()
+		_, err := copyStream(s.writer(s.Local, &s.bytesIn), observe(s.Remote, s.observeIn))
+
+		t.lk.Lock()
+		defer t.lk.Unlock()
+		if err != nil || t.stopped {
+			t.fail(s, err)
+			return
+		}
+		if fullClose {
+			t.close(s)
+			return
+		}
+
+		// everything the remote side sent was written already, the local
+		// application reads an EOF and may still finish its side
+		if !closeWrite(s.Local) {
+			localClosed = true
+			s.Local.Close()
 		}
 	}()
 
 	go func() {
-		_, err := io.Copy(s.Remote, s.Local)
-		if err != nil {
-			s.Reset()
-		} else {
+		defer wg.Done()
+		_, err := copyStream(s.writer(s.Remote, &s.bytesOut), observe(s.Local, s.observeOut))
+
+		t.lk.Lock()
+		defer t.lk.Unlock()
+		if localClosed {
+			// reading fails once the local endpoint is closed entirely
+			err = nil
+		}
+		if err != nil || t.stopped {
+			t.fail(s, err)
+			return
+		}
+		if fullClose {
+			t.close(s)
+			return
+		}
+
+		// Close only closes libp2p streams for writing, the remote side
+		// reads an EOF and may still send its response
+		if !closeWrite(s.Remote) {
+			s.Remote.Close()
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		if !t.stopped {
 			s.Close()
 		}
+		if r, ok := s.Local.(releaser); ok {
+			r.release()
+		}
+		s.logClosed(t.err)
+		if s.Registry != nil {
+			s.Registry.ended(s, t.err)
+		}
+		close(s.done)
 	}()
 }
 
+// teardown coordinates the two copy loops of a stream. The first loop to fail
+// resets the stream, which stops the other one: the error that one gets then
+// is a consequence of the reset, not a failure of its own, and isn't
+// reported. Errors caused by closing the stream on purpose aren't either.
+type teardown struct {
+	lk      sync.Mutex
+	stopped bool
+
+	// error the stream failed with, nil if it ended cleanly or was closed
+	err error
+}
+
+// fail stops the stream after a copy loop failed, the caller holds lk
+func (t *teardown) fail(s *StreamInfo, err error) {
+	if t.stopped {
+		return
+	}
+	t.stopped = true
+	if atomic.LoadInt32(&s.closing) == 0 {
+		t.err = err
+	}
+	s.Reset()
+}
+
+// close stops the stream after a copy loop ended cleanly, closing both
+// directions at once, the caller holds lk
+func (t *teardown) close(s *StreamInfo) {
+	if t.stopped {
+		return
+	}
+	t.stopped = true
+	s.Close()
+}
+
+// writer wraps one of the stream endpoints for the copy loops, counting the
+// bytes written and applying the byte cap and the bandwidth limits. Writes
+// wait for the limit of their direction before the node-wide one, so that
+// a stream over its own limit doesn't hold back the others.
+func (s *StreamInfo) writer(w io.Writer, n *uint64) io.Writer {
+	var cw io.Writer = &countingWriter{w: w, n: n, last: &s.lastActivity}
+	cw = s.cappedWriter(cw, n)
+	if s.Limiter != nil {
+		cw = &limitedWriter{w: cw, l: s.Limiter, prio: s.Priority}
+	}
+
+	dirLimiter := s.DownLimiter
+	if n == &s.bytesOut {
+		dirLimiter = s.UpLimiter
+	}
+	if dirLimiter == nil {
+		return cw
+	}
+	return &limitedWriter{w: cw, l: dirLimiter, prio: s.Priority}
+}
+
+func (s *StreamInfo) logClosed(err error) {
+	reason := "eof"
+	if err != nil {
+		reason = err.Error()
+	}
+
+	lm := s.loggable()
+	lm["duration"] = time.Since(s.opened).String()
+	lm["bytesIn"] = s.BytesIn()
+	lm["bytesOut"] = s.BytesOut()
+	lm["reason"] = reason
+	log.Event(context.TODO(), "P2P.StreamClosed", lm)
+
+	if s.Registry != nil && s.Registry.JSONLog {
+		ev := streamEvent(EventStreamClosed, s)
+		ev.Bytes = &EventBytes{In: s.BytesIn(), Out: s.BytesOut()}
+		if err != nil {
+			ev.Error = reason
+		}
+		s.Registry.logEvent(ev)
+		return
+	}
+
+	if err != nil {
+		log.Infof("stream %d (%s with %s) reset: %s", s.HandlerID, s.Protocol, s.RemotePeer.Pretty(), reason)
+	} else {
+		log.Debugf("stream %d closed", s.HandlerID)
+	}
+}
+
+// countingWriter counts bytes written to the underlying writer
+type countingWriter struct {
+	w    io.Writer
+	n    *uint64
+	last *int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddUint64(cw.n, uint64(n))
+	if n > 0 {
+		atomic.StoreInt64(cw.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (cw *countingWriter) CloseWrite() error {
+	return forwardCloseWrite(cw.w)
+}
+
+func addrString(a ma.Multiaddr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
 // StreamRegistry is a collection of active incoming and outgoing protocol app streams.
 type StreamRegistry struct {
 	Streams []*StreamInfo
+	lk      sync.Mutex
+
+	// number of active inbound streams per remote peer, to all listeners
+	// and to each one, for the stream limits
+	inbound         map[peer.ID]int
+	inboundListener map[listenerPeer]int
 
 	nextID uint64
+
+	// counters covering the streams which already ended
+	failed   uint64
+	bytesIn  uint64
+	bytesOut uint64
+
+	// channels of Subscribe, notified of registered streams
+	subs map[chan *StreamInfo]struct{}
+
+	// JSONLog logs the streams opened and closed, and the dials of
+	// listeners which failed, as JSON objects with the fields of Event
+	// instead of messages. Set it before streams are registered.
+	JSONLog bool
+}
+
+// StreamTotals are cumulative counters of all streams a registry has seen
+type StreamTotals struct {
+	// Streams registered since the node started
+	Opened uint64
+	// Streams which ended with an error, and were reset, other than by
+	// being closed
+	Failed uint64
+	// Bytes copied from the remote to the local endpoint and vice versa
+	BytesIn  uint64
+	BytesOut uint64
 }
 
 // Register registers a stream to the registry
 func (c *StreamRegistry) Register(streamInfo *StreamInfo) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
 	streamInfo.HandlerID = c.nextID
+	if streamInfo.done == nil {
+		streamInfo.done = make(chan struct{})
+	}
 	c.Streams = append(c.Streams, streamInfo)
+	c.countInbound(streamInfo, 1)
 	c.nextID++
+
+	for ch := range c.subs {
+		select {
+		case ch <- streamInfo:
+		default:
+			// the subscriber fell behind, it must not block streams
+		}
+	}
+}
+
+// subscriptionBuffer is the number of registered streams a subscriber may
+// fall behind by before it misses some
+const subscriptionBuffer = 16
+
+// Subscribe returns a channel receiving the streams registered from now on,
+// and a function ending the subscription, which must be called once the
+// caller is done. Streams are dropped if the caller doesn't keep up.
+func (c *StreamRegistry) Subscribe() (<-chan *StreamInfo, func()) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if c.subs == nil {
+		c.subs = make(map[chan *StreamInfo]struct{})
+	}
+	ch := make(chan *StreamInfo, subscriptionBuffer)
+	c.subs[ch] = struct{}{}
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			c.lk.Lock()
+			defer c.lk.Unlock()
+			delete(c.subs, ch)
+		})
+	}
 }
 
 // Deregister deregisters stream from the registry
 func (c *StreamRegistry) Deregister(handlerID uint64) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
 	foundAt := -1
 	for i, s := range c.Streams {
 		if s.HandlerID == handlerID {
@@ -145,6 +842,107 @@ func (c *StreamRegistry) Deregister(handlerID uint64) {
 	}
 
 	if foundAt != -1 {
+		c.countInbound(c.Streams[foundAt], -1)
 		c.Streams = append(c.Streams[:foundAt], c.Streams[foundAt+1:]...)
 	}
 }
+
+// Snapshot returns a copy of the list of currently registered streams
+func (c *StreamRegistry) Snapshot() []*StreamInfo {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	streams := make([]*StreamInfo, len(c.Streams))
+	copy(streams, c.Streams)
+	return streams
+}
+
+// Totals returns the cumulative counters of the registry, including the
+// bytes transferred so far by active streams
+func (c *StreamRegistry) Totals() StreamTotals {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	t := StreamTotals{
+		Opened:   c.nextID,
+		Failed:   c.failed,
+		BytesIn:  c.bytesIn,
+		BytesOut: c.bytesOut,
+	}
+	for _, s := range c.Streams {
+		t.BytesIn += s.BytesIn()
+		t.BytesOut += s.BytesOut()
+	}
+	return t
+}
+
+// ended adds a stream which ended to the cumulative counters
+func (c *StreamRegistry) ended(s *StreamInfo, err error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if err != nil && atomic.LoadInt32(&s.closing) == 0 {
+		c.failed++
+	}
+	c.bytesIn += s.BytesIn()
+	c.bytesOut += s.BytesOut()
+}
+
+// listenerPeer keys the inbound streams of a remote peer to a listener
+type listenerPeer struct {
+	listener *ListenerInfo
+	peer     peer.ID
+}
+
+// countInbound adds delta to the inbound stream counts of the stream's remote
+// peer, the caller holds lk. Streams we opened aren't counted.
+func (c *StreamRegistry) countInbound(s *StreamInfo, delta int) {
+	if s.Direction != DirInbound {
+		return
+	}
+	if c.inbound == nil {
+		c.inbound = make(map[peer.ID]int)
+		c.inboundListener = make(map[listenerPeer]int)
+	}
+
+	c.inbound[s.RemotePeer] += delta
+	if c.inbound[s.RemotePeer] <= 0 {
+		delete(c.inbound, s.RemotePeer)
+	}
+	if s.Listener != nil {
+		key := listenerPeer{s.Listener, s.RemotePeer}
+		c.inboundListener[key] += delta
+		if c.inboundListener[key] <= 0 {
+			delete(c.inboundListener, key)
+		}
+	}
+}
+
+// InboundStreams returns the number of active streams the remote peer opened
+// to the listeners of this node
+func (c *StreamRegistry) InboundStreams(p peer.ID) int {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	return c.inbound[p]
+}
+
+// listenerStreams returns the number of active streams the remote peer opened
+// to the listener
+func (c *StreamRegistry) listenerStreams(l *ListenerInfo, p peer.ID) int {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	return c.inboundListener[listenerPeer{l, p}]
+}
+
+// CloseAll closes all streams in the registry and waits for their copy loops
+// to finish
+func (c *StreamRegistry) CloseAll(ctx context.Context) error {
+	for _, s := range c.Snapshot() {
+		if err := s.CloseAndWait(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,629 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	gonet "net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	peer "gx/ipfs/QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74/go-libp2p-peer"
+)
+
+func TestStreamRegistryInboundStreams(t *testing.T) {
+	var reg StreamRegistry
+	a := peer.ID("peer-a")
+	b := peer.ID("peer-b")
+	l1 := &ListenerInfo{Protocol: "/p2p/one"}
+	l2 := &ListenerInfo{Protocol: "/p2p/two"}
+
+	s1 := &StreamInfo{RemotePeer: a, Direction: DirInbound, Listener: l1}
+	s2 := &StreamInfo{RemotePeer: a, Direction: DirInbound, Listener: l2}
+	s3 := &StreamInfo{RemotePeer: b, Direction: DirInbound, Listener: l1}
+	out := &StreamInfo{RemotePeer: a, Direction: DirOutbound, Listener: l1}
+	reg.Register(s1)
+	reg.Register(s2)
+	reg.Register(s3)
+	reg.Register(out)
+
+	// streams we opened to the peer aren't counted
+	if n := reg.InboundStreams(a); n != 2 {
+		t.Fatalf("expected 2 streams for peer a, got %d", n)
+	}
+	if n := reg.InboundStreams(b); n != 1 {
+		t.Fatalf("expected 1 stream for peer b, got %d", n)
+	}
+	if n := reg.listenerStreams(l1, a); n != 1 {
+		t.Fatalf("expected 1 stream for peer a on the first listener, got %d", n)
+	}
+
+	// both copy loops deregister the stream on teardown, the count must
+	// only be decremented once
+	reg.Deregister(s1.HandlerID)
+	reg.Deregister(s1.HandlerID)
+	if n := reg.InboundStreams(a); n != 1 {
+		t.Fatalf("expected 1 stream for peer a, got %d", n)
+	}
+	if n := reg.listenerStreams(l1, a); n != 0 {
+		t.Fatalf("expected no stream for peer a on the first listener, got %d", n)
+	}
+
+	reg.Deregister(s2.HandlerID)
+	reg.Deregister(s3.HandlerID)
+	reg.Deregister(out.HandlerID)
+	if n := reg.InboundStreams(a) + reg.InboundStreams(b); n != 0 {
+		t.Fatalf("expected no streams left, got %d", n)
+	}
+	if len(reg.inbound)+len(reg.inboundListener) != 0 {
+		t.Fatalf("expected the counts to be cleaned up, got %v %v", reg.inbound, reg.inboundListener)
+	}
+}
+
+// pipeConn is an in-memory manet.Conn counting writes made after it was
+// marked as finished
+type pipeConn struct {
+	gonet.Conn
+
+	finished int32
+	late     int32
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.finished) == 1 {
+		atomic.AddInt32(&c.late, 1)
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *pipeConn) LocalMultiaddr() ma.Multiaddr {
+	return nil
+}
+
+func (c *pipeConn) RemoteMultiaddr() ma.Multiaddr {
+	return nil
+}
+
+// testRemote is an in-memory RemoteStream counting resets
+type testRemote struct {
+	gonet.Conn
+
+	resets int32
+}
+
+func (r *testRemote) Reset() error {
+	atomic.AddInt32(&r.resets, 1)
+	return r.Conn.Close()
+}
+
+// shortWriter is a local endpoint which never writes more than half of
+// the data it is given
+type shortWriter struct {
+	gonet.Conn
+}
+
+func (w *shortWriter) Write(b []byte) (int, error) {
+	n := len(b) / 2
+	if n == 0 {
+		n = 1
+	}
+	return w.Conn.Write(b[:n])
+}
+
+func waitDone(t *testing.T, s *StreamInfo) {
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+		t.Fatal("stream copy loops didn't exit")
+	}
+}
+
+// newTestStream sets up a stream between in-memory endpoints. The remote
+// end keeps sending data until the stream is torn down, the local end is
+// drained.
+func newTestStream(reg *StreamRegistry) (*StreamInfo, *pipeConn) {
+	local, localEnd := gonet.Pipe()
+	remote, remoteEnd := gonet.Pipe()
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := remoteEnd.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := localEnd.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	lconn := &pipeConn{Conn: local}
+	s := NewStream(lconn, &testRemote{Conn: remote}, "/p2p/test", DirInbound)
+	s.RemotePeer = peer.ID("remote")
+	s.Registry = reg
+	reg.Register(s)
+	s.startStreaming()
+
+	return s, lconn
+}
+
+func TestStreamRegistrySubscribe(t *testing.T) {
+	var reg StreamRegistry
+	reg.Register(&StreamInfo{})
+
+	streams, cancel := reg.Subscribe()
+	s := &StreamInfo{}
+	reg.Register(s)
+
+	select {
+	case got := <-streams:
+		if got != s {
+			t.Fatal("expected the stream registered after subscribing")
+		}
+	default:
+		t.Fatal("expected the subscriber to be notified")
+	}
+
+	// a subscriber which doesn't keep up doesn't block registering
+	for i := 0; i < subscriptionBuffer+1; i++ {
+		reg.Register(&StreamInfo{})
+	}
+	if n := len(streams); n != subscriptionBuffer {
+		t.Fatalf("expected %d buffered streams, got %d", subscriptionBuffer, n)
+	}
+
+	cancel()
+	cancel()
+	for len(streams) > 0 {
+		<-streams
+	}
+	reg.Register(&StreamInfo{})
+	if len(streams) != 0 {
+		t.Fatal("expected no notification after the subscription ended")
+	}
+}
+
+func TestStreamCloseAndWait(t *testing.T) {
+	var reg StreamRegistry
+	s, lconn := newTestStream(&reg)
+
+	// let some data flow
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.CloseAndWait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&lconn.finished, 1)
+
+	if len(reg.Streams) != 0 {
+		t.Fatal("stream wasn't deregistered")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt32(&lconn.late); n != 0 {
+		t.Fatalf("%d writes after CloseAndWait returned", n)
+	}
+}
+
+func TestStreamRegistryCloseAll(t *testing.T) {
+	var reg StreamRegistry
+	var conns []*pipeConn
+	for i := 0; i < 3; i++ {
+		_, lconn := newTestStream(&reg)
+		conns = append(conns, lconn)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := reg.CloseAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range conns {
+		atomic.StoreInt32(&c.finished, 1)
+	}
+
+	if len(reg.Streams) != 0 {
+		t.Fatalf("expected no streams left, got %d", len(reg.Streams))
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	for _, c := range conns {
+		if n := atomic.LoadInt32(&c.late); n != 0 {
+			t.Fatalf("%d writes after CloseAll returned", n)
+		}
+	}
+}
+
+func TestStreamRegistryTotals(t *testing.T) {
+	var reg StreamRegistry
+
+	// closing a stream on purpose isn't a failure
+	closed, _ := newTestStream(&reg)
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := closed.CloseAndWait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the local endpoint is gone, writing the data of the remote one fails
+	local, localEnd := gonet.Pipe()
+	remote, remoteEnd := gonet.Pipe()
+	localEnd.Close()
+	go remoteEnd.Write([]byte("hello"))
+
+	failed := NewStream(local, &testRemote{Conn: remote}, "/p2p/test", DirInbound)
+	failed.Registry = &reg
+	reg.Register(failed)
+	failed.startStreaming()
+	waitDone(t, failed)
+
+	totals := reg.Totals()
+	if totals.Opened != 2 {
+		t.Fatalf("expected 2 opened streams, got %d", totals.Opened)
+	}
+	if totals.Failed != 1 {
+		t.Fatalf("expected 1 failed stream, got %d", totals.Failed)
+	}
+	if totals.BytesIn != closed.BytesIn() || totals.BytesIn == 0 {
+		t.Fatalf("expected the bytes of the closed stream to be counted, got %d of %d", totals.BytesIn, closed.BytesIn())
+	}
+}
+
+func TestStreamRemoteEOF(t *testing.T) {
+	local, localEnd := gonet.Pipe()
+	remote, remoteEnd := gonet.Pipe()
+	r := &testRemote{Conn: remote}
+
+	s := NewStream(local, r, "/p2p/test", DirInbound)
+	s.startStreaming()
+
+	go func() {
+		remoteEnd.Write([]byte("hello"))
+		remoteEnd.Close()
+	}()
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(localEnd, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("expected 'hello', got %q", buf)
+	}
+
+	waitDone(t, s)
+
+	if n := atomic.LoadInt32(&r.resets); n != 0 {
+		t.Fatalf("clean EOF reset the remote stream %d times", n)
+	}
+	if _, err := localEnd.Read(buf); err == nil {
+		t.Fatal("expected local end to be closed")
+	}
+}
+
+func TestStreamShortWrite(t *testing.T) {
+	local, localEnd := gonet.Pipe()
+	remote, remoteEnd := gonet.Pipe()
+	r := &testRemote{Conn: remote}
+
+	var reg StreamRegistry
+	s := NewStream(&shortWriter{Conn: local}, r, "/p2p/test", DirInbound)
+	s.Registry = &reg
+	reg.Register(s)
+	s.startStreaming()
+
+	received := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(localEnd)
+		received <- b
+	}()
+	remoteEnd.Write([]byte("hello world"))
+	remoteEnd.Close()
+
+	// the rest of a short write is written after it, instead of the stream
+	// being reset
+	select {
+	case b := <-received:
+		if string(b) != "hello world" {
+			t.Fatalf("expected %q, got %q", "hello world", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("data wasn't delivered")
+	}
+	localEnd.Close()
+	waitDone(t, s)
+
+	if n := atomic.LoadInt32(&r.resets); n != 0 {
+		t.Fatalf("expected remote stream not to be reset, got %d resets", n)
+	}
+	if len(reg.Streams) != 0 {
+		t.Fatal("stream wasn't deregistered")
+	}
+}
+
+func TestStreamSlowReader(t *testing.T) {
+	local, localEnd := gonet.Pipe()
+	remote, remoteEnd := gonet.Pipe()
+
+	s := NewStream(local, &testRemote{Conn: remote}, "/p2p/test", DirInbound)
+	s.startStreaming()
+
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() {
+		remoteEnd.Write(data)
+		remoteEnd.Close()
+	}()
+
+	var out bytes.Buffer
+	buf := make([]byte, 4096)
+	for out.Len() < len(data) {
+		n, err := localEnd.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Write(buf[:n])
+		time.Sleep(time.Millisecond)
+	}
+
+	waitDone(t, s)
+
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("data corrupted in transit")
+	}
+	if n := s.BytesIn(); n != uint64(len(data)) {
+		t.Fatalf("expected %d bytes in, got %d", len(data), n)
+	}
+}
+
+func TestStreamLastActivity(t *testing.T) {
+	local, localEnd := gonet.Pipe()
+	remote, remoteEnd := gonet.Pipe()
+
+	s := NewStream(local, &testRemote{Conn: remote}, "/p2p/test", DirInbound)
+	s.startStreaming()
+	defer s.Close()
+
+	opened := s.LastActivity()
+	time.Sleep(10 * time.Millisecond)
+
+	go remoteEnd.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(localEnd, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the timestamp is updated right after the write returns
+	for i := 0; !s.LastActivity().After(opened); i++ {
+		if i == 100 {
+			t.Fatal("expected activity timestamp to advance after a write")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// halfRemote is an in-memory RemoteStream with the semantics of libp2p
+// streams, Close only closes it for writing. It counts closes and resets.
+type halfRemote struct {
+	in  gonet.Conn
+	out gonet.Conn
+
+	closes int32
+	resets int32
+}
+
+func (r *halfRemote) Read(b []byte) (int, error) {
+	return r.in.Read(b)
+}
+
+func (r *halfRemote) Write(b []byte) (int, error) {
+	return r.out.Write(b)
+}
+
+func (r *halfRemote) Close() error {
+	atomic.AddInt32(&r.closes, 1)
+	return r.out.Close()
+}
+
+func (r *halfRemote) Reset() error {
+	atomic.AddInt32(&r.resets, 1)
+	r.out.Close()
+	return r.in.Close()
+}
+
+// wrappedConn embeds a connection without forwarding its CloseWrite
+type wrappedConn struct {
+	gonet.Conn
+}
+
+func TestCloseWriteWrapped(t *testing.T) {
+	ln, err := gonet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	app, err := gonet.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	local, err := wrapConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &limitedWriter{w: &countingWriter{w: local, n: new(uint64), last: new(int64)}, l: NewRateLimiter(1 << 20)}
+	if err := w.CloseWrite(); err != nil {
+		t.Fatalf("expected the wrapped connection to be closed for writing: %s", err)
+	}
+	if _, err := ioutil.ReadAll(app); err != nil {
+		t.Fatal(err)
+	}
+
+	// reading still works
+	app.Write([]byte("late"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(local, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := gonet.Pipe()
+	defer b.Close()
+	if closeWrite(&wrappedConn{Conn: a}) {
+		t.Fatal("expected a connection not forwarding CloseWrite not to be closed for writing")
+	}
+	if closeWrite(&pooledConn{Conn: local}) {
+		t.Fatal("expected a pooled connection not to be closed for writing")
+	}
+}
+
+func TestStreamHalfClose(t *testing.T) {
+	ln, err := gonet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	app, err := gonet.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	local, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in, peerOut := gonet.Pipe()
+	out, peerIn := gonet.Pipe()
+	r := &halfRemote{in: in, out: out}
+
+	s := NewStream(local, r, "/p2p/test", DirInbound)
+	s.startStreaming()
+
+	// the peer answers once it read the whole request
+	go func() {
+		req, _ := ioutil.ReadAll(peerIn)
+		peerOut.Write(append([]byte("re: "), req...))
+		peerOut.Close()
+	}()
+
+	app.Write([]byte("ping"))
+	app.(*gonet.TCPConn).CloseWrite()
+
+	resp, err := ioutil.ReadAll(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "re: ping" {
+		t.Fatalf("expected the response to arrive, got %q", resp)
+	}
+
+	waitDone(t, s)
+
+	if n := atomic.LoadInt32(&r.resets); n != 0 {
+		t.Fatalf("clean request/response reset the remote stream %d times", n)
+	}
+	if n := atomic.LoadInt32(&r.closes); n == 0 {
+		t.Fatal("expected the remote stream to be closed")
+	}
+}
+
+func TestStreamSimultaneousClose(t *testing.T) {
+	var lk sync.Mutex
+	closed := make(map[string][]Event)
+	logJSON = func(args ...interface{}) {
+		var ev Event
+		if err := json.Unmarshal([]byte(fmt.Sprint(args...)), &ev); err != nil {
+			t.Errorf("expected a JSON object, got %v: %s", args, err)
+		}
+		if ev.Event == EventStreamClosed {
+			lk.Lock()
+			closed[ev.StreamID] = append(closed[ev.StreamID], ev)
+			lk.Unlock()
+		}
+	}
+	defer func() { logJSON = log.Info }()
+
+	reg := StreamRegistry{JSONLog: true}
+
+	// closing a stream on purpose while data flows doesn't report the errors
+	// the copy loops get from the closed endpoints
+	s, _ := newTestStream(&reg)
+	time.Sleep(10 * time.Millisecond)
+	s.Close()
+	waitDone(t, s)
+
+	id := strconv.FormatUint(s.HandlerID, 10)
+	lk.Lock()
+	if evs := closed[id]; len(evs) != 1 || evs[0].Error != "" {
+		t.Fatalf("expected one clean %s event, got %v", EventStreamClosed, evs)
+	}
+	lk.Unlock()
+
+	// closing and resetting both sides at the same time tears each stream
+	// down once
+	var streams []*StreamInfo
+	for i := 0; i < 50; i++ {
+		s, _ := newTestStream(&reg)
+		streams = append(streams, s)
+	}
+	var wg sync.WaitGroup
+	for _, s := range streams {
+		wg.Add(3)
+		go func(s *StreamInfo) {
+			defer wg.Done()
+			s.Close()
+		}(s)
+		go func(s *StreamInfo) {
+			defer wg.Done()
+			s.Reset()
+		}(s)
+		go func(s *StreamInfo) {
+			defer wg.Done()
+			s.Remote.Reset()
+		}(s)
+	}
+	wg.Wait()
+
+	for _, s := range streams {
+		waitDone(t, s)
+	}
+	if len(reg.Streams) != 0 {
+		t.Fatalf("expected no streams left, got %d", len(reg.Streams))
+	}
+	if n := reg.InboundStreams(peer.ID("remote")); n != 0 {
+		t.Fatalf("expected no streams of the peer left, got %d", n)
+	}
+
+	lk.Lock()
+	defer lk.Unlock()
+	for _, s := range streams {
+		id := strconv.FormatUint(s.HandlerID, 10)
+		if n := len(closed[id]); n != 1 {
+			t.Fatalf("expected stream %s to be closed once, got %d %s events", id, n, EventStreamClosed)
+		}
+	}
+}
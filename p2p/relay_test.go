@@ -0,0 +1,73 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+
+	circuit "gx/ipfs/QmR5sXZi68rm9m2E3KiXj6hE5m3GeLaDjbLPUeV6W3MLR8/go-libp2p-circuit"
+	manet "gx/ipfs/QmRK2LxanhK2gZq6k6R7vk5ZoYZk8ULSSTB7FzDsMUX6CB/go-multiaddr-net"
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	bhost "gx/ipfs/QmY6iAoG9DVgZwh5ZRcQEpa2uErAe1Hbei8qXPCjpDS9Ge/go-libp2p/p2p/host/basic"
+	testutil "gx/ipfs/Qma2UuHusnaFV24DgeZ5hyrM9uc4UdyVaZbtn2FQsPRhES/go-libp2p-netutil"
+	pstore "gx/ipfs/QmdeiKhUy1TVGBaKxt7y1QmBDLBdisSrLJ1x58Eoj4PXUh/go-libp2p-peerstore"
+)
+
+// TestDialRelayed forwards to a peer the client has no direct connection to,
+// only the relayed address of the peer. Mocknet has no relay transport, so
+// this uses real swarms on the loopback interface.
+func TestDialRelayed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	relay := bhost.New(testutil.GenSwarmNetwork(t, ctx))
+	target := bhost.New(testutil.GenSwarmNetwork(t, ctx))
+	client := bhost.New(testutil.GenSwarmNetwork(t, ctx))
+
+	// the relay's own circuit address is listed too once it has the transport
+	relayAddr := relay.Addrs()[0]
+	if err := circuit.AddRelayTransport(ctx, relay, circuit.OptHop); err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []*bhost.BasicHost{target, client} {
+		if err := circuit.AddRelayTransport(ctx, h); err != nil {
+			t.Fatal(err)
+		}
+		relayInfo := pstore.PeerInfo{ID: relay.ID(), Addrs: []ma.Multiaddr{relayAddr}}
+		if err := h.Connect(ctx, relayInfo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	echo := startEcho(t)
+	defer echo.Close()
+	targetP2P := NewP2P(target.ID(), target, target.Peerstore())
+	if _, err := targetP2P.NewListener(ctx, "/p2p/echo", echo.Multiaddr(), ListenerOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	relayed, err := ma.NewMultiaddr(relayAddr.String() + "/ipfs/" + relay.ID().Pretty() + "/p2p-circuit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Peerstore().AddAddr(target.ID(), relayed, pstore.TempAddrTTL)
+
+	clientP2P := NewP2P(client.ID(), client, client.Peerstore())
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	listenerInfo, err := clientP2P.Dial(ctx, relayed, target.ID(), "/p2p/echo", bindAddr, DialOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := manet.Dial(listenerInfo.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	echoRoundTrip(t, c, "hello relay")
+
+	for _, conn := range client.Network().ConnsToPeer(target.ID()) {
+		if _, err := conn.RemoteMultiaddr().ValueForProtocol(circuit.P_CIRCUIT); err != nil {
+			t.Fatalf("expected the connection to the target to be relayed, got %s", conn.RemoteMultiaddr())
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"io"
+	gonet "net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	net "gx/ipfs/QmXoz9o2PT3tEzf7hicegwex5UgVP54n3k82K7jrWFyN86/go-libp2p-net"
+	pro "gx/ipfs/QmZNkThpqfVXs9GNbexPrfBbXSLNYeKrE7jwFM2oqHbyqN/go-libp2p-protocol"
+	peer "gx/ipfs/QmcJukH2sAFjY3HdBKq35WDzWoL3UUu2gt9wdfqZTUyM74/go-libp2p-peer"
+	ic "gx/ipfs/Qme1knMqwt1hKZbc1BmQFmnm9f36nyQGwXxPGVpVJ9rMK5/go-libp2p-crypto"
+)
+
+// ErrNoSelfListener is returned when dialing a protocol on the local node
+// which has no listener registered
+var ErrNoSelfListener = errors.New("no local listener registered for protocol")
+
+var (
+	errSelfStreamReset = errors.New("stream reset")
+	errSelfNewStream   = errors.New("can't open streams on a connection to self")
+)
+
+// newSelfStream connects to a listener of this node without going through
+// the network, as libp2p doesn't allow opening streams to self. The other end
+// of the stream is handed directly to the listener's accept loop.
+func (p2p *P2P) newSelfStream(ctx context.Context, protocols ...string) (net.Stream, error) {
+	var listener *P2PListener
+	var proto string
+	for _, proto = range protocols {
+		listener = p2p.selfListener(proto)
+		if listener != nil {
+			break
+		}
+	}
+	if listener == nil {
+		return nil, ErrNoSelfListener
+	}
+
+	var addr ma.Multiaddr
+	if addrs := p2p.peerHost.Addrs(); len(addrs) > 0 {
+		addr = addrs[0]
+	} else {
+		addr, _ = ma.NewMultiaddr("/ip4/127.0.0.1")
+	}
+
+	conn := &selfConn{
+		id:   p2p.identity,
+		addr: addr,
+		priv: p2p.peerstore.PrivKey(p2p.identity),
+		pub:  p2p.peerstore.PubKey(p2p.identity),
+	}
+	local, remote := newSelfStreams(conn, pro.ID(proto))
+
+	select {
+	case listener.conCh <- remote:
+	case <-listener.ctx.Done():
+		conn.Close()
+		return nil, listener.ctx.Err()
+	case <-ctx.Done():
+		conn.Close()
+		return nil, ctx.Err()
+	}
+
+	return local, nil
+}
+
+// selfListener returns the listener of this node handling the protocol
+func (p2p *P2P) selfListener(proto string) *P2PListener {
+	for _, l := range p2p.Listeners.List() {
+		if !l.HasProtocol(proto) {
+			continue
+		}
+		if pl, ok := l.Closer.(*P2PListener); ok {
+			return pl
+		}
+		return nil
+	}
+	return nil
+}
+
+// selfStream is one end of an in-memory net.Stream connecting two ends within
+// this node. Each direction is a pipe of its own, so that like libp2p streams
+// Close only closes the stream for writing while Reset aborts both directions.
+type selfStream struct {
+	in  gonet.Conn // read end of the pipe the other end writes to
+	out gonet.Conn // write end of the pipe the other end reads from
+
+	// set once either end was reset, shared by both ends
+	reset *int32
+
+	conn *selfConn
+
+	lk    sync.Mutex
+	proto pro.ID
+}
+
+// newSelfStreams creates the two ends of a stream over the connection
+func newSelfStreams(conn *selfConn, proto pro.ID) (*selfStream, *selfStream) {
+	aIn, bOut := gonet.Pipe()
+	bIn, aOut := gonet.Pipe()
+	reset := new(int32)
+
+	a := &selfStream{in: aIn, out: aOut, reset: reset, conn: conn, proto: proto}
+	b := &selfStream{in: bIn, out: bOut, reset: reset, conn: conn, proto: proto}
+	conn.add(a, b)
+	return a, b
+}
+
+func (s *selfStream) Read(b []byte) (int, error) {
+	n, err := s.in.Read(b)
+	if err == io.EOF && atomic.LoadInt32(s.reset) != 0 {
+		err = errSelfStreamReset
+	}
+	return n, err
+}
+
+func (s *selfStream) Write(b []byte) (int, error) {
+	return s.out.Write(b)
+}
+
+// Close closes the stream for writing, the other end reads an EOF and may
+// still send its response
+func (s *selfStream) Close() error {
+	return s.out.Close()
+}
+
+// Reset aborts both directions, reads on the other end fail
+func (s *selfStream) Reset() error {
+	atomic.StoreInt32(s.reset, 1)
+	s.out.Close()
+	return s.in.Close()
+}
+
+func (s *selfStream) SetDeadline(t time.Time) error {
+	if err := s.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return s.SetWriteDeadline(t)
+}
+
+func (s *selfStream) SetReadDeadline(t time.Time) error {
+	return s.in.SetReadDeadline(t)
+}
+
+func (s *selfStream) SetWriteDeadline(t time.Time) error {
+	return s.out.SetWriteDeadline(t)
+}
+
+func (s *selfStream) Protocol() pro.ID {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.proto
+}
+
+func (s *selfStream) SetProtocol(proto pro.ID) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.proto = proto
+}
+
+func (s *selfStream) Conn() net.Conn {
+	return s.conn
+}
+
+// selfConn is the connection of a selfStream, both sides of it are the local
+// node
+type selfConn struct {
+	id   peer.ID
+	addr ma.Multiaddr
+	priv ic.PrivKey
+	pub  ic.PubKey
+
+	lk      sync.Mutex
+	streams []net.Stream
+}
+
+func (c *selfConn) add(streams ...net.Stream) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.streams = append(c.streams, streams...)
+}
+
+// Close resets the streams of the connection
+func (c *selfConn) Close() error {
+	for _, s := range c.GetStreams() {
+		s.Reset()
+	}
+	return nil
+}
+
+// NewStream fails, self streams are opened with newSelfStream
+func (c *selfConn) NewStream() (net.Stream, error) {
+	return nil, errSelfNewStream
+}
+
+func (c *selfConn) GetStreams() []net.Stream {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return append([]net.Stream(nil), c.streams...)
+}
+
+func (c *selfConn) LocalPeer() peer.ID {
+	return c.id
+}
+
+func (c *selfConn) LocalPrivateKey() ic.PrivKey {
+	return c.priv
+}
+
+func (c *selfConn) RemotePeer() peer.ID {
+	return c.id
+}
+
+func (c *selfConn) RemotePublicKey() ic.PubKey {
+	return c.pub
+}
+
+func (c *selfConn) LocalMultiaddr() ma.Multiaddr {
+	return c.addr
+}
+
+func (c *selfConn) RemoteMultiaddr() ma.Multiaddr {
+	return c.addr
+}
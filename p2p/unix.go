@@ -0,0 +1,43 @@
+package p2p
+
+import (
+	"fmt"
+	"strings"
+
+	manet "gx/ipfs/QmRK2LxanhK2gZq6k6R7vk5ZoYZk8ULSSTB7FzDsMUX6CB/go-multiaddr-net"
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+)
+
+// abstractName returns the name of the Linux abstract namespace socket the
+// address designates, written /unix/@name. manet would take it for the path
+// /@name on the filesystem.
+func abstractName(addr ma.Multiaddr) (string, bool) {
+	path, err := addr.ValueForProtocol(ma.P_UNIX)
+	if err != nil {
+		return "", false
+	}
+	path = strings.TrimPrefix(path, "/")
+	if !strings.HasPrefix(path, "@") || len(path) == 1 {
+		return "", false
+	}
+	return path, true
+}
+
+// listen is the default ListenFunc. It binds abstract namespace sockets as
+// well as the addresses manet knows about. Abstract sockets have no file,
+// so there is nothing to clean up when they are closed, or when the daemon
+// dies without closing them.
+func listen(addr ma.Multiaddr) (manet.Listener, error) {
+	if name, ok := abstractName(addr); ok {
+		return listenAbstract(name)
+	}
+
+	l, err := netListen(addr)
+	if err != nil {
+		if zone, zerr := addr.ValueForProtocol(ma.P_IP6ZONE); zerr == nil {
+			return nil, fmt.Errorf("%s, check that the address is assigned to interface %s", err, zone)
+		}
+		return nil, err
+	}
+	return l, nil
+}
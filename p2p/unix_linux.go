@@ -0,0 +1,19 @@
+// +build linux
+
+package p2p
+
+import (
+	gonet "net"
+
+	manet "gx/ipfs/QmRK2LxanhK2gZq6k6R7vk5ZoYZk8ULSSTB7FzDsMUX6CB/go-multiaddr-net"
+)
+
+// listenAbstract binds the abstract namespace socket name, which starts with
+// the '@' the net package takes for the leading null byte
+func listenAbstract(name string) (manet.Listener, error) {
+	l, err := gonet.Listen("unix", name)
+	if err != nil {
+		return nil, err
+	}
+	return wrapListener(l)
+}
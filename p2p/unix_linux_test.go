@@ -0,0 +1,97 @@
+// +build linux
+
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"io"
+	gonet "net"
+	"os"
+	"testing"
+	"time"
+
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	mocknet "gx/ipfs/QmY6iAoG9DVgZwh5ZRcQEpa2uErAe1Hbei8qXPCjpDS9Ge/go-libp2p/p2p/net/mock"
+)
+
+func TestDialAbstractUnix(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2p := NewP2P(h.ID(), h, h.Peerstore())
+
+	echo := startEcho(t)
+	defer echo.Close()
+	if _, err := p2p.NewListener(ctx, "/p2p/echo", echo.Multiaddr(), ListenerOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	name := fmt.Sprintf("@ipfs-p2p-test-%d", time.Now().UnixNano())
+	bindAddr, err := ma.NewMultiaddr("/unix/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listenerInfo, err := p2p.Dial(ctx, nil, h.ID(), "/p2p/echo", bindAddr, DialOpts{OnDemand: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := abstractName(listenerInfo.Address); !ok || got != name {
+		t.Fatalf("expected the listener to be bound to %s, got %s", name, listenerInfo.Address)
+	}
+
+	c, err := gonet.Dial("unix", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("expected the echo, got %q", buf)
+	}
+	c.Close()
+
+	if err := listenerInfo.Closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("/" + name); !os.IsNotExist(err) {
+		t.Fatalf("expected no socket file, got %v", err)
+	}
+
+	// the name is free again right away, there is no stale file in the way
+	listenerInfo, err = p2p.Dial(ctx, nil, h.ID(), "/p2p/echo", bindAddr, DialOpts{OnDemand: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenerInfo.Closer.Close()
+}
+
+func TestAbstractName(t *testing.T) {
+	cases := map[string]string{
+		"/unix/@ipfs":          "@ipfs",
+		"/unix/tmp/ipfs.sock":  "",
+		"/unix/@":              "",
+		"/ip4/127.0.0.1/tcp/0": "",
+	}
+
+	for text, expected := range cases {
+		addr, err := ma.NewMultiaddr(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, ok := abstractName(addr)
+		if name != expected || ok != (expected != "") {
+			t.Fatalf("%s: expected %q, got %q", text, expected, name)
+		}
+	}
+}
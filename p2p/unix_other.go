@@ -0,0 +1,13 @@
+// +build !linux
+
+package p2p
+
+import (
+	"errors"
+
+	manet "gx/ipfs/QmRK2LxanhK2gZq6k6R7vk5ZoYZk8ULSSTB7FzDsMUX6CB/go-multiaddr-net"
+)
+
+func listenAbstract(name string) (manet.Listener, error) {
+	return nil, errors.New("abstract unix sockets are only supported on Linux")
+}
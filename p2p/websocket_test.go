@@ -0,0 +1,290 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	gonet "net"
+	"net/http"
+	"testing"
+	"time"
+
+	manet "gx/ipfs/QmRK2LxanhK2gZq6k6R7vk5ZoYZk8ULSSTB7FzDsMUX6CB/go-multiaddr-net"
+	ma "gx/ipfs/QmWWQ2Txc2c6tqjsBpzg5Ar652cHPGNsQQp2SejkNmkUMb/go-multiaddr"
+	mocknet "gx/ipfs/QmY6iAoG9DVgZwh5ZRcQEpa2uErAe1Hbei8qXPCjpDS9Ge/go-libp2p/p2p/net/mock"
+	ping "gx/ipfs/QmY6iAoG9DVgZwh5ZRcQEpa2uErAe1Hbei8qXPCjpDS9Ge/go-libp2p/p2p/protocol/ping"
+)
+
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsKey  = "dGhlIHNhbXBsZSBub25jZQ=="
+)
+
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// wsWriteFrame writes a single unfragmented frame, masked as clients must
+func wsWriteFrame(w io.Writer, opcode byte, payload []byte, masked bool) error {
+	hdr := []byte{0x80 | opcode, 0}
+	if len(payload) < 126 {
+		hdr[1] = byte(len(payload))
+	} else {
+		hdr[1] = 126
+		hdr = append(hdr, 0, 0)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(payload)))
+	}
+
+	body := payload
+	if masked {
+		hdr[1] |= 0x80
+		mask := []byte{1, 2, 3, 4}
+		hdr = append(hdr, mask...)
+		body = make([]byte, len(payload))
+		for i := range payload {
+			body[i] = payload[i] ^ mask[i%4]
+		}
+	}
+
+	_, err := w.Write(append(hdr, body...))
+	return err
+}
+
+// wsReadFrame reads a single unfragmented frame, unmasking it if needed
+func wsReadFrame(r io.Reader) (byte, []byte, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, nil, err
+	}
+
+	n := int(hdr[1] & 0x7f)
+	if n == 126 {
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return 0, nil, err
+		}
+		n = int(binary.BigEndian.Uint16(ext))
+	}
+
+	var mask []byte
+	if hdr[1]&0x80 != 0 {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(r, mask); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if mask != nil {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return hdr[0] & 0x0f, payload, nil
+}
+
+// startWSEcho starts a minimal websocket service echoing back every frame,
+// which answers a close frame and then closes the connection
+func startWSEcho(t testing.TB) manet.Listener {
+	addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := manet.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+
+				r := bufio.NewReader(c)
+				req, err := http.ReadRequest(r)
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+					wsAccept(req.Header.Get("Sec-WebSocket-Key")))
+
+				for {
+					op, payload, err := wsReadFrame(r)
+					if err != nil {
+						return
+					}
+					if err := wsWriteFrame(c, op, payload, false); err != nil || op == wsClose {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+// wsDial connects to the address and upgrades the connection to a websocket
+func wsDial(t *testing.T, addr ma.Multiaddr) (gonet.Conn, *bufio.Reader) {
+	na, err := manet.ToNetAddr(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := gonet.Dial("tcp", na.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprintf(c, "GET /echo HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", na, wsKey)
+
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the connection to be upgraded, got %s", resp.Status)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != wsAccept(wsKey) {
+		t.Fatalf("unexpected Sec-WebSocket-Accept %q", got)
+	}
+	return c, r
+}
+
+func wsEcho(t *testing.T, c gonet.Conn, r io.Reader, msg string) {
+	if err := wsWriteFrame(c, wsText, []byte(msg), true); err != nil {
+		t.Fatal(err)
+	}
+	op, payload, err := wsReadFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op != wsText || string(payload) != msg {
+		t.Fatalf("expected %q echoed, got opcode %d %q", msg, op, payload)
+	}
+}
+
+func TestWebSocketFriendly(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h1, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	ping.NewPingService(h1)
+	ping.NewPingService(h2)
+
+	client := NewP2P(h1.ID(), h1, h1.Peerstore())
+	client.LivenessInterval = 20 * time.Millisecond
+	server := NewP2P(h2.ID(), h2, h2.Peerstore())
+	server.LivenessInterval = 20 * time.Millisecond
+
+	backend := startWSEcho(t)
+	defer backend.Close()
+
+	if _, err := server.NewListener(ctx, "/p2p/ws", backend.Multiaddr(), ListenerOpts{WebSocketFriendly: true}); err != nil {
+		t.Fatal(err)
+	}
+	bindAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	listenerInfo, err := client.Dial(ctx, nil, h2.ID(), "/p2p/ws", bindAddr, DialOpts{WebSocketFriendly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, r := wsDial(t, listenerInfo.Address)
+	defer c.Close()
+	wsEcho(t, c, r, "hello")
+
+	// a quiet session stays open while the peers answer their pings
+	time.Sleep(200 * time.Millisecond)
+	wsEcho(t, c, r, "still there")
+	if n := len(client.Streams.Snapshot()); n != 1 {
+		t.Fatalf("expected the stream to stay open, got %d streams", n)
+	}
+
+	// the backend closing the session closes the stream both ways, while
+	// the client hasn't closed its side yet
+	if err := wsWriteFrame(c, wsClose, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if op, _, err := wsReadFrame(r); err != nil || op != wsClose {
+		t.Fatalf("expected the close frame echoed, got opcode %d: %v", op, err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("expected an EOF once the backend closed, got %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(client.Streams.Snapshot())+len(server.Streams.Snapshot()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the streams to be closed, got %d on the client and %d on the server",
+				len(client.Streams.Snapshot()), len(server.Streams.Snapshot()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLivenessResetsStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	h1, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	// h2 doesn't answer pings
+	p2p := NewP2P(h1.ID(), h1, h1.Peerstore())
+	p2p.LivenessInterval = 20 * time.Millisecond
+
+	local, _ := gonet.Pipe()
+	remote, _ := gonet.Pipe()
+	s := NewStream(local, &testRemote{Conn: remote}, "/p2p/test", DirOutbound)
+	s.RemotePeer = h2.ID()
+	s.Listener = &ListenerInfo{Protocol: "/p2p/test", WebSocketFriendly: true}
+	s.Registry = &p2p.Streams
+	p2p.Streams.Register(s)
+	s.startStreaming()
+	defer s.Close()
+
+	go p2p.checkLiveness(s)
+
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the stream to be reset once the peer didn't answer pings")
+	}
+}
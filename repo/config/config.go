@@ -25,6 +25,7 @@ type Config struct {
 	Gateway   Gateway   // local node's gateway server options
 	API       API       // local node's API settings
 	Swarm     SwarmConfig
+	P2P       P2P // libp2p stream mounting settings
 
 	Reprovider   Reprovider
 	Experimental Experiments
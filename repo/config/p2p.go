@@ -0,0 +1,47 @@
+package config
+
+// P2P contains options for the libp2p stream mounting subsystem.
+type P2P struct {
+	// MaxStreamsPerPeer limits the number of concurrent streams a single
+	// remote peer may have open to the p2p listeners of the node, counted
+	// across all of them. Zero means unlimited.
+	MaxStreamsPerPeer int
+
+	// BandwidthLimit caps the bandwidth used by all p2p streams together,
+	// in bytes per second. Zero means unlimited.
+	BandwidthLimit int64
+
+	// ResetStreamsOnDisconnect resets the streams of a peer as soon as the
+	// node gets disconnected from it.
+	ResetStreamsOnDisconnect bool
+
+	// DialTimeout bounds connecting to a peer and opening a stream to it,
+	// e.g. "10s". Empty means 30 seconds.
+	DialTimeout string
+
+	// LivenessInterval is how often the remote peer of websocket-friendly
+	// streams is pinged, e.g. "1m". Empty means 30 seconds.
+	LivenessInterval string
+
+	// JSONLog logs the streams opened and closed, and failed dials, as JSON
+	// objects with the same fields for all events, for log pipelines.
+	JSONLog bool
+
+	// Listeners are opened when the daemon starts, if stream mounting is
+	// enabled. A listener which can't be opened is logged and skipped, see
+	// 'ipfs p2p restore-status'.
+	Listeners []P2PListener
+}
+
+// P2PListener is a listener opened from the config
+type P2PListener struct {
+	// Protocol is the full protocol id, e.g. "/p2p/my-app"
+	Protocol string
+
+	// Address streams are forwarded to, e.g. "/ip4/127.0.0.1/tcp/8080"
+	Address string
+
+	// Group the listener is in, like those of 'ipfs p2p listener group'.
+	// Optional.
+	Group string `json:",omitempty"`
+}
@@ -27,7 +27,10 @@ test_expect_success "test ports are closed" '
 '
 
 test_expect_success 'fail without config option being enabled' '
-  test_must_fail ipfsi 0 p2p stream ls
+  test_must_fail ipfsi 0 p2p stream ls 2>stream-ls-err.log &&
+  grep "ipfs daemon --enable-p2p" stream-ls-err.log &&
+  grep "ipfs config --json Experimental.Libp2pStreamMounting true" stream-ls-err.log &&
+  grep "restart the daemon" stream-ls-err.log
 '
 
 test_expect_success "enable filestore config setting" '
@@ -139,6 +142,25 @@ test_expect_success "'ipfs p2p stream ls' succeeds(2)" '
   test_cmp expected actual
 '
 
+test_expect_success "'ipfs p2p stream ls -v' prints the traffic of each stream" '
+  ipfsi 0 p2p stream ls -v > actual &&
+  test_should_contain "^3 /p2p/p2p-test2 /ip4/127.0.0.1/tcp/10101 $PEERID_1 .*B .*B " actual &&
+  test_must_fail grep -q "HandlerID" actual
+'
+
+test_expect_success "'ipfs p2p stream ls --headers' prints the table headers" '
+  ipfsi 0 p2p stream ls --headers > actual &&
+  test_should_contain "^HandlerID *Protocol *Local *Remote$" actual &&
+  test_should_contain "^3 /p2p/p2p-test2 " actual
+'
+
+test_expect_success "'ipfs p2p listener close --dry-run' keeps app handlers" '
+  ipfsi 0 p2p listener close -a --dry-run > actual &&
+  test_should_contain "Closed 1 listener(s)" actual &&
+  ipfsi 0 p2p listener ls > actual &&
+  test_should_contain "/p2p/p2p-test2" actual
+'
+
 test_expect_success "'ipfs p2p listener close -a' closes app handlers" '
   ipfsi 0 p2p listener close -a &&
   ipfsi 0 p2p listener ls > actual &&
@@ -159,9 +181,34 @@ test_expect_success "'ipfs p2p listener close' closes app numeric handlers" '
   test_must_be_empty actual
 '
 
+test_expect_success "'ipfs p2p listener retarget' switches the target address" '
+  ipfsi 0 p2p listener open p2p-retarget /ip4/127.0.0.1/tcp/10101 &&
+  ipfsi 0 p2p listener retarget p2p-retarget /ip4/127.0.0.1/tcp/10103 &&
+  echo "/ip4/127.0.0.1/tcp/10103 /p2p/p2p-retarget" > expected &&
+  ipfsi 0 p2p listener ls > actual &&
+  test_cmp expected actual &&
+  ipfsi 0 p2p listener close p2p-retarget
+'
+
+test_expect_success "'ipfs p2p listener close' fails when nothing matched" '
+  test_expect_code 1 ipfsi 0 p2p listener close doesnotexist &&
+  test_expect_code 1 ipfsi 0 p2p stream close 12345
+'
+
+test_expect_success "'ipfs p2p listener close --ignore-missing' succeeds when nothing matched" '
+  ipfsi 0 p2p listener close --ignore-missing doesnotexist &&
+  ipfsi 0 p2p listener close -q doesnotexist &&
+  ipfsi 0 p2p stream close --ignore-missing 12345
+'
+
 test_expect_success 'stop iptb' '
   iptb stop
 '
 
+test_expect_success 'fail without the daemon' '
+  test_must_fail ipfsi 0 p2p listener ls 2>listener-ls-err.log &&
+  grep "ipfs daemon" listener-ls-err.log
+'
+
 test_done
 
@@ -0,0 +1,47 @@
+#!/usr/bin/env bash
+
+test_description="Test enabling the p2p commands with 'ipfs daemon --enable-p2p'"
+
+. lib/test-lib.sh
+
+test_expect_success 'init iptb' '
+  iptb init -n 2 --bootstrap=none --port=0
+'
+
+test_expect_success 'generate test data' '
+  echo "ABCDEF" > test0.bin
+'
+
+startup_cluster 2 --enable-p2p
+
+test_expect_success 'peer ids' '
+  PEERID_0=$(iptb get id 0)
+'
+
+test_expect_success 'the flag is not saved to the config' '
+  echo false > expected &&
+  ipfsi 0 config Experimental.Libp2pStreamMounting > actual &&
+  test_cmp expected actual
+'
+
+test_expect_success 'start p2p listener' '
+  ipfsi 0 p2p listener open p2p-test /ip4/127.0.0.1/tcp/10101
+'
+
+test_expect_success 'forward data over a p2p stream' '
+  ma-pipe-unidir --listen --pidFile=listener.pid send /ip4/127.0.0.1/tcp/10101 < test0.bin &
+
+  test_wait_for_file 30 100ms listener.pid &&
+  kill -0 $(cat listener.pid) &&
+
+  ipfsi 1 p2p stream dial $PEERID_0 p2p-test /ip4/127.0.0.1/tcp/10102 &&
+  ma-pipe-unidir recv /ip4/127.0.0.1/tcp/10102 > client.out &&
+  test ! -f listener.pid &&
+  test_cmp test0.bin client.out
+'
+
+test_expect_success 'stop iptb' '
+  iptb stop
+'
+
+test_done